@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -12,20 +13,35 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/dynamic-resource-allocation/kubeletplugin"
+	"k8s.io/dynamic-resource-allocation/resourceslice"
 	"k8s.io/klog/v2"
 
+	"github.com/example/dra-poc/pkg/dhcp"
 	"github.com/example/dra-poc/pkg/driver"
 	"github.com/example/dra-poc/pkg/handler"
 	"github.com/example/dra-poc/pkg/handler/combo"
 	"github.com/example/dra-poc/pkg/handler/netdev"
 	"github.com/example/dra-poc/pkg/handler/rdma"
+	"github.com/example/dra-poc/pkg/ipam"
+	"github.com/example/dra-poc/pkg/macpool"
 	nriplugin "github.com/example/dra-poc/pkg/nri"
+	"github.com/example/dra-poc/pkg/ovs"
 )
 
 var (
-	driverName string
-	nodeName   string
-	podUID     string
+	driverName   string
+	nodeName     string
+	podUID       string
+	virtualSlots map[string]int
+	vfProfiles   map[string]string
+	vfBudget     map[string]int
+	removeIdle   bool
+	ovsdbSocket  string
+	ipamConfig   string
+	macPool      string
+	sysctls      []string
+	ipPools      string
+	segmentPools string
 )
 
 func main() {
@@ -35,9 +51,35 @@ func main() {
 		Run:   run,
 	}
 
-	cmd.Flags().StringVar(&driverName, "driver-name", "dra.example.com", "Name of the DRA driver")
+	cmd.PersistentFlags().StringVar(&driverName, "driver-name", "dra.example.com", "Name of the DRA driver")
 	cmd.Flags().StringVar(&nodeName, "node-name", "", "Name of the node (from downward API)")
 	cmd.Flags().StringVar(&podUID, "pod-uid", "", "UID of this driver pod (from downward API, enables rolling updates)")
+	cmd.Flags().StringToIntVar(&virtualSlots, "virtual-slots", nil,
+		fmt.Sprintf("Per-kind slot capacity of virtual netdev devices, e.g. veth=64,dummy=256 (default %d each)", driver.DefaultVirtualSlots))
+	cmd.Flags().StringToStringVar(&vfProfiles, "sriov-vf-profiles", nil,
+		"SR-IOV VF profiles offered on every VF as <name>=<bandwidth>/<queue-pairs>, e.g. small=1G/2,large=10G/8")
+	cmd.Flags().StringToIntVar(&vfBudget, "sriov-vf-budget", nil,
+		"PFs whose VFs are created on demand, with the number of VFs the driver may create on each, e.g. ens1f0=8")
+	cmd.Flags().BoolVar(&removeIdle, "sriov-remove-idle-vfs", false,
+		"Remove the VFs of an on-demand PF once no claim holds any of them")
+	cmd.Flags().StringVar(&ovsdbSocket, "ovsdb-socket", ovs.DefaultSocket,
+		"Unix socket of the local OVSDB server for plugging veth host ends and VF representors into OVS bridges (empty disables)")
+	cmd.Flags().StringVar(&ipamConfig, "ipam-config", "",
+		"JSON file defining the node-local IPAM ranges claims can lease addresses from (empty disables IPAM)")
+	cmd.Flags().StringVar(&macPool, "mac-pool", "",
+		"MACs for claims with macPolicy pool, as an OUI (e.g. 02:00:5e) or <first>-<last> (empty disables the pool)")
+	cmd.Flags().StringSliceVar(&sysctls, "allowed-sysctls", driver.DefaultSysctls,
+		"Per-interface sysctls claims may set, as ipv4.<name> or ipv6.<name> (empty rejects all)")
+
+	controllerCmd := &cobra.Command{
+		Use:   "controller",
+		Short: "Publish cluster-scoped IP address and VLAN/VNI pools for the scheduler to allocate",
+		Run:   runController,
+	}
+	controllerCmd.Flags().StringVar(&ipPools, "ip-pools", "", "JSON file defining the cluster-scoped IP pools")
+	controllerCmd.Flags().StringVar(&segmentPools, "segment-pools", "", "JSON file defining the cluster-scoped VLAN ID and VNI pools")
+	controllerCmd.MarkFlagsOneRequired("ip-pools", "segment-pools")
+	cmd.AddCommand(controllerCmd)
 
 	if err := cmd.Execute(); err != nil {
 		klog.Fatal(err)
@@ -62,8 +104,37 @@ func run(cmd *cobra.Command, args []string) {
 	// (which performs the actual netlink move when the pod sandbox is created).
 	rdmaTracker := nriplugin.NewRDMANetnsTracker()
 
+	// Create the link setup tracker.  Handlers register configuration that
+	// only survives if applied after the runtime moved the link into the pod
+	// netns (e.g. tc shaping, addresses); the NRI plugin applies it.
+	linkTracker := nriplugin.NewLinkSetupTracker()
+
+	profiles, err := driver.ParseVFProfiles(vfProfiles)
+	if err != nil {
+		klog.Fatalf("--sriov-vf-profiles: %v", err)
+	}
+	for pf, n := range vfBudget {
+		if n <= 0 {
+			klog.Fatalf("--sriov-vf-budget: VF budget for %s must be positive, got %d", pf, n)
+		}
+	}
+
+	// The SR-IOV handler also creates on-demand VFs for the binding
+	// controller, so it is shared with it.  VFs allocated through a profile
+	// are rate limited to its bandwidth.
+	sriovHandler := &netdev.SriovVfHandler{OnDemand: vfBudget, RemoveIdleVFs: removeIdle, Links: linkTracker,
+		ProfileRates: make(map[string]int)}
+	for _, p := range profiles {
+		sriovHandler.ProfileRates[p.Name] = p.Rate()
+	}
+
+	// The DHCP client runs on behalf of macvlan and ipvlan claims in dhcp
+	// IPAM mode.  Its leases are kept next to the plugin socket so that they
+	// survive a restart.
+	dhcpManager := &dhcp.Manager{StateDir: filepath.Join("/var/lib/kubelet/plugins", driverName, "dhcp")}
+
 	// Build the handler registry with all supported device handlers
-	registry := buildHandlerRegistry(rdmaTracker)
+	registry := buildHandlerRegistry(rdmaTracker, linkTracker, sriovHandler, dhcpManager)
 	for typ, kinds := range registry.ListRegistered() {
 		klog.Infof("Registered handlers for type=%s: %v", typ, kinds)
 	}
@@ -80,6 +151,36 @@ func run(cmd *cobra.Command, args []string) {
 	if err != nil {
 		klog.Fatalf("Failed to create Kubernetes client: %v", err)
 	}
+	plugin.Client = clientset
+
+	// Load the IPAM ranges and the MAC pool, then reconcile their leases
+	// with the persisted allocations before any claim is prepared.
+	if ipamConfig != "" {
+		cfg, err := ipam.LoadConfig(ipamConfig)
+		if err != nil {
+			klog.Fatalf("--ipam-config: %v", err)
+		}
+		plugin.IPAM, err = ipam.New(cfg)
+		if err != nil {
+			klog.Fatalf("--ipam-config: %v", err)
+		}
+		klog.Infof("Loaded %d IPAM ranges from %s", len(cfg.Ranges), ipamConfig)
+	}
+	if macPool != "" {
+		plugin.MACs, err = macpool.Parse(macPool)
+		if err != nil {
+			klog.Fatalf("--mac-pool: %v", err)
+		}
+		klog.Infof("Leasing MACs from %s", plugin.MACs)
+	}
+	plugin.Sysctls = sysctls
+	// Handlers register the link setups of restored claims again; the
+	// tracker's record tells which of them were already applied.
+	if err := linkTracker.Persist(filepath.Join("/var/lib/kubelet/plugins", driverName, "links.json")); err != nil {
+		klog.Warningf("Failed to load link setup state: %v", err)
+	}
+	plugin.Restore()
+	dhcpManager.Restore()
 
 	// Ensure the plugin directory exists so the kubelet plugin can create its
 	// Unix domain socket.  The kubelet only provides the parent directory
@@ -126,29 +227,38 @@ func run(cmd *cobra.Command, args []string) {
 		klog.Fatalf("Failed to start kubelet plugin: %v", err)
 	}
 
-	// Start the NRI plugin for RDMA netns management in exclusive mode.
-	// The plugin receives RunPodSandbox/StopPodSandbox events and moves
-	// RDMA devices into/out of pod network namespaces via netlink.
-	if rdma.DetectNetnsMode() == rdma.NetnsExclusive {
-		nriPlugin, err := nriplugin.NewPlugin(rdmaTracker)
-		if err != nil {
-			klog.Fatalf("Failed to create NRI plugin: %v", err)
-		}
-		go func() {
-			if err := nriPlugin.Run(ctx); err != nil {
-				klog.Errorf("NRI plugin exited: %v", err)
-			}
-		}()
-		defer nriPlugin.Stop()
-		klog.Info("NRI plugin started for exclusive RDMA netns mode")
+	// Start the NRI plugin.  It receives RunPodSandbox/StopPodSandbox events to
+	// move RDMA devices into/out of pod network namespaces in exclusive mode,
+	// and StartContainer requests to configure links moved into pods.
+	nriPlugin, err := nriplugin.NewPlugin(rdmaTracker, linkTracker)
+	if err != nil {
+		klog.Fatalf("Failed to create NRI plugin: %v", err)
 	}
+	go func() {
+		if err := nriPlugin.Run(ctx); err != nil {
+			klog.Errorf("NRI plugin exited: %v", err)
+		}
+	}()
+	defer nriPlugin.Stop()
+	klog.Infof("NRI plugin started (RDMA netns mode: %s)", rdma.DetectNetnsMode())
 
 	// Publish ResourceSlices
-	resources := driver.DiscoverResources(driverName, nodeName)
+	resources := driver.DiscoverResources(driverName, nodeName, buildVirtualSlots(registry),
+		driver.SriovOptions{Profiles: profiles, OnDemand: vfBudget})
 	if err := helper.PublishResources(ctx, resources); err != nil {
 		klog.Errorf("Failed to publish resources: %v", err)
 	}
 
+	// Create on-demand VFs as claims get allocated on this node
+	if len(vfBudget) > 0 {
+		controller := driver.NewBindingController(driverName, nodeName, clientset, sriovHandler)
+		go func() {
+			if err := controller.Run(ctx); err != nil {
+				klog.Errorf("VF binding controller exited: %v", err)
+			}
+		}()
+	}
+
 	// Block until context is cancelled
 	<-ctx.Done()
 	klog.Info("Stopping helper")
@@ -156,18 +266,79 @@ func run(cmd *cobra.Command, args []string) {
 	klog.Info("Driver stopped")
 }
 
+// runController publishes the IP and segment pools as ResourceSlices that are
+// not tied to a node.  It runs as a single-replica Deployment next to the
+// node plugins.
+func runController(cmd *cobra.Command, args []string) {
+	resources := resourceslice.DriverResources{}
+	if ipPools != "" {
+		cfg, err := ipam.LoadPoolConfig(ipPools)
+		if err != nil {
+			klog.Fatalf("--ip-pools: %v", err)
+		}
+		if resources, err = driver.BuildIPPools(cfg); err != nil {
+			klog.Fatalf("--ip-pools: %v", err)
+		}
+	}
+	if segmentPools != "" {
+		cfg, err := driver.LoadSegmentPoolConfig(segmentPools)
+		if err != nil {
+			klog.Fatalf("--segment-pools: %v", err)
+		}
+		if err := driver.BuildSegmentPools(&resources, cfg); err != nil {
+			klog.Fatalf("--segment-pools: %v", err)
+		}
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		klog.Fatalf("Failed to get in-cluster config: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.Fatalf("Failed to create Kubernetes client: %v", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	klog.Infof("Starting pool controller for %s with %d pools", driverName, len(resources.Pools))
+	controller, err := resourceslice.StartController(ctx, resourceslice.Options{
+		DriverName: driverName,
+		KubeClient: clientset,
+		Resources:  &resources,
+	})
+	if err != nil {
+		klog.Fatalf("Failed to start ResourceSlice controller: %v", err)
+	}
+
+	<-ctx.Done()
+	controller.Stop()
+	klog.Info("Pool controller stopped")
+}
+
 // buildHandlerRegistry creates and populates the handler registry with all device handlers
-func buildHandlerRegistry(rdmaTracker *nriplugin.RDMANetnsTracker) *handler.HandlerRegistry {
+func buildHandlerRegistry(rdmaTracker *nriplugin.RDMANetnsTracker, linkTracker *nriplugin.LinkSetupTracker, sriovHandler *netdev.SriovVfHandler, dhcpManager *dhcp.Manager) *handler.HandlerRegistry {
 	registry := handler.NewHandlerRegistry()
 
 	// Network device handlers
-	registry.Register(&netdev.MacvlanHandler{})
-	registry.Register(&netdev.IpvlanHandler{})
-	registry.Register(&netdev.VethHandler{})
-	registry.Register(&netdev.SriovVfHandler{})
-	registry.Register(&netdev.DummyHandler{})
-	registry.Register(&netdev.HostDeviceHandler{})
-	registry.Register(&netdev.IpoibHandler{})
+	registry.Register(&netdev.MacvlanHandler{Links: linkTracker, DHCP: dhcpManager})
+	registry.Register(&netdev.IpvlanHandler{Links: linkTracker, DHCP: dhcpManager})
+	registry.Register(&netdev.VlanHandler{Links: linkTracker})
+	registry.Register(&netdev.VxlanHandler{Links: linkTracker})
+	registry.Register(&netdev.GeneveHandler{Links: linkTracker})
+	registry.Register(&netdev.BondHandler{Links: linkTracker, VFs: sriovHandler})
+	vethHandler := &netdev.VethHandler{Links: linkTracker}
+	if ovsdbSocket != "" {
+		vethHandler.OVS = &ovs.Client{Socket: ovsdbSocket}
+		sriovHandler.OVS = vethHandler.OVS
+	}
+	registry.Register(vethHandler)
+	registry.Register(sriovHandler)
+	registry.Register(&netdev.SFHandler{Links: linkTracker})
+	registry.Register(&netdev.DummyHandler{Links: linkTracker})
+	registry.Register(&netdev.HostDeviceHandler{Links: linkTracker})
+	registry.Register(&netdev.IpoibHandler{Links: linkTracker})
 
 	// RDMA device handlers — pass the tracker for exclusive netns mode.
 	uverbsHandler := &rdma.UverbsHandler{Tracker: rdmaTracker}
@@ -176,9 +347,28 @@ func buildHandlerRegistry(rdmaTracker *nriplugin.RDMANetnsTracker) *handler.Hand
 	// Combo device handlers (composed from others)
 	// RoCE uses a dummy netdev handler by default for the network side;
 	// in production, this could be a specific handler for the RoCE net interface
-	dummyHandler := &netdev.DummyHandler{}
+	dummyHandler := &netdev.DummyHandler{Links: linkTracker}
 	roceHandler := combo.NewRoCEHandler(uverbsHandler, dummyHandler)
 	registry.Register(roceHandler)
 
 	return registry
 }
+
+// buildVirtualSlots returns the slot capacity of every registered virtual kind,
+// applying --virtual-slots overrides.
+func buildVirtualSlots(registry *handler.HandlerRegistry) map[string]int {
+	slots := make(map[string]int)
+	for _, kind := range registry.VirtualKinds() {
+		slots[kind] = driver.DefaultVirtualSlots
+	}
+	for kind, n := range virtualSlots {
+		if _, ok := slots[kind]; !ok {
+			klog.Fatalf("--virtual-slots: %q is not a registered virtual kind (have %v)", kind, registry.VirtualKinds())
+		}
+		if n <= 0 {
+			klog.Fatalf("--virtual-slots: slot capacity for %s must be positive, got %d", kind, n)
+		}
+		slots[kind] = n
+	}
+	return slots
+}
@@ -0,0 +1,688 @@
+package dhcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"k8s.io/klog/v2"
+)
+
+// Retransmission and retry intervals.  Retransmissions double from the
+// first interval up to the second (RFC 2131 section 4.1, RFC 8415 section
+// 15); failed acquisitions in the background back off the same way.
+const (
+	retransmitMin = 4 * time.Second
+	retransmitMax = 64 * time.Second
+	retryMin      = 4 * time.Second
+	retryMax      = 2 * time.Minute
+
+	// readPoll bounds each socket read so cancellation is noticed.
+	readPoll = time.Second
+)
+
+// errLeaseLost means the server refused to extend a lease (DHCPNAK, or a
+// DHCPv6 reply without the address), which must be dropped at once.
+var errLeaseLost = errors.New("server no longer grants the lease")
+
+var broadcast4 = netip.AddrPortFrom(netip.AddrFrom4([4]byte{255, 255, 255, 255}), v4ServerPort)
+
+// client holds the leases of one claim on one link in a pod netns.
+type client struct {
+	m *Manager
+
+	mu sync.Mutex // Guards st
+	st *state
+
+	nl    *netlink.Handle // Bound to the pod netns
+	link  netlink.Link
+	mac   net.HardwareAddr
+	duid  []byte
+	iaid  uint32
+	conn4 net.PacketConn
+	conn6 net.PacketConn
+
+	// ctx is cancelled by Stop to end the renewal loops.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newClient opens the link and the client sockets in st's netns.
+func newClient(m *Manager, st *state) (*client, error) {
+	ns, err := netns.GetFromPath(st.NetnsPath)
+	if err != nil {
+		return nil, fmt.Errorf("open netns %s: %w", st.NetnsPath, err)
+	}
+	defer ns.Close()
+
+	nl, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, fmt.Errorf("netlink handle in %s: %w", st.NetnsPath, err)
+	}
+	c := &client{m: m, st: st, nl: nl, duid: duid(st.ClaimUID), iaid: iaid(st.IfName)}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	if c.link, err = nl.LinkByName(st.IfName); err != nil {
+		c.close()
+		return nil, fmt.Errorf("link %s in %s: %w", st.IfName, st.NetnsPath, err)
+	}
+	if err := nl.LinkSetUp(c.link); err != nil {
+		c.close()
+		return nil, fmt.Errorf("set %s up: %w", st.IfName, err)
+	}
+	c.mac = c.link.Attrs().HardwareAddr
+
+	err = runInNetns(ns, func() error {
+		var err error
+		if st.Options.IPv4 {
+			if c.conn4, err = listen("udp4", fmt.Sprintf("0.0.0.0:%d", v4ClientPort), st.IfName); err != nil {
+				return err
+			}
+		}
+		if st.Options.IPv6 {
+			if c.conn6, err = listen("udp6", fmt.Sprintf("[::]:%d", v6ClientPort), st.IfName); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.close()
+		return nil, fmt.Errorf("open DHCP sockets on %s: %w", st.IfName, err)
+	}
+	return c, nil
+}
+
+// listen opens a UDP socket bound to ifName, so that clients of several
+// claims in the same netns don't see each other's traffic.
+func listen(network, address, ifName string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: func(_, _ string, rc syscall.RawConn) error {
+		var err error
+		cerr := rc.Control(func(fd uintptr) {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+				return
+			}
+			if network == "udp4" {
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
+					return
+				}
+			}
+			err = syscall.BindToDevice(int(fd), ifName)
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	return lc.ListenPacket(context.Background(), network, address)
+}
+
+// close releases the sockets and the netlink handle.
+func (c *client) close() {
+	c.cancel()
+	if c.conn4 != nil {
+		c.conn4.Close()
+	}
+	if c.conn6 != nil {
+		c.conn6.Close()
+	}
+	c.nl.Close()
+}
+
+func (c *client) save() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m.persist(c.st)
+}
+
+func (c *client) leases() (*Lease4, *Lease6) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.st.V4, c.st.V6
+}
+
+// ─── DHCPv4 ────────────────────────────────────────────────────────────────
+
+func (c *client) newMessage4(msgType byte) *message4 {
+	m := &message4{
+		op:     bootRequest,
+		xid:    rand.Uint32(),
+		chaddr: c.mac,
+		options: map[byte][]byte{
+			optMessageType:  {msgType},
+			optClientID:     append(append([]byte{0xff}, uint32Option(c.iaid)...), c.duid...),
+			optParamRequest: {optSubnetMask, optRouter, optLeaseTime, optServerID, optRenewalTime, optRebindTime},
+		},
+	}
+	if c.st.Options.Hostname != "" {
+		m.options[optHostname] = []byte(c.st.Options.Hostname)
+	}
+	return m
+}
+
+// acquire4 runs DISCOVER, OFFER, REQUEST, ACK and configures the lease.
+func (c *client) acquire4(ctx context.Context) error {
+	discover := c.newMessage4(v4Discover)
+	discover.flags = flagBroadcast
+	offer, err := c.transact4(ctx, discover, broadcast4, func(m *message4) bool {
+		return m.msgType() == v4Offer && m.yiaddr.Is4() && !m.yiaddr.IsUnspecified() && m.addr4(optServerID).IsValid()
+	})
+	if err != nil {
+		return fmt.Errorf("no offer: %w", err)
+	}
+
+	request := c.newMessage4(v4Request)
+	request.flags = flagBroadcast
+	request.options[optRequestedIP] = offer.yiaddr.AsSlice()
+	request.options[optServerID] = offer.options[optServerID]
+	ack, err := c.transact4(ctx, request, broadcast4, isAck4)
+	if err != nil {
+		return fmt.Errorf("no reply to request for %s: %w", offer.yiaddr, err)
+	}
+	if ack.msgType() == v4Nak {
+		return fmt.Errorf("server %s refused %s", offer.addr4(optServerID), offer.yiaddr)
+	}
+	return c.bind4(ack)
+}
+
+// renew4 extends l, from the server that granted it or, when rebinding, from
+// any server.
+func (c *client) renew4(ctx context.Context, l *Lease4, rebind bool) error {
+	prefix, err := netip.ParsePrefix(l.Address)
+	if err != nil {
+		return err
+	}
+	request := c.newMessage4(v4Request)
+	request.ciaddr = prefix.Addr()
+	to := broadcast4
+	if !rebind {
+		server, err := netip.ParseAddr(l.ServerID)
+		if err != nil {
+			return err
+		}
+		to = netip.AddrPortFrom(server, v4ServerPort)
+	}
+	ack, err := c.transact4(ctx, request, to, isAck4)
+	if err != nil {
+		return err
+	}
+	if ack.msgType() == v4Nak || ack.yiaddr != prefix.Addr() {
+		return errLeaseLost
+	}
+	return c.bind4(ack)
+}
+
+func isAck4(m *message4) bool {
+	return m.msgType() == v4Ack || m.msgType() == v4Nak
+}
+
+// bind4 configures the lease an ACK grants on the link and records it.
+func (c *client) bind4(ack *message4) error {
+	l, err := lease4(ack, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := c.apply4(l); err != nil {
+		return err
+	}
+	old, _ := c.leases()
+	if old != nil && old.Address != l.Address {
+		c.removeAddr(old.Address)
+	}
+	c.mu.Lock()
+	c.st.V4 = l
+	c.mu.Unlock()
+	c.save()
+	klog.V(2).Infof("DHCPv4 lease for claim %s: %s from %s for %s", c.st.ClaimUID, l.Address, l.ServerID, l.LeaseTime)
+	return nil
+}
+
+// apply4 adds the lease's address, and optionally its default route, to the
+// link.  The address expires with the lease.
+func (c *client) apply4(l *Lease4) error {
+	left := lifetime(l.LeaseTime, l.Acquired)
+	addr, err := linkAddr(l.Address, left, left)
+	if err != nil {
+		return err
+	}
+	if err := c.nl.AddrReplace(c.link, addr); err != nil {
+		return fmt.Errorf("add %s to %s: %w", l.Address, c.st.IfName, err)
+	}
+	opts := c.st.Options
+	router := net.ParseIP(l.Router)
+	if opts.NoRouter {
+		router = nil
+	}
+	if opts.Table != 0 {
+		if err := c.routeInTable(addr, router); err != nil {
+			return err
+		}
+	}
+	if opts.DefaultRoute && router != nil {
+		// The claim asked to take over the pod's default route.
+		route := &netlink.Route{LinkIndex: c.link.Attrs().Index, Gw: router}
+		if err := c.nl.RouteReplace(route); err != nil {
+			return fmt.Errorf("add default route via %s: %w", l.Router, err)
+		}
+	}
+	return nil
+}
+
+// routeInTable routes addr's subnet, and the default via router if set, in
+// the options' table, and selects the table for traffic from addr.
+func (c *client) routeInTable(addr *netlink.Addr, router net.IP) error {
+	table := c.st.Options.Table
+	subnet := &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+	routes := []*netlink.Route{{LinkIndex: c.link.Attrs().Index, Dst: subnet, Src: addr.IP, Scope: netlink.SCOPE_LINK, Table: table}}
+	if router != nil {
+		routes = append(routes, &netlink.Route{LinkIndex: c.link.Attrs().Index, Gw: router, Table: table})
+	}
+	for _, r := range routes {
+		if err := c.nl.RouteReplace(r); err != nil {
+			return fmt.Errorf("add route to %s in table %d: %w", r.Dst, table, err)
+		}
+	}
+	// Rules cannot be replaced; one left by an earlier apply is fine.
+	if err := c.nl.RuleAdd(c.rule(addr.IP)); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("add rule from %s lookup %d: %w", addr.IP, table, err)
+	}
+	return nil
+}
+
+// rule returns the rule selecting the options' table for traffic from ip.
+func (c *client) rule(ip net.IP) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Src = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	rule.Table = c.st.Options.Table
+	rule.Priority = c.st.Options.RulePriority
+	rule.Family = netlink.FAMILY_V4
+	return rule
+}
+
+func (c *client) drop4() {
+	l, _ := c.leases()
+	if l == nil {
+		return
+	}
+	c.removeAddr(l.Address)
+	c.mu.Lock()
+	c.st.V4 = nil
+	c.mu.Unlock()
+	c.save()
+}
+
+// transact4 sends msg to to until a reply with its transaction ID that
+// accept takes arrives, or ctx is done.
+func (c *client) transact4(ctx context.Context, msg *message4, to netip.AddrPort, accept func(*message4) bool) (*message4, error) {
+	b := msg.marshal()
+	var reply *message4
+	err := c.transact(ctx, c.conn4, b, net.UDPAddrFromAddrPort(to), func(p []byte) bool {
+		m, err := parseMessage4(p)
+		if err != nil || m.op != bootReply || m.xid != msg.xid || !accept(m) {
+			return false
+		}
+		reply = m
+		return true
+	})
+	return reply, err
+}
+
+// ─── DHCPv6 ────────────────────────────────────────────────────────────────
+
+// newMessage6 builds a client message.  serverID and addr are optional.
+func (c *client) newMessage6(msgType byte, serverID []byte, addr netip.Addr) *message6 {
+	m := &message6{
+		msgType: msgType,
+		xid:     rand.Uint32() & 0xffffff,
+		options: []option6{{opt6ClientID, c.duid}},
+	}
+	if serverID != nil {
+		m.options = append(m.options, option6{opt6ServerID, serverID})
+	}
+	ia := &iaNA{iaid: c.iaid, addr: addr}
+	m.options = append(m.options,
+		option6{opt6ElapsedTime, []byte{0, 0}},
+		option6{opt6IANA, ia.marshal()},
+	)
+	return m
+}
+
+// acquire6 runs SOLICIT, ADVERTISE, REQUEST, REPLY and configures the
+// lease.  Messages are sourced from the link-local address, so it waits for
+// duplicate address detection to finish first.
+func (c *client) acquire6(ctx context.Context) error {
+	if err := c.waitLinkLocal(ctx); err != nil {
+		return err
+	}
+	solicit := c.newMessage6(v6Solicit, nil, netip.Addr{})
+	advertise, err := c.transact6(ctx, solicit, func(m *message6) bool {
+		if m.msgType != v6Advertise || m.status() != status6Success {
+			return false
+		}
+		_, err := lease6(m, c.iaid, time.Now())
+		return err == nil
+	})
+	if err != nil {
+		return fmt.Errorf("no advertise: %w", err)
+	}
+
+	request := c.newMessage6(v6Request, advertise.option(opt6ServerID), netip.Addr{})
+	reply, err := c.transact6(ctx, request, isReply6)
+	if err != nil {
+		return fmt.Errorf("no reply to request: %w", err)
+	}
+	return c.bind6(reply)
+}
+
+// renew6 extends l with RENEW to the server that granted it or, when
+// rebinding, with REBIND to any server.
+func (c *client) renew6(ctx context.Context, l *Lease6, rebind bool) error {
+	prefix, err := netip.ParsePrefix(l.Address)
+	if err != nil {
+		return err
+	}
+	msg := c.newMessage6(v6Renew, l.ServerID, prefix.Addr())
+	if rebind {
+		msg = c.newMessage6(v6Rebind, nil, prefix.Addr())
+	}
+	reply, err := c.transact6(ctx, msg, isReply6)
+	if err != nil {
+		return err
+	}
+	granted, err := lease6(reply, c.iaid, time.Now())
+	if err != nil || granted.Address != l.Address {
+		return errLeaseLost
+	}
+	return c.bind6(reply)
+}
+
+func isReply6(m *message6) bool {
+	return m.msgType == v6Reply
+}
+
+// bind6 configures the lease a REPLY grants on the link and records it.
+func (c *client) bind6(reply *message6) error {
+	l, err := lease6(reply, c.iaid, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := c.apply6(l); err != nil {
+		return err
+	}
+	_, old := c.leases()
+	if old != nil && old.Address != l.Address {
+		c.removeAddr(old.Address)
+	}
+	c.mu.Lock()
+	c.st.V6 = l
+	c.mu.Unlock()
+	c.save()
+	klog.V(2).Infof("DHCPv6 lease for claim %s: %s for %s", c.st.ClaimUID, l.Address, l.Valid)
+	return nil
+}
+
+// apply6 adds the lease's address to the link.  The server already checked
+// that it is unique, so duplicate address detection is skipped.
+func (c *client) apply6(l *Lease6) error {
+	addr, err := linkAddr(l.Address, lifetime(l.Valid, l.Acquired), lifetime(l.Preferred, l.Acquired))
+	if err != nil {
+		return err
+	}
+	addr.Flags = syscall.IFA_F_NODAD
+	if err := c.nl.AddrReplace(c.link, addr); err != nil {
+		return fmt.Errorf("add %s to %s: %w", l.Address, c.st.IfName, err)
+	}
+	return nil
+}
+
+func (c *client) drop6() {
+	_, l := c.leases()
+	if l == nil {
+		return
+	}
+	c.removeAddr(l.Address)
+	c.mu.Lock()
+	c.st.V6 = nil
+	c.mu.Unlock()
+	c.save()
+}
+
+// waitLinkLocal waits until the link has a usable link-local address.
+func (c *client) waitLinkLocal(ctx context.Context) error {
+	for {
+		addrs, err := c.nl.AddrList(c.link, netlink.FAMILY_V6)
+		if err != nil {
+			return fmt.Errorf("list addresses of %s: %w", c.st.IfName, err)
+		}
+		for _, a := range addrs {
+			if a.IP.IsLinkLocalUnicast() && a.Flags&syscall.IFA_F_TENTATIVE == 0 {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s has no link-local address: %w", c.st.IfName, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// transact6 sends msg to all DHCP servers on the link until a reply with
+// its transaction ID that accept takes arrives, or ctx is done.
+func (c *client) transact6(ctx context.Context, msg *message6, accept func(*message6) bool) (*message6, error) {
+	to := &net.UDPAddr{IP: allDHCPServers.AsSlice(), Port: v6ServerPort, Zone: strconv.Itoa(c.link.Attrs().Index)}
+	var reply *message6
+	err := c.transact(ctx, c.conn6, msg.marshal(), to, func(p []byte) bool {
+		m, err := parseMessage6(p)
+		if err != nil || m.xid != msg.xid || !accept(m) {
+			return false
+		}
+		reply = m
+		return true
+	})
+	return reply, err
+}
+
+// ─── Common ────────────────────────────────────────────────────────────────
+
+// transact sends b and retransmits it with exponential backoff until accept
+// takes a received packet or ctx is done.
+func (c *client) transact(ctx context.Context, conn net.PacketConn, b []byte, to net.Addr, accept func([]byte) bool) error {
+	buf := make([]byte, 1500)
+	for interval := retransmitMin; ; interval = min(2*interval, retransmitMax) {
+		if _, err := conn.WriteTo(b, to); err != nil {
+			return fmt.Errorf("send to %s: %w", to, err)
+		}
+		for resend := time.Now().Add(interval); time.Now().Before(resend); {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			conn.SetReadDeadline(time.Now().Add(min(readPoll, time.Until(resend))))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					continue
+				}
+				return fmt.Errorf("receive: %w", err)
+			}
+			if accept(buf[:n]) {
+				return nil
+			}
+		}
+	}
+}
+
+func (c *client) removeAddr(cidr string) {
+	addr, err := netlink.ParseAddr(cidr)
+	if err == nil {
+		err = c.nl.AddrDel(c.link, addr)
+	}
+	if err != nil {
+		klog.V(2).Infof("Failed to remove %s from %s: %v", cidr, c.st.IfName, err)
+		return
+	}
+	// The routes using the address as source go with it, its rule does not.
+	if c.st.Options.Table != 0 && addr.IP.To4() != nil {
+		if err := c.nl.RuleDel(c.rule(addr.IP)); err != nil {
+			klog.V(2).Infof("Failed to remove rule from %s: %v", addr.IP, err)
+		}
+	}
+}
+
+// reapply configures leases restored from state on the link again; they may
+// have expired while the driver was down.
+func (c *client) reapply() {
+	v4, v6 := c.leases()
+	if v4 != nil {
+		if time.Now().After(v4.Acquired.Add(v4.LeaseTime)) {
+			c.drop4()
+		} else if err := c.apply4(v4); err != nil {
+			klog.Warningf("Failed to restore DHCPv4 lease of claim %s: %v", c.st.ClaimUID, err)
+		}
+	}
+	if v6 != nil {
+		if time.Now().After(v6.Acquired.Add(v6.Valid)) {
+			c.drop6()
+		} else if err := c.apply6(v6); err != nil {
+			klog.Warningf("Failed to restore DHCPv6 lease of claim %s: %v", c.st.ClaimUID, err)
+		}
+	}
+}
+
+// release gives the leases back to their servers and removes the addresses.
+// Errors are ignored: the pod netns may already be gone.
+func (c *client) release() {
+	v4, v6 := c.leases()
+	if v4 != nil && c.conn4 != nil {
+		prefix, err1 := netip.ParsePrefix(v4.Address)
+		server, err2 := netip.ParseAddr(v4.ServerID)
+		if err1 == nil && err2 == nil {
+			msg := c.newMessage4(v4Release)
+			msg.ciaddr = prefix.Addr()
+			msg.options[optServerID] = server.AsSlice()
+			delete(msg.options, optParamRequest)
+			c.conn4.WriteTo(msg.marshal(), net.UDPAddrFromAddrPort(netip.AddrPortFrom(server, v4ServerPort)))
+		}
+		c.removeAddr(v4.Address)
+	}
+	if v6 != nil && c.conn6 != nil {
+		if prefix, err := netip.ParsePrefix(v6.Address); err == nil {
+			msg := c.newMessage6(v6Release, v6.ServerID, prefix.Addr())
+			to := &net.UDPAddr{IP: allDHCPServers.AsSlice(), Port: v6ServerPort, Zone: strconv.Itoa(c.link.Attrs().Index)}
+			c.conn6.WriteTo(msg.marshal(), to)
+		}
+		c.removeAddr(v6.Address)
+	}
+	c.mu.Lock()
+	c.st.V4, c.st.V6 = nil, nil
+	c.mu.Unlock()
+}
+
+// start runs a renewal loop per requested family until Stop.
+func (c *client) start() {
+	if c.st.Options.IPv4 {
+		c.wg.Add(1)
+		go c.maintain("DHCPv4", func() (*leaseTimes, bool) {
+			l, _ := c.leases()
+			if l == nil {
+				return nil, false
+			}
+			return &leaseTimes{l.Acquired, l.T1, l.T2, l.LeaseTime}, true
+		}, c.acquire4, func(ctx context.Context, rebind bool) error {
+			l, _ := c.leases()
+			return c.renew4(ctx, l, rebind)
+		}, c.drop4)
+	}
+	if c.st.Options.IPv6 {
+		c.wg.Add(1)
+		go c.maintain("DHCPv6", func() (*leaseTimes, bool) {
+			_, l := c.leases()
+			if l == nil {
+				return nil, false
+			}
+			return &leaseTimes{l.Acquired, l.T1, l.T2, l.Valid}, true
+		}, c.acquire6, func(ctx context.Context, rebind bool) error {
+			_, l := c.leases()
+			return c.renew6(ctx, l, rebind)
+		}, c.drop6)
+	}
+}
+
+// leaseTimes are the points in a lease's life the renewal loop acts on.
+type leaseTimes struct {
+	acquired      time.Time
+	t1, t2, valid time.Duration
+}
+
+// maintain keeps one family's lease: it renews from T1, rebinds from T2,
+// drops the lease when it expires or the server refuses it, and acquires a
+// new one while there is none.
+func (c *client) maintain(family string, times func() (*leaseTimes, bool),
+	acquire func(context.Context) error, renew func(context.Context, bool) error, drop func()) {
+	defer c.wg.Done()
+	backoff := retryMin
+	for c.ctx.Err() == nil {
+		lt, ok := times()
+		now := time.Now()
+		switch {
+		case !ok:
+			ctx, cancel := context.WithTimeout(c.ctx, c.m.timeout())
+			err := acquire(ctx)
+			cancel()
+			if err == nil {
+				backoff = retryMin
+				continue
+			}
+			if c.ctx.Err() == nil {
+				klog.Warningf("%s for claim %s on %s: %v", family, c.st.ClaimUID, c.st.IfName, err)
+			}
+			c.sleep(backoff)
+			backoff = min(2*backoff, retryMax)
+
+		case now.Before(lt.acquired.Add(lt.t1)):
+			c.sleep(lt.acquired.Add(lt.t1).Sub(now))
+
+		case now.Before(lt.acquired.Add(lt.valid)):
+			rebind := !now.Before(lt.acquired.Add(lt.t2))
+			deadline := lt.acquired.Add(lt.t2)
+			if rebind {
+				deadline = lt.acquired.Add(lt.valid)
+			}
+			ctx, cancel := context.WithDeadline(c.ctx, deadline)
+			err := renew(ctx, rebind)
+			cancel()
+			switch {
+			case errors.Is(err, errLeaseLost):
+				klog.Warningf("%s lease of claim %s on %s lost: %v", family, c.st.ClaimUID, c.st.IfName, err)
+				drop()
+			case err != nil && c.ctx.Err() == nil:
+				klog.V(2).Infof("%s renewal for claim %s on %s: %v", family, c.st.ClaimUID, c.st.IfName, err)
+				c.sleep(min(time.Second, time.Until(deadline)))
+			}
+
+		default:
+			klog.Warningf("%s lease of claim %s on %s expired", family, c.st.ClaimUID, c.st.IfName)
+			drop()
+		}
+	}
+}
+
+// sleep waits for d or until the client is stopped.
+func (c *client) sleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-c.ctx.Done():
+	case <-t.C:
+	}
+}
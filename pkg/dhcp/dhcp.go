@@ -0,0 +1,312 @@
+// Package dhcp runs DHCPv4 and DHCPv6 clients on behalf of claims, on links
+// inside pod network namespaces.  A client acquires its leases when the link
+// lands in the pod, renews them for the claim's lifetime and releases them
+// when the claim is unprepared.  Leases are written to a state directory so
+// that clients resume after a driver restart.
+package dhcp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"k8s.io/klog/v2"
+)
+
+// DefaultTimeout bounds the initial lease acquisition.
+const DefaultTimeout = 10 * time.Second
+
+// Options select what a client asks for.
+type Options struct {
+	IPv4     bool   `json:"ipv4,omitempty"`
+	IPv6     bool   `json:"ipv6,omitempty"`
+	Hostname string `json:"hostname,omitempty"` // Sent to the DHCPv4 server
+
+	// Routing of DHCPv4 leases.  By default only the lease's subnet is
+	// routed, on the link, and the pod keeps the default route of its
+	// primary interface.
+	DefaultRoute bool `json:"defaultRoute,omitempty"` // Replace the pod's default route with one via the router
+	Table        int  `json:"table,omitempty"`        // Also route the subnet, and via the router, in this table
+	RulePriority int  `json:"rulePriority,omitempty"` // Priority of the rule selecting Table for the lease's address
+	NoRouter     bool `json:"noRouter,omitempty"`     // Ignore the router, as the claim sets its own IPv4 gateway
+}
+
+// Lease4 is a DHCPv4 lease.
+type Lease4 struct {
+	Address   string        `json:"address"` // CIDR, e.g. 192.0.2.10/24
+	Router    string        `json:"router,omitempty"`
+	ServerID  string        `json:"serverID"`
+	Acquired  time.Time     `json:"acquired"`
+	LeaseTime time.Duration `json:"leaseTime"`
+	T1        time.Duration `json:"t1"`
+	T2        time.Duration `json:"t2"`
+}
+
+// Lease6 is a DHCPv6 address lease (IA_NA).
+type Lease6 struct {
+	Address   string        `json:"address"` // e.g. 2001:db8::10/128
+	ServerID  []byte        `json:"serverID"`
+	Acquired  time.Time     `json:"acquired"`
+	Preferred time.Duration `json:"preferred"`
+	Valid     time.Duration `json:"valid"`
+	T1        time.Duration `json:"t1"`
+	T2        time.Duration `json:"t2"`
+}
+
+// state is what a client persists.
+type state struct {
+	ClaimUID  string  `json:"claimUID"`
+	NetnsPath string  `json:"netnsPath"`
+	IfName    string  `json:"ifName"`
+	Options   Options `json:"options"`
+	V4        *Lease4 `json:"v4,omitempty"`
+	V6        *Lease6 `json:"v6,omitempty"`
+}
+
+// Manager runs a client per claim.  Thread-safe.
+type Manager struct {
+	// StateDir holds a lease file per claim.  Empty disables persistence.
+	StateDir string
+	// Timeout bounds the initial acquisition in Start (default
+	// DefaultTimeout).
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*client // nil while Start acquires the leases
+}
+
+// Start acquires leases for claimUID on ifName in the netns at netnsPath,
+// configures them on the link and keeps renewing them until Stop.  It
+// returns once every requested family has a lease.
+func (m *Manager) Start(claimUID, netnsPath, ifName string, opts Options) error {
+	// Reserve the claim, so that a concurrent Start does not acquire a
+	// second set of leases.
+	m.mu.Lock()
+	c, running := m.clients[claimUID]
+	if !running {
+		if m.clients == nil {
+			m.clients = make(map[string]*client)
+		}
+		m.clients[claimUID] = nil
+	}
+	m.mu.Unlock()
+	if running {
+		if c == nil {
+			return fmt.Errorf("DHCP client for claim %s is still starting", claimUID)
+		}
+		return nil
+	}
+
+	c, err := newClient(m, &state{ClaimUID: claimUID, NetnsPath: netnsPath, IfName: ifName, Options: opts})
+	if err != nil {
+		m.unreserve(claimUID)
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout())
+	defer cancel()
+	if opts.IPv4 {
+		err = c.acquire4(ctx)
+		if err != nil {
+			err = fmt.Errorf("DHCPv4 on %s: %w", ifName, err)
+		}
+	}
+	if opts.IPv6 && err == nil {
+		err = c.acquire6(ctx)
+		if err != nil {
+			err = fmt.Errorf("DHCPv6 on %s: %w", ifName, err)
+		}
+	}
+	if err != nil {
+		c.release()
+		c.close()
+		m.unreserve(claimUID)
+		m.remove(claimUID)
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if placeholder, ok := m.clients[claimUID]; !ok || placeholder != nil {
+		// Stopped while the leases were acquired.
+		c.release()
+		c.close()
+		return fmt.Errorf("DHCP client for claim %s was stopped while starting", claimUID)
+	}
+	m.add(c)
+	return nil
+}
+
+// unreserve drops the reservation Start made for claimUID.
+func (m *Manager) unreserve(claimUID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.clients[claimUID]; ok && c == nil {
+		delete(m.clients, claimUID)
+	}
+}
+
+// Stop releases the leases of claimUID, stops renewing them and forgets its
+// state.  Stopping a claim without a client is a no-op.
+func (m *Manager) Stop(claimUID string) {
+	m.mu.Lock()
+	c := m.clients[claimUID]
+	delete(m.clients, claimUID)
+	m.mu.Unlock()
+
+	if c != nil {
+		c.cancel()
+		c.wg.Wait()
+		c.release()
+		c.close()
+		klog.Infof("Stopped DHCP client for claim %s", claimUID)
+	}
+	m.remove(claimUID)
+}
+
+// Restore resumes the clients recorded in the state directory.  Clients
+// whose netns or link is gone are dropped; leases that expired while the
+// driver was down are acquired again in the background.
+func (m *Manager) Restore() {
+	if m.StateDir == "" {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(m.StateDir, "*.json"))
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			klog.Warningf("Failed to read DHCP state %s: %v", path, err)
+			continue
+		}
+		var st state
+		if err := json.Unmarshal(data, &st); err != nil || st.ClaimUID == "" {
+			klog.Warningf("Skipping invalid DHCP state %s: %v", path, err)
+			continue
+		}
+		if _, ok := m.clients[st.ClaimUID]; ok {
+			continue
+		}
+		c, err := newClient(m, &st)
+		if err != nil {
+			klog.Infof("Dropping DHCP leases of claim %s: %v", st.ClaimUID, err)
+			os.Remove(path)
+			continue
+		}
+		c.reapply()
+		m.add(c)
+		klog.Infof("Resumed DHCP client for claim %s on %s", st.ClaimUID, st.IfName)
+	}
+}
+
+// add registers c and starts its renewal loops.  Called with m.mu held.
+func (m *Manager) add(c *client) {
+	if m.clients == nil {
+		m.clients = make(map[string]*client)
+	}
+	m.clients[c.st.ClaimUID] = c
+	c.save()
+	c.start()
+}
+
+func (m *Manager) timeout() time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (m *Manager) statePath(claimUID string) string {
+	return filepath.Join(m.StateDir, claimUID+".json")
+}
+
+// persist writes st, replacing the previous file atomically.
+func (m *Manager) persist(st *state) {
+	if m.StateDir == "" {
+		return
+	}
+	data, err := json.Marshal(st)
+	if err == nil {
+		err = os.MkdirAll(m.StateDir, 0755)
+	}
+	if err == nil {
+		tmp := m.statePath(st.ClaimUID) + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, m.statePath(st.ClaimUID))
+		}
+	}
+	if err != nil {
+		klog.Warningf("Failed to persist DHCP leases of claim %s: %v", st.ClaimUID, err)
+	}
+}
+
+func (m *Manager) remove(claimUID string) {
+	if m.StateDir != "" {
+		os.Remove(m.statePath(claimUID))
+	}
+}
+
+// duid returns the DUID-UUID (RFC 6355) identifying a claim's client.  Claim
+// UIDs are UUIDs; anything else is hashed into one.
+func duid(claimUID string) []byte {
+	id, err := hex.DecodeString(strings.ReplaceAll(claimUID, "-", ""))
+	if err != nil || len(id) != 16 {
+		sum := sha256.Sum256([]byte(claimUID))
+		id = sum[:16]
+	}
+	return append([]byte{0, 4}, id...)
+}
+
+// iaid identifies the link within the client (RFC 4361, RFC 8415).
+func iaid(ifName string) uint32 {
+	return crc32.ChecksumIEEE([]byte(ifName))
+}
+
+// runInNetns runs fn on a fresh OS thread inside ns, e.g. to open sockets
+// there.  The thread is never unlocked, so it exits with its goroutine
+// instead of returning to the scheduler in the wrong netns.
+func runInNetns(ns netns.NsHandle, fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := netns.Set(ns); err != nil {
+			errCh <- fmt.Errorf("enter netns: %w", err)
+			return
+		}
+		errCh <- fn()
+	}()
+	return <-errCh
+}
+
+// lifetime converts what is left of a lease into an address lifetime in
+// seconds.  Infinite leases give 0, which leaves the address permanent.
+func lifetime(d time.Duration, since time.Time) int {
+	if d >= 0xffffffff*time.Second {
+		return 0
+	}
+	return max(1, int(time.Until(since.Add(d))/time.Second))
+}
+
+// linkAddr is the netlink address for a lease.
+func linkAddr(cidr string, valid, preferred int) (*netlink.Addr, error) {
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		return nil, err
+	}
+	addr.ValidLft, addr.PreferedLft = valid, preferred
+	return addr, nil
+}
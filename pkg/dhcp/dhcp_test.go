@@ -0,0 +1,636 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// ─── Codec tests ────────────────────────────────────────────────────────────
+
+func TestMessage4_RoundTrip(t *testing.T) {
+	m := &message4{
+		op:     bootRequest,
+		xid:    0xdeadbeef,
+		flags:  flagBroadcast,
+		ciaddr: netip.MustParseAddr("192.0.2.10"),
+		yiaddr: netip.IPv4Unspecified(),
+		chaddr: net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		options: map[byte][]byte{
+			optMessageType: {v4Request},
+			optHostname:    []byte("web-0"),
+			optLeaseTime:   uint32Option(3600),
+		},
+	}
+	b := m.marshal()
+	if len(b) < 300 {
+		t.Errorf("message is %d bytes, want at least 300", len(b))
+	}
+	if b[240] != optMessageType {
+		t.Errorf("first option = %d, want the message type", b[240])
+	}
+	got, err := parseMessage4(b)
+	if err != nil {
+		t.Fatalf("parseMessage4: %v", err)
+	}
+	if got.xid != m.xid || got.flags != m.flags || got.ciaddr != m.ciaddr || !bytes.Equal(got.chaddr, m.chaddr) {
+		t.Errorf("header = %+v, want %+v", got, m)
+	}
+	if got.msgType() != v4Request || string(got.options[optHostname]) != "web-0" || got.seconds(optLeaseTime) != time.Hour {
+		t.Errorf("options = %v", got.options)
+	}
+
+	if _, err := parseMessage4(b[:200]); err == nil {
+		t.Error("expected error for a short message")
+	}
+	b[241] = 200 // Message type option overruns the packet.
+	if _, err := parseMessage4(b[:250]); err == nil {
+		t.Error("expected error for a truncated option")
+	}
+}
+
+func TestLease4(t *testing.T) {
+	now := time.Now()
+	ack := &message4{
+		yiaddr: netip.MustParseAddr("192.0.2.10"),
+		options: map[byte][]byte{
+			optSubnetMask: {255, 255, 255, 0},
+			optRouter:     {192, 0, 2, 1},
+			optServerID:   {192, 0, 2, 2},
+			optLeaseTime:  uint32Option(800),
+		},
+	}
+	l, err := lease4(ack, now)
+	if err != nil {
+		t.Fatalf("lease4: %v", err)
+	}
+	want := Lease4{Address: "192.0.2.10/24", Router: "192.0.2.1", ServerID: "192.0.2.2", Acquired: now,
+		LeaseTime: 800 * time.Second, T1: 400 * time.Second, T2: 700 * time.Second}
+	if *l != want {
+		t.Errorf("lease = %+v, want %+v", *l, want)
+	}
+
+	ack.options[optRenewalTime] = uint32Option(100)
+	if l, _ := lease4(ack, now); l.T1 != 100*time.Second {
+		t.Errorf("T1 = %s, want the server's 100s", l.T1)
+	}
+	for _, code := range []byte{optSubnetMask, optServerID, optLeaseTime} {
+		incomplete := &message4{yiaddr: ack.yiaddr, options: map[byte][]byte{}}
+		for k, v := range ack.options {
+			if k != code {
+				incomplete.options[k] = v
+			}
+		}
+		if _, err := lease4(incomplete, now); err == nil {
+			t.Errorf("expected error without option %d", code)
+		}
+	}
+}
+
+func TestMessage6_RoundTrip(t *testing.T) {
+	ia := &iaNA{iaid: 7, t1: time.Minute, t2: 2 * time.Minute,
+		addr: netip.MustParseAddr("2001:db8::10"), preferred: time.Hour, valid: 2 * time.Hour}
+	m := &message6{msgType: v6Reply, xid: 0xabcdef, options: []option6{
+		{opt6ClientID, duid("11111111-2222-3333-4444-555555555555")},
+		{opt6ServerID, []byte{0, 3, 0, 1, 2, 0, 0, 0, 0, 2}},
+		{opt6IANA, ia.marshal()},
+	}}
+	got, err := parseMessage6(m.marshal())
+	if err != nil {
+		t.Fatalf("parseMessage6: %v", err)
+	}
+	if got.msgType != v6Reply || got.xid != 0xabcdef || len(got.options) != 3 {
+		t.Fatalf("message = %+v", got)
+	}
+	gotIA, err := parseIANA(got.option(opt6IANA))
+	if err != nil {
+		t.Fatalf("parseIANA: %v", err)
+	}
+	if *gotIA != *ia {
+		t.Errorf("IA_NA = %+v, want %+v", *gotIA, *ia)
+	}
+
+	now := time.Now()
+	l, err := lease6(got, 7, now)
+	if err != nil {
+		t.Fatalf("lease6: %v", err)
+	}
+	if l.Address != "2001:db8::10/128" || l.Valid != 2*time.Hour || l.T1 != time.Minute || !bytes.Equal(l.ServerID, m.options[1].data) {
+		t.Errorf("lease = %+v", l)
+	}
+	if _, err := lease6(got, 8, now); err == nil {
+		t.Error("expected error for another IAID")
+	}
+
+	if _, err := parseMessage6([]byte{v6Reply, 0, 0, 1, 0, 1, 0, 9}); err == nil {
+		t.Error("expected error for a truncated option")
+	}
+}
+
+func TestLease6_Status(t *testing.T) {
+	status := binary.BigEndian.AppendUint16(nil, 3) // NoBinding
+	ia := (&iaNA{iaid: 1}).marshal()
+	ia = appendOptions6(ia, []option6{{opt6StatusCode, status}})
+	reply := &message6{msgType: v6Reply, options: []option6{{opt6ServerID, []byte{1}}, {opt6IANA, ia}}}
+	if _, err := lease6(reply, 1, time.Now()); err == nil {
+		t.Error("expected error for an IA with status NoBinding")
+	}
+	reply.options = append(reply.options, option6{opt6StatusCode, status})
+	if _, err := lease6(reply, 1, time.Now()); err == nil {
+		t.Error("expected error for a reply with status NoBinding")
+	}
+}
+
+func TestDUID(t *testing.T) {
+	d := duid("11111111-2222-3333-4444-555555555555")
+	if len(d) != 18 || d[1] != 4 || d[2] != 0x11 || d[17] != 0x55 {
+		t.Errorf("duid = %x", d)
+	}
+	if h := duid("not-a-uuid"); len(h) != 18 || bytes.Equal(h, duid("other")) {
+		t.Errorf("hashed duid = %x", h)
+	}
+}
+
+// ─── Client tests (root required) ───────────────────────────────────────────
+
+// testServer is a minimal DHCPv4 and DHCPv6 server handing out one address
+// per family.
+type testServer struct {
+	conn4, conn6 net.PacketConn
+
+	mu        sync.Mutex
+	hostname  string
+	renewals  int
+	released4 bool
+	released6 bool
+}
+
+var (
+	testServerID6 = []byte{0, 3, 0, 1, 2, 0, 0, 0, 0, 1}
+	testAddr4     = netip.MustParseAddr("192.0.2.10")
+	testAddr6     = netip.MustParseAddr("2001:db8::10")
+)
+
+func (s *testServer) serve4() {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := s.conn4.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req, err := parseMessage4(buf[:n])
+		if err != nil || req.op != bootRequest {
+			continue
+		}
+		reply := &message4{op: bootReply, xid: req.xid, flags: req.flags, yiaddr: testAddr4, chaddr: req.chaddr,
+			options: map[byte][]byte{
+				optSubnetMask:  {255, 255, 255, 0},
+				optRouter:      {192, 0, 2, 1},
+				optServerID:    {192, 0, 2, 1},
+				optLeaseTime:   uint32Option(4),
+				optRenewalTime: uint32Option(1),
+				optRebindTime:  uint32Option(3),
+			}}
+		s.mu.Lock()
+		switch req.msgType() {
+		case v4Discover:
+			reply.options[optMessageType] = []byte{v4Offer}
+		case v4Request:
+			reply.options[optMessageType] = []byte{v4Ack}
+			s.hostname = string(req.options[optHostname])
+			if req.ciaddr.IsValid() && !req.ciaddr.IsUnspecified() {
+				s.renewals++
+			}
+		case v4Release:
+			s.released4 = req.ciaddr == testAddr4
+			reply = nil
+		default:
+			reply = nil
+		}
+		s.mu.Unlock()
+		if reply == nil {
+			continue
+		}
+		to := &net.UDPAddr{IP: net.IPv4bcast, Port: v4ClientPort}
+		if req.ciaddr.IsValid() && !req.ciaddr.IsUnspecified() {
+			to.IP = req.ciaddr.AsSlice()
+		}
+		s.conn4.WriteTo(reply.marshal(), to)
+	}
+}
+
+func (s *testServer) serve6() {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := s.conn6.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req, err := parseMessage6(buf[:n])
+		if err != nil {
+			continue
+		}
+		ia, err := parseIANA(req.option(opt6IANA))
+		if err != nil {
+			continue
+		}
+		granted := &iaNA{iaid: ia.iaid, t1: 30 * time.Second, t2: 48 * time.Second,
+			addr: testAddr6, preferred: time.Minute, valid: 2 * time.Minute}
+		reply := &message6{xid: req.xid, options: []option6{
+			{opt6ClientID, req.option(opt6ClientID)},
+			{opt6ServerID, testServerID6},
+			{opt6IANA, granted.marshal()},
+		}}
+		switch req.msgType {
+		case v6Solicit:
+			reply.msgType = v6Advertise
+		case v6Request, v6Renew, v6Rebind:
+			reply.msgType = v6Reply
+		case v6Release:
+			s.mu.Lock()
+			s.released6 = ia.addr == testAddr6 && bytes.Equal(req.option(opt6ServerID), testServerID6)
+			s.mu.Unlock()
+			reply.msgType = v6Reply
+		default:
+			continue
+		}
+		s.conn6.WriteTo(reply.marshal(), from)
+	}
+}
+
+// setupTestNetns creates a server and a client netns joined by a veth pair
+// and starts a test server on the server side.  The client end is named
+// ifName and left down.
+func setupTestNetns(t *testing.T, ifName string) (*testServer, string) {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("skipping: requires root / CAP_NET_ADMIN")
+	}
+	serverNS, clientNS := newTestNetns(t, "dhcptest-server"), newTestNetns(t, "dhcptest-client")
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "dhcptest-s"}, PeerName: "dhcptest-c"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("skipping: cannot create veth pair: %v", err)
+	}
+	server, err := netlink.LinkByName("dhcptest-s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := netlink.LinkByName("dhcptest-c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetNsFd(server, int(serverNS)); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(clientNS)); err != nil {
+		t.Fatal(err)
+	}
+
+	cnl, err := netlink.NewHandleAt(clientNS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cnl.Close()
+	if peer, err = cnl.LinkByName("dhcptest-c"); err == nil {
+		err = cnl.LinkSetName(peer, ifName)
+	}
+	if err != nil {
+		t.Fatalf("rename client link: %v", err)
+	}
+
+	snl, err := netlink.NewHandleAt(serverNS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snl.Close()
+	if server, err = snl.LinkByName("dhcptest-s"); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []string{"192.0.2.1/24", "fe80::1/64", "2001:db8::1/64"} {
+		addr, _ := netlink.ParseAddr(a)
+		addr.Flags = syscall.IFA_F_NODAD
+		if err := snl.AddrAdd(server, addr); err != nil {
+			t.Fatalf("add %s: %v", a, err)
+		}
+	}
+	if err := snl.LinkSetUp(server); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{}
+	err = runInNetns(serverNS, func() error {
+		var err error
+		if s.conn4, err = listen("udp4", fmt.Sprintf("0.0.0.0:%d", v4ServerPort), "dhcptest-s"); err != nil {
+			return err
+		}
+		if s.conn6, err = listen("udp6", fmt.Sprintf("[::]:%d", v6ServerPort), "dhcptest-s"); err != nil {
+			return err
+		}
+		sc, err := s.conn6.(*net.UDPConn).SyscallConn()
+		if err != nil {
+			return err
+		}
+		mreq := &syscall.IPv6Mreq{Multiaddr: allDHCPServers.As16(), Interface: uint32(server.Attrs().Index)}
+		var serr error
+		if err := sc.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+		}); err != nil {
+			return err
+		}
+		return serr
+	})
+	if err != nil {
+		t.Fatalf("start test server: %v", err)
+	}
+	t.Cleanup(func() {
+		s.conn4.Close()
+		s.conn6.Close()
+	})
+	go s.serve4()
+	go s.serve6()
+	return s, filepath.Join("/var/run/netns", "dhcptest-client")
+}
+
+// newTestNetns creates a named netns without leaving the calling thread in it.
+func newTestNetns(t *testing.T, name string) netns.NsHandle {
+	t.Helper()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+	netns.DeleteNamed(name)
+	ns, err := netns.NewNamed(name)
+	if err != nil {
+		netns.Set(orig)
+		t.Skipf("skipping: cannot create netns: %v", err)
+	}
+	if err := netns.Set(orig); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ns.Close()
+		netns.DeleteNamed(name)
+	})
+	return ns
+}
+
+// linkAddrs returns the global addresses of ifName in the netns at path.
+func linkAddrs(t *testing.T, path, ifName string) []string {
+	t.Helper()
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	nl, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nl.Close()
+	link, err := nl.LinkByName(ifName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := nl.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, a := range addrs {
+		if a.IP.IsGlobalUnicast() {
+			out = append(out, a.IPNet.String())
+		}
+	}
+	return out
+}
+
+// defaultGateways returns the gateways of the IPv4 default routes in table
+// of the netns at path.
+func defaultGateways(t *testing.T, path string, table int) []string {
+	t.Helper()
+	nl := nsHandle(t, path)
+	defer nl.Close()
+	routes, err := nl.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, r := range routes {
+		if r.Dst == nil || r.Dst.IP.IsUnspecified() {
+			out = append(out, r.Gw.String())
+		}
+	}
+	return out
+}
+
+// tableRules returns the sources of the IPv4 rules selecting table in the
+// netns at path.
+func tableRules(t *testing.T, path string, table int) []string {
+	t.Helper()
+	nl := nsHandle(t, path)
+	defer nl.Close()
+	rules, err := nl.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, r := range rules {
+		if r.Table == table && r.Src != nil {
+			out = append(out, r.Src.String())
+		}
+	}
+	return out
+}
+
+func nsHandle(t *testing.T, path string) *netlink.Handle {
+	t.Helper()
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	nl, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nl
+}
+
+func TestManager_Lifecycle(t *testing.T) {
+	s, nsPath := setupTestNetns(t, "net1")
+	stateDir := t.TempDir()
+	const claimUID = "dhcp0000-1111-2222-3333-444444444444"
+
+	m := &Manager{StateDir: stateDir}
+	opts := Options{IPv4: true, IPv6: true, Hostname: "web-0", DefaultRoute: true}
+	if err := m.Start(claimUID, nsPath, "net1", opts); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	addrs := linkAddrs(t, nsPath, "net1")
+	if !slices.Contains(addrs, "192.0.2.10/24") || !slices.Contains(addrs, "2001:db8::10/128") {
+		t.Errorf("addresses = %v", addrs)
+	}
+	if gws := defaultGateways(t, nsPath, 254); !slices.Equal(gws, []string{"192.0.2.1"}) {
+		t.Errorf("main default routes via %v, want the router", gws)
+	}
+	s.mu.Lock()
+	if s.hostname != "web-0" {
+		t.Errorf("server saw hostname %q", s.hostname)
+	}
+	s.mu.Unlock()
+	if _, err := os.Stat(filepath.Join(stateDir, claimUID+".json")); err != nil {
+		t.Errorf("state not persisted: %v", err)
+	}
+	// Starting again, as a retried link setup does, keeps the client.
+	if err := m.Start(claimUID, nsPath, "net1", opts); err != nil {
+		t.Errorf("second Start: %v", err)
+	}
+
+	// The 4s lease is renewed from T1 (1s) on.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		renewals := s.renewals
+		s.mu.Unlock()
+		if renewals > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lease was not renewed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Simulate a driver restart: stop the loops without releasing, then
+	// resume from the state directory.
+	m.mu.Lock()
+	c := m.clients[claimUID]
+	m.mu.Unlock()
+	c.cancel()
+	c.wg.Wait()
+	c.close()
+
+	restored := &Manager{StateDir: stateDir}
+	restored.Restore()
+	if _, ok := restored.clients[claimUID]; !ok {
+		t.Fatal("client not restored")
+	}
+	if addrs := linkAddrs(t, nsPath, "net1"); !slices.Contains(addrs, "192.0.2.10/24") {
+		t.Errorf("addresses after restore = %v", addrs)
+	}
+
+	restored.Stop(claimUID)
+	time.Sleep(200 * time.Millisecond)
+	s.mu.Lock()
+	if !s.released4 || !s.released6 {
+		t.Errorf("released v4=%v v6=%v, want both", s.released4, s.released6)
+	}
+	s.mu.Unlock()
+	if addrs := linkAddrs(t, nsPath, "net1"); len(addrs) != 0 {
+		t.Errorf("addresses after Stop = %v", addrs)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, claimUID+".json")); !os.IsNotExist(err) {
+		t.Errorf("state left behind: %v", err)
+	}
+}
+
+func TestManager_Routing(t *testing.T) {
+	_, nsPath := setupTestNetns(t, "net1")
+	m := &Manager{StateDir: t.TempDir()}
+
+	// By default the router is not used: the pod keeps its default route.
+	if err := m.Start("claim-a", nsPath, "net1", Options{IPv4: true}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if gws := defaultGateways(t, nsPath, 254); len(gws) != 0 {
+		t.Errorf("main default routes via %v, want none", gws)
+	}
+	m.Stop("claim-a")
+
+	// With a table, the router is the default route of the table, which a
+	// rule selects for the lease's address.
+	opts := Options{IPv4: true, Table: 100, RulePriority: 100}
+	if err := m.Start("claim-b", nsPath, "net1", opts); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if gws := defaultGateways(t, nsPath, 254); len(gws) != 0 {
+		t.Errorf("main default routes via %v, want none", gws)
+	}
+	if gws := defaultGateways(t, nsPath, 100); !slices.Equal(gws, []string{"192.0.2.1"}) {
+		t.Errorf("table 100 default routes via %v, want the router", gws)
+	}
+	if srcs := tableRules(t, nsPath, 100); !slices.Equal(srcs, []string{"192.0.2.10/32"}) {
+		t.Errorf("rules for table 100 = %v", srcs)
+	}
+	m.Stop("claim-b")
+	if srcs := tableRules(t, nsPath, 100); len(srcs) != 0 {
+		t.Errorf("rules left after Stop = %v", srcs)
+	}
+}
+
+func TestManager_StartFailure(t *testing.T) {
+	_, nsPath := setupTestNetns(t, "net1")
+	stateDir := t.TempDir()
+	m := &Manager{StateDir: stateDir, Timeout: time.Second}
+
+	if err := m.Start("claim-a", nsPath, "missing", Options{IPv4: true}); err == nil {
+		t.Error("expected error for a missing link")
+	}
+	if err := m.Start("claim-a", "/nonexistent/netns", "net1", Options{IPv4: true}); err == nil {
+		t.Error("expected error for a missing netns")
+	}
+	if files, _ := filepath.Glob(filepath.Join(stateDir, "*")); len(files) != 0 {
+		t.Errorf("state left behind: %v", files)
+	}
+
+	// Restore drops state whose netns is gone.
+	os.WriteFile(filepath.Join(stateDir, "claim-b.json"),
+		[]byte(`{"claimUID": "claim-b", "netnsPath": "/nonexistent/netns", "ifName": "net1", "options": {"ipv4": true}}`), 0644)
+	m.Restore()
+	if files, _ := filepath.Glob(filepath.Join(stateDir, "*")); len(files) != 0 {
+		t.Errorf("stale state kept: %v", files)
+	}
+}
+
+func TestManager_StartReservesClaim(t *testing.T) {
+	m := &Manager{StateDir: t.TempDir(), Timeout: time.Second}
+
+	// A claim whose client is still starting is not started twice.
+	m.clients = map[string]*client{"claim-a": nil}
+	if err := m.Start("claim-a", "/nonexistent/netns", "net1", Options{IPv4: true}); err == nil ||
+		!strings.Contains(err.Error(), "still starting") {
+		t.Errorf("Start of a starting claim: %v", err)
+	}
+
+	// A failed Start drops its reservation, so the claim can be retried.
+	if err := m.Start("claim-b", "/nonexistent/netns", "net1", Options{IPv4: true}); err == nil {
+		t.Error("expected error for a missing netns")
+	}
+	if _, ok := m.clients["claim-b"]; ok {
+		t.Error("reservation kept after a failed Start")
+	}
+
+	// Stopping a starting claim drops the reservation.
+	m.Stop("claim-a")
+	if _, ok := m.clients["claim-a"]; ok {
+		t.Error("reservation kept after Stop")
+	}
+}
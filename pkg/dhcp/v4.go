@@ -0,0 +1,193 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// DHCPv4 ports, message types and options (RFC 2131, RFC 2132).
+const (
+	v4ServerPort = 67
+	v4ClientPort = 68
+
+	v4Discover = 1
+	v4Offer    = 2
+	v4Request  = 3
+	v4Ack      = 5
+	v4Nak      = 6
+	v4Release  = 7
+
+	optPad          = 0
+	optSubnetMask   = 1
+	optRouter       = 3
+	optHostname     = 12
+	optRequestedIP  = 50
+	optLeaseTime    = 51
+	optMessageType  = 53
+	optServerID     = 54
+	optParamRequest = 55
+	optRenewalTime  = 58
+	optRebindTime   = 59
+	optClientID     = 61
+	optEnd          = 255
+
+	bootRequest = 1
+	bootReply   = 2
+
+	flagBroadcast = 0x8000
+)
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+// message4 is a DHCPv4 message.  Only the fields the client and test server
+// use are kept.
+type message4 struct {
+	op      byte
+	xid     uint32
+	flags   uint16
+	ciaddr  netip.Addr
+	yiaddr  netip.Addr
+	chaddr  net.HardwareAddr
+	options map[byte][]byte
+}
+
+func (m *message4) msgType() byte {
+	if t := m.options[optMessageType]; len(t) == 1 {
+		return t[0]
+	}
+	return 0
+}
+
+// addr4 returns option code as an IPv4 address.
+func (m *message4) addr4(code byte) netip.Addr {
+	if v := m.options[code]; len(v) >= 4 {
+		return netip.AddrFrom4([4]byte(v[:4]))
+	}
+	return netip.Addr{}
+}
+
+// seconds returns option code as a duration, or 0 if it is absent.
+func (m *message4) seconds(code byte) time.Duration {
+	if v := m.options[code]; len(v) == 4 {
+		return time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	return 0
+}
+
+func (m *message4) marshal() []byte {
+	b := make([]byte, 240, 300)
+	b[0] = m.op
+	b[1] = 1 // Ethernet
+	b[2] = 6
+	binary.BigEndian.PutUint32(b[4:], m.xid)
+	binary.BigEndian.PutUint16(b[10:], m.flags)
+	putAddr4(b[12:], m.ciaddr)
+	putAddr4(b[16:], m.yiaddr)
+	copy(b[28:44], m.chaddr)
+	copy(b[236:], magicCookie)
+
+	// Message type first, as some servers expect.
+	if t, ok := m.options[optMessageType]; ok {
+		b = append(b, optMessageType, byte(len(t)))
+		b = append(b, t...)
+	}
+	for code := 1; code < optEnd; code++ {
+		v, ok := m.options[byte(code)]
+		if !ok || code == optMessageType {
+			continue
+		}
+		b = append(b, byte(code), byte(len(v)))
+		b = append(b, v...)
+	}
+	b = append(b, optEnd)
+	// Pad to the minimum BOOTP message size.
+	for len(b) < 300 {
+		b = append(b, optPad)
+	}
+	return b
+}
+
+func putAddr4(b []byte, addr netip.Addr) {
+	if addr.Is4() {
+		a := addr.As4()
+		copy(b, a[:])
+	}
+}
+
+func parseMessage4(b []byte) (*message4, error) {
+	if len(b) < 240 || string(b[236:240]) != string(magicCookie) {
+		return nil, fmt.Errorf("not a DHCPv4 message")
+	}
+	hlen := int(b[2])
+	if hlen > 16 {
+		return nil, fmt.Errorf("hardware address length %d", hlen)
+	}
+	m := &message4{
+		op:      b[0],
+		xid:     binary.BigEndian.Uint32(b[4:]),
+		flags:   binary.BigEndian.Uint16(b[10:]),
+		ciaddr:  netip.AddrFrom4([4]byte(b[12:16])),
+		yiaddr:  netip.AddrFrom4([4]byte(b[16:20])),
+		chaddr:  net.HardwareAddr(append([]byte(nil), b[28:28+hlen]...)),
+		options: make(map[byte][]byte),
+	}
+	for opts := b[240:]; len(opts) > 0; {
+		code := opts[0]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		n := int(opts[1])
+		m.options[code] = append(m.options[code], opts[2:2+n]...)
+		opts = opts[2+n:]
+	}
+	return m, nil
+}
+
+func uint32Option(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+// lease4 builds the lease an ACK grants.  T1 and T2 default to half and
+// seven eighths of the lease time (RFC 2131 section 4.4.5).
+func lease4(ack *message4, now time.Time) (*Lease4, error) {
+	mask := ack.options[optSubnetMask]
+	if len(mask) != 4 {
+		return nil, fmt.Errorf("DHCPACK for %s has no subnet mask", ack.yiaddr)
+	}
+	bits, _ := net.IPMask(mask).Size()
+	server := ack.addr4(optServerID)
+	if !server.IsValid() {
+		return nil, fmt.Errorf("DHCPACK for %s has no server identifier", ack.yiaddr)
+	}
+	l := &Lease4{
+		Address:   netip.PrefixFrom(ack.yiaddr, bits).String(),
+		ServerID:  server.String(),
+		Acquired:  now,
+		LeaseTime: ack.seconds(optLeaseTime),
+		T1:        ack.seconds(optRenewalTime),
+		T2:        ack.seconds(optRebindTime),
+	}
+	if r := ack.addr4(optRouter); r.IsValid() {
+		l.Router = r.String()
+	}
+	if l.LeaseTime == 0 {
+		return nil, fmt.Errorf("DHCPACK for %s has no lease time", ack.yiaddr)
+	}
+	if l.T1 == 0 {
+		l.T1 = l.LeaseTime / 2
+	}
+	if l.T2 == 0 {
+		l.T2 = l.LeaseTime * 7 / 8
+	}
+	return l, nil
+}
@@ -0,0 +1,208 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// DHCPv6 ports, message types, options and status codes (RFC 8415).
+const (
+	v6ServerPort = 547
+	v6ClientPort = 546
+
+	v6Solicit   = 1
+	v6Advertise = 2
+	v6Request   = 3
+	v6Renew     = 5
+	v6Rebind    = 6
+	v6Reply     = 7
+	v6Release   = 8
+
+	opt6ClientID    = 1
+	opt6ServerID    = 2
+	opt6IANA        = 3
+	opt6IAAddr      = 5
+	opt6ElapsedTime = 8
+	opt6StatusCode  = 13
+
+	status6Success = 0
+)
+
+// allDHCPServers is the All_DHCP_Relay_Agents_and_Servers group.
+var allDHCPServers = netip.MustParseAddr("ff02::1:2")
+
+// message6 is a DHCPv6 message.  Options may repeat, so they keep their
+// order.
+type message6 struct {
+	msgType byte
+	xid     uint32 // 24 bits
+	options []option6
+}
+
+type option6 struct {
+	code uint16
+	data []byte
+}
+
+func (m *message6) option(code uint16) []byte {
+	for _, o := range m.options {
+		if o.code == code {
+			return o.data
+		}
+	}
+	return nil
+}
+
+func (m *message6) marshal() []byte {
+	b := []byte{m.msgType, byte(m.xid >> 16), byte(m.xid >> 8), byte(m.xid)}
+	return appendOptions6(b, m.options)
+}
+
+func appendOptions6(b []byte, options []option6) []byte {
+	for _, o := range options {
+		b = binary.BigEndian.AppendUint16(b, o.code)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(o.data)))
+		b = append(b, o.data...)
+	}
+	return b
+}
+
+func parseOptions6(b []byte) ([]option6, error) {
+	var options []option6
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("truncated option")
+		}
+		code, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		options = append(options, option6{code: code, data: b[4 : 4+n]})
+		b = b[4+n:]
+	}
+	return options, nil
+}
+
+func parseMessage6(b []byte) (*message6, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("not a DHCPv6 message")
+	}
+	options, err := parseOptions6(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	return &message6{
+		msgType: b[0],
+		xid:     uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]),
+		options: options,
+	}, nil
+}
+
+// iaNA is an identity association for non-temporary addresses with at most
+// one address, which is all the client asks for.
+type iaNA struct {
+	iaid      uint32
+	t1, t2    time.Duration
+	addr      netip.Addr
+	preferred time.Duration
+	valid     time.Duration
+	status    uint16
+}
+
+func (ia *iaNA) marshal() []byte {
+	b := binary.BigEndian.AppendUint32(nil, ia.iaid)
+	b = binary.BigEndian.AppendUint32(b, uint32(ia.t1/time.Second))
+	b = binary.BigEndian.AppendUint32(b, uint32(ia.t2/time.Second))
+	if ia.addr.IsValid() {
+		a := ia.addr.As16()
+		addr := binary.BigEndian.AppendUint32(a[:], uint32(ia.preferred/time.Second))
+		addr = binary.BigEndian.AppendUint32(addr, uint32(ia.valid/time.Second))
+		b = appendOptions6(b, []option6{{opt6IAAddr, addr}})
+	}
+	return b
+}
+
+// parseIANA decodes an IA_NA option.  A status code inside the IA, or inside
+// its address, is returned in status.
+func parseIANA(b []byte) (*iaNA, error) {
+	if len(b) < 12 {
+		return nil, fmt.Errorf("truncated IA_NA")
+	}
+	ia := &iaNA{
+		iaid: binary.BigEndian.Uint32(b),
+		t1:   time.Duration(binary.BigEndian.Uint32(b[4:])) * time.Second,
+		t2:   time.Duration(binary.BigEndian.Uint32(b[8:])) * time.Second,
+	}
+	options, err := parseOptions6(b[12:])
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range options {
+		switch o.code {
+		case opt6StatusCode:
+			if len(o.data) >= 2 {
+				ia.status = binary.BigEndian.Uint16(o.data)
+			}
+		case opt6IAAddr:
+			if len(o.data) < 24 {
+				return nil, fmt.Errorf("truncated IAADDR")
+			}
+			ia.addr = netip.AddrFrom16([16]byte(o.data[:16]))
+			ia.preferred = time.Duration(binary.BigEndian.Uint32(o.data[16:])) * time.Second
+			ia.valid = time.Duration(binary.BigEndian.Uint32(o.data[20:])) * time.Second
+			if sub, err := parseOptions6(o.data[24:]); err == nil {
+				for _, s := range sub {
+					if s.code == opt6StatusCode && len(s.data) >= 2 {
+						ia.status = binary.BigEndian.Uint16(s.data)
+					}
+				}
+			}
+		}
+	}
+	return ia, nil
+}
+
+// status returns the message's top-level status code.
+func (m *message6) status() uint16 {
+	if s := m.option(opt6StatusCode); len(s) >= 2 {
+		return binary.BigEndian.Uint16(s)
+	}
+	return status6Success
+}
+
+// lease6 builds the lease a Reply grants for iaid.  T1 and T2 default to
+// half and four fifths of the preferred lifetime (RFC 8415 section 21.4).
+func lease6(reply *message6, iaid uint32, now time.Time) (*Lease6, error) {
+	if s := reply.status(); s != status6Success {
+		return nil, fmt.Errorf("DHCPv6 reply status %d", s)
+	}
+	server := reply.option(opt6ServerID)
+	if len(server) == 0 {
+		return nil, fmt.Errorf("DHCPv6 reply has no server identifier")
+	}
+	ia, err := parseIANA(reply.option(opt6IANA))
+	if err != nil {
+		return nil, err
+	}
+	if ia.iaid != iaid || ia.status != status6Success || !ia.addr.IsValid() || ia.valid == 0 {
+		return nil, fmt.Errorf("DHCPv6 reply grants no address (status %d)", ia.status)
+	}
+	l := &Lease6{
+		Address:   netip.PrefixFrom(ia.addr, 128).String(),
+		ServerID:  append([]byte(nil), server...),
+		Acquired:  now,
+		Preferred: ia.preferred,
+		Valid:     ia.valid,
+		T1:        ia.t1,
+		T2:        ia.t2,
+	}
+	if l.T1 == 0 {
+		l.T1 = l.Preferred / 2
+	}
+	if l.T2 == 0 {
+		l.T2 = l.Preferred * 4 / 5
+	}
+	return l, nil
+}
@@ -0,0 +1,191 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/ipam"
+)
+
+// ipamLeasesKey is the allocation metadata key holding a claim's IPAM
+// leases, so they are persisted with the rest of its allocation state.
+const ipamLeasesKey = "ipamLeases"
+
+// dhcpKinds are the netdev kinds whose handlers run DHCP clients.
+var dhcpKinds = []string{"macvlan", "ipvlan"}
+
+// validateIPAM checks the IPAM mode of a claim and the ranges it names.
+func (d *Driver) validateIPAM(config *handler.DeviceConfig) error {
+	cfg := netdevConfig(config)
+	if cfg == nil || cfg.IPAM == nil {
+		return nil
+	}
+	switch mode := cfg.IPAM.Mode; mode {
+	case "", handler.IPAMModeHostLocal:
+	case handler.IPAMModeDHCP:
+		if !slices.Contains(dhcpKinds, cfg.Kind) {
+			return fmt.Errorf("ipam mode dhcp is only supported for %s, not %s", strings.Join(dhcpKinds, " and "), cfg.Kind)
+		}
+		if len(cfg.IPAM.Ranges) > 0 {
+			return fmt.Errorf("ipam.ranges cannot be used in dhcp mode")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported ipam mode %q (use host-local or dhcp)", mode)
+	}
+	if cfg.IPAM.DHCP != nil {
+		return fmt.Errorf("ipam.dhcp needs ipam mode dhcp")
+	}
+	ranges := cfg.IPAM.Ranges
+	if len(ranges) == 0 {
+		return fmt.Errorf("ipam.ranges is empty")
+	}
+	if d.IPAM == nil {
+		return fmt.Errorf("claim requests IPAM ranges %v but the driver has no IPAM configuration", ranges)
+	}
+	for i, name := range ranges {
+		if !d.IPAM.HasRange(name) {
+			return fmt.Errorf("unknown IPAM range %q", name)
+		}
+		if slices.Index(ranges, name) != i {
+			return fmt.Errorf("IPAM range %s listed twice", name)
+		}
+	}
+	return nil
+}
+
+// allocateAddresses leases an address from each IPAM range the claim names
+// and adds the addresses, and the ranges' gateways as addRangeGateway
+// allows, to its netdev config.
+// The handler then configures them like static addresses.  In dhcp mode
+// the handler gets its addresses itself.
+func (d *Driver) allocateAddresses(claimUID string, config *handler.DeviceConfig) ([]ipam.Lease, error) {
+	cfg := netdevConfig(config)
+	if cfg == nil || cfg.IPAM == nil || cfg.IPAM.Mode == handler.IPAMModeDHCP {
+		return nil, nil
+	}
+	var leases []ipam.Lease
+	for _, name := range cfg.IPAM.Ranges {
+		lease, err := d.IPAM.Allocate(claimUID, name)
+		if err != nil {
+			d.IPAM.Release(claimUID)
+			return nil, err
+		}
+		leases = append(leases, lease)
+		cfg.Addresses = append(cfg.Addresses, lease.Address)
+		addRangeGateway(cfg, lease.Gateway)
+	}
+	return leases, nil
+}
+
+// addRangeGateway adds the gateway of a range the claim got an address
+// from to its gateways, unless it sets one for that address family.  The
+// pod's default route belongs to its primary interface, so the gateway is
+// only used when the claim asks for routing through a table of the link's
+// own or for the default route.  The range's subnet is reachable on-link
+// either way.
+func addRangeGateway(cfg *handler.NetdevConfig, gw string) {
+	if gw == "" || cfg.Routing == nil || (cfg.Routing.Table == 0 && !cfg.Routing.DefaultRoute) {
+		return
+	}
+	if !hasGatewayFor(cfg.Gateways, gw) {
+		cfg.Gateways = append(cfg.Gateways, gw)
+	}
+}
+
+// hasGatewayFor reports whether gateways has one of gw's address family.
+func hasGatewayFor(gateways []string, gw string) bool {
+	addr, err := netip.ParseAddr(gw)
+	if err != nil {
+		return false
+	}
+	for _, g := range gateways {
+		if other, err := netip.ParseAddr(g); err == nil && other.Is4() == addr.Is4() {
+			return true
+		}
+	}
+	return false
+}
+
+// recordLeases stores leases in the allocation's metadata.
+func recordLeases(alloc *handler.AllocationInfo, leases []ipam.Lease) {
+	if len(leases) == 0 {
+		return
+	}
+	if alloc.Metadata == nil {
+		alloc.Metadata = make(map[string]string)
+	}
+	data, _ := json.Marshal(leases)
+	alloc.Metadata[ipamLeasesKey] = string(data)
+}
+
+// restoreLeases re-leases the addresses recorded in a persisted allocation.
+func (d *Driver) restoreLeases(alloc *handler.AllocationInfo) {
+	data := alloc.Metadata[ipamLeasesKey]
+	if data == "" {
+		return
+	}
+	if d.IPAM == nil {
+		klog.Warningf("Claim %s holds IPAM leases but the driver has no IPAM configuration", alloc.ClaimUID)
+		return
+	}
+	var leases []ipam.Lease
+	if err := json.Unmarshal([]byte(data), &leases); err != nil {
+		klog.Warningf("Failed to decode IPAM leases of claim %s: %v", alloc.ClaimUID, err)
+		return
+	}
+	d.IPAM.Restore(alloc.ClaimUID, leases)
+}
+
+// releaseLeases returns the addresses leased to an allocation's claim.
+func (d *Driver) releaseLeases(alloc *handler.AllocationInfo) {
+	if d.IPAM != nil && alloc.Metadata[ipamLeasesKey] != "" {
+		d.IPAM.Release(alloc.ClaimUID)
+	}
+}
+
+// publishNetworkData reports the interface name and addresses of a prepared
+// netdev in the claim's device status.  Failures are logged: the status is
+// informational and the pod can start without it.
+func (d *Driver) publishNetworkData(ctx context.Context, rc *resourceapi.ResourceClaim, alloc *handler.AllocationInfo) {
+	if d.Client == nil || alloc.Metadata["addresses"] == "" {
+		return
+	}
+	result := d.getAllocationResult(rc)
+	if result == nil {
+		return
+	}
+	data := &resourceapi.NetworkDeviceData{
+		InterfaceName: alloc.Metadata["containerName"],
+		IPs:           strings.Split(alloc.Metadata["addresses"], ","),
+	}
+
+	claims := d.Client.ResourceV1().ResourceClaims(rc.Namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		claim, err := claims.Get(ctx, rc.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if claim.UID != rc.UID {
+			return fmt.Errorf("claim %s/%s was replaced", rc.Namespace, rc.Name)
+		}
+		deviceStatus(claim, *result).NetworkData = data
+		_, err = claims.UpdateStatus(ctx, claim, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		klog.Warningf("Failed to publish network data of claim %s/%s: %v", rc.Namespace, rc.Name, err)
+		return
+	}
+	klog.V(2).Infof("Published network data of claim %s/%s: %s %v", rc.Namespace, rc.Name, data.InterfaceName, data.IPs)
+}
@@ -0,0 +1,255 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	resourceapi "k8s.io/api/resource/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	resourceinformers "k8s.io/client-go/informers/resource/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/handler/netdev"
+)
+
+// VFProvisioner creates and releases on-demand VFs.  Implemented by
+// netdev.SriovVfHandler.
+type VFProvisioner interface {
+	ProvisionVF(ctx context.Context, claimUID, pf string, index int) (string, error)
+	ReleaseVF(claimUID, pf string, index int)
+}
+
+// bindingWorkers is how many claims are provisioned at once.  Provisioning
+// a claim waits for its VFs to appear, so one slow PF must not hold up the
+// claims of the others.
+const bindingWorkers = 4
+
+// BindingController creates on-demand VFs for claims allocated on this node
+// and reports the outcome through the binding conditions in the claim's
+// device status.  Pods using such a claim are only bound to the node once
+// their VFs exist.
+type BindingController struct {
+	driverName string
+	nodeName   string
+	client     kubernetes.Interface
+	vfs        VFProvisioner
+
+	claims resourceinformers.ResourceClaimInformer
+	queue  workqueue.TypedRateLimitingInterface[string]
+}
+
+// NewBindingController creates a controller for the claims of this node.
+func NewBindingController(driverName, nodeName string, client kubernetes.Interface, vfs VFProvisioner) *BindingController {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	return &BindingController{
+		driverName: driverName,
+		nodeName:   nodeName,
+		client:     client,
+		vfs:        vfs,
+		claims:     factory.Resource().V1().ResourceClaims(),
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "vf-binding"},
+		),
+	}
+}
+
+// Run watches claims until ctx is cancelled.
+func (c *BindingController) Run(ctx context.Context) error {
+	defer c.queue.ShutDown()
+
+	informer := c.claims.Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(oldObj, newObj any) {
+			c.releaseDropped(oldObj, newObj)
+			c.enqueue(newObj)
+		},
+		DeleteFunc: func(obj any) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			c.releaseDropped(obj, nil)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch resource claims: %w", err)
+	}
+
+	go informer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("resource claim cache did not sync")
+	}
+	klog.Info("VF binding controller started")
+
+	for range bindingWorkers {
+		go wait.UntilWithContext(ctx, c.worker, time.Second)
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (c *BindingController) enqueue(obj any) {
+	claim, ok := obj.(*resourceapi.ResourceClaim)
+	if !ok || len(c.onDemandResults(claim)) == 0 {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(claim)
+	if err != nil {
+		klog.Warningf("Cannot queue claim: %v", err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *BindingController) worker(ctx context.Context) {
+	for {
+		key, shutdown := c.queue.Get()
+		if shutdown {
+			return
+		}
+		if err := c.sync(ctx, key); err != nil {
+			klog.Warningf("Syncing claim %s: %v", key, err)
+			c.queue.AddRateLimited(key)
+		} else {
+			c.queue.Forget(key)
+		}
+		c.queue.Done(key)
+	}
+}
+
+// sync provisions the on-demand VFs of one claim and records the outcome in
+// its device status.
+func (c *BindingController) sync(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	claim, err := c.claims.Lister().ResourceClaims(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	claim = claim.DeepCopy()
+	changed := false
+	for _, result := range c.onDemandResults(claim) {
+		status := deviceStatus(claim, result)
+		if meta.IsStatusConditionTrue(status.Conditions, ConditionVFReady) ||
+			meta.IsStatusConditionTrue(status.Conditions, ConditionVFFailed) {
+			continue
+		}
+
+		pf, index, _ := netdev.SplitOnDemandVFDevice(result.Device)
+		condition := metav1.Condition{
+			Type:               ConditionVFReady,
+			Status:             metav1.ConditionTrue,
+			Reason:             "VFCreated",
+			ObservedGeneration: claim.Generation,
+		}
+		vfName, err := c.vfs.ProvisionVF(ctx, string(claim.UID), pf, index)
+		if err != nil {
+			klog.Errorf("Failed to provision VF %d on PF %s for claim %s: %v", index, pf, key, err)
+			condition.Type = ConditionVFFailed
+			condition.Reason = "VFCreateFailed"
+			condition.Message = err.Error()
+		} else {
+			condition.Message = fmt.Sprintf("VF %s is ready", vfName)
+		}
+		if meta.SetStatusCondition(&status.Conditions, condition) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	_, err = c.client.ResourceV1().ResourceClaims(namespace).UpdateStatus(ctx, claim, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to update device status: %w", err)
+	}
+	return nil
+}
+
+// releaseDropped releases the on-demand VFs that oldObj was allocated and
+// newObj (nil if deleted) no longer is.
+func (c *BindingController) releaseDropped(oldObj, newObj any) {
+	oldClaim, ok := oldObj.(*resourceapi.ResourceClaim)
+	if !ok {
+		return
+	}
+	var kept []resourceapi.DeviceRequestAllocationResult
+	if newClaim, ok := newObj.(*resourceapi.ResourceClaim); ok {
+		kept = c.onDemandResults(newClaim)
+	}
+	for _, result := range c.onDemandResults(oldClaim) {
+		if slices.ContainsFunc(kept, func(r resourceapi.DeviceRequestAllocationResult) bool {
+			return r.Device == result.Device
+		}) {
+			continue
+		}
+		pf, index, _ := netdev.SplitOnDemandVFDevice(result.Device)
+		c.vfs.ReleaseVF(string(oldClaim.UID), pf, index)
+	}
+}
+
+// onDemandResults returns the allocation results of claim that are
+// on-demand VFs of this node.
+func (c *BindingController) onDemandResults(claim *resourceapi.ResourceClaim) []resourceapi.DeviceRequestAllocationResult {
+	if claim.Status.Allocation == nil {
+		return nil
+	}
+	var results []resourceapi.DeviceRequestAllocationResult
+	for _, result := range claim.Status.Allocation.Devices.Results {
+		if result.Driver != c.driverName || result.Pool != c.nodeName ||
+			!slices.Contains(result.BindingConditions, ConditionVFReady) {
+			continue
+		}
+		if _, _, ok := netdev.SplitOnDemandVFDevice(result.Device); ok {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// deviceStatus returns the status entry of an allocated device, adding an
+// empty one if the claim has none yet.
+func deviceStatus(claim *resourceapi.ResourceClaim, result resourceapi.DeviceRequestAllocationResult) *resourceapi.AllocatedDeviceStatus {
+	var shareID *string
+	if result.ShareID != nil {
+		id := string(*result.ShareID)
+		shareID = &id
+	}
+	for i := range claim.Status.Devices {
+		status := &claim.Status.Devices[i]
+		if status.Driver == result.Driver && status.Pool == result.Pool && status.Device == result.Device &&
+			ptrEqual(status.ShareID, shareID) {
+			return status
+		}
+	}
+	claim.Status.Devices = append(claim.Status.Devices, resourceapi.AllocatedDeviceStatus{
+		Driver:  result.Driver,
+		Pool:    result.Pool,
+		Device:  result.Device,
+		ShareID: shareID,
+	})
+	return &claim.Status.Devices[len(claim.Status.Devices)-1]
+}
+
+func ptrEqual[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
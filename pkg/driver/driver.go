@@ -9,12 +9,16 @@ import (
 	"strings"
 
 	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/dynamic-resource-allocation/kubeletplugin"
 	"k8s.io/klog/v2"
 	cdispec "tags.cncf.io/container-device-interface/specs-go"
 
 	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/ipam"
+	"github.com/example/dra-poc/pkg/macpool"
 )
 
 const (
@@ -29,6 +33,22 @@ type Driver struct {
 
 	// Track allocated devices: claimUID -> AllocationInfo
 	allocations map[string]*handler.AllocationInfo
+
+	// IPAM leases addresses to claims that name IPAM ranges.  Nil rejects
+	// such claims.
+	IPAM *ipam.Allocator
+
+	// MACs leases MACs to claims with macPolicy pool.  Nil rejects such
+	// claims.
+	MACs *macpool.Pool
+
+	// Sysctls lists the per-interface sysctls claims may set, e.g.
+	// ipv4.rp_filter.  Nil rejects claims that set any.
+	Sysctls []string
+
+	// Client publishes the addresses of prepared netdevs in the claim's
+	// device status.  Nil disables publishing.
+	Client kubernetes.Interface
 }
 
 // New creates a new DRA driver instance.
@@ -62,7 +82,7 @@ func (d *Driver) PrepareResourceClaims(ctx context.Context, claims []*resourceap
 
 		// Idempotent: if we already have state for this claim, return it.
 		if existing, ok := d.allocations[uid]; ok {
-			cdiDeviceID := fmt.Sprintf("%s/%s=%s", d.driverName, existing.Type, existing.DeviceName)
+			cdiDeviceID := fmt.Sprintf("%s/%s=%s", d.driverName, existing.Type, cdiDeviceName(existing))
 			klog.Infof("Claim %s already prepared (restored state), returning cdi=%s", uid, cdiDeviceID)
 			results[rc.UID] = d.prepareResultFromAlloc(existing, cdiDeviceID)
 			continue
@@ -76,7 +96,7 @@ func (d *Driver) PrepareResourceClaims(ctx context.Context, claims []*resourceap
 		}
 
 		// Create CDI spec from handler's edits
-		cdiDeviceID, err := d.createCDISpec(uid, result)
+		cdiDeviceID, err := d.createCDISpec(result)
 		if err != nil {
 			d.unprepareAllocation(ctx, result.Allocation)
 			results[rc.UID] = kubeletplugin.PrepareResult{Err: err}
@@ -85,16 +105,11 @@ func (d *Driver) PrepareResourceClaims(ctx context.Context, claims []*resourceap
 
 		d.allocations[uid] = result.Allocation
 
-		klog.Infof("Successfully prepared claim %s: pool=%s device=%s cdi=%s",
-			uid, result.PoolName, result.DeviceName, cdiDeviceID)
+		klog.Infof("Successfully prepared claim %s: pool=%s device=%s share=%s cdi=%s",
+			uid, result.Allocation.PoolName, result.DeviceName, result.Allocation.ShareID, cdiDeviceID)
+		d.publishNetworkData(ctx, rc, result.Allocation)
 
-		results[rc.UID] = kubeletplugin.PrepareResult{
-			Devices: []kubeletplugin.Device{{
-				PoolName:     result.PoolName,
-				DeviceName:   result.DeviceName,
-				CDIDeviceIDs: []string{cdiDeviceID},
-			}},
-		}
+		results[rc.UID] = d.prepareResultFromAlloc(result.Allocation, cdiDeviceID)
 	}
 
 	return results, nil
@@ -128,7 +143,7 @@ func (d *Driver) UnprepareResourceClaims(ctx context.Context, claims []kubeletpl
 			continue
 		}
 
-		d.deleteCDISpec(uid)
+		d.deleteCDISpec(alloc)
 		delete(d.allocations, uid)
 
 		results[claim.UID] = nil
@@ -150,7 +165,19 @@ func (d *Driver) HandleError(ctx context.Context, err error, msg string) {
 // prepareClaim dispatches to the appropriate handler based on config.
 func (d *Driver) prepareClaim(ctx context.Context, rc *resourceapi.ResourceClaim) (*handler.PrepareResult, error) {
 	config := d.parseConfig(rc)
-	allocatedDevice := d.getAllocatedDevice(rc)
+	allocation := d.getAllocationResult(rc)
+
+	var allocatedDevice, shareID string
+	if allocation != nil {
+		allocatedDevice = allocation.Device
+		if allocation.ShareID != nil {
+			shareID = string(*allocation.ShareID)
+		}
+	}
+
+	if err := resolveNetdevKind(config, allocatedDevice); err != nil {
+		return nil, err
+	}
 
 	kind := config.GetKind()
 	h, err := d.registry.MustGet(config.Type, kind)
@@ -158,17 +185,78 @@ func (d *Driver) prepareClaim(ctx context.Context, rc *resourceapi.ResourceClaim
 		return nil, err
 	}
 
+	if err := d.poolAddresses(ctx, rc, config); err != nil {
+		return nil, err
+	}
+	if err := d.segmentIDs(rc, config); err != nil {
+		return nil, err
+	}
+	if err := d.validateIPAM(config); err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
+	if err := d.validateMACPolicy(config); err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
+	if err := d.validateSysctls(config); err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
+	// Leased addresses are added to the config before the handler sees it.
+	leases, err := d.allocateAddresses(string(rc.UID), config)
+	if err != nil {
+		return nil, err
+	}
+	prepared := false
+	if len(leases) > 0 {
+		defer func() {
+			if !prepared {
+				d.IPAM.Release(string(rc.UID))
+			}
+		}()
+	}
+	// So is the MAC its policy picks.
+	macLeased, err := d.assignMAC(rc, config)
+	if macLeased {
+		defer func() {
+			if !prepared {
+				d.MACs.Release(string(rc.UID))
+			}
+		}()
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	if err := h.Validate(ctx, config); err != nil {
 		return nil, fmt.Errorf("config validation failed: %w", err)
 	}
 
-	return h.Prepare(ctx, &handler.PrepareRequest{
-		ClaimUID:        string(rc.UID),
-		Namespace:       rc.Namespace,
-		ClaimName:       rc.Name,
-		AllocatedDevice: allocatedDevice,
-		Config:          config,
+	result, err := h.Prepare(ctx, &handler.PrepareRequest{
+		ClaimUID:         string(rc.UID),
+		Namespace:        rc.Namespace,
+		ClaimName:        rc.Name,
+		AllocatedDevice:  allocatedDevice,
+		AllocatedDevices: d.allocatedDevices(rc),
+		Config:           config,
+		ShareID:          shareID,
+		ConsumedCapacity: consumedCapacity(allocation),
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the scheduler's identity for the allocation so that the kubelet
+	// and the status API can tell apart claims sharing the same device.
+	if allocation != nil {
+		result.Allocation.PoolName = allocation.Pool
+		result.Allocation.AllocatedDevice = allocation.Device
+		result.Allocation.ShareID = shareID
+	} else {
+		result.Allocation.PoolName = result.PoolName
+	}
+	recordLeases(result.Allocation, leases)
+	recordMAC(result.Allocation, config)
+	prepared = true
+	return result, nil
 }
 
 // unprepareAllocation delegates to the appropriate handler for cleanup.
@@ -178,25 +266,36 @@ func (d *Driver) unprepareAllocation(ctx context.Context, alloc *handler.Allocat
 		return fmt.Errorf("no handler for type=%s kind=%s during unprepare", alloc.Type, alloc.Kind)
 	}
 
-	return h.Unprepare(ctx, &handler.UnprepareRequest{
+	if err := h.Unprepare(ctx, &handler.UnprepareRequest{
 		ClaimUID:   alloc.ClaimUID,
 		Allocation: alloc,
-	})
+	}); err != nil {
+		return err
+	}
+	d.releaseLeases(alloc)
+	d.releaseMAC(alloc)
+	return nil
 }
 
+// defaultNetdevKind is used when neither the claim config nor the allocated
+// device determine the netdev kind.
+const defaultNetdevKind = "dummy"
+
 // parseConfig extracts the DeviceConfig from a ResourceClaim.
-// If rc is nil, a sensible default is returned.
+// If rc is nil, a sensible default is returned.  A claim without opaque
+// config gets a netdev config with no kind, so that resolveNetdevKind can
+// take it from the allocated device.
 func (d *Driver) parseConfig(rc *resourceapi.ResourceClaim) *handler.DeviceConfig {
 	config := &handler.DeviceConfig{
 		Type: handler.DeviceTypeNetdev,
 		Netdev: &handler.NetdevConfig{
-			Kind:          "dummy",
 			InterfaceName: "eth1",
 		},
 	}
 
 	if rc == nil {
 		klog.V(2).Info("No ResourceClaim available, using default config")
+		config.Netdev.Kind = defaultNetdevKind
 		return config
 	}
 
@@ -218,51 +317,153 @@ func (d *Driver) parseConfig(rc *resourceapi.ResourceClaim) *handler.DeviceConfi
 	return config
 }
 
-// getAllocatedDevice extracts the scheduler-assigned device name from the
-// claim's allocation results.
-func (d *Driver) getAllocatedDevice(rc *resourceapi.ResourceClaim) string {
+// resolveNetdevKind fills in the netdev kind from the allocated per-kind
+// virtual device (netdev-virtual-<kind>) when the claim config omits it, and
+// rejects a config whose kind contradicts that device.
+func resolveNetdevKind(config *handler.DeviceConfig, allocatedDevice string) error {
+	if config.Type != handler.DeviceTypeNetdev || config.Netdev == nil {
+		return nil
+	}
+
+	if allocatedKind, ok := strings.CutPrefix(allocatedDevice, VirtualDevicePrefix); ok {
+		switch config.Netdev.Kind {
+		case "":
+			config.Netdev.Kind = allocatedKind
+			klog.V(2).Infof("Selected netdev kind %s from allocated device %s", allocatedKind, allocatedDevice)
+		case allocatedKind:
+		default:
+			return fmt.Errorf("claim config requests netdev kind %q but the scheduler allocated %s",
+				config.Netdev.Kind, allocatedDevice)
+		}
+	}
+
+	if config.Netdev.Kind == "" {
+		config.Netdev.Kind = defaultNetdevKind
+	}
+	return nil
+}
+
+// netdevConfig returns the interface settings of a claim: its netdev config,
+// or the netdev side of a combo.  Nil if it has neither.
+func netdevConfig(config *handler.DeviceConfig) *handler.NetdevConfig {
+	if config.Combo != nil {
+		return &config.Combo.Netdev
+	}
+	return config.Netdev
+}
+
+// getAllocationResult returns this driver's entry in the claim's allocation
+// results, or nil if the claim has none.  Addresses and segment IDs from
+// cluster pools are not devices on this node and are skipped.
+func (d *Driver) getAllocationResult(rc *resourceapi.ResourceClaim) *resourceapi.DeviceRequestAllocationResult {
 	if rc == nil || rc.Status.Allocation == nil {
-		return ""
+		return nil
 	}
 
-	for _, result := range rc.Status.Allocation.Devices.Results {
-		if result.Driver != d.driverName {
+	for i := range rc.Status.Allocation.Devices.Results {
+		result := &rc.Status.Allocation.Devices.Results[i]
+		if result.Driver != d.driverName || isClusterPoolResult(result) {
 			continue
 		}
-		klog.Infof("Scheduler allocated device: pool=%s device=%s (request=%s)",
-			result.Pool, result.Device, result.Request)
-		return result.Device
+		shareID := ""
+		if result.ShareID != nil {
+			shareID = string(*result.ShareID)
+		}
+		klog.Infof("Scheduler allocated device: pool=%s device=%s share=%s (request=%s)",
+			result.Pool, result.Device, shareID, result.Request)
+		return result
+	}
+
+	return nil
+}
+
+// allocatedDevices returns the names of every device allocated to the claim
+// from this driver, except addresses and segment IDs from cluster pools.
+func (d *Driver) allocatedDevices(rc *resourceapi.ResourceClaim) []string {
+	if rc == nil || rc.Status.Allocation == nil {
+		return nil
+	}
+
+	var devices []string
+	for _, result := range rc.Status.Allocation.Devices.Results {
+		if result.Driver == d.driverName && !isClusterPoolResult(&result) {
+			devices = append(devices, result.Device)
+		}
+	}
+	return devices
+}
+
+// consumedCapacity returns the capacity the scheduler charged to an
+// allocation on a multi-allocatable device (DRAConsumableCapacity).
+func consumedCapacity(result *resourceapi.DeviceRequestAllocationResult) map[string]resource.Quantity {
+	if result == nil || len(result.ConsumedCapacity) == 0 {
+		return nil
 	}
 
-	return ""
+	consumed := make(map[string]resource.Quantity, len(result.ConsumedCapacity))
+	for name, q := range result.ConsumedCapacity {
+		consumed[string(name)] = q
+	}
+	return consumed
 }
 
 // prepareResultFromAlloc builds a kubeletplugin.PrepareResult from cached state.
+// The device identity is the scheduler's allocation result when known, so
+// that shares of the same multi-allocatable device stay distinguishable.
 func (d *Driver) prepareResultFromAlloc(alloc *handler.AllocationInfo, cdiDeviceID string) kubeletplugin.PrepareResult {
 	poolName := "default"
-	if p, ok := alloc.Metadata["poolName"]; ok {
+	if alloc.PoolName != "" {
+		poolName = alloc.PoolName
+	} else if p, ok := alloc.Metadata["poolName"]; ok {
 		poolName = p
 	}
-	return kubeletplugin.PrepareResult{
-		Devices: []kubeletplugin.Device{{
-			PoolName:     poolName,
-			DeviceName:   alloc.DeviceName,
-			CDIDeviceIDs: []string{cdiDeviceID},
-		}},
+	deviceName := alloc.DeviceName
+	if alloc.AllocatedDevice != "" {
+		deviceName = alloc.AllocatedDevice
+	}
+
+	device := kubeletplugin.Device{
+		PoolName:     poolName,
+		DeviceName:   deviceName,
+		CDIDeviceIDs: []string{cdiDeviceID},
+	}
+	if alloc.ShareID != "" {
+		shareID := types.UID(alloc.ShareID)
+		device.ShareID = &shareID
 	}
+	return kubeletplugin.PrepareResult{Devices: []kubeletplugin.Device{device}}
 }
 
 // ──────────────────────────────────────────────────────────────────────────────
 // CDI spec management
 // ──────────────────────────────────────────────────────────────────────────────
 
+// stateKey identifies an allocation in CDI and state file names.  Shares of
+// a multi-allocatable device append their ShareID so they never collide.
+func stateKey(alloc *handler.AllocationInfo) string {
+	if alloc.ShareID != "" {
+		return handler.ShortID(alloc.ClaimUID) + "-" + handler.ShortID(alloc.ShareID)
+	}
+	return handler.ShortID(alloc.ClaimUID)
+}
+
+// cdiDeviceName returns the CDI device name for an allocation.  Handlers
+// that expose the same host device to every share (e.g. shared uverbs) would
+// otherwise define the same CDI device in several spec files.
+func cdiDeviceName(alloc *handler.AllocationInfo) string {
+	if alloc.ShareID != "" {
+		return alloc.DeviceName + "-" + handler.ShortID(alloc.ShareID)
+	}
+	return alloc.DeviceName
+}
+
 // cdiFilePrefix returns the common prefix for CDI and allocation state files.
-func (d *Driver) cdiFilePrefix(claimUID string) string {
-	return fmt.Sprintf("%s-%s", strings.ReplaceAll(d.driverName, "/", "-"), claimUID[:8])
+func (d *Driver) cdiFilePrefix(key string) string {
+	return fmt.Sprintf("%s-%s", strings.ReplaceAll(d.driverName, "/", "-"), key)
 }
 
 // createCDISpec creates a CDI spec file from the handler's edits.
-func (d *Driver) createCDISpec(claimUID string, result *handler.PrepareResult) (string, error) {
+func (d *Driver) createCDISpec(result *handler.PrepareResult) (string, error) {
 	if err := os.MkdirAll(cdiDir, 0755); err != nil {
 		return "", fmt.Errorf("failed to create CDI directory: %w", err)
 	}
@@ -271,7 +472,7 @@ func (d *Driver) createCDISpec(claimUID string, result *handler.PrepareResult) (
 		Version: cdiVersion,
 		Kind:    fmt.Sprintf("%s/%s", d.driverName, result.Allocation.Type),
 		Devices: []cdispec.Device{{
-			Name:           result.DeviceName,
+			Name:           cdiDeviceName(result.Allocation),
 			ContainerEdits: *result.CDIEdits,
 		}},
 	}
@@ -281,25 +482,25 @@ func (d *Driver) createCDISpec(claimUID string, result *handler.PrepareResult) (
 		return "", fmt.Errorf("failed to marshal CDI spec: %w", err)
 	}
 
-	prefix := d.cdiFilePrefix(claimUID)
+	prefix := d.cdiFilePrefix(stateKey(result.Allocation))
 	cdiFilePath := filepath.Join(cdiDir, prefix+".json")
 
 	if err := os.WriteFile(cdiFilePath, data, 0644); err != nil {
 		return "", fmt.Errorf("failed to write CDI spec: %w", err)
 	}
 
-	if err := d.saveAllocation(claimUID, result.Allocation); err != nil {
-		klog.Warningf("Failed to save allocation state for claim %s: %v", claimUID, err)
+	if err := d.saveAllocation(result.Allocation); err != nil {
+		klog.Warningf("Failed to save allocation state for claim %s: %v", result.Allocation.ClaimUID, err)
 	}
 
-	cdiDeviceID := fmt.Sprintf("%s/%s=%s", d.driverName, result.Allocation.Type, result.DeviceName)
+	cdiDeviceID := fmt.Sprintf("%s/%s=%s", d.driverName, result.Allocation.Type, cdiDeviceName(result.Allocation))
 	klog.Infof("Created CDI spec at %s (id: %s)", cdiFilePath, cdiDeviceID)
 	return cdiDeviceID, nil
 }
 
 // deleteCDISpec removes the CDI spec and allocation state for a claim.
-func (d *Driver) deleteCDISpec(claimUID string) {
-	prefix := d.cdiFilePrefix(claimUID)
+func (d *Driver) deleteCDISpec(alloc *handler.AllocationInfo) {
+	prefix := d.cdiFilePrefix(stateKey(alloc))
 
 	cdiFilePath := filepath.Join(cdiDir, prefix+".json")
 	if err := os.Remove(cdiFilePath); err != nil && !os.IsNotExist(err) {
@@ -308,7 +509,7 @@ func (d *Driver) deleteCDISpec(claimUID string) {
 		klog.Infof("Deleted CDI spec at %s", cdiFilePath)
 	}
 
-	d.removeAllocationState(claimUID)
+	d.removeAllocationState(alloc)
 }
 
 // ──────────────────────────────────────────────────────────────────────────────
@@ -316,12 +517,12 @@ func (d *Driver) deleteCDISpec(claimUID string) {
 // ──────────────────────────────────────────────────────────────────────────────
 
 // saveAllocation persists AllocationInfo to a sidecar file alongside the CDI spec.
-func (d *Driver) saveAllocation(claimUID string, alloc *handler.AllocationInfo) error {
+func (d *Driver) saveAllocation(alloc *handler.AllocationInfo) error {
 	data, err := json.MarshalIndent(alloc, "", "  ")
 	if err != nil {
 		return fmt.Errorf("marshal allocation: %w", err)
 	}
-	path := filepath.Join(cdiDir, d.cdiFilePrefix(claimUID)+".alloc.json")
+	path := filepath.Join(cdiDir, d.cdiFilePrefix(stateKey(alloc))+".alloc.json")
 	if err := os.WriteFile(path, data, 0644); err != nil {
 		return fmt.Errorf("write allocation state: %w", err)
 	}
@@ -330,16 +531,24 @@ func (d *Driver) saveAllocation(claimUID string, alloc *handler.AllocationInfo)
 }
 
 // removeAllocationState deletes the sidecar allocation state file.
-func (d *Driver) removeAllocationState(claimUID string) {
-	path := filepath.Join(cdiDir, d.cdiFilePrefix(claimUID)+".alloc.json")
+func (d *Driver) removeAllocationState(alloc *handler.AllocationInfo) {
+	path := filepath.Join(cdiDir, d.cdiFilePrefix(stateKey(alloc))+".alloc.json")
 	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 		klog.Warningf("Failed to delete allocation state %s: %v", path, err)
 	}
 }
 
+// Restore reloads the persisted allocations, so that handlers and IPAM know
+// about devices and addresses held by claims prepared before a restart.
+// Claims are also restored lazily on every prepare and unprepare; calling
+// Restore at startup reconciles before the first request arrives.
+func (d *Driver) Restore() {
+	d.restoreAllocations()
+}
+
 // restoreAllocations rebuilds the in-memory allocations map from persisted state files.
 func (d *Driver) restoreAllocations() {
-	pattern := filepath.Join(cdiDir, d.cdiFilePrefix("00000000")[:len(strings.ReplaceAll(d.driverName, "/", "-"))+1]+"*.alloc.json")
+	pattern := filepath.Join(cdiDir, d.cdiFilePrefix("*.alloc.json"))
 	matches, err := filepath.Glob(pattern)
 	if err != nil {
 		klog.Warningf("Failed to glob allocation state files: %v", err)
@@ -365,7 +574,14 @@ func (d *Driver) restoreAllocations() {
 			continue
 		}
 
+		if _, known := d.allocations[alloc.ClaimUID]; known {
+			continue
+		}
+
 		d.allocations[alloc.ClaimUID] = &alloc
+		d.restoreHandlerState(&alloc)
+		d.restoreLeases(&alloc)
+		d.restoreMAC(&alloc)
 		restored++
 		klog.V(2).Infof("Restored allocation: claim=%s type=%s kind=%s device=%s",
 			alloc.ClaimUID, alloc.Type, alloc.Kind, alloc.DeviceName)
@@ -375,3 +591,13 @@ func (d *Driver) restoreAllocations() {
 		klog.Infof("Restored %d allocations from disk", restored)
 	}
 }
+
+// restoreHandlerState lets the allocation's handler rebuild in-memory state.
+func (d *Driver) restoreHandlerState(alloc *handler.AllocationInfo) {
+	if d.registry == nil {
+		return
+	}
+	if h, ok := d.registry.Get(alloc.Type, alloc.Kind).(handler.RestoringHandler); ok {
+		h.Restore(alloc)
+	}
+}
@@ -3,15 +3,26 @@ package driver
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
 	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/dynamic-resource-allocation/resourceslice"
 	cdispec "tags.cncf.io/container-device-interface/specs-go"
 
 	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/ipam"
+	"github.com/example/dra-poc/pkg/macpool"
 )
 
 // fakeHandler implements handler.DeviceHandler for driver-level testing.
@@ -25,6 +36,7 @@ type fakeHandler struct {
 
 	prepareCalled   int
 	unprepareCalled int
+	lastRequest     *handler.PrepareRequest
 }
 
 func (f *fakeHandler) Type() handler.DeviceType { return f.deviceType }
@@ -34,6 +46,7 @@ func (f *fakeHandler) Validate(_ context.Context, _ *handler.DeviceConfig) error
 
 func (f *fakeHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
 	f.prepareCalled++
+	f.lastRequest = req
 	if f.prepareErr != nil {
 		return nil, f.prepareErr
 	}
@@ -231,6 +244,125 @@ func TestPrepareClaim_DispatchToHandler(t *testing.T) {
 	}
 }
 
+func TestPrepareClaim_ShareID(t *testing.T) {
+	fh := &fakeHandler{
+		deviceType: handler.DeviceTypeNetdev,
+		kinds:      []string{"dummy"},
+	}
+	reg := handler.NewHandlerRegistry()
+	reg.Register(fh)
+	d := &Driver{
+		driverName:  "dra.example.com",
+		registry:    reg,
+		allocations: make(map[string]*handler.AllocationInfo),
+	}
+
+	shareID := types.UID("5ba1e000-aaaa-bbbb-cccc-dddddddddddd")
+	rc := &resourceapi.ResourceClaim{
+		ObjectMeta: metav1.ObjectMeta{UID: "share000-1111-2222-3333-444444444444"},
+		Status: resourceapi.ResourceClaimStatus{
+			Allocation: &resourceapi.AllocationResult{
+				Devices: resourceapi.DeviceAllocationResult{
+					Results: []resourceapi.DeviceRequestAllocationResult{{
+						Request: "net",
+						Driver:  "dra.example.com",
+						Pool:    "node-1",
+						Device:  "netdev-virtual-dummy",
+						ShareID: &shareID,
+						ConsumedCapacity: map[resourceapi.QualifiedName]resource.Quantity{
+							"dra.example.com/slots": resource.MustParse("1"),
+						},
+					}},
+				},
+			},
+		},
+	}
+
+	result, err := d.prepareClaim(context.Background(), rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := fh.lastRequest
+	if req.ShareID != string(shareID) {
+		t.Errorf("PrepareRequest.ShareID = %q, want %q", req.ShareID, shareID)
+	}
+	if req.NameSuffix() != "5ba1e000" {
+		t.Errorf("NameSuffix = %q, want 5ba1e000", req.NameSuffix())
+	}
+	if _, ok := req.ConsumedCapacity["dra.example.com/slots"]; !ok {
+		t.Errorf("PrepareRequest.ConsumedCapacity = %v, want slots entry", req.ConsumedCapacity)
+	}
+
+	alloc := result.Allocation
+	if alloc.PoolName != "node-1" || alloc.AllocatedDevice != "netdev-virtual-dummy" || alloc.ShareID != string(shareID) {
+		t.Errorf("allocation identity = %s/%s share=%s, want node-1/netdev-virtual-dummy share=%s",
+			alloc.PoolName, alloc.AllocatedDevice, alloc.ShareID, shareID)
+	}
+
+	pr := d.prepareResultFromAlloc(alloc, "dra.example.com/netdev=testdev0-5ba1e000")
+	if len(pr.Devices) != 1 {
+		t.Fatalf("Devices = %d, want 1", len(pr.Devices))
+	}
+	dev := pr.Devices[0]
+	if dev.PoolName != "node-1" || dev.DeviceName != "netdev-virtual-dummy" {
+		t.Errorf("device = %s/%s, want node-1/netdev-virtual-dummy", dev.PoolName, dev.DeviceName)
+	}
+	if dev.ShareID == nil || *dev.ShareID != shareID {
+		t.Errorf("device ShareID = %v, want %s", dev.ShareID, shareID)
+	}
+}
+
+func TestPrepareResultFromAlloc_NoAllocationIdentity(t *testing.T) {
+	d := &Driver{driverName: "dra.example.com"}
+	pr := d.prepareResultFromAlloc(&handler.AllocationInfo{
+		Type:       handler.DeviceTypeNetdev,
+		ClaimUID:   "legacy00-1111-2222-3333-444444444444",
+		DeviceName: "dmlegacy0",
+	}, "dra.example.com/netdev=dmlegacy0")
+
+	dev := pr.Devices[0]
+	if dev.PoolName != "default" || dev.DeviceName != "dmlegacy0" {
+		t.Errorf("device = %s/%s, want default/dmlegacy0", dev.PoolName, dev.DeviceName)
+	}
+	if dev.ShareID != nil {
+		t.Errorf("device ShareID = %v, want nil", *dev.ShareID)
+	}
+}
+
+func TestStateKeyAndCDIDeviceName(t *testing.T) {
+	tests := []struct {
+		name        string
+		alloc       handler.AllocationInfo
+		wantKey     string
+		wantCDIName string
+	}{
+		{
+			name:        "exclusive",
+			alloc:       handler.AllocationInfo{ClaimUID: "aabbccdd-1111", DeviceName: "uverbs0"},
+			wantKey:     "aabbccdd",
+			wantCDIName: "uverbs0",
+		},
+		{
+			name:        "shared",
+			alloc:       handler.AllocationInfo{ClaimUID: "aabbccdd-1111", DeviceName: "uverbs0", ShareID: "11223344-5555"},
+			wantKey:     "aabbccdd-11223344",
+			wantCDIName: "uverbs0-11223344",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stateKey(&tt.alloc); got != tt.wantKey {
+				t.Errorf("stateKey = %q, want %q", got, tt.wantKey)
+			}
+			if got := cdiDeviceName(&tt.alloc); got != tt.wantCDIName {
+				t.Errorf("cdiDeviceName = %q, want %q", got, tt.wantCDIName)
+			}
+		})
+	}
+}
+
 func TestPrepareClaim_UnknownKindFails(t *testing.T) {
 	reg := handler.NewHandlerRegistry()
 
@@ -326,24 +458,74 @@ func TestParseConfig_DefaultsWhenNilClaim(t *testing.T) {
 	}
 }
 
-// ─── getAllocatedDevice tests ───────────────────────────────────────────────
+// ─── resolveNetdevKind tests ────────────────────────────────────────────────
 
-func TestGetAllocatedDevice_NilClaim(t *testing.T) {
+func TestResolveNetdevKind(t *testing.T) {
+	tests := []struct {
+		name      string
+		kind      string
+		allocated string
+		want      string
+		wantErr   bool
+	}{
+		{"kind from virtual device", "", "netdev-virtual-veth", "veth", false},
+		{"matching kind", "veth", "netdev-virtual-veth", "veth", false},
+		{"conflicting kind", "dummy", "netdev-virtual-veth", "", true},
+		{"default without device", "", "", "dummy", false},
+		{"non-virtual device keeps kind", "sriov-vf", "ens1f0v0", "sriov-vf", false},
+		{"non-virtual device defaults", "", "uverbs0", "dummy", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &handler.DeviceConfig{
+				Type:   handler.DeviceTypeNetdev,
+				Netdev: &handler.NetdevConfig{Kind: tt.kind},
+			}
+			err := resolveNetdevKind(config, tt.allocated)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error for conflicting kind")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if config.Netdev.Kind != tt.want {
+				t.Errorf("kind = %q, want %q", config.Netdev.Kind, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveNetdevKind_IgnoresOtherTypes(t *testing.T) {
+	config := &handler.DeviceConfig{Type: handler.DeviceTypeRDMA}
+	if err := resolveNetdevKind(config, "netdev-virtual-veth"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.GetKind() != "uverbs" {
+		t.Errorf("kind = %q, want uverbs", config.GetKind())
+	}
+}
+
+// ─── getAllocationResult tests ──────────────────────────────────────────────
+
+func TestGetAllocationResult_NilClaim(t *testing.T) {
 	d := &Driver{driverName: "dra.example.com"}
-	if got := d.getAllocatedDevice(nil); got != "" {
-		t.Errorf("expected empty string for nil claim, got %q", got)
+	if got := d.getAllocationResult(nil); got != nil {
+		t.Errorf("expected nil for nil claim, got %+v", got)
 	}
 }
 
-func TestGetAllocatedDevice_NoAllocation(t *testing.T) {
+func TestGetAllocationResult_NoAllocation(t *testing.T) {
 	d := &Driver{driverName: "dra.example.com"}
 	rc := &resourceapi.ResourceClaim{}
-	if got := d.getAllocatedDevice(rc); got != "" {
-		t.Errorf("expected empty string for claim without allocation, got %q", got)
+	if got := d.getAllocationResult(rc); got != nil {
+		t.Errorf("expected nil for claim without allocation, got %+v", got)
 	}
 }
 
-func TestGetAllocatedDevice_FiniteDevice(t *testing.T) {
+func TestGetAllocationResult_FiniteDevice(t *testing.T) {
 	d := &Driver{driverName: "dra.example.com"}
 	rc := &resourceapi.ResourceClaim{
 		Status: resourceapi.ResourceClaimStatus{
@@ -362,13 +544,13 @@ func TestGetAllocatedDevice_FiniteDevice(t *testing.T) {
 		},
 	}
 
-	got := d.getAllocatedDevice(rc)
-	if got != "uverbs0" {
-		t.Errorf("getAllocatedDevice = %q, want uverbs0", got)
+	got := d.getAllocationResult(rc)
+	if got == nil || got.Device != "uverbs0" {
+		t.Errorf("getAllocationResult = %+v, want device uverbs0", got)
 	}
 }
 
-func TestGetAllocatedDevice_VirtualDevice(t *testing.T) {
+func TestGetAllocationResult_VirtualDevice(t *testing.T) {
 	d := &Driver{driverName: "dra.example.com"}
 	rc := &resourceapi.ResourceClaim{
 		Status: resourceapi.ResourceClaimStatus{
@@ -379,7 +561,7 @@ func TestGetAllocatedDevice_VirtualDevice(t *testing.T) {
 							Request: "net",
 							Driver:  "dra.example.com",
 							Pool:    "node-1",
-							Device:  "netdev-virtual",
+							Device:  "netdev-virtual-veth",
 						},
 					},
 				},
@@ -387,14 +569,14 @@ func TestGetAllocatedDevice_VirtualDevice(t *testing.T) {
 		},
 	}
 
-	// Virtual devices return the shared device name; the handler ignores it.
-	got := d.getAllocatedDevice(rc)
-	if got != "netdev-virtual" {
-		t.Errorf("getAllocatedDevice = %q, want netdev-virtual", got)
+	// Virtual devices return the per-kind device name; it selects the kind.
+	got := d.getAllocationResult(rc)
+	if got == nil || got.Device != "netdev-virtual-veth" {
+		t.Errorf("getAllocationResult = %+v, want device netdev-virtual-veth", got)
 	}
 }
 
-func TestGetAllocatedDevice_OtherDriver(t *testing.T) {
+func TestGetAllocationResult_OtherDriver(t *testing.T) {
 	d := &Driver{driverName: "dra.example.com"}
 	rc := &resourceapi.ResourceClaim{
 		Status: resourceapi.ResourceClaimStatus{
@@ -414,9 +596,83 @@ func TestGetAllocatedDevice_OtherDriver(t *testing.T) {
 	}
 
 	// Result from a different driver should be ignored
-	got := d.getAllocatedDevice(rc)
-	if got != "" {
-		t.Errorf("expected empty string when no results match our driver, got %q", got)
+	got := d.getAllocationResult(rc)
+	if got != nil {
+		t.Errorf("expected nil when no results match our driver, got %+v", got)
+	}
+}
+
+func TestAllocatedDevices(t *testing.T) {
+	d := &Driver{driverName: "dra.example.com"}
+	rc := &resourceapi.ResourceClaim{
+		Status: resourceapi.ResourceClaimStatus{
+			Allocation: &resourceapi.AllocationResult{
+				Devices: resourceapi.DeviceAllocationResult{
+					Results: []resourceapi.DeviceRequestAllocationResult{
+						{Request: "bond", Driver: "dra.example.com", Pool: "node-1", Device: "netdev-virtual-bond"},
+						{Request: "gpu", Driver: "some-other-driver.io", Pool: "node-1", Device: "gpu0"},
+						{Request: "links", Driver: "dra.example.com", Pool: "node-1", Device: "ens1f0v0"},
+						{Request: "links", Driver: "dra.example.com", Pool: "node-1", Device: "ens1f1v0"},
+					},
+				},
+			},
+		},
+	}
+
+	got := d.allocatedDevices(rc)
+	want := []string{"netdev-virtual-bond", "ens1f0v0", "ens1f1v0"}
+	if !slices.Equal(got, want) {
+		t.Errorf("allocatedDevices = %v, want %v", got, want)
+	}
+	if got := d.allocatedDevices(nil); got != nil {
+		t.Errorf("allocatedDevices(nil) = %v, want nil", got)
+	}
+}
+
+// ─── consumedCapacity tests ─────────────────────────────────────────────────
+
+func TestConsumedCapacity(t *testing.T) {
+	d := &Driver{driverName: "dra.example.com"}
+	if got := consumedCapacity(nil); got != nil {
+		t.Errorf("expected nil for nil claim, got %v", got)
+	}
+
+	rc := &resourceapi.ResourceClaim{
+		Status: resourceapi.ResourceClaimStatus{
+			Allocation: &resourceapi.AllocationResult{
+				Devices: resourceapi.DeviceAllocationResult{
+					Results: []resourceapi.DeviceRequestAllocationResult{
+						{
+							Request: "gpu",
+							Driver:  "some-other-driver.io",
+							Pool:    "node-1",
+							Device:  "gpu0",
+							ConsumedCapacity: map[resourceapi.QualifiedName]resource.Quantity{
+								"memory": resource.MustParse("1Gi"),
+							},
+						},
+						{
+							Request: "net",
+							Driver:  "dra.example.com",
+							Pool:    "node-1",
+							Device:  "ens1f0-macvlan-pool",
+							ConsumedCapacity: map[resourceapi.QualifiedName]resource.Quantity{
+								handler.CapacityBandwidth: resource.MustParse("10G"),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	got := consumedCapacity(d.getAllocationResult(rc))
+	if len(got) != 1 {
+		t.Fatalf("expected 1 capacity entry, got %v", got)
+	}
+	bw := got[handler.CapacityBandwidth]
+	if bw.Value() != 10_000_000_000 {
+		t.Errorf("bandwidth = %s, want 10G", bw.String())
 	}
 }
 
@@ -640,3 +896,1044 @@ func TestRestoreAllocations_SkipsInvalidFiles(t *testing.T) {
 		t.Errorf("expected 1 valid allocation, got %d", validCount)
 	}
 }
+
+// restoringHandler is a fakeHandler that records restored allocations.
+type restoringHandler struct {
+	fakeHandler
+	restored []string
+}
+
+func (r *restoringHandler) Restore(alloc *handler.AllocationInfo) {
+	r.restored = append(r.restored, alloc.ClaimUID)
+}
+
+func TestRestoreHandlerState(t *testing.T) {
+	rh := &restoringHandler{fakeHandler: fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"sriov-vf"}}}
+	reg := handler.NewHandlerRegistry()
+	reg.Register(rh)
+	reg.Register(&fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"dummy"}})
+	d := &Driver{registry: reg}
+
+	d.restoreHandlerState(&handler.AllocationInfo{Type: handler.DeviceTypeNetdev, Kind: "sriov-vf", ClaimUID: "vf-claim"})
+	d.restoreHandlerState(&handler.AllocationInfo{Type: handler.DeviceTypeNetdev, Kind: "dummy", ClaimUID: "dummy-claim"})
+	d.restoreHandlerState(&handler.AllocationInfo{Type: handler.DeviceTypeNetdev, Kind: "gone", ClaimUID: "orphan-claim"})
+
+	if len(rh.restored) != 1 || rh.restored[0] != "vf-claim" {
+		t.Errorf("restored = %v, want [vf-claim]", rh.restored)
+	}
+}
+
+// ─── SR-IOV partitionable device tests ──────────────────────────────────────
+
+func TestParseVFProfiles(t *testing.T) {
+	profiles, err := ParseVFProfiles(map[string]string{
+		"small": "1G/2",
+		"large": "10G/8",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 || profiles[0].Name != "large" || profiles[1].Name != "small" {
+		t.Fatalf("profiles = %+v, want large and small sorted by name", profiles)
+	}
+	if profiles[0].Bandwidth.Value() != 10_000_000_000 || profiles[0].QueuePairs != 8 {
+		t.Errorf("large = %s/%d, want 10G/8", profiles[0].Bandwidth.String(), profiles[0].QueuePairs)
+	}
+	if rate := profiles[0].Rate(); rate != 10000 {
+		t.Errorf("large rate = %d Mb/s, want 10000", rate)
+	}
+
+	for _, bad := range []map[string]string{
+		{"Small": "1G/2"},
+		{"small": "1G"},
+		{"small": "0/2"},
+		{"small": "1G/0"},
+		{"small": "fast/2"},
+	} {
+		if _, err := ParseVFProfiles(bad); err == nil {
+			t.Errorf("ParseVFProfiles(%v) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestBuildSriovResources_Plain(t *testing.T) {
+	vfs := []vfInfo{
+		{Name: "ens1f0v1", Parent: "ens1f0", Index: 1, NUMANode: -1, QueuePairs: 4, MaxTxRate: 5000},
+		{Name: "ens1f0v0", Parent: "ens1f0", Index: 0, NUMANode: 0, QueuePairs: 4, EswitchMode: "switchdev"},
+		{Name: "orphanvf", Index: -1, NUMANode: -1},
+	}
+
+	devices, sets := buildSriovResources(vfs, map[string]pfBudget{"ens1f0": {Speed: 25000, QueuePairs: 6}}, nil)
+
+	if len(sets) != 1 {
+		t.Fatalf("counter sets = %d, want 1", len(sets))
+	}
+	set := sets[0]
+	if set.Name != "pf-ens1f0" {
+		t.Errorf("counter set name = %s, want pf-ens1f0", set.Name)
+	}
+	if bw := set.Counters[counterBandwidth].Value; bw.Value() != 25_000_000_000 {
+		t.Errorf("bandwidth counter = %s, want 25G", bw.String())
+	}
+	// The PF's own queue pairs, not the sum of its VFs', limit them.
+	if qp := set.Counters[counterQueuePairs].Value; qp.Value() != 6 {
+		t.Errorf("queue-pairs counter = %s, want 6", qp.String())
+	}
+
+	if len(devices) != 3 {
+		t.Fatalf("devices = %d, want 3", len(devices))
+	}
+	if devices[0].Name != "orphanvf" || devices[0].ConsumesCounters != nil {
+		t.Errorf("VF without PF should consume nothing, got %+v", devices[0])
+	}
+	vf0 := devices[1]
+	if vf0.Name != "ens1f0v0" {
+		t.Fatalf("devices[1] = %s, want ens1f0v0 (sorted per PF)", vf0.Name)
+	}
+	if len(vf0.ConsumesCounters) != 1 || vf0.ConsumesCounters[0].CounterSet != "pf-ens1f0" {
+		t.Fatalf("ConsumesCounters = %+v, want one entry for pf-ens1f0", vf0.ConsumesCounters)
+	}
+	consumed := vf0.ConsumesCounters[0].Counters
+	// Without a rate limit, a VF consumes an equal share of the PF's speed.
+	if bw := consumed[counterBandwidth].Value; bw.Value() != 12_500_000_000 {
+		t.Errorf("consumed bandwidth = %s, want 12.5G", bw.String())
+	}
+	if bw := devices[2].ConsumesCounters[0].Counters[counterBandwidth].Value; bw.Value() != 5_000_000_000 {
+		t.Errorf("rate-limited VF consumes %s bandwidth, want its 5G limit", bw.String())
+	}
+	if qp := consumed[counterQueuePairs].Value; qp.Value() != 4 {
+		t.Errorf("consumed queue-pairs = %s, want 4", qp.String())
+	}
+	if idx := vf0.Attributes["dra.example.com/vf-index"].IntValue; idx == nil || *idx != 0 {
+		t.Errorf("vf-index attribute = %v, want 0", idx)
+	}
+	if mode := vf0.Attributes["dra.example.com/eswitch-mode"].StringValue; mode == nil || *mode != "switchdev" {
+		t.Errorf("eswitch-mode attribute = %v, want switchdev", mode)
+	}
+	if _, ok := devices[0].Attributes["dra.example.com/eswitch-mode"]; ok {
+		t.Error("eswitch-mode attribute set although the mode is unknown")
+	}
+}
+
+func TestBuildSriovResources_Profiles(t *testing.T) {
+	vfs := []vfInfo{
+		{Name: "ens1f0v0", Parent: "ens1f0", Index: 0, NUMANode: -1, QueuePairs: 4},
+		{Name: "ens1f0v1", Parent: "ens1f0", Index: 1, NUMANode: -1, QueuePairs: 4},
+	}
+	profiles, err := ParseVFProfiles(map[string]string{"small": "1G/2", "large": "10G/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown PF speed: no bandwidth counter, so nothing consumes it.
+	devices, sets := buildSriovResources(vfs, map[string]pfBudget{"ens1f0": {Speed: -1, QueuePairs: 16}}, profiles)
+
+	if len(sets) != 1 {
+		t.Fatalf("counter sets = %d, want 1", len(sets))
+	}
+	counters := sets[0].Counters
+	if _, ok := counters[counterBandwidth]; ok {
+		t.Error("bandwidth counter published for PF with unknown speed")
+	}
+	for _, name := range []string{counterQueuePairs, "vf0", "vf1"} {
+		if _, ok := counters[name]; !ok {
+			t.Errorf("counter %s missing from %v", name, counters)
+		}
+	}
+
+	want := []string{"ens1f0v0-profile-large", "ens1f0v0-profile-small", "ens1f0v1-profile-large", "ens1f0v1-profile-small"}
+	if len(devices) != len(want) {
+		t.Fatalf("devices = %d, want %d", len(devices), len(want))
+	}
+	for i, name := range want {
+		if devices[i].Name != name {
+			t.Errorf("devices[%d] = %s, want %s", i, devices[i].Name, name)
+		}
+	}
+
+	large := devices[0].ConsumesCounters[0].Counters
+	if qp := large[counterQueuePairs].Value; qp.Value() != 8 {
+		t.Errorf("large consumes %s queue pairs, want 8", qp.String())
+	}
+	if vf := large["vf0"].Value; vf.Value() != 1 {
+		t.Errorf("large consumes %s of vf0, want 1", vf.String())
+	}
+	if _, ok := large[counterBandwidth]; ok {
+		t.Error("profile consumes bandwidth the PF does not publish")
+	}
+	if p := devices[1].Attributes["dra.example.com/profile"].StringValue; p == nil || *p != "small" {
+		t.Errorf("profile attribute = %v, want small", p)
+	}
+}
+
+func TestSriovCounterSetName(t *testing.T) {
+	tests := map[string]string{
+		"ens1f0":                "pf-ens1f0",
+		"enP1s2f0np0":           "pf-enp1s2f0np0",
+		"eth_0.100":             "pf-eth-0-100",
+		strings.Repeat("a", 70): "pf-" + strings.Repeat("a", 60),
+	}
+	for pf, want := range tests {
+		if got := sriovCounterSetName(pf); got != want {
+			t.Errorf("sriovCounterSetName(%q) = %q, want %q", pf, got, want)
+		}
+	}
+}
+
+func TestBuildSlices(t *testing.T) {
+	var devices []resourceapi.Device
+	for i := 0; i < 3; i++ {
+		devices = append(devices, resourceapi.Device{Name: fmt.Sprintf("plain%d", i)})
+	}
+	for i := 0; i < resourceapi.ResourceSliceMaxDevicesWithTaintsOrConsumesCounters+1; i++ {
+		devices = append(devices, resourceapi.Device{
+			Name:             fmt.Sprintf("vf%d", i),
+			ConsumesCounters: []resourceapi.DeviceCounterConsumption{{CounterSet: "pf-ens1f0"}},
+		})
+	}
+	sets := []resourceapi.CounterSet{{Name: "pf-ens1f0"}}
+
+	slices := buildSlices(devices, sets)
+	if len(slices) != 4 {
+		t.Fatalf("slices = %d, want 4 (plain, 2x consuming, counters)", len(slices))
+	}
+	if len(slices[0].Devices) != 3 || len(slices[1].Devices) != 64 || len(slices[2].Devices) != 1 {
+		t.Errorf("device slice sizes = %d/%d/%d, want 3/64/1",
+			len(slices[0].Devices), len(slices[1].Devices), len(slices[2].Devices))
+	}
+	for i, s := range slices {
+		if len(s.Devices) > 0 && len(s.SharedCounters) > 0 {
+			t.Errorf("slice %d carries both devices and shared counters", i)
+		}
+	}
+	if len(slices[3].SharedCounters) != 1 {
+		t.Errorf("counter slice has %d sets, want 1", len(slices[3].SharedCounters))
+	}
+
+	if got := buildSlices(nil, nil); len(got) != 1 {
+		t.Errorf("empty pool published %d slices, want 1", len(got))
+	}
+}
+
+func TestBuildOnDemandVFs(t *testing.T) {
+	devices, counterSets := buildOnDemandVFs(map[string]int{"ens2f0": 1, "ens1f0": 2},
+		map[string]pfBudget{"ens1f0": {Speed: 25000, QueuePairs: 64}})
+
+	var names []string
+	for _, d := range devices {
+		names = append(names, d.Name)
+	}
+	if want := "ens1f0-vf0,ens1f0-vf1,ens2f0-vf0"; strings.Join(names, ",") != want {
+		t.Fatalf("devices = %v, want %s", names, want)
+	}
+
+	d := devices[1]
+	if d.BindsToNode == nil || !*d.BindsToNode {
+		t.Error("on-demand VF does not bind to the node")
+	}
+	if len(d.BindingConditions) != 1 || d.BindingConditions[0] != ConditionVFReady {
+		t.Errorf("binding conditions = %v", d.BindingConditions)
+	}
+	if len(d.BindingFailureConditions) != 1 || d.BindingFailureConditions[0] != ConditionVFFailed {
+		t.Errorf("binding failure conditions = %v", d.BindingFailureConditions)
+	}
+	if got := d.Attributes["dra.example.com/vf-index"].IntValue; got == nil || *got != 1 {
+		t.Errorf("vf-index = %v, want 1", got)
+	}
+	if got := d.Attributes["dra.example.com/on-demand"].BoolValue; got == nil || !*got {
+		t.Error("on-demand attribute not set")
+	}
+
+	// Only ens1f0 has a known budget, split between its two VFs.
+	if len(counterSets) != 1 || counterSets[0].Name != "pf-ens1f0" {
+		t.Fatalf("counter sets = %+v, want pf-ens1f0 only", counterSets)
+	}
+	if len(d.ConsumesCounters) != 1 || d.ConsumesCounters[0].CounterSet != "pf-ens1f0" {
+		t.Fatalf("consumes counters = %+v", d.ConsumesCounters)
+	}
+	consumed := d.ConsumesCounters[0].Counters
+	bandwidth, queuePairs := consumed[counterBandwidth].Value, consumed[counterQueuePairs].Value
+	if got := bandwidth.Value(); got != 12_500_000_000 {
+		t.Errorf("bandwidth consumed = %d, want 12.5G", got)
+	}
+	if got := queuePairs.Value(); got != 32 {
+		t.Errorf("queue pairs consumed = %d, want 32", got)
+	}
+	if devices[2].ConsumesCounters != nil {
+		t.Errorf("VF of a PF without budget consumes %+v", devices[2].ConsumesCounters)
+	}
+}
+
+func TestMergeCounterSets(t *testing.T) {
+	// A PF whose budget is smaller than its VF count publishes both
+	// on-demand and discovered VFs against one counter set.
+	_, discovered := buildSriovResources([]vfInfo{
+		{Name: "ens1f0v4", Parent: "ens1f0", Index: 4, NUMANode: -1, QueuePairs: 4},
+		{Name: "ens2f0v0", Parent: "ens2f0", Index: 0, NUMANode: -1, QueuePairs: 4},
+	}, map[string]pfBudget{"ens1f0": {Speed: 25000, QueuePairs: 64}, "ens2f0": {Speed: 10000}}, nil)
+	_, onDemand := buildOnDemandVFs(map[string]int{"ens1f0": 4},
+		map[string]pfBudget{"ens1f0": {Speed: 25000, QueuePairs: 64}})
+
+	sets := mergeCounterSets(append(discovered, onDemand...))
+	var names []string
+	for _, set := range sets {
+		names = append(names, set.Name)
+	}
+	if want := "pf-ens1f0,pf-ens2f0"; strings.Join(names, ",") != want {
+		t.Fatalf("counter sets = %v, want %s", names, want)
+	}
+	if len(sets[0].Counters) != 2 {
+		t.Errorf("pf-ens1f0 counters = %v, want bandwidth and queue-pairs", sets[0].Counters)
+	}
+}
+
+// fakeProvisioner records ProvisionVF and ReleaseVF calls.
+type fakeProvisioner struct {
+	err      error
+	provided []string
+	released []string
+}
+
+func (p *fakeProvisioner) ProvisionVF(_ context.Context, claimUID, pf string, index int) (string, error) {
+	p.provided = append(p.provided, fmt.Sprintf("%s/%s/%d", claimUID, pf, index))
+	if p.err != nil {
+		return "", p.err
+	}
+	return fmt.Sprintf("%sv%d", pf, index), nil
+}
+
+func (p *fakeProvisioner) ReleaseVF(claimUID, pf string, index int) {
+	p.released = append(p.released, fmt.Sprintf("%s/%s/%d", claimUID, pf, index))
+}
+
+func onDemandClaim() *resourceapi.ResourceClaim {
+	return &resourceapi.ResourceClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "vf", Namespace: "default", UID: "claim-uid"},
+		Status: resourceapi.ResourceClaimStatus{
+			Allocation: &resourceapi.AllocationResult{
+				Devices: resourceapi.DeviceAllocationResult{
+					Results: []resourceapi.DeviceRequestAllocationResult{
+						{Request: "vf", Driver: "dra.example.com", Pool: "node-1", Device: "ens1f0-vf2",
+							BindingConditions: []string{ConditionVFReady}},
+						{Request: "other", Driver: "dra.example.com", Pool: "node-2", Device: "ens1f0-vf0",
+							BindingConditions: []string{ConditionVFReady}},
+						{Request: "plain", Driver: "dra.example.com", Pool: "node-1", Device: "ens1f0v0"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestBindingController_Sync(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		condition string
+	}{
+		{"ready", nil, ConditionVFReady},
+		{"failed", fmt.Errorf("no VFs"), ConditionVFFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			claim := onDemandClaim()
+			client := fake.NewClientset(claim)
+			vfs := &fakeProvisioner{err: tt.err}
+			c := NewBindingController("dra.example.com", "node-1", client, vfs)
+			if err := c.claims.Informer().GetIndexer().Add(claim); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.sync(ctx, "default/vf"); err != nil {
+				t.Fatalf("sync: %v", err)
+			}
+			if want := []string{"claim-uid/ens1f0/2"}; fmt.Sprint(vfs.provided) != fmt.Sprint(want) {
+				t.Errorf("provisioned %v, want %v", vfs.provided, want)
+			}
+
+			updated, err := client.ResourceV1().ResourceClaims("default").Get(ctx, "vf", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(updated.Status.Devices) != 1 {
+				t.Fatalf("device status = %+v, want one entry", updated.Status.Devices)
+			}
+			status := updated.Status.Devices[0]
+			if status.Device != "ens1f0-vf2" || status.Pool != "node-1" {
+				t.Errorf("status for %s/%s, want node-1/ens1f0-vf2", status.Pool, status.Device)
+			}
+			if len(status.Conditions) != 1 || status.Conditions[0].Type != tt.condition ||
+				status.Conditions[0].Status != metav1.ConditionTrue {
+				t.Errorf("conditions = %+v, want %s=True", status.Conditions, tt.condition)
+			}
+
+			// Once the outcome is recorded the VF is left alone.
+			if err := c.claims.Informer().GetIndexer().Update(updated); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.sync(ctx, "default/vf"); err != nil {
+				t.Fatalf("second sync: %v", err)
+			}
+			if len(vfs.provided) != 1 {
+				t.Errorf("VF provisioned again: %v", vfs.provided)
+			}
+		})
+	}
+}
+
+func TestBindingController_ReleaseDropped(t *testing.T) {
+	vfs := &fakeProvisioner{}
+	c := NewBindingController("dra.example.com", "node-1", fake.NewClientset(), vfs)
+
+	allocated := onDemandClaim()
+	c.releaseDropped(allocated, allocated)
+	if len(vfs.released) != 0 {
+		t.Errorf("released %v while still allocated", vfs.released)
+	}
+
+	deallocated := allocated.DeepCopy()
+	deallocated.Status.Allocation = nil
+	c.releaseDropped(allocated, deallocated)
+	if want := []string{"claim-uid/ens1f0/2"}; fmt.Sprint(vfs.released) != fmt.Sprint(want) {
+		t.Errorf("released %v, want %v", vfs.released, want)
+	}
+
+	vfs.released = nil
+	c.releaseDropped(allocated, nil)
+	if len(vfs.released) != 1 {
+		t.Errorf("released %v after delete, want one VF", vfs.released)
+	}
+}
+
+// ─── IPAM tests ─────────────────────────────────────────────────────────────
+
+func newIPAMDriver(t *testing.T, fh *fakeHandler) *Driver {
+	t.Helper()
+	alloc, err := ipam.New(&ipam.Config{Ranges: []ipam.Range{
+		{Name: "data", Subnet: "10.10.0.0/24", Gateway: "10.10.0.1"},
+		{Name: "data6", Subnet: "2001:db8::/64", Gateway: "2001:db8::1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := handler.NewHandlerRegistry()
+	reg.Register(fh)
+	return &Driver{
+		driverName:  "dra.example.com",
+		registry:    reg,
+		allocations: make(map[string]*handler.AllocationInfo),
+		IPAM:        alloc,
+	}
+}
+
+func ipamClaim(params string) *resourceapi.ResourceClaim {
+	return &resourceapi.ResourceClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "net", Namespace: "default", UID: "ipam0000-1111-2222-3333-444444444444"},
+		Spec: resourceapi.ResourceClaimSpec{
+			Devices: resourceapi.DeviceClaim{
+				Config: []resourceapi.DeviceClaimConfiguration{{
+					DeviceConfiguration: resourceapi.DeviceConfiguration{
+						Opaque: &resourceapi.OpaqueDeviceConfiguration{
+							Driver:     "dra.example.com",
+							Parameters: runtime.RawExtension{Raw: []byte(params)},
+						},
+					},
+				}},
+			},
+		},
+		Status: resourceapi.ResourceClaimStatus{
+			Allocation: &resourceapi.AllocationResult{
+				Devices: resourceapi.DeviceAllocationResult{
+					Results: []resourceapi.DeviceRequestAllocationResult{
+						{Request: "net", Driver: "dra.example.com", Pool: "node-1", Device: "netdev-virtual-dummy"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestPrepareClaim_IPAM(t *testing.T) {
+	fh := &fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"dummy"}}
+	d := newIPAMDriver(t, fh)
+	rc := ipamClaim(`{"type": "netdev", "netdev": {"kind": "dummy", "gateways": ["10.10.0.254"], "routing": {"table": 100}, "ipam": {"ranges": ["data", "data6"]}}}`)
+
+	result, err := d.prepareClaim(context.Background(), rc)
+	if err != nil {
+		t.Fatalf("prepareClaim: %v", err)
+	}
+	cfg := fh.lastRequest.Config.Netdev
+	if want := []string{"10.10.0.2/24", "2001:db8::2/64"}; !slices.Equal(cfg.Addresses, want) {
+		t.Errorf("addresses = %v, want %v", cfg.Addresses, want)
+	}
+	// The claim's own IPv4 gateway wins over the range's.
+	if want := []string{"10.10.0.254", "2001:db8::1"}; !slices.Equal(cfg.Gateways, want) {
+		t.Errorf("gateways = %v, want %v", cfg.Gateways, want)
+	}
+
+	var leases []ipam.Lease
+	if err := json.Unmarshal([]byte(result.Allocation.Metadata[ipamLeasesKey]), &leases); err != nil {
+		t.Fatalf("decode leases: %v", err)
+	}
+	if len(leases) != 2 || leases[0].Address != "10.10.0.2/24" || leases[1].Range != "data6" {
+		t.Errorf("recorded leases = %+v", leases)
+	}
+
+	// Unprepare returns the addresses to the ranges.
+	if err := d.unprepareAllocation(context.Background(), result.Allocation); err != nil {
+		t.Fatalf("unprepareAllocation: %v", err)
+	}
+	next, err := d.IPAM.Allocate("other", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.IPAM.Release("other")
+	// Round-robin moves past the released address; restoring the old lease
+	// must still succeed since nothing holds it.
+	if next.Address != "10.10.0.3/24" {
+		t.Errorf("next lease = %s, want 10.10.0.3/24", next.Address)
+	}
+	d.restoreLeases(result.Allocation)
+	if lease, _ := d.IPAM.Allocate(string(rc.UID), "data"); lease.Address != "10.10.0.2/24" {
+		t.Errorf("restored lease = %s, want 10.10.0.2/24", lease.Address)
+	}
+}
+
+func TestPrepareClaim_IPAMRangeGateway(t *testing.T) {
+	tests := []struct {
+		name    string
+		routing string
+		want    []string
+	}{
+		{"primary keeps the default route", ``, nil},
+		{"route table", `"routing": {"table": 100},`, []string{"10.10.0.1"}},
+		{"default route", `"routing": {"defaultRoute": true},`, []string{"10.10.0.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fh := &fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"dummy"}}
+			d := newIPAMDriver(t, fh)
+			rc := ipamClaim(`{"type": "netdev", "netdev": {"kind": "dummy", ` + tt.routing + ` "ipam": {"ranges": ["data"]}}}`)
+			if _, err := d.prepareClaim(context.Background(), rc); err != nil {
+				t.Fatalf("prepareClaim: %v", err)
+			}
+			if got := fh.lastRequest.Config.Netdev.Gateways; !slices.Equal(got, tt.want) {
+				t.Errorf("gateways = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareClaim_IPAMReleasedOnFailure(t *testing.T) {
+	fh := &fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"dummy"}, prepareErr: fmt.Errorf("boom")}
+	d := newIPAMDriver(t, fh)
+	rc := ipamClaim(`{"type": "netdev", "netdev": {"kind": "dummy", "ipam": {"ranges": ["data"]}}}`)
+
+	if _, err := d.prepareClaim(context.Background(), rc); err == nil {
+		t.Fatal("expected prepare failure")
+	}
+	d.IPAM.Restore("other", []ipam.Lease{{Range: "data", Address: "10.10.0.2/24"}})
+	if lease, _ := d.IPAM.Allocate("other", "data"); lease.Address != "10.10.0.2/24" {
+		t.Errorf("address still held after failed prepare: other got %s", lease.Address)
+	}
+}
+
+func TestPrepareClaim_IPAMValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges string
+		noIPAM bool
+	}{
+		{"empty", `[]`, false},
+		{"unknown range", `["nope"]`, false},
+		{"duplicate", `["data", "data"]`, false},
+		{"not configured", `["data"]`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fh := &fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"dummy"}}
+			d := newIPAMDriver(t, fh)
+			if tt.noIPAM {
+				d.IPAM = nil
+			}
+			rc := ipamClaim(`{"type": "netdev", "netdev": {"kind": "dummy", "ipam": {"ranges": ` + tt.ranges + `}}}`)
+			if _, err := d.prepareClaim(context.Background(), rc); err == nil {
+				t.Error("expected validation error")
+			}
+			if fh.prepareCalled != 0 {
+				t.Error("handler Prepare called for an invalid claim")
+			}
+		})
+	}
+}
+
+func TestPrepareClaim_IPAMDHCP(t *testing.T) {
+	dhcpClaim := func(kind, ipam string) *resourceapi.ResourceClaim {
+		rc := ipamClaim(`{"type": "netdev", "netdev": {"kind": "` + kind + `", "ipam": ` + ipam + `}}`)
+		rc.Status.Allocation.Devices.Results[0].Device = "netdev-virtual-" + kind
+		return rc
+	}
+	fh := &fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"macvlan", "dummy"}}
+	d := newIPAMDriver(t, fh)
+	// The handler runs the DHCP client; the driver needs no IPAM ranges.
+	d.IPAM = nil
+	if _, err := d.prepareClaim(context.Background(), dhcpClaim("macvlan", `{"mode": "dhcp", "dhcp": {"ipv6": true}}`)); err != nil {
+		t.Fatalf("prepareClaim: %v", err)
+	}
+	if cfg := fh.lastRequest.Config.Netdev; len(cfg.Addresses) != 0 || cfg.IPAM.DHCP == nil || !cfg.IPAM.DHCP.IPv6 {
+		t.Errorf("handler got addresses %v, ipam %+v", cfg.Addresses, cfg.IPAM)
+	}
+
+	tests := []struct {
+		name, kind, ipam string
+	}{
+		{"unsupported kind", "dummy", `{"mode": "dhcp"}`},
+		{"ranges in dhcp mode", "macvlan", `{"mode": "dhcp", "ranges": ["data"]}`},
+		{"dhcp in host-local mode", "macvlan", `{"ranges": ["data"], "dhcp": {}}`},
+		{"unknown mode", "macvlan", `{"mode": "slaac"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fh := &fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"macvlan", "dummy"}}
+			d := newIPAMDriver(t, fh)
+			if _, err := d.prepareClaim(context.Background(), dhcpClaim(tt.kind, tt.ipam)); err == nil {
+				t.Error("expected validation error")
+			}
+			if fh.prepareCalled != 0 {
+				t.Error("handler Prepare called for an invalid claim")
+			}
+		})
+	}
+}
+
+func TestPrepareClaim_MACPolicy(t *testing.T) {
+	newMACDriver := func(t *testing.T, fh *fakeHandler) *Driver {
+		d := newIPAMDriver(t, fh)
+		pool, err := macpool.Parse("02:00:5e:77:00:00-02:00:5e:77:00:01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.MACs = pool
+		return d
+	}
+	macClaim := func(netdev string) *resourceapi.ResourceClaim {
+		return ipamClaim(`{"type": "netdev", "netdev": {"kind": "dummy", ` + netdev + `}}`)
+	}
+
+	t.Run("stable", func(t *testing.T) {
+		fh := &fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"dummy"}}
+		d := newMACDriver(t, fh)
+		result, err := d.prepareClaim(context.Background(), macClaim(`"macPolicy": "stable"`))
+		if err != nil {
+			t.Fatalf("prepareClaim: %v", err)
+		}
+		want := macpool.Stable("default", "net").String()
+		if got := fh.lastRequest.Config.Netdev.MAC; got != want {
+			t.Errorf("handler got MAC %q, want %s", got, want)
+		}
+		if md := result.Allocation.Metadata; md[macKey] != want || md[macPolicyKey] != MACPolicyStable {
+			t.Errorf("metadata = %v", md)
+		}
+	})
+
+	t.Run("pool", func(t *testing.T) {
+		fh := &fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"dummy"}}
+		d := newMACDriver(t, fh)
+		// A claim prepared earlier holds the first MAC.
+		d.allocations["other"] = &handler.AllocationInfo{ClaimUID: "other", Metadata: map[string]string{
+			macKey: "02:00:5e:77:00:00", macPolicyKey: MACPolicyPool,
+		}}
+		d.restoreMAC(d.allocations["other"])
+
+		result, err := d.prepareClaim(context.Background(), macClaim(`"macPolicy": "pool"`))
+		if err != nil {
+			t.Fatalf("prepareClaim: %v", err)
+		}
+		if got := fh.lastRequest.Config.Netdev.MAC; got != "02:00:5e:77:00:01" {
+			t.Errorf("handler got MAC %q", got)
+		}
+		if md := result.Allocation.Metadata; md[macPolicyKey] != MACPolicyPool {
+			t.Errorf("metadata = %v", md)
+		}
+		if _, err := d.MACs.Allocate("third", func(net.HardwareAddr) bool { return false }); err == nil {
+			t.Error("expected the pool to be exhausted")
+		}
+
+		d.releaseMAC(result.Allocation)
+		if mac, err := d.MACs.Allocate("third", func(net.HardwareAddr) bool { return false }); err != nil || mac.String() != "02:00:5e:77:00:01" {
+			t.Errorf("after release third got %s, %v", mac, err)
+		}
+	})
+
+	t.Run("pool released on failure", func(t *testing.T) {
+		fh := &fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"dummy"}, prepareErr: fmt.Errorf("boom")}
+		d := newMACDriver(t, fh)
+		if _, err := d.prepareClaim(context.Background(), macClaim(`"macPolicy": "pool"`)); err == nil {
+			t.Fatal("expected prepare failure")
+		}
+		for _, uid := range []string{"a", "b"} {
+			if _, err := d.MACs.Allocate(uid, func(net.HardwareAddr) bool { return false }); err != nil {
+				t.Errorf("MAC still held after failed prepare: %v", err)
+			}
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		fh := &fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"dummy"}}
+		d := newMACDriver(t, fh)
+		d.allocations["other"] = &handler.AllocationInfo{ClaimUID: "other", Metadata: map[string]string{macKey: "02:00:c0:00:02:0a"}}
+		if _, err := d.prepareClaim(context.Background(), macClaim(`"mac": "02:00:C0:00:02:0A"`)); err == nil {
+			t.Error("expected error for a MAC held by another claim")
+		}
+	})
+
+	tests := []struct {
+		name   string
+		netdev string
+		noPool bool
+	}{
+		{"mac with stable", `"macPolicy": "stable", "mac": "02:00:c0:00:02:0a"`, false},
+		{"unknown policy", `"macPolicy": "random"`, false},
+		{"invalid static", `"mac": "02:00"`, false},
+		{"pool not configured", `"macPolicy": "pool"`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fh := &fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"dummy"}}
+			d := newMACDriver(t, fh)
+			if tt.noPool {
+				d.MACs = nil
+			}
+			if _, err := d.prepareClaim(context.Background(), macClaim(tt.netdev)); err == nil {
+				t.Error("expected validation error")
+			}
+			if fh.prepareCalled != 0 {
+				t.Error("handler Prepare called for an invalid claim")
+			}
+		})
+	}
+}
+
+func TestPublishNetworkData(t *testing.T) {
+	ctx := context.Background()
+	rc := ipamClaim(`{}`)
+	client := fake.NewClientset(rc)
+	d := &Driver{driverName: "dra.example.com", Client: client}
+
+	d.publishNetworkData(ctx, rc, &handler.AllocationInfo{Metadata: map[string]string{
+		"containerName": "net1",
+		"addresses":     "10.10.0.2/24,2001:db8::2/64",
+	}})
+
+	updated, err := client.ResourceV1().ResourceClaims("default").Get(ctx, "net", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updated.Status.Devices) != 1 {
+		t.Fatalf("device status = %+v, want one entry", updated.Status.Devices)
+	}
+	status := updated.Status.Devices[0]
+	if status.Device != "netdev-virtual-dummy" || status.NetworkData == nil {
+		t.Fatalf("status = %+v, want network data for netdev-virtual-dummy", status)
+	}
+	if status.NetworkData.InterfaceName != "net1" ||
+		!slices.Equal(status.NetworkData.IPs, []string{"10.10.0.2/24", "2001:db8::2/64"}) {
+		t.Errorf("network data = %+v", status.NetworkData)
+	}
+}
+
+// ─── IP pool tests ──────────────────────────────────────────────────────────
+
+func TestBuildIPPools(t *testing.T) {
+	resources, err := BuildIPPools(&ipam.PoolConfig{Pools: []ipam.Pool{
+		{Range: ipam.Range{Name: "flat", Subnet: "10.1.0.0/24", Gateway: "10.1.0.1"}},
+		{Range: ipam.Range{Name: "v6", Subnet: "2001:db8::/120"}, BlockSize: 124, NodeSelector: map[string]string{"rack": "a"}},
+	}})
+	if err != nil {
+		t.Fatalf("BuildIPPools: %v", err)
+	}
+
+	flat := resources.Pools[IPPoolPrefix+"flat"]
+	if flat.NodeSelector != nil {
+		t.Errorf("flat pool node selector = %+v, want all nodes", flat.NodeSelector)
+	}
+	// 253 addresses (.0, .1 and .255 are reserved) split into slices.
+	if len(flat.Slices) != 2 || len(flat.Slices[0].Devices)+len(flat.Slices[1].Devices) != 253 {
+		t.Fatalf("flat pool has %d slices", len(flat.Slices))
+	}
+	dev := flat.Slices[0].Devices[0]
+	if dev.Name != "ip-10-1-0-2" {
+		t.Errorf("first device = %s, want ip-10-1-0-2", dev.Name)
+	}
+	for attr, want := range map[resourceapi.QualifiedName]string{
+		"dra.example.com/type":    "ip",
+		"dra.example.com/pool":    "flat",
+		"dra.example.com/family":  "ipv4",
+		"dra.example.com/address": "10.1.0.2/24",
+		"dra.example.com/cidr":    "10.1.0.2/32",
+		"dra.example.com/gateway": "10.1.0.1",
+	} {
+		if got := dev.Attributes[attr].StringValue; got == nil || *got != want {
+			t.Errorf("%s = %v, want %s", attr, got, want)
+		}
+	}
+
+	v6 := resources.Pools[IPPoolPrefix+"v6"]
+	if v6.NodeSelector == nil || v6.NodeSelector.NodeSelectorTerms[0].MatchExpressions[0].Key != "rack" {
+		t.Errorf("v6 pool node selector = %+v, want rack=a", v6.NodeSelector)
+	}
+	if n := len(v6.Slices[0].Devices); n != 15 {
+		t.Errorf("v6 pool has %d /124 blocks, want 15", n)
+	}
+	if name := v6.Slices[0].Devices[0].Name; name != "ip-2001-0db8-0000-0000-0000-0000-0000-0010-124" {
+		t.Errorf("v6 device name = %s", name)
+	}
+
+	if _, err := BuildIPPools(&ipam.PoolConfig{Pools: []ipam.Pool{
+		{Range: ipam.Range{Name: "a", Subnet: "10.1.0.0/24"}},
+		{Range: ipam.Range{Name: "a", Subnet: "10.2.0.0/24"}},
+	}}); err == nil {
+		t.Error("expected error for a pool defined twice")
+	}
+}
+
+// ipPoolClaim returns a claim for an address from pool flat, with extra
+// netdev settings such as `"routing": {"table": 100}`.
+func ipPoolClaim(extra ...string) *resourceapi.ResourceClaim {
+	netdev := `"kind": "dummy"`
+	for _, e := range extra {
+		netdev += ", " + e
+	}
+	rc := ipamClaim(`{"type": "netdev", "netdev": {` + netdev + `}}`)
+	rc.Status.Allocation.Devices.Results = append(rc.Status.Allocation.Devices.Results,
+		resourceapi.DeviceRequestAllocationResult{Request: "ip", Driver: "dra.example.com", Pool: IPPoolPrefix + "flat", Device: "ip-10-1-0-7"})
+	return rc
+}
+
+func TestPrepareClaim_IPPool(t *testing.T) {
+	resources, err := BuildIPPools(&ipam.PoolConfig{Pools: []ipam.Pool{
+		{Range: ipam.Range{Name: "flat", Subnet: "10.1.0.0/24", Gateway: "10.1.0.1"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var objects []runtime.Object
+	for i, s := range resources.Pools[IPPoolPrefix+"flat"].Slices {
+		objects = append(objects, &resourceapi.ResourceSlice{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("flat-%d", i)},
+			Spec: resourceapi.ResourceSliceSpec{
+				Driver:   "dra.example.com",
+				Pool:     resourceapi.ResourcePool{Name: IPPoolPrefix + "flat", ResourceSliceCount: 2},
+				AllNodes: boolPtr(true),
+				Devices:  s.Devices,
+			},
+		})
+	}
+
+	fh := &fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"dummy"}}
+	reg := handler.NewHandlerRegistry()
+	reg.Register(fh)
+	d := &Driver{
+		driverName:  "dra.example.com",
+		registry:    reg,
+		allocations: make(map[string]*handler.AllocationInfo),
+		Client:      fake.NewClientset(objects...),
+	}
+
+	rc := ipPoolClaim()
+	if _, err := d.prepareClaim(context.Background(), rc); err != nil {
+		t.Fatalf("prepareClaim: %v", err)
+	}
+	req := fh.lastRequest
+	// The pod's primary interface keeps the default route.
+	if !slices.Equal(req.Config.Netdev.Addresses, []string{"10.1.0.7/24"}) || len(req.Config.Netdev.Gateways) != 0 {
+		t.Errorf("config = %+v, want 10.1.0.7/24 without a gateway", req.Config.Netdev)
+	}
+	// The handler only sees devices on this node.
+	if req.AllocatedDevice != "netdev-virtual-dummy" || !slices.Equal(req.AllocatedDevices, []string{"netdev-virtual-dummy"}) {
+		t.Errorf("allocated device %s %v, want netdev-virtual-dummy only", req.AllocatedDevice, req.AllocatedDevices)
+	}
+
+	if _, err := d.prepareClaim(context.Background(), ipPoolClaim(`"routing": {"defaultRoute": true}`)); err != nil {
+		t.Fatalf("prepareClaim: %v", err)
+	}
+	if gws := fh.lastRequest.Config.Netdev.Gateways; !slices.Equal(gws, []string{"10.1.0.1"}) {
+		t.Errorf("gateways with routing.defaultRoute = %v, want the pool's", gws)
+	}
+
+	// An address that is no longer published fails the prepare.
+	rc = ipPoolClaim()
+	rc.Status.Allocation.Devices.Results[1].Device = "ip-10-9-0-1"
+	if _, err := d.prepareClaim(context.Background(), rc); err == nil {
+		t.Error("expected error for an unpublished address")
+	}
+	d.Client = nil
+	if _, err := d.prepareClaim(context.Background(), ipPoolClaim()); err == nil {
+		t.Error("expected error without an API client")
+	}
+}
+
+// ─── Segment pool tests ─────────────────────────────────────────────────────
+
+func TestBuildSegmentPools(t *testing.T) {
+	resources := resourceslice.DriverResources{}
+	err := BuildSegmentPools(&resources, &SegmentPoolConfig{Pools: []SegmentPool{
+		{Name: "tenant-a", Type: "vlan", Start: 100, End: 109, Exclude: []int{105}, Purpose: "storage", Tenant: "a"},
+		{Name: "overlay", Type: "vni", Start: 5000, End: 5199, NodeSelector: map[string]string{"zone": "z1"}},
+	}})
+	if err != nil {
+		t.Fatalf("BuildSegmentPools: %v", err)
+	}
+
+	vlans := resources.Pools[SegmentPoolPrefix+"tenant-a"]
+	if len(vlans.Slices) != 1 || len(vlans.Slices[0].Devices) != 9 {
+		t.Fatalf("vlan pool = %+v, want 9 devices in one slice", vlans.Slices)
+	}
+	dev := vlans.Slices[0].Devices[0]
+	if dev.Name != "vlan-100" || *dev.Attributes["dra.example.com/id"].IntValue != 100 {
+		t.Errorf("first device = %s, want vlan-100", dev.Name)
+	}
+	for attr, want := range map[resourceapi.QualifiedName]string{
+		"dra.example.com/type":        "segment",
+		"dra.example.com/segmentType": "vlan",
+		"dra.example.com/pool":        "tenant-a",
+		"dra.example.com/range":       "100-109",
+		"dra.example.com/purpose":     "storage",
+		"dra.example.com/tenant":      "a",
+	} {
+		if got := dev.Attributes[attr].StringValue; got == nil || *got != want {
+			t.Errorf("%s = %v, want %s", attr, got, want)
+		}
+	}
+	for _, d := range vlans.Slices[0].Devices {
+		if d.Name == "vlan-105" {
+			t.Error("excluded VLAN 105 published")
+		}
+	}
+
+	vnis := resources.Pools[SegmentPoolPrefix+"overlay"]
+	if len(vnis.Slices) != 2 || vnis.NodeSelector == nil {
+		t.Errorf("vni pool has %d slices, selector %+v; want 2 slices and zone=z1", len(vnis.Slices), vnis.NodeSelector)
+	}
+
+	for _, p := range []SegmentPool{
+		{Name: "bad-type", Type: "vrf", Start: 1, End: 2},
+		{Name: "vlan-range", Type: "vlan", Start: 4000, End: 4095},
+		{Name: "empty", Type: "vni", Start: 10, End: 9},
+		{Name: "huge", Type: "vni", Start: 1, End: 1 << 20},
+		{Type: "vlan", Start: 1, End: 2},
+	} {
+		if err := BuildSegmentPools(&resourceslice.DriverResources{}, &SegmentPoolConfig{Pools: []SegmentPool{p}}); err == nil {
+			t.Errorf("expected error for pool %+v", p)
+		}
+	}
+}
+
+func TestSegmentIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		device  string
+		netdev  string
+		check   func(*handler.NetdevConfig) bool
+		wantErr bool
+	}{
+		{"vlan", "vlan-100", `{"kind": "vlan", "parent": "eth0"}`,
+			func(c *handler.NetdevConfig) bool { return c.VLAN.ID == 100 }, false},
+		{"vlan matching config", "vlan-100", `{"kind": "vlan", "vlan": {"id": 100, "protocol": "802.1ad"}}`,
+			func(c *handler.NetdevConfig) bool { return c.VLAN.ID == 100 && c.VLAN.Protocol == "802.1ad" }, false},
+		{"vlan conflicting config", "vlan-100", `{"kind": "vlan", "vlan": {"id": 200}}`, nil, true},
+		{"vf", "vlan-300", `{"kind": "sriov-vf", "vf": {"qos": 3}}`,
+			func(c *handler.NetdevConfig) bool { return *c.VF.VLAN == 300 && c.VF.QoS == 3 }, false},
+		{"veth ovs", "vlan-10", `{"kind": "veth", "ovs": {"bridge": "br-int"}}`,
+			func(c *handler.NetdevConfig) bool { return c.OVS.Tag == 10 }, false},
+		{"veth bridge", "vlan-10", `{"kind": "veth", "bridge": {"name": "br0"}}`,
+			func(c *handler.NetdevConfig) bool { return c.Bridge.PVID == 10 }, false},
+		{"plain veth", "vlan-10", `{"kind": "veth"}`, nil, true},
+		{"vxlan", "vni-5001", `{"kind": "vxlan", "tunnel": {"remote": "192.0.2.1"}}`,
+			func(c *handler.NetdevConfig) bool { return c.Tunnel.VNI == 5001 && c.Tunnel.Remote == "192.0.2.1" }, false},
+		{"geneve", "vni-7", `{"kind": "geneve"}`,
+			func(c *handler.NetdevConfig) bool { return c.Tunnel.VNI == 7 }, false},
+		{"vni on vlan", "vni-7", `{"kind": "vlan"}`, nil, true},
+		{"bad name", "vlan-x", `{"kind": "vlan"}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Driver{driverName: "dra.example.com"}
+			rc := ipamClaim(`{"type": "netdev", "netdev": ` + tt.netdev + `}`)
+			rc.Status.Allocation.Devices.Results = append(rc.Status.Allocation.Devices.Results,
+				resourceapi.DeviceRequestAllocationResult{Request: "seg", Driver: "dra.example.com", Pool: SegmentPoolPrefix + "p", Device: tt.device})
+			config := d.parseConfig(rc)
+
+			err := d.segmentIDs(rc, config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("segmentIDs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.check != nil && !tt.check(config.Netdev) {
+				t.Errorf("config = %+v", config.Netdev)
+			}
+		})
+	}
+}
+
+func TestGetAllocationResult_SkipsClusterPools(t *testing.T) {
+	d := &Driver{driverName: "dra.example.com"}
+	rc := ipamClaim(`{}`)
+	results := []resourceapi.DeviceRequestAllocationResult{
+		{Request: "ip", Driver: "dra.example.com", Pool: IPPoolPrefix + "flat", Device: "ip-10-1-0-7"},
+		{Request: "seg", Driver: "dra.example.com", Pool: SegmentPoolPrefix + "tenant-a", Device: "vlan-100"},
+	}
+	rc.Status.Allocation.Devices.Results = append(results, rc.Status.Allocation.Devices.Results...)
+
+	if result := d.getAllocationResult(rc); result == nil || result.Device != "netdev-virtual-dummy" {
+		t.Errorf("getAllocationResult = %+v, want netdev-virtual-dummy", result)
+	}
+	if devices := d.allocatedDevices(rc); !slices.Equal(devices, []string{"netdev-virtual-dummy"}) {
+		t.Errorf("allocatedDevices = %v, want [netdev-virtual-dummy]", devices)
+	}
+}
+
+func TestPrepareClaim_Sysctls(t *testing.T) {
+	sysctlClaim := func(sysctls string) *resourceapi.ResourceClaim {
+		return ipamClaim(`{"type": "netdev", "netdev": {"kind": "dummy", "sysctls": ` + sysctls + `}}`)
+	}
+	tests := []struct {
+		name    string
+		allowed []string
+		sysctls string
+		wantErr bool
+	}{
+		{"allowed", DefaultSysctls, `{"ipv4.rp_filter": "0", "ipv6.accept_ra": "0"}`, false},
+		{"not on the allow-list", DefaultSysctls, `{"ipv4.rp_filter": "0", "ipv4.forwarding": "1"}`, true},
+		{"no allow-list", nil, `{"ipv4.rp_filter": "0"}`, true},
+		{"none", nil, `{}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fh := &fakeHandler{deviceType: handler.DeviceTypeNetdev, kinds: []string{"dummy"}}
+			d := newIPAMDriver(t, fh)
+			d.Sysctls = tt.allowed
+			_, err := d.prepareClaim(context.Background(), sysctlClaim(tt.sysctls))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("prepareClaim() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && fh.lastRequest != nil {
+				t.Error("handler called for a rejected claim")
+			}
+		})
+	}
+}
+
+func TestPrepareClaim_ComboSysctls(t *testing.T) {
+	fh := &fakeHandler{deviceType: handler.DeviceTypeCombo, kinds: []string{"roce"}}
+	d := newIPAMDriver(t, fh)
+	d.Sysctls = DefaultSysctls
+	rc := ipamClaim(`{"type": "combo", "combo": {"netdev": {"sysctls": {"ipv4.forwarding": "1"}}}}`)
+
+	if _, err := d.prepareClaim(context.Background(), rc); err == nil {
+		t.Fatal("prepareClaim() accepted a roce claim with a sysctl outside the allow-list")
+	}
+	if fh.lastRequest != nil {
+		t.Error("handler called for a rejected claim")
+	}
+}
@@ -0,0 +1,202 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/dynamic-resource-allocation/resourceslice"
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/ipam"
+)
+
+// IPPoolPrefix prefixes the names of the cluster-scoped pools published by
+// the controller, which keeps them apart from the per-node pools.
+const IPPoolPrefix = "ippool-"
+
+// BuildIPPools returns the ResourceSlices publishing every address or block
+// of the configured pools as a device.  The pools are not node-local, so
+// the scheduler allocates each device to one claim cluster-wide.
+func BuildIPPools(cfg *ipam.PoolConfig) (resourceslice.DriverResources, error) {
+	resources := resourceslice.DriverResources{Pools: make(map[string]resourceslice.Pool)}
+	for _, p := range cfg.Pools {
+		if p.Name == "" {
+			return resources, fmt.Errorf("IP pool for %s has no name", p.Subnet)
+		}
+		name := IPPoolPrefix + p.Name
+		if _, ok := resources.Pools[name]; ok {
+			return resources, fmt.Errorf("IP pool %s defined twice", p.Name)
+		}
+		blocks, err := p.Blocks()
+		if err != nil {
+			return resources, fmt.Errorf("IP pool %s: %w", p.Name, err)
+		}
+
+		devices := make([]resourceapi.Device, 0, len(blocks))
+		for _, b := range blocks {
+			devices = append(devices, ipDevice(p.Name, b))
+		}
+		slices := buildSlices(devices, nil)
+		if len(slices) == 0 {
+			// Publish the pool even when every address is reserved.
+			slices = []resourceslice.Slice{{}}
+		}
+		resources.Pools[name] = resourceslice.Pool{
+			NodeSelector: nodeSelector(p.NodeSelector),
+			Slices:       slices,
+		}
+		klog.Infof("IP pool %s: %d devices in %d slices", p.Name, len(devices), len(slices))
+	}
+	return resources, nil
+}
+
+// ipDevice builds the device for one address or block of a pool.
+func ipDevice(pool string, b ipam.Block) resourceapi.Device {
+	family := "ipv4"
+	if b.Prefix.Addr().Is6() {
+		family = "ipv6"
+	}
+	device := resourceapi.Device{
+		Name: ipDeviceName(b),
+		Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+			"dra.example.com/type": {
+				StringValue: stringPtr("ip"),
+			},
+			"dra.example.com/pool": {
+				StringValue: stringPtr(pool),
+			},
+			"dra.example.com/family": {
+				StringValue: stringPtr(family),
+			},
+			"dra.example.com/address": {
+				StringValue: stringPtr(b.Address),
+			},
+			"dra.example.com/cidr": {
+				StringValue: stringPtr(b.Prefix.String()),
+			},
+		},
+	}
+	if b.Gateway != "" {
+		device.Attributes["dra.example.com/gateway"] = resourceapi.DeviceAttribute{StringValue: stringPtr(b.Gateway)}
+	}
+	return device
+}
+
+// ipDeviceName turns a block into a DNS label: ip-10-0-0-5 for an address,
+// ip-10-0-0-8-30 for a block.  IPv6 addresses are written out in full, so
+// the name never ends in a dash.
+func ipDeviceName(b ipam.Block) string {
+	addr := b.Prefix.Addr()
+	s := addr.String()
+	if addr.Is6() {
+		s = addr.StringExpanded()
+	}
+	name := "ip-" + strings.NewReplacer(".", "-", ":", "-").Replace(s)
+	if b.Prefix.Bits() != addr.BitLen() {
+		name += fmt.Sprintf("-%d", b.Prefix.Bits())
+	}
+	return name
+}
+
+// nodeSelector requires every label in labels.  Nil labels select all nodes.
+func nodeSelector(labels map[string]string) *corev1.NodeSelector {
+	if len(labels) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var exprs []corev1.NodeSelectorRequirement
+	for _, key := range keys {
+		exprs = append(exprs, corev1.NodeSelectorRequirement{
+			Key:      key,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   []string{labels[key]},
+		})
+	}
+	return &corev1.NodeSelector{
+		NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: exprs}},
+	}
+}
+
+// isIPPoolResult reports whether result is an address from a cluster pool
+// rather than a device on this node.
+func isIPPoolResult(result *resourceapi.DeviceRequestAllocationResult) bool {
+	return strings.HasPrefix(result.Pool, IPPoolPrefix)
+}
+
+// poolAddresses adds the addresses the scheduler allocated to the claim from
+// cluster pools, and their gateways, to its netdev config.  The addresses
+// belong to the claim for as long as it is allocated, so nothing is released
+// on Unprepare.
+func (d *Driver) poolAddresses(ctx context.Context, rc *resourceapi.ResourceClaim, config *handler.DeviceConfig) error {
+	if rc == nil || rc.Status.Allocation == nil {
+		return nil
+	}
+	var results []resourceapi.DeviceRequestAllocationResult
+	for _, result := range rc.Status.Allocation.Devices.Results {
+		if result.Driver == d.driverName && isIPPoolResult(&result) {
+			results = append(results, result)
+		}
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	if config.Type != handler.DeviceTypeNetdev || config.Netdev == nil {
+		return fmt.Errorf("IP pool addresses need a netdev config, got type %s", config.Type)
+	}
+	if d.Client == nil {
+		return fmt.Errorf("claim was allocated IP pool addresses but the driver has no API client to look them up")
+	}
+
+	slices, err := d.Client.ResourceV1().ResourceSlices().List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector(resourceapi.ResourceSliceSelectorDriver, d.driverName).String(),
+	})
+	if err != nil {
+		return fmt.Errorf("list ResourceSlices: %w", err)
+	}
+	cfg := config.Netdev
+	for _, result := range results {
+		device := findDevice(slices.Items, result.Pool, result.Device)
+		if device == nil {
+			return fmt.Errorf("allocated IP pool device %s/%s is not published", result.Pool, result.Device)
+		}
+		address := device.Attributes["dra.example.com/address"].StringValue
+		if address == nil {
+			return fmt.Errorf("IP pool device %s/%s has no address", result.Pool, result.Device)
+		}
+		cfg.Addresses = append(cfg.Addresses, *address)
+		if gw := device.Attributes["dra.example.com/gateway"].StringValue; gw != nil {
+			addRangeGateway(cfg, *gw)
+		}
+		klog.V(2).Infof("Claim %s got %s from IP pool %s", rc.UID, *address, result.Pool)
+	}
+	return nil
+}
+
+// findDevice returns the device named name in the newest generation of pool.
+func findDevice(slices []resourceapi.ResourceSlice, pool, name string) *resourceapi.Device {
+	var found *resourceapi.Device
+	var generation int64
+	for i := range slices {
+		slice := &slices[i]
+		if slice.Spec.Pool.Name != pool || (found != nil && slice.Spec.Pool.Generation < generation) {
+			continue
+		}
+		for j := range slice.Spec.Devices {
+			if slice.Spec.Devices[j].Name == name {
+				found, generation = &slice.Spec.Devices[j], slice.Spec.Pool.Generation
+			}
+		}
+	}
+	return found
+}
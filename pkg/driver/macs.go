@@ -0,0 +1,180 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/macpool"
+)
+
+// Allocation metadata keys recording the MAC a claim was given and how.
+const (
+	macKey       = "mac"
+	macPolicyKey = "macPolicy"
+)
+
+// MAC policies.
+const (
+	MACPolicyStatic = "static" // netdev.mac as given (default)
+	MACPolicyStable = "stable" // Derived from the claim's namespace and name
+	MACPolicyPool   = "pool"   // Leased from the driver's MAC pool
+)
+
+// netnsDir holds the named network namespaces, including the pod sandboxes
+// of containerd and CRI-O.
+const netnsDir = "/var/run/netns"
+
+// validateMACPolicy checks the claim's MAC policy.
+func (d *Driver) validateMACPolicy(config *handler.DeviceConfig) error {
+	cfg := netdevConfig(config)
+	if cfg == nil {
+		return nil
+	}
+	switch cfg.MACPolicy {
+	case "", MACPolicyStatic:
+		if cfg.MAC == "" {
+			return nil
+		}
+		if _, err := net.ParseMAC(cfg.MAC); err != nil {
+			return fmt.Errorf("invalid MAC %q: %w", cfg.MAC, err)
+		}
+	case MACPolicyStable, MACPolicyPool:
+		if cfg.MAC != "" {
+			return fmt.Errorf("mac cannot be set with macPolicy %s", cfg.MACPolicy)
+		}
+		if cfg.MACPolicy == MACPolicyPool && d.MACs == nil {
+			return fmt.Errorf("claim requests a pool MAC but the driver has no MAC pool")
+		}
+	default:
+		return fmt.Errorf("unsupported macPolicy %q (use static, stable or pool)", cfg.MACPolicy)
+	}
+	return nil
+}
+
+// assignMAC resolves the claim's MAC policy into netdev.mac, which the
+// handler then applies like a static MAC.  It reports whether a MAC was
+// leased from the pool.  Whatever the policy, the MAC must not belong to
+// another claim prepared on this node.
+func (d *Driver) assignMAC(rc *resourceapi.ResourceClaim, config *handler.DeviceConfig) (bool, error) {
+	cfg := netdevConfig(config)
+	if cfg == nil {
+		return false, nil
+	}
+	claimUID := string(rc.UID)
+	leased := false
+	switch cfg.MACPolicy {
+	case MACPolicyStable:
+		cfg.MAC = macpool.Stable(rc.Namespace, rc.Name).String()
+	case MACPolicyPool:
+		used := linkMACs()
+		for uid, alloc := range d.allocations {
+			if mac := alloc.Metadata[macKey]; mac != "" && uid != claimUID {
+				used[mac] = true
+			}
+		}
+		mac, err := d.MACs.Allocate(claimUID, func(mac net.HardwareAddr) bool { return used[mac.String()] })
+		if err != nil {
+			return false, err
+		}
+		cfg.MAC, leased = mac.String(), true
+	}
+	if cfg.MAC == "" {
+		return false, nil
+	}
+
+	// Compare in canonical form.
+	mac, _ := net.ParseMAC(cfg.MAC)
+	cfg.MAC = mac.String()
+	for uid, alloc := range d.allocations {
+		if uid != claimUID && alloc.Metadata[macKey] == cfg.MAC {
+			return leased, fmt.Errorf("MAC %s is already used by claim %s on this node", cfg.MAC, uid)
+		}
+	}
+	return leased, nil
+}
+
+// recordMAC stores the claim's MAC and policy in the allocation's metadata.
+func recordMAC(alloc *handler.AllocationInfo, config *handler.DeviceConfig) {
+	cfg := netdevConfig(config)
+	if cfg == nil || cfg.MAC == "" {
+		return
+	}
+	if alloc.Metadata == nil {
+		alloc.Metadata = make(map[string]string)
+	}
+	alloc.Metadata[macKey] = cfg.MAC
+	policy := cfg.MACPolicy
+	if policy == "" {
+		policy = MACPolicyStatic
+	}
+	alloc.Metadata[macPolicyKey] = policy
+}
+
+// restoreMAC re-leases the pool MAC recorded in a persisted allocation.
+func (d *Driver) restoreMAC(alloc *handler.AllocationInfo) {
+	if alloc.Metadata[macPolicyKey] != MACPolicyPool {
+		return
+	}
+	if d.MACs == nil {
+		klog.Warningf("Claim %s holds a pool MAC but the driver has no MAC pool", alloc.ClaimUID)
+		return
+	}
+	mac, err := net.ParseMAC(alloc.Metadata[macKey])
+	if err != nil {
+		klog.Warningf("Failed to decode MAC of claim %s: %v", alloc.ClaimUID, err)
+		return
+	}
+	d.MACs.Restore(alloc.ClaimUID, mac)
+}
+
+// releaseMAC returns the pool MAC of an allocation's claim.
+func (d *Driver) releaseMAC(alloc *handler.AllocationInfo) {
+	if d.MACs != nil && alloc.Metadata[macPolicyKey] == MACPolicyPool {
+		d.MACs.Release(alloc.ClaimUID)
+	}
+}
+
+// linkMACs returns the MACs of the links in the host netns and in every
+// named netns, which covers the pod sandboxes.  Namespaces that cannot be
+// read are skipped.
+func linkMACs() map[string]bool {
+	used := make(map[string]bool)
+	add := func(links []netlink.Link) {
+		for _, link := range links {
+			if mac := link.Attrs().HardwareAddr; len(mac) == 6 {
+				used[mac.String()] = true
+			}
+		}
+	}
+	if links, err := netlink.LinkList(); err == nil {
+		add(links)
+	} else {
+		klog.Warningf("Failed to list host links for MAC duplicate detection: %v", err)
+	}
+	paths, _ := filepath.Glob(filepath.Join(netnsDir, "*"))
+	for _, path := range paths {
+		ns, err := netns.GetFromPath(path)
+		if err != nil {
+			continue
+		}
+		nl, err := netlink.NewHandleAt(ns)
+		ns.Close()
+		if err != nil {
+			continue
+		}
+		if links, err := nl.LinkList(); err == nil {
+			add(links)
+		} else {
+			klog.V(2).Infof("Failed to list links in %s: %v", path, err)
+		}
+		nl.Close()
+	}
+	return used
+}
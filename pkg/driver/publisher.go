@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -12,41 +13,92 @@ import (
 	"k8s.io/dynamic-resource-allocation/resourceslice"
 	"k8s.io/klog/v2"
 
+	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/handler/netdev"
 	"github.com/example/dra-poc/pkg/handler/rdma"
 )
 
 // DiscoverResources discovers all devices on this node and returns them as
 // a DriverResources structure suitable for kubeletplugin.Helper.PublishResources.
 // The helper takes care of creating/updating/deleting ResourceSlices.
-func DiscoverResources(driverName, nodeName string) resourceslice.DriverResources {
+//
+// virtualSlots maps each virtual netdev kind to the number of concurrent
+// allocations its device allows.  sriov controls how SR-IOV VFs are
+// published.
+func DiscoverResources(driverName, nodeName string, virtualSlots map[string]int, sriov SriovOptions) resourceslice.DriverResources {
 	var allDevices []resourceapi.Device
 
 	netDevices := discoverNetworkDevices()
 	allDevices = append(allDevices, netDevices...)
 
+	sriovDevices, counterSets := discoverSriovDevices(sriov)
+	allDevices = append(allDevices, sriovDevices...)
+
 	rdmaDevices := discoverRDMADevices()
 	allDevices = append(allDevices, rdmaDevices...)
 
-	virtualDevices := discoverVirtualPools()
+	virtualDevices := discoverVirtualPools(virtualSlots)
 	allDevices = append(allDevices, virtualDevices...)
 
-	klog.Infof("Discovered %d devices (net=%d, rdma=%d, virtual=%d)",
-		len(allDevices), len(netDevices), len(rdmaDevices), len(virtualDevices))
+	klog.Infof("Discovered %d devices (net=%d, sriov=%d, rdma=%d, virtual=%d) and %d PF counter sets",
+		len(allDevices), len(netDevices), len(sriovDevices), len(rdmaDevices), len(virtualDevices), len(counterSets))
 
 	// One pool per node. The pool name must be non-empty; we use the node
 	// name so every node publishes into its own pool.
 	return resourceslice.DriverResources{
 		Pools: map[string]resourceslice.Pool{
 			nodeName: {
-				Slices: []resourceslice.Slice{{
-					Devices: allDevices,
-				}},
+				Slices: buildSlices(allDevices, counterSets),
 			},
 		},
 	}
 }
 
-// discoverNetworkDevices discovers physical/SR-IOV network interfaces
+// buildSlices splits the pool into ResourceSlices.  A slice carries either
+// devices or shared counters, never both, and devices that consume counters
+// are subject to a lower per-slice limit than the others.
+func buildSlices(devices []resourceapi.Device, counterSets []resourceapi.CounterSet) []resourceslice.Slice {
+	var plain, consuming []resourceapi.Device
+	for _, device := range devices {
+		if len(device.ConsumesCounters) > 0 {
+			consuming = append(consuming, device)
+		} else {
+			plain = append(plain, device)
+		}
+	}
+
+	var slices []resourceslice.Slice
+	for _, chunk := range chunk(plain, resourceapi.ResourceSliceMaxDevices) {
+		slices = append(slices, resourceslice.Slice{Devices: chunk})
+	}
+	for _, chunk := range chunk(consuming, resourceapi.ResourceSliceMaxDevicesWithTaintsOrConsumesCounters) {
+		slices = append(slices, resourceslice.Slice{Devices: chunk})
+	}
+	for _, chunk := range chunk(counterSets, resourceapi.ResourceSliceMaxCounterSets) {
+		slices = append(slices, resourceslice.Slice{SharedCounters: chunk})
+	}
+
+	// Always publish at least one slice so the pool exists.
+	if len(slices) == 0 {
+		slices = append(slices, resourceslice.Slice{})
+	}
+	return slices
+}
+
+// chunk splits items into consecutive slices of at most size elements.
+func chunk[T any](items []T, size int) [][]T {
+	var chunks [][]T
+	for len(items) > size {
+		chunks = append(chunks, items[:size])
+		items = items[size:]
+	}
+	if len(items) > 0 {
+		chunks = append(chunks, items)
+	}
+	return chunks
+}
+
+// discoverNetworkDevices discovers physical network interfaces
 func discoverNetworkDevices() []resourceapi.Device {
 	var devices []resourceapi.Device
 
@@ -64,36 +116,8 @@ func discoverNetworkDevices() []resourceapi.Device {
 			continue
 		}
 
-		// Check for SR-IOV VFs
+		// SR-IOV VFs are published by discoverSriovDevices
 		if isVF(name) {
-			device := resourceapi.Device{
-				Name: name,
-				Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
-					"dra.example.com/type": {
-						StringValue: stringPtr("netdev"),
-					},
-					"dra.example.com/kind": {
-						StringValue: stringPtr("sriov-vf"),
-					},
-					"dra.example.com/parent": {
-						StringValue: stringPtr(getVFParent(name)),
-					},
-				},
-			}
-			// Try to read PCI address
-			if pciAddr := getPCIAddress(name); pciAddr != "" {
-				device.Attributes["dra.example.com/pci-address"] = resourceapi.DeviceAttribute{
-					StringValue: stringPtr(pciAddr),
-				}
-			}
-			// Try to read NUMA node
-			if numaNode := getNUMANode(name); numaNode >= 0 {
-				device.Attributes["dra.example.com/numa-node"] = resourceapi.DeviceAttribute{
-					IntValue: int64Ptr(int64(numaNode)),
-				}
-			}
-			devices = append(devices, device)
-			klog.V(2).Infof("Discovered SR-IOV VF: %s", name)
 			continue
 		}
 
@@ -177,93 +201,141 @@ func discoverRDMADevices() []resourceapi.Device {
 	return devices
 }
 
-// maxVirtualSlots is the total number of virtual netdev allocations allowed per node.
-// Virtual devices (dummy, veth, macvlan, ipvlan, host-device) are created on-demand,
-// so there is no hard physical limit.  We use DRAConsumableCapacity to advertise a
-// single device with a consumable "slots" capacity — each allocation consumes one slot.
-const maxVirtualSlots = 128
+// DefaultVirtualSlots is the number of concurrent allocations a virtual kind
+// allows per node unless overridden.  Virtual devices (dummy, veth, macvlan,
+// ipvlan, vlan, host-device) are created on-demand, so there is no hard physical
+// limit.  We use DRAConsumableCapacity to advertise one device per kind with
+// a consumable "slots" capacity — each allocation consumes one slot.
+const DefaultVirtualSlots = 128
+
+// VirtualDevicePrefix prefixes the per-kind virtual device names
+// (e.g. netdev-virtual-veth).
+const VirtualDevicePrefix = "netdev-virtual-"
 
 // discoverVirtualPools discovers parent interfaces suitable for virtual device pools
-func discoverVirtualPools() []resourceapi.Device {
+func discoverVirtualPools(virtualSlots map[string]int) []resourceapi.Device {
 	var devices []resourceapi.Device
 
-	// Single virtual device with consumable capacity (DRAConsumableCapacity feature gate).
-	// AllowMultipleAllocations lets the scheduler allocate this device to many claims;
-	// each allocation consumes 1 slot out of maxVirtualSlots.
+	// One virtual device per kind with consumable capacity (DRAConsumableCapacity
+	// feature gate).  AllowMultipleAllocations lets the scheduler allocate each
+	// device to many claims; each allocation consumes 1 of the kind's slots.
+	kinds := make([]string, 0, len(virtualSlots))
+	for kind := range virtualSlots {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		devices = append(devices, virtualKindDevice(kind, virtualSlots[kind]))
+	}
+
+	// Discover interfaces that can be parents for macvlan/ipvlan/vlan
+	netDir := "/sys/class/net"
+	entries, err := os.ReadDir(netDir)
+	if err != nil {
+		return devices
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "lo" {
+			continue
+		}
+
+		// Physical interfaces can serve as macvlan/ipvlan/vlan parents.  Each
+		// pool device can be allocated to many claims; when the link speed
+		// is known, each claim consumes part of the parent's bandwidth.
+		if isPhysicalInterface(name) {
+			speed := getLinkSpeed(name)
+			devices = append(devices,
+				parentPoolDevice(name, "macvlan", speed),
+				parentPoolDevice(name, "ipvlan", speed),
+				parentPoolDevice(name, "vlan", speed),
+			)
+
+			// Scalable functions need the PF's eswitch in switchdev mode.
+			if netdev.EswitchMode(name) == netdev.EswitchModeSwitchdev {
+				devices = append(devices, parentPoolDevice(name, "sf", speed))
+			}
+
+			klog.V(2).Infof("Discovered virtual pool parent: %s (speed=%dMb/s)", name, speed)
+		}
+	}
+
+	return devices
+}
+
+// virtualKindDevice builds the multi-allocatable device for an on-demand kind.
+func virtualKindDevice(kind string, slots int) resourceapi.Device {
 	defaultSlot := resource.MustParse("1")
-	devices = append(devices, resourceapi.Device{
-		Name:                     "netdev-virtual",
+	return resourceapi.Device{
+		Name:                     VirtualDevicePrefix + kind,
 		AllowMultipleAllocations: boolPtr(true),
 		Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
 			"dra.example.com/type": {
 				StringValue: stringPtr("netdev"),
 			},
 			"dra.example.com/kind": {
-				StringValue: stringPtr("virtual"),
+				StringValue: stringPtr(kind),
+			},
+			"dra.example.com/virtual": {
+				BoolValue: boolPtr(true),
 			},
 		},
 		Capacity: map[resourceapi.QualifiedName]resourceapi.DeviceCapacity{
 			"dra.example.com/slots": {
-				Value: resource.MustParse(fmt.Sprintf("%d", maxVirtualSlots)),
+				Value: *resource.NewQuantity(int64(slots), resource.DecimalSI),
 				RequestPolicy: &resourceapi.CapacityRequestPolicy{
 					Default: &defaultSlot,
 				},
 			},
 		},
-	})
-
-	// Discover interfaces that can be parents for macvlan/ipvlan
-	netDir := "/sys/class/net"
-	entries, err := os.ReadDir(netDir)
-	if err != nil {
-		return devices
 	}
+}
 
-	for _, entry := range entries {
-		name := entry.Name()
-		if name == "lo" {
-			continue
-		}
+// defaultBandwidthRequest is the bandwidth (bits/s) charged to a claim that
+// does not request any from a parent pool device.
+const defaultBandwidthRequest = 100_000_000
 
-		// Physical interfaces can serve as macvlan/ipvlan parents
-		if isPhysicalInterface(name) {
-			// Macvlan pool template
-			devices = append(devices, resourceapi.Device{
-				Name: fmt.Sprintf("%s-macvlan-pool", name),
-				Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
-					"dra.example.com/type": {
-						StringValue: stringPtr("netdev"),
-					},
-					"dra.example.com/kind": {
-						StringValue: stringPtr("macvlan"),
-					},
-					"dra.example.com/parent": {
-						StringValue: stringPtr(name),
-					},
-				},
-			})
-
-			// Ipvlan pool template
-			devices = append(devices, resourceapi.Device{
-				Name: fmt.Sprintf("%s-ipvlan-pool", name),
-				Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
-					"dra.example.com/type": {
-						StringValue: stringPtr("netdev"),
-					},
-					"dra.example.com/kind": {
-						StringValue: stringPtr("ipvlan"),
-					},
-					"dra.example.com/parent": {
-						StringValue: stringPtr(name),
-					},
-				},
-			})
+// parentPoolDevice builds the pool device for creating <kind> links off
+// parent.  speedMbps <= 0 means the link speed is unknown, in which case no
+// bandwidth capacity is published.
+func parentPoolDevice(parent, kind string, speedMbps int64) resourceapi.Device {
+	device := resourceapi.Device{
+		Name:                     fmt.Sprintf("%s-%s-pool", parent, kind),
+		AllowMultipleAllocations: boolPtr(true),
+		Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+			"dra.example.com/type": {
+				StringValue: stringPtr("netdev"),
+			},
+			"dra.example.com/kind": {
+				StringValue: stringPtr(kind),
+			},
+			"dra.example.com/parent": {
+				StringValue: stringPtr(parent),
+			},
+		},
+	}
 
-			klog.V(2).Infof("Discovered virtual pool parent: %s", name)
-		}
+	if speedMbps <= 0 {
+		return device
 	}
 
-	return devices
+	total := speedMbps * 1_000_000
+	def := resource.NewQuantity(min(defaultBandwidthRequest, total), resource.DecimalSI)
+	step := resource.MustParse("1M")
+	device.Capacity = map[resourceapi.QualifiedName]resourceapi.DeviceCapacity{
+		handler.CapacityBandwidth: {
+			Value: *resource.NewQuantity(total, resource.DecimalSI),
+			RequestPolicy: &resourceapi.CapacityRequestPolicy{
+				Default: def,
+				ValidRange: &resourceapi.CapacityRequestPolicyRange{
+					Min:  &step,
+					Step: &step,
+				},
+			},
+		},
+	}
+	return device
 }
 
 // --- Helper functions ---
@@ -326,6 +398,20 @@ func getNUMANode(name string) int {
 	return node
 }
 
+// getLinkSpeed returns the negotiated link speed in Mb/s, or -1 if unknown
+// (link down, or a virtual interface that does not report one).
+func getLinkSpeed(name string) int64 {
+	data, err := os.ReadFile(filepath.Join("/sys/class/net", name, "speed"))
+	if err != nil {
+		return -1
+	}
+	speed, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || speed <= 0 {
+		return -1
+	}
+	return speed
+}
+
 // isAllocatableInterface determines if a network interface can be allocated
 func isAllocatableInterface(name string) bool {
 	patterns := []string{
@@ -0,0 +1,250 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/dynamic-resource-allocation/resourceslice"
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/handler"
+)
+
+// SegmentPoolPrefix prefixes the names of the cluster-scoped VLAN and VNI
+// pools published by the controller.
+const SegmentPoolPrefix = "segpool-"
+
+// maxSegmentPoolDevices caps the IDs a segment pool may publish; VNI ranges
+// can otherwise span millions of devices.
+const maxSegmentPoolDevices = 4096
+
+// Segment types and the largest ID of each.
+const (
+	SegmentVLAN = "vlan"
+	SegmentVNI  = "vni"
+
+	maxVLANID = 4094
+	maxVNI    = 1<<24 - 1
+)
+
+// SegmentPoolConfig defines cluster-scoped pools of VLAN IDs and VNIs.
+type SegmentPoolConfig struct {
+	Pools []SegmentPool `json:"pools"`
+}
+
+// SegmentPool is a range of VLAN IDs or VNIs, each published as a device
+// that the scheduler hands to at most one claim.
+type SegmentPool struct {
+	Name         string            `json:"name"`
+	Type         string            `json:"type"`                   // "vlan" or "vni"
+	Start        int               `json:"start"`                  // First ID
+	End          int               `json:"end"`                    // Last ID
+	Exclude      []int             `json:"exclude,omitempty"`      // IDs never handed out
+	Purpose      string            `json:"purpose,omitempty"`      // Published as an attribute, e.g. "storage"
+	Tenant       string            `json:"tenant,omitempty"`       // Published as an attribute
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"` // Nodes the IDs can be used on (default: all)
+}
+
+// LoadSegmentPoolConfig reads a JSON segment pool configuration file.
+func LoadSegmentPoolConfig(path string) (*SegmentPoolConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read segment pool config: %w", err)
+	}
+	var cfg SegmentPoolConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse segment pool config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// BuildSegmentPools adds the ResourceSlices publishing every ID of the
+// configured pools to resources.
+func BuildSegmentPools(resources *resourceslice.DriverResources, cfg *SegmentPoolConfig) error {
+	if resources.Pools == nil {
+		resources.Pools = make(map[string]resourceslice.Pool)
+	}
+	for _, p := range cfg.Pools {
+		if p.Name == "" {
+			return fmt.Errorf("segment pool %d-%d has no name", p.Start, p.End)
+		}
+		name := SegmentPoolPrefix + p.Name
+		if _, ok := resources.Pools[name]; ok {
+			return fmt.Errorf("segment pool %s defined twice", p.Name)
+		}
+		devices, err := segmentDevices(p)
+		if err != nil {
+			return fmt.Errorf("segment pool %s: %w", p.Name, err)
+		}
+		poolSlices := buildSlices(devices, nil)
+		if len(poolSlices) == 0 {
+			// Publish the pool even when every ID is excluded.
+			poolSlices = []resourceslice.Slice{{}}
+		}
+		resources.Pools[name] = resourceslice.Pool{
+			NodeSelector: nodeSelector(p.NodeSelector),
+			Slices:       poolSlices,
+		}
+		klog.Infof("Segment pool %s: %d %s IDs in %d slices", p.Name, len(devices), p.Type, len(poolSlices))
+	}
+	return nil
+}
+
+// segmentDevices validates a pool and returns a device per ID.
+func segmentDevices(p SegmentPool) ([]resourceapi.Device, error) {
+	var maxID int
+	switch p.Type {
+	case SegmentVLAN:
+		maxID = maxVLANID
+	case SegmentVNI:
+		maxID = maxVNI
+	default:
+		return nil, fmt.Errorf("unsupported type %q (use vlan or vni)", p.Type)
+	}
+	if p.Start < 1 || p.End > maxID || p.End < p.Start {
+		return nil, fmt.Errorf("%s range %d-%d is not within 1-%d", p.Type, p.Start, p.End, maxID)
+	}
+	idRange := fmt.Sprintf("%d-%d", p.Start, p.End)
+	var devices []resourceapi.Device
+	for id := p.Start; id <= p.End; id++ {
+		if slices.Contains(p.Exclude, id) {
+			continue
+		}
+		if len(devices) == maxSegmentPoolDevices {
+			return nil, fmt.Errorf("more than %d IDs", maxSegmentPoolDevices)
+		}
+		device := resourceapi.Device{
+			Name: segmentDeviceName(p.Type, id),
+			Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+				"dra.example.com/type": {
+					StringValue: stringPtr("segment"),
+				},
+				"dra.example.com/segmentType": {
+					StringValue: stringPtr(p.Type),
+				},
+				"dra.example.com/id": {
+					IntValue: int64Ptr(int64(id)),
+				},
+				"dra.example.com/pool": {
+					StringValue: stringPtr(p.Name),
+				},
+				"dra.example.com/range": {
+					StringValue: stringPtr(idRange),
+				},
+			},
+		}
+		if p.Purpose != "" {
+			device.Attributes["dra.example.com/purpose"] = resourceapi.DeviceAttribute{StringValue: stringPtr(p.Purpose)}
+		}
+		if p.Tenant != "" {
+			device.Attributes["dra.example.com/tenant"] = resourceapi.DeviceAttribute{StringValue: stringPtr(p.Tenant)}
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// segmentDeviceName names the device for an ID, e.g. vlan-100 or vni-5001.
+// The node side parses the name back, so it needs no API lookup.
+func segmentDeviceName(segmentType string, id int) string {
+	return fmt.Sprintf("%s-%d", segmentType, id)
+}
+
+// parseSegmentDeviceName is the reverse of segmentDeviceName.
+func parseSegmentDeviceName(name string) (string, int, error) {
+	segmentType, idStr, ok := strings.Cut(name, "-")
+	if !ok || (segmentType != SegmentVLAN && segmentType != SegmentVNI) {
+		return "", 0, fmt.Errorf("%s is not a segment device", name)
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("%s is not a segment device: %w", name, err)
+	}
+	return segmentType, id, nil
+}
+
+// isClusterPoolResult reports whether result comes from a pool the
+// controller publishes rather than from a device on this node.
+func isClusterPoolResult(result *resourceapi.DeviceRequestAllocationResult) bool {
+	return isIPPoolResult(result) || isSegmentPoolResult(result)
+}
+
+// isSegmentPoolResult reports whether result is a VLAN ID or VNI from a
+// cluster pool rather than a device on this node.
+func isSegmentPoolResult(result *resourceapi.DeviceRequestAllocationResult) bool {
+	return strings.HasPrefix(result.Pool, SegmentPoolPrefix)
+}
+
+// segmentIDs applies the VLAN IDs and VNIs the scheduler allocated to the
+// claim from cluster pools to its netdev config: the ID of a vlan
+// sub-interface, the VLAN of a VF, the access VLAN of a veth's bridge or OVS
+// port, or the VNI of a tunnel.  An ID already set in the config must match.
+func (d *Driver) segmentIDs(rc *resourceapi.ResourceClaim, config *handler.DeviceConfig) error {
+	if rc == nil || rc.Status.Allocation == nil {
+		return nil
+	}
+	for _, result := range rc.Status.Allocation.Devices.Results {
+		if result.Driver != d.driverName || !isSegmentPoolResult(&result) {
+			continue
+		}
+		segmentType, id, err := parseSegmentDeviceName(result.Device)
+		if err != nil {
+			return err
+		}
+		if config.Type != handler.DeviceTypeNetdev || config.Netdev == nil {
+			return fmt.Errorf("%s %d from pool %s needs a netdev config, got type %s", segmentType, id, result.Pool, config.Type)
+		}
+		if err := applySegmentID(config.Netdev, segmentType, id); err != nil {
+			return fmt.Errorf("%s %d from pool %s: %w", segmentType, id, result.Pool, err)
+		}
+		klog.V(2).Infof("Claim %s got %s %d from segment pool %s", rc.UID, segmentType, id, result.Pool)
+	}
+	return nil
+}
+
+func applySegmentID(cfg *handler.NetdevConfig, segmentType string, id int) error {
+	switch {
+	case segmentType == SegmentVLAN && cfg.Kind == "vlan":
+		if cfg.VLAN == nil {
+			cfg.VLAN = &handler.VLANConfig{}
+		}
+		return setID(&cfg.VLAN.ID, id)
+	case segmentType == SegmentVLAN && cfg.Kind == "sriov-vf":
+		if cfg.VF == nil {
+			cfg.VF = &handler.VFConfig{}
+		}
+		if cfg.VF.VLAN == nil {
+			cfg.VF.VLAN = new(int)
+		}
+		return setID(cfg.VF.VLAN, id)
+	case segmentType == SegmentVLAN && cfg.Kind == "veth" && cfg.OVS != nil:
+		return setID(&cfg.OVS.Tag, id)
+	case segmentType == SegmentVLAN && cfg.Kind == "veth" && cfg.Bridge != nil:
+		return setID(&cfg.Bridge.PVID, id)
+	case segmentType == SegmentVNI && (cfg.Kind == "vxlan" || cfg.Kind == "geneve"):
+		if cfg.Tunnel == nil {
+			cfg.Tunnel = &handler.TunnelConfig{}
+		}
+		vni := int(cfg.Tunnel.VNI)
+		if err := setID(&vni, id); err != nil {
+			return err
+		}
+		cfg.Tunnel.VNI = uint32(vni)
+		return nil
+	}
+	return fmt.Errorf("netdev kind %s cannot use it", cfg.Kind)
+}
+
+// setID sets *field to id unless the config already holds another ID.
+func setID(field *int, id int) error {
+	if *field != 0 && *field != id {
+		return fmt.Errorf("config already sets %d", *field)
+	}
+	*field = id
+	return nil
+}
@@ -0,0 +1,504 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/ethtool"
+	"github.com/example/dra-poc/pkg/handler/netdev"
+)
+
+// SR-IOV VFs are published as partitionable devices (DRAPartitionableDevices
+// feature gate).  Every PF publishes a counter set with the budget its VFs
+// share, and every VF device declares what it consumes from that set, so the
+// scheduler enforces per-PF limits that the VFs alone cannot express.
+const (
+	counterBandwidth  = "bandwidth"   // PF link speed, bits/s
+	counterQueuePairs = "queue-pairs" // Queue pairs of the PF's hardware
+
+	// maxProfiledVFs is how many VFs of one PF can be offered in profiles:
+	// each needs its own counter next to bandwidth and queue-pairs.
+	maxProfiledVFs = resourceapi.ResourceSliceMaxCountersPerCounterSet - 2
+)
+
+// VFProfile is a VF size offered on every VF of a PF.  A VF with profiles is
+// published once per profile; all of them consume the VF's own counter, so
+// the scheduler allocates at most one profile of each VF.
+type VFProfile struct {
+	Name       string
+	Bandwidth  resource.Quantity // Bits/s charged against the PF's bandwidth
+	QueuePairs int64
+}
+
+// Rate returns the profile's bandwidth in Mb/s, the max TX rate of its VFs.
+func (p VFProfile) Rate() int {
+	return int(max(p.Bandwidth.Value()/1_000_000, 1))
+}
+
+// ParseVFProfiles parses --sriov-vf-profiles, which maps profile names to
+// <bandwidth>/<queue-pairs>, e.g. small=1G/2,large=10G/8.  Profiles are
+// returned sorted by name.
+func ParseVFProfiles(spec map[string]string) ([]VFProfile, error) {
+	profiles := make([]VFProfile, 0, len(spec))
+	for name, value := range spec {
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return nil, fmt.Errorf("profile name %q: %s", name, strings.Join(errs, "; "))
+		}
+		bw, qp, ok := strings.Cut(value, "/")
+		if !ok {
+			return nil, fmt.Errorf("profile %s: %q is not <bandwidth>/<queue-pairs>", name, value)
+		}
+		bandwidth, err := resource.ParseQuantity(bw)
+		if err != nil || bandwidth.Sign() <= 0 {
+			return nil, fmt.Errorf("profile %s: invalid bandwidth %q", name, bw)
+		}
+		queuePairs, err := strconv.ParseInt(qp, 10, 64)
+		if err != nil || queuePairs <= 0 {
+			return nil, fmt.Errorf("profile %s: invalid queue pair count %q", name, qp)
+		}
+		profiles = append(profiles, VFProfile{Name: name, Bandwidth: bandwidth, QueuePairs: queuePairs})
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles, nil
+}
+
+// SriovOptions controls how SR-IOV VFs are published.
+type SriovOptions struct {
+	// Profiles, if any, are offered on every pre-created VF.
+	Profiles []VFProfile
+
+	// OnDemand maps PFs to the number of VFs the driver may create on each.
+	// Their VFs are published before they exist; see onDemandVFDevice.
+	OnDemand map[string]int
+}
+
+// Binding conditions of on-demand VFs (DRADeviceBindingConditions feature
+// gate).  The scheduler holds the pod until the BindingController has created
+// the VF and set ConditionVFReady in the claim's device status, and gives up
+// on the allocation if it sets ConditionVFFailed instead.
+const (
+	ConditionVFReady  = "dra.example.com/VFReady"
+	ConditionVFFailed = "dra.example.com/VFFailed"
+)
+
+// vfInfo is what the publisher knows about one VF.
+type vfInfo struct {
+	Name       string
+	Parent     string // PF interface name, "" if unknown
+	Index      int    // VF index on the PF, -1 if unknown
+	PCIAddress string
+	NUMANode   int
+	QueuePairs int64
+	MaxTxRate  int64 // Mb/s, 0 if the VF is not rate limited
+
+	// EswitchMode is the devlink eswitch mode of the PF, "" if unknown.
+	EswitchMode string
+}
+
+// pfBudget is what a PF shares among its VFs.
+type pfBudget struct {
+	Speed      int64 // Link speed in Mb/s, <= 0 if unknown
+	QueuePairs int64 // Queue pairs of the hardware, 0 if unknown
+}
+
+// getPFBudget returns the budget of pf.  Its queue pairs are its maximum
+// channel counts: combined channels, plus pairs of rx and tx channels.
+func getPFBudget(pf string) pfBudget {
+	budget := pfBudget{Speed: getLinkSpeed(pf)}
+	ch, err := ethtool.GetChannels(pf)
+	if err != nil {
+		klog.V(2).Infof("Failed to get the channels of PF %s, not limiting its queue pairs: %v", pf, err)
+		return budget
+	}
+	budget.QueuePairs = int64(ch.MaxCombined) + int64(min(ch.MaxRX, ch.MaxTX))
+	return budget
+}
+
+// getVFRates returns the TX rate limits of the VFs of pf, in Mb/s by index.
+func getVFRates(pf string) map[int]int64 {
+	link, err := netlink.LinkByName(pf)
+	if err != nil {
+		return nil
+	}
+	rates := make(map[int]int64)
+	for _, vf := range link.Attrs().Vfs {
+		if vf.MaxTxRate > 0 {
+			rates[vf.ID] = int64(vf.MaxTxRate)
+		}
+	}
+	return rates
+}
+
+// discoverSriovDevices discovers VFs and returns their devices and the
+// counter sets of their PFs.  VFs of on-demand PFs are published from the
+// PF's budget instead; existing VFs beyond the budget are discovered like
+// any other and share the PF's counter set.
+func discoverSriovDevices(opts SriovOptions) ([]resourceapi.Device, []resourceapi.CounterSet) {
+	vfBudgets := onDemandBudgets(opts.OnDemand)
+	pfBudgets := make(map[string]pfBudget, len(vfBudgets))
+	for pf := range vfBudgets {
+		pfBudgets[pf] = getPFBudget(pf)
+	}
+	onDemand, onDemandSets := buildOnDemandVFs(vfBudgets, pfBudgets)
+
+	netDir := "/sys/class/net"
+	entries, err := os.ReadDir(netDir)
+	if err != nil {
+		klog.Warningf("Failed to read %s: %v", netDir, err)
+		return onDemand, onDemandSets
+	}
+
+	var vfs []vfInfo
+	budgets := make(map[string]pfBudget)
+	pfModes := make(map[string]string)
+	pfRates := make(map[string]map[int]int64)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !isVF(name) {
+			continue
+		}
+		parent := getVFParent(name)
+		index := getVFIndex(name)
+		if budget, ok := vfBudgets[parent]; ok && index >= 0 && index < budget {
+			continue
+		}
+		vf := vfInfo{
+			Name:       name,
+			Parent:     parent,
+			Index:      index,
+			PCIAddress: getPCIAddress(name),
+			NUMANode:   getNUMANode(name),
+			QueuePairs: getQueuePairs(name),
+		}
+		if _, ok := budgets[vf.Parent]; vf.Parent != "" && !ok {
+			budgets[vf.Parent] = getPFBudget(vf.Parent)
+			pfModes[vf.Parent] = netdev.EswitchMode(vf.Parent)
+			pfRates[vf.Parent] = getVFRates(vf.Parent)
+		}
+		vf.EswitchMode = pfModes[vf.Parent]
+		vf.MaxTxRate = pfRates[vf.Parent][vf.Index]
+		vfs = append(vfs, vf)
+		klog.V(2).Infof("Discovered SR-IOV VF: %s (pf=%s index=%d queue-pairs=%d)", name, vf.Parent, vf.Index, vf.QueuePairs)
+	}
+
+	devices, counterSets := buildSriovResources(vfs, budgets, opts.Profiles)
+	return append(devices, onDemand...), mergeCounterSets(append(counterSets, onDemandSets...))
+}
+
+// mergeCounterSets merges counter sets of the same name, which a PF with
+// both on-demand and discovered VFs gets from each.  Both hold the same PF
+// budget; the counters of either are kept.
+func mergeCounterSets(sets []resourceapi.CounterSet) []resourceapi.CounterSet {
+	var merged []resourceapi.CounterSet
+	index := make(map[string]int)
+	for _, set := range sets {
+		i, ok := index[set.Name]
+		if !ok {
+			index[set.Name] = len(merged)
+			merged = append(merged, set)
+			continue
+		}
+		for name, c := range set.Counters {
+			if _, ok := merged[i].Counters[name]; !ok {
+				merged[i].Counters[name] = c
+			}
+		}
+	}
+	return merged
+}
+
+// onDemandBudgets caps the configured VF budget of every on-demand PF to
+// what the PF supports.  A PF that already has VFs cannot get more without
+// first dropping to zero, so its budget is capped to its current count.
+func onDemandBudgets(configured map[string]int) map[string]int {
+	budgets := make(map[string]int)
+	for pf, budget := range configured {
+		current, total, err := netdev.NumVFs(pf)
+		if err != nil {
+			klog.Warningf("PF %s cannot create VFs on demand: %v", pf, err)
+			continue
+		}
+		if budget > total {
+			klog.Warningf("PF %s supports %d VFs, capping its budget of %d", pf, total, budget)
+			budget = total
+		}
+		if current > 0 && current < budget {
+			klog.Warningf("PF %s already has %d VFs, capping its budget of %d", pf, current, budget)
+			budget = current
+		}
+		if budget > 0 {
+			budgets[pf] = budget
+		}
+	}
+	return budgets
+}
+
+// buildOnDemandVFs publishes budget VFs for every on-demand PF, and the
+// counter sets of the PFs.  As the VFs do not exist yet, each consumes an
+// equal share of its PF's bandwidth and queue pairs.
+func buildOnDemandVFs(budgets map[string]int, pfBudgets map[string]pfBudget) ([]resourceapi.Device, []resourceapi.CounterSet) {
+	pfs := make([]string, 0, len(budgets))
+	for pf := range budgets {
+		pfs = append(pfs, pf)
+	}
+	sort.Strings(pfs)
+
+	var devices []resourceapi.Device
+	var counterSets []resourceapi.CounterSet
+	for _, pf := range pfs {
+		count := int64(budgets[pf])
+		budget := pfBudgets[pf]
+		counters := make(map[string]resourceapi.Counter)
+		if budget.Speed > 0 {
+			counters[counterBandwidth] = counter(budget.Speed * 1_000_000)
+		}
+		if budget.QueuePairs > 0 {
+			counters[counterQueuePairs] = counter(budget.QueuePairs)
+		}
+		setName := sriovCounterSetName(pf)
+		consumes := consumption(setName, counters, map[string]int64{
+			counterBandwidth:  budget.Speed * 1_000_000 / count,
+			counterQueuePairs: budget.QueuePairs / count,
+		})
+
+		mode := netdev.EswitchMode(pf)
+		for i := 0; i < budgets[pf]; i++ {
+			devices = append(devices, onDemandVFDevice(pf, i, mode, consumes))
+		}
+		if len(counters) > 0 {
+			counterSets = append(counterSets, resourceapi.CounterSet{
+				Name:     setName,
+				Counters: counters,
+			})
+		}
+		klog.V(2).Infof("Publishing %d on-demand VFs of PF %s", budgets[pf], pf)
+	}
+	return devices, counterSets
+}
+
+// onDemandVFDevice builds the device for VF index of pf, which need not
+// exist yet.  Pod binding waits until the BindingController has created it.
+func onDemandVFDevice(pf string, index int, eswitchMode string, consumes []resourceapi.DeviceCounterConsumption) resourceapi.Device {
+	device := vfDevice(vfInfo{
+		Name:        netdev.OnDemandVFDeviceName(pf, index),
+		Parent:      pf,
+		Index:       index,
+		NUMANode:    getNUMANode(pf),
+		EswitchMode: eswitchMode,
+	}, consumes)
+	device.Attributes["dra.example.com/on-demand"] = resourceapi.DeviceAttribute{
+		BoolValue: boolPtr(true),
+	}
+	device.BindsToNode = boolPtr(true)
+	device.BindingConditions = []string{ConditionVFReady}
+	device.BindingFailureConditions = []string{ConditionVFFailed}
+	return device
+}
+
+// buildSriovResources turns discovered VFs into devices and per-PF counter
+// sets holding the budgets of the PFs.  A plain VF consumes its queue pairs
+// and its TX rate limit, or without one an equal share of the PF's speed.
+func buildSriovResources(vfs []vfInfo, budgets map[string]pfBudget, profiles []VFProfile) ([]resourceapi.Device, []resourceapi.CounterSet) {
+	byPF := make(map[string][]vfInfo)
+	var pfs []string
+	var devices []resourceapi.Device
+	for _, vf := range vfs {
+		if vf.Parent == "" {
+			// Nothing to share a budget with.
+			devices = append(devices, vfDevice(vf, nil))
+			continue
+		}
+		if _, ok := byPF[vf.Parent]; !ok {
+			pfs = append(pfs, vf.Parent)
+		}
+		byPF[vf.Parent] = append(byPF[vf.Parent], vf)
+	}
+	sort.Strings(pfs)
+
+	var counterSets []resourceapi.CounterSet
+	for _, pf := range pfs {
+		pfVFs := byPF[pf]
+		sort.Slice(pfVFs, func(i, j int) bool { return pfVFs[i].Name < pfVFs[j].Name })
+
+		budget := budgets[pf]
+		counters := make(map[string]resourceapi.Counter)
+		if budget.Speed > 0 {
+			counters[counterBandwidth] = counter(budget.Speed * 1_000_000)
+		}
+		if budget.QueuePairs > 0 {
+			counters[counterQueuePairs] = counter(budget.QueuePairs)
+		}
+
+		profiled := len(profiles) > 0
+		if profiled && len(pfVFs) > maxProfiledVFs {
+			klog.Warningf("PF %s has %d VFs; VF profiles support at most %d per PF, publishing plain VFs", pf, len(pfVFs), maxProfiledVFs)
+			profiled = false
+		}
+
+		setName := sriovCounterSetName(pf)
+		for i, vf := range pfVFs {
+			if !profiled {
+				rate := vf.MaxTxRate
+				if rate == 0 && budget.Speed > 0 {
+					rate = budget.Speed / int64(len(pfVFs))
+				}
+				devices = append(devices, vfDevice(vf, consumption(setName, counters, map[string]int64{
+					counterBandwidth:  rate * 1_000_000,
+					counterQueuePairs: vf.QueuePairs,
+				})))
+				continue
+			}
+
+			// Every profile of a VF consumes the VF's own counter, which
+			// makes them mutually exclusive.
+			vfCounter := fmt.Sprintf("vf%d", i)
+			counters[vfCounter] = counter(1)
+			for _, p := range profiles {
+				device := vfDevice(vf, consumption(setName, counters, map[string]int64{
+					counterBandwidth:  p.Bandwidth.Value(),
+					counterQueuePairs: p.QueuePairs,
+					vfCounter:         1,
+				}))
+				device.Name = netdev.VFProfileDeviceName(vf.Name, p.Name)
+				device.Attributes["dra.example.com/profile"] = resourceapi.DeviceAttribute{
+					StringValue: stringPtr(p.Name),
+				}
+				devices = append(devices, device)
+			}
+		}
+
+		if len(counters) > 0 {
+			counterSets = append(counterSets, resourceapi.CounterSet{
+				Name:     setName,
+				Counters: counters,
+			})
+		}
+	}
+
+	return devices, counterSets
+}
+
+// vfDevice builds the device for a VF, consuming the given PF counters.
+func vfDevice(vf vfInfo, consumes []resourceapi.DeviceCounterConsumption) resourceapi.Device {
+	device := resourceapi.Device{
+		Name: vf.Name,
+		Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+			"dra.example.com/type": {
+				StringValue: stringPtr("netdev"),
+			},
+			"dra.example.com/kind": {
+				StringValue: stringPtr("sriov-vf"),
+			},
+			"dra.example.com/parent": {
+				StringValue: stringPtr(vf.Parent),
+			},
+		},
+		ConsumesCounters: consumes,
+	}
+	if vf.PCIAddress != "" {
+		device.Attributes["dra.example.com/pci-address"] = resourceapi.DeviceAttribute{
+			StringValue: stringPtr(vf.PCIAddress),
+		}
+	}
+	if vf.NUMANode >= 0 {
+		device.Attributes["dra.example.com/numa-node"] = resourceapi.DeviceAttribute{
+			IntValue: int64Ptr(int64(vf.NUMANode)),
+		}
+	}
+	if vf.EswitchMode != "" {
+		device.Attributes["dra.example.com/eswitch-mode"] = resourceapi.DeviceAttribute{
+			StringValue: stringPtr(vf.EswitchMode),
+		}
+	}
+	if vf.Index >= 0 {
+		device.Attributes["dra.example.com/vf-index"] = resourceapi.DeviceAttribute{
+			IntValue: int64Ptr(int64(vf.Index)),
+		}
+	}
+	return device
+}
+
+// consumption returns the counters a device consumes from setName, limited
+// to counters the set publishes.  Returns nil if there is nothing to consume.
+func consumption(setName string, available map[string]resourceapi.Counter, amounts map[string]int64) []resourceapi.DeviceCounterConsumption {
+	consumed := make(map[string]resourceapi.Counter)
+	for name, amount := range amounts {
+		if _, ok := available[name]; !ok || amount <= 0 {
+			continue
+		}
+		consumed[name] = counter(amount)
+	}
+	if len(consumed) == 0 {
+		return nil
+	}
+	return []resourceapi.DeviceCounterConsumption{{
+		CounterSet: setName,
+		Counters:   consumed,
+	}}
+}
+
+func counter(value int64) resourceapi.Counter {
+	return resourceapi.Counter{Value: *resource.NewQuantity(value, resource.DecimalSI)}
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// sriovCounterSetName returns the name of the counter set holding a PF's
+// budget.  Counter set names must be DNS labels.
+func sriovCounterSetName(pf string) string {
+	name := "pf-" + strings.Trim(invalidLabelChars.ReplaceAllString(strings.ToLower(pf), "-"), "-")
+	if len(name) > validation.DNS1123LabelMaxLength {
+		name = strings.TrimRight(name[:validation.DNS1123LabelMaxLength], "-")
+	}
+	return name
+}
+
+// getVFIndex returns the index of a VF on its PF, or -1 if unknown.
+func getVFIndex(vfName string) int {
+	pciAddr := getPCIAddress(vfName)
+	pfDevice := filepath.Join("/sys/class/net", vfName, "device", "physfn")
+	links, err := filepath.Glob(filepath.Join(pfDevice, "virtfn*"))
+	if err != nil || pciAddr == "" {
+		return -1
+	}
+	for _, link := range links {
+		target, err := os.Readlink(link)
+		if err != nil || filepath.Base(target) != pciAddr {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(link), "virtfn"))
+		if err == nil {
+			return index
+		}
+	}
+	return -1
+}
+
+// getQueuePairs returns the number of rx/tx queue pairs of an interface.
+func getQueuePairs(name string) int64 {
+	entries, err := os.ReadDir(filepath.Join("/sys/class/net", name, "queues"))
+	if err != nil {
+		return 0
+	}
+	var rx, tx int64
+	for _, entry := range entries {
+		switch {
+		case strings.HasPrefix(entry.Name(), "rx-"):
+			rx++
+		case strings.HasPrefix(entry.Name(), "tx-"):
+			tx++
+		}
+	}
+	return min(rx, tx)
+}
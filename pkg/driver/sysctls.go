@@ -0,0 +1,39 @@
+package driver
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/example/dra-poc/pkg/handler"
+)
+
+// DefaultSysctls are the per-interface sysctls claims may set unless the
+// driver is given another allow-list.
+var DefaultSysctls = []string{
+	"ipv4.arp_announce",
+	"ipv4.arp_ignore",
+	"ipv4.rp_filter",
+	"ipv6.accept_ra",
+	"ipv6.addr_gen_mode",
+	"ipv6.disable_ipv6",
+}
+
+// validateSysctls checks the claim's sysctls against the allow-list.
+func (d *Driver) validateSysctls(config *handler.DeviceConfig) error {
+	cfg := netdevConfig(config)
+	if cfg == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(cfg.Sysctls))
+	for key := range cfg.Sysctls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !slices.Contains(d.Sysctls, key) {
+			return fmt.Errorf("sysctl %s is not allowed on this node", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,407 @@
+// Package ethtool reads and changes the ring sizes, channel counts,
+// interrupt coalescing and offload features of network interfaces through
+// the SIOCETHTOOL ioctl.  Interfaces are named in the calling thread's netns.
+package ethtool
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// ethtool commands, see include/uapi/linux/ethtool.h.
+const (
+	siocEthtool = 0x8946
+
+	cmdGCoalesce  = 0x0e
+	cmdSCoalesce  = 0x0f
+	cmdGRingParam = 0x10
+	cmdSRingParam = 0x11
+	cmdGStrings   = 0x1b
+	cmdGSsetInfo  = 0x37
+	cmdGFeatures  = 0x3a
+	cmdSFeatures  = 0x3b
+	cmdGChannels  = 0x3c
+	cmdSChannels  = 0x3d
+
+	ssFeatures = 4 // ETH_SS_FEATURES
+
+	stringLen = 32 // ETH_GSTRING_LEN
+
+	// Flags returned by ETHTOOL_SFEATURES.
+	featuresUnsupported = 1 << 0 // Some features cannot be changed
+	featuresWish        = 1 << 1 // Some features were not applied as requested
+)
+
+// Rings are the sizes of an interface's descriptor rings.  The maxima are
+// read-only.
+type Rings struct {
+	RXMax      uint32 `json:"rxMax"`
+	RXMiniMax  uint32 `json:"rxMiniMax"`
+	RXJumboMax uint32 `json:"rxJumboMax"`
+	TXMax      uint32 `json:"txMax"`
+	RX         uint32 `json:"rx"`
+	RXMini     uint32 `json:"rxMini"`
+	RXJumbo    uint32 `json:"rxJumbo"`
+	TX         uint32 `json:"tx"`
+}
+
+// Channels are an interface's queue counts.  The maxima are read-only.
+type Channels struct {
+	MaxRX       uint32 `json:"maxRx"`
+	MaxTX       uint32 `json:"maxTx"`
+	MaxOther    uint32 `json:"maxOther"`
+	MaxCombined uint32 `json:"maxCombined"`
+	RX          uint32 `json:"rx"`
+	TX          uint32 `json:"tx"`
+	Other       uint32 `json:"other"`
+	Combined    uint32 `json:"combined"`
+}
+
+// Coalesce are an interface's interrupt coalescing parameters, in the
+// order of struct ethtool_coalesce.
+type Coalesce struct {
+	RXUsecs            uint32 `json:"rxUsecs"`
+	RXMaxFrames        uint32 `json:"rxMaxFrames"`
+	RXUsecsIRQ         uint32 `json:"rxUsecsIrq"`
+	RXMaxFramesIRQ     uint32 `json:"rxMaxFramesIrq"`
+	TXUsecs            uint32 `json:"txUsecs"`
+	TXMaxFrames        uint32 `json:"txMaxFrames"`
+	TXUsecsIRQ         uint32 `json:"txUsecsIrq"`
+	TXMaxFramesIRQ     uint32 `json:"txMaxFramesIrq"`
+	StatsBlockUsecs    uint32 `json:"statsBlockUsecs"`
+	AdaptiveRX         uint32 `json:"adaptiveRx"`
+	AdaptiveTX         uint32 `json:"adaptiveTx"`
+	PktRateLow         uint32 `json:"pktRateLow"`
+	RXUsecsLow         uint32 `json:"rxUsecsLow"`
+	RXMaxFramesLow     uint32 `json:"rxMaxFramesLow"`
+	TXUsecsLow         uint32 `json:"txUsecsLow"`
+	TXMaxFramesLow     uint32 `json:"txMaxFramesLow"`
+	PktRateHigh        uint32 `json:"pktRateHigh"`
+	RXUsecsHigh        uint32 `json:"rxUsecsHigh"`
+	RXMaxFramesHigh    uint32 `json:"rxMaxFramesHigh"`
+	TXUsecsHigh        uint32 `json:"txUsecsHigh"`
+	TXMaxFramesHigh    uint32 `json:"txMaxFramesHigh"`
+	RateSampleInterval uint32 `json:"rateSampleInterval"`
+}
+
+// ifreq is struct ifreq with the ethtool command as its data.  It is
+// padded to the kernel's size, which copies the whole union.  data is a
+// pointer so that the command is kept on the heap with the ifreq; see
+// ioctlHeap.
+type ifreq struct {
+	name [syscall.IFNAMSIZ]byte
+	data unsafe.Pointer
+	_    [16]byte
+}
+
+// ioctl runs the ethtool command cmd points to on ifname.  It returns the
+// ioctl's result, which some commands use for flags.
+func ioctl(ifname string, cmd unsafe.Pointer) (uintptr, error) {
+	if len(ifname) >= syscall.IFNAMSIZ {
+		return 0, fmt.Errorf("interface name %q too long", ifname)
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(fd)
+
+	req := ifreq{data: cmd}
+	copy(req.name[:], ifname)
+	r, errno := ioctlHeap(fd, siocEthtool, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+// ioctlHeap runs ioctl request on fd.  arg, and anything it points to, is
+// moved to the heap: a stack copy during the syscall would otherwise leave
+// the kernel with stale addresses.
+//
+//go:uintptrescapes
+func ioctlHeap(fd int, request, arg uintptr) (uintptr, syscall.Errno) {
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, arg)
+	return r, errno
+}
+
+// IsNotSupported reports whether err means the interface's driver does not
+// implement an operation.
+func IsNotSupported(err error) bool {
+	return errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// GetRings returns the ring sizes of ifname.
+func GetRings(ifname string) (Rings, error) {
+	req := struct {
+		cmd uint32
+		Rings
+	}{cmd: cmdGRingParam}
+	if _, err := ioctl(ifname, unsafe.Pointer(&req)); err != nil {
+		return Rings{}, fmt.Errorf("get rings of %s: %w", ifname, err)
+	}
+	return req.Rings, nil
+}
+
+// SetRings sets the ring sizes of ifname.
+func SetRings(ifname string, r Rings) error {
+	req := struct {
+		cmd uint32
+		Rings
+	}{cmdSRingParam, r}
+	if _, err := ioctl(ifname, unsafe.Pointer(&req)); err != nil {
+		return fmt.Errorf("set rings of %s: %w", ifname, err)
+	}
+	return nil
+}
+
+// GetChannels returns the channel counts of ifname.
+func GetChannels(ifname string) (Channels, error) {
+	req := struct {
+		cmd uint32
+		Channels
+	}{cmd: cmdGChannels}
+	if _, err := ioctl(ifname, unsafe.Pointer(&req)); err != nil {
+		return Channels{}, fmt.Errorf("get channels of %s: %w", ifname, err)
+	}
+	return req.Channels, nil
+}
+
+// SetChannels sets the channel counts of ifname.
+func SetChannels(ifname string, c Channels) error {
+	req := struct {
+		cmd uint32
+		Channels
+	}{cmdSChannels, c}
+	if _, err := ioctl(ifname, unsafe.Pointer(&req)); err != nil {
+		return fmt.Errorf("set channels of %s: %w", ifname, err)
+	}
+	return nil
+}
+
+// GetCoalesce returns the interrupt coalescing parameters of ifname.
+func GetCoalesce(ifname string) (Coalesce, error) {
+	req := struct {
+		cmd uint32
+		Coalesce
+	}{cmd: cmdGCoalesce}
+	if _, err := ioctl(ifname, unsafe.Pointer(&req)); err != nil {
+		return Coalesce{}, fmt.Errorf("get coalescing of %s: %w", ifname, err)
+	}
+	return req.Coalesce, nil
+}
+
+// SetCoalesce sets the interrupt coalescing parameters of ifname.
+func SetCoalesce(ifname string, c Coalesce) error {
+	req := struct {
+		cmd uint32
+		Coalesce
+	}{cmdSCoalesce, c}
+	if _, err := ioctl(ifname, unsafe.Pointer(&req)); err != nil {
+		return fmt.Errorf("set coalescing of %s: %w", ifname, err)
+	}
+	return nil
+}
+
+// Feature is the state of one offload feature.
+type Feature struct {
+	Active     bool // Currently on
+	Changeable bool // Can be turned on or off
+}
+
+// GetFeatures returns the features of ifname by their kernel names, e.g.
+// rx-gro or tx-tcp-segmentation.
+func GetFeatures(ifname string) (map[string]Feature, error) {
+	names, err := featureNames(ifname)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := getFeatureBlocks(ifname, len(names))
+	if err != nil {
+		return nil, err
+	}
+	features := make(map[string]Feature, len(names))
+	for i, name := range names {
+		b, bit := blocks[i/32], uint32(1)<<(i%32)
+		features[name] = Feature{Active: b.active&bit != 0, Changeable: b.available&bit != 0}
+	}
+	return features, nil
+}
+
+// SetFeatures turns the features of ifname, given by their kernel names,
+// on or off.  Features that already have the wanted state are left alone;
+// it is an error if any other cannot be changed or did not change.
+func SetFeatures(ifname string, want map[string]bool) error {
+	names, err := featureNames(ifname)
+	if err != nil {
+		return err
+	}
+	blocks, err := getFeatureBlocks(ifname, len(names))
+	if err != nil {
+		return err
+	}
+	index := make(map[string]int, len(names))
+	for i, name := range names {
+		index[name] = i
+	}
+
+	set := make([]setFeatureBlock, len(blocks))
+	changes := 0
+	for name, on := range want {
+		i, ok := index[name]
+		if !ok {
+			return fmt.Errorf("%s has no feature %s", ifname, name)
+		}
+		b, bit := blocks[i/32], uint32(1)<<(i%32)
+		if (b.active&bit != 0) == on {
+			continue
+		}
+		if b.available&bit == 0 {
+			return fmt.Errorf("feature %s of %s cannot be changed", name, ifname)
+		}
+		set[i/32].valid |= bit
+		if on {
+			set[i/32].requested |= bit
+		}
+		changes++
+	}
+	if changes == 0 {
+		return nil
+	}
+
+	buf := make([]uint32, 2+2*len(set))
+	buf[0], buf[1] = cmdSFeatures, uint32(len(set))
+	for i, b := range set {
+		buf[2+2*i], buf[3+2*i] = b.valid, b.requested
+	}
+	flags, err := ioctl(ifname, unsafe.Pointer(&buf[0]))
+	if err != nil {
+		return fmt.Errorf("set features of %s: %w", ifname, err)
+	}
+	if flags&(featuresUnsupported|featuresWish) == 0 {
+		return nil
+	}
+	// Some were refused, e.g. because they depend on a feature that is off.
+	current, err := GetFeatures(ifname)
+	if err != nil {
+		return err
+	}
+	for name, on := range want {
+		if current[name].Active != on {
+			return fmt.Errorf("feature %s of %s did not change", name, ifname)
+		}
+	}
+	return nil
+}
+
+// featureBlock is struct ethtool_get_features_block.
+type featureBlock struct {
+	available    uint32
+	requested    uint32
+	active       uint32
+	neverChanged uint32
+}
+
+// setFeatureBlock is struct ethtool_set_features_block.
+type setFeatureBlock struct {
+	valid     uint32
+	requested uint32
+}
+
+func getFeatureBlocks(ifname string, count int) ([]featureBlock, error) {
+	n := (count + 31) / 32
+	buf := make([]uint32, 2+4*n)
+	buf[0], buf[1] = cmdGFeatures, uint32(n)
+	if _, err := ioctl(ifname, unsafe.Pointer(&buf[0])); err != nil {
+		return nil, fmt.Errorf("get features of %s: %w", ifname, err)
+	}
+	blocks := make([]featureBlock, n)
+	for i := range blocks {
+		b := buf[2+4*i:]
+		blocks[i] = featureBlock{b[0], b[1], b[2], b[3]}
+	}
+	return blocks, nil
+}
+
+// featureNames returns the kernel's feature names, in bit order.
+func featureNames(ifname string) ([]string, error) {
+	info := struct {
+		cmd      uint32
+		reserved uint32
+		mask     uint64
+		data     uint32
+	}{cmd: cmdGSsetInfo, mask: 1 << ssFeatures}
+	if _, err := ioctl(ifname, unsafe.Pointer(&info)); err != nil {
+		return nil, fmt.Errorf("get feature count of %s: %w", ifname, err)
+	}
+	if info.mask == 0 {
+		return nil, fmt.Errorf("get feature count of %s: %w", ifname, syscall.EOPNOTSUPP)
+	}
+	count := int(info.data)
+
+	// struct ethtool_gstrings: cmd, string_set, len, then the strings.
+	buf := make([]byte, 12+count*stringLen)
+	hdr := (*[3]uint32)(unsafe.Pointer(&buf[0]))
+	hdr[0], hdr[1], hdr[2] = cmdGStrings, ssFeatures, uint32(count)
+	if _, err := ioctl(ifname, unsafe.Pointer(&buf[0])); err != nil {
+		return nil, fmt.Errorf("get feature names of %s: %w", ifname, err)
+	}
+	names := make([]string, count)
+	for i := range names {
+		s := buf[12+i*stringLen : 12+(i+1)*stringLen]
+		if n := bytes.IndexByte(s, 0); n >= 0 {
+			s = s[:n]
+		}
+		names[i] = string(s)
+	}
+	return names, nil
+}
+
+// featureAliases maps the short names of `ethtool -K` to kernel features.
+var featureAliases = map[string][]string{
+	"rx":     {"rx-checksum"},
+	"sg":     {"tx-scatter-gather"},
+	"tso":    {"tx-tcp-segmentation", "tx-tcp-ecn-segmentation", "tx-tcp-mangleid-segmentation", "tx-tcp6-segmentation"},
+	"gso":    {"tx-generic-segmentation"},
+	"gro":    {"rx-gro"},
+	"lro":    {"rx-lro"},
+	"rxvlan": {"rx-vlan-hw-parse"},
+	"txvlan": {"tx-vlan-hw-insert"},
+	"ntuple": {"rx-ntuple-filter"},
+	"rxhash": {"rx-hashing"},
+}
+
+// Resolve maps feature names, either kernel names or the short names of
+// `ethtool -K` such as gro or tso, to the kernel features of ifname.
+// Short names standing for several features cover those ifname has, like
+// ethtool does.
+func Resolve(ifname string, want map[string]bool) (map[string]bool, error) {
+	features, err := GetFeatures(ifname)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make(map[string]bool, len(want))
+	for name, on := range want {
+		aliases, ok := featureAliases[name]
+		if !ok {
+			if _, ok := features[name]; !ok {
+				return nil, fmt.Errorf("%s has no feature %s", ifname, name)
+			}
+			resolved[name] = on
+			continue
+		}
+		found := false
+		for _, kname := range aliases {
+			if _, ok := features[kname]; ok {
+				resolved[kname], found = on, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s has no feature %s", ifname, name)
+		}
+	}
+	return resolved, nil
+}
@@ -0,0 +1,127 @@
+package ethtool
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// inScratchNetns runs the test on a veth pair in a new netns.
+func inScratchNetns(t *testing.T) {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("skipping: requires root / CAP_NET_ADMIN")
+	}
+	runtime.LockOSThread()
+	origNS, err := netns.Get()
+	if err != nil {
+		t.Fatalf("get netns: %v", err)
+	}
+	testNS, err := netns.New()
+	if err != nil {
+		origNS.Close()
+		t.Skipf("skipping: cannot create netns: %v", err)
+	}
+	t.Cleanup(func() {
+		netns.Set(origNS)
+		testNS.Close()
+		origNS.Close()
+		runtime.UnlockOSThread()
+	})
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0", NumTxQueues: 4, NumRxQueues: 4}, PeerName: "eth1"}); err != nil {
+		t.Skipf("skipping: cannot create veth pair: %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	got, err := Resolve("lo", map[string]bool{"tso": false, "rx-gro": true})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if on, ok := got["tx-tcp-segmentation"]; !ok || on {
+		t.Errorf("tso resolved to %v", got)
+	}
+	if on := got["rx-gro"]; !on {
+		t.Errorf("rx-gro resolved to %v", got)
+	}
+	if _, ok := got["tso"]; ok {
+		t.Errorf("short name kept in %v", got)
+	}
+	if _, err := Resolve("lo", map[string]bool{"no-such-feature": true}); err == nil {
+		t.Error("expected error for an unknown feature")
+	}
+	if _, err := Resolve("no-such-link", map[string]bool{"gro": true}); err == nil {
+		t.Error("expected error for a missing interface")
+	}
+}
+
+func TestSetFeatures(t *testing.T) {
+	inScratchNetns(t)
+
+	features, err := GetFeatures("eth0")
+	if err != nil {
+		t.Fatalf("GetFeatures: %v", err)
+	}
+	tso := features["tx-tcp-segmentation"]
+	if !tso.Changeable {
+		t.Skip("skipping: tx-tcp-segmentation is fixed on veth")
+	}
+	for _, on := range []bool{!tso.Active, tso.Active} {
+		if err := SetFeatures("eth0", map[string]bool{"tx-tcp-segmentation": on}); err != nil {
+			t.Fatalf("SetFeatures(%t): %v", on, err)
+		}
+		features, _ = GetFeatures("eth0")
+		if features["tx-tcp-segmentation"].Active != on {
+			t.Errorf("tx-tcp-segmentation = %t, want %t", !on, on)
+		}
+	}
+	// Setting the current state is a no-op, even for fixed features.
+	current := map[string]bool{}
+	for name, f := range features {
+		if !f.Changeable {
+			current[name] = f.Active
+		}
+	}
+	if err := SetFeatures("eth0", current); err != nil {
+		t.Errorf("SetFeatures with the current state: %v", err)
+	}
+	for name, f := range features {
+		if !f.Changeable {
+			if err := SetFeatures("eth0", map[string]bool{name: !f.Active}); err == nil {
+				t.Errorf("expected error changing fixed feature %s", name)
+			}
+			break
+		}
+	}
+}
+
+func TestChannels(t *testing.T) {
+	inScratchNetns(t)
+
+	orig, err := GetChannels("eth0")
+	if IsNotSupported(err) {
+		t.Skipf("skipping: %v", err)
+	} else if err != nil {
+		t.Fatalf("GetChannels: %v", err)
+	}
+	if orig.MaxRX < 2 {
+		t.Skipf("skipping: eth0 has at most %d rx channels", orig.MaxRX)
+	}
+	next := orig
+	next.RX = 2
+	if next.RX == orig.RX {
+		next.RX = 1
+	}
+	if err := SetChannels("eth0", next); err != nil {
+		t.Fatalf("SetChannels: %v", err)
+	}
+	if got, _ := GetChannels("eth0"); got.RX != next.RX {
+		t.Errorf("rx channels = %d, want %d", got.RX, next.RX)
+	}
+	if _, err := GetRings("eth0"); err != nil && !IsNotSupported(err) {
+		t.Errorf("GetRings: %v", err)
+	}
+}
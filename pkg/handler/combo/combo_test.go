@@ -17,6 +17,7 @@ type fakeHandler struct {
 	prepareResult *handler.PrepareResult
 	prepareErr    error
 	unprepareErr  error
+	validateErr   error
 
 	prepareCalled   bool
 	unprepareCalled bool
@@ -25,7 +26,9 @@ type fakeHandler struct {
 func (f *fakeHandler) Type() handler.DeviceType { return f.deviceType }
 func (f *fakeHandler) Kinds() []string          { return f.kinds }
 
-func (f *fakeHandler) Validate(_ context.Context, _ *handler.DeviceConfig) error { return nil }
+func (f *fakeHandler) Validate(_ context.Context, _ *handler.DeviceConfig) error {
+	return f.validateErr
+}
 
 func (f *fakeHandler) Prepare(_ context.Context, _ *handler.PrepareRequest) (*handler.PrepareResult, error) {
 	f.prepareCalled = true
@@ -64,6 +67,17 @@ func TestRoCEHandler_Validate(t *testing.T) {
 	}
 }
 
+func TestRoCEHandler_ValidateChecksNetdev(t *testing.T) {
+	netdev := &fakeHandler{validateErr: fmt.Errorf("bad netdev config")}
+	h := NewRoCEHandler(&fakeHandler{}, netdev)
+
+	if err := h.Validate(context.Background(), &handler.DeviceConfig{
+		Combo: &handler.ComboConfig{},
+	}); err == nil {
+		t.Error("expected the netdev handler's validation error")
+	}
+}
+
 func TestRoCEHandler_PrepareNilCombo(t *testing.T) {
 	h := NewRoCEHandler(&fakeHandler{}, &fakeHandler{})
 	_, err := h.Prepare(context.Background(), &handler.PrepareRequest{
@@ -281,6 +295,40 @@ func TestRoCEHandler_UnprepareSuccess(t *testing.T) {
 	}
 }
 
+// restoringHandler is a fakeHandler that records the allocation it restores.
+type restoringHandler struct {
+	fakeHandler
+	restored *handler.AllocationInfo
+}
+
+func (r *restoringHandler) Restore(alloc *handler.AllocationInfo) { r.restored = alloc }
+
+func TestRoCEHandler_Restore(t *testing.T) {
+	netdev := &restoringHandler{}
+	h := NewRoCEHandler(&fakeHandler{}, netdev)
+
+	h.Restore(&handler.AllocationInfo{
+		Type:     handler.DeviceTypeCombo,
+		Kind:     "roce",
+		ClaimUID: "restore0-0000-0000-0000-000000000000",
+		Metadata: map[string]string{
+			"net_created":        "dmrestore0",
+			"net_container_name": "roce0",
+			"net_config":         `{"kind":"dummy","addresses":["192.0.2.10/24"]}`,
+		},
+	})
+	got := netdev.restored
+	if got == nil {
+		t.Fatal("netdev handler did not restore the allocation")
+	}
+	if got.ClaimUID != "restore0-0000-0000-0000-000000000000" || got.Type != handler.DeviceTypeNetdev {
+		t.Errorf("restored allocation = %+v", got)
+	}
+	if got.Metadata["containerName"] != "roce0" || got.Metadata["netdevConfig"] == "" {
+		t.Errorf("restored metadata = %v", got.Metadata)
+	}
+}
+
 func TestRoCEHandler_UnpreparePartialFailure(t *testing.T) {
 	rdma := &fakeHandler{
 		deviceType:   handler.DeviceTypeRDMA,
@@ -31,7 +31,8 @@ func (h *RoCEHandler) Validate(ctx context.Context, cfg *handler.DeviceConfig) e
 	if cfg.Combo == nil {
 		return fmt.Errorf("combo config is required for roce")
 	}
-	return nil
+	// The netdev side is prepared by the netdev handler, which checks it.
+	return h.netdevHandler.Validate(ctx, &handler.DeviceConfig{Type: handler.DeviceTypeNetdev, Netdev: &cfg.Combo.Netdev})
 }
 
 func (h *RoCEHandler) Prepare(ctx context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
@@ -92,11 +93,36 @@ func (h *RoCEHandler) Prepare(ctx context.Context, req *handler.PrepareRequest)
 				"rdma_ibdev":         rdmaResult.Allocation.Metadata["ibdev"],
 				"net_created":        netResult.Allocation.Metadata["createdInterface"],
 				"net_host_end":       netResult.Allocation.Metadata["hostEnd"],
+				// And for rebuilding its link setups after a restart
+				"net_container_name": netResult.Allocation.Metadata["containerName"],
+				"net_config":         netResult.Allocation.Metadata["netdevConfig"],
 			},
 		},
 	}, nil
 }
 
+// Restore lets the netdev handler register the pod-side link setups of a
+// persisted allocation again.
+func (h *RoCEHandler) Restore(alloc *handler.AllocationInfo) {
+	restorer, ok := h.netdevHandler.(handler.RestoringHandler)
+	if !ok {
+		return
+	}
+	metadata := map[string]string{
+		"containerName": alloc.Metadata["net_container_name"],
+	}
+	if cfg := alloc.Metadata["net_config"]; cfg != "" {
+		metadata["netdevConfig"] = cfg
+	}
+	restorer.Restore(&handler.AllocationInfo{
+		Type:     handler.DeviceTypeNetdev,
+		Kind:     "dummy",
+		ClaimUID: alloc.ClaimUID,
+		ShareID:  alloc.ShareID,
+		Metadata: metadata,
+	})
+}
+
 func (h *RoCEHandler) Unprepare(ctx context.Context, req *handler.UnprepareRequest) error {
 	var errs []error
 
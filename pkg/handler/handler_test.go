@@ -137,3 +137,49 @@ func TestHandlerRegistry_OverwriteKind(t *testing.T) {
 		t.Error("expected second handler to overwrite first")
 	}
 }
+
+// fakeVirtualHandler is a fakeHandler that creates devices on demand.
+type fakeVirtualHandler struct {
+	fakeHandler
+}
+
+func (f *fakeVirtualHandler) Virtual() bool { return true }
+
+func TestHandlerRegistry_VirtualKinds(t *testing.T) {
+	reg := NewHandlerRegistry()
+
+	reg.Register(&fakeVirtualHandler{fakeHandler{typ: DeviceTypeNetdev, kinds: []string{"veth"}}})
+	reg.Register(&fakeVirtualHandler{fakeHandler{typ: DeviceTypeNetdev, kinds: []string{"dummy"}}})
+	reg.Register(&fakeHandler{typ: DeviceTypeNetdev, kinds: []string{"sriov-vf"}})
+	reg.Register(&fakeHandler{typ: DeviceTypeRDMA, kinds: []string{"uverbs"}})
+
+	got := reg.VirtualKinds()
+	want := []string{"dummy", "veth"}
+	if len(got) != len(want) {
+		t.Fatalf("VirtualKinds() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("VirtualKinds()[%d] = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPrepareRequest_NameSuffix(t *testing.T) {
+	tests := []struct {
+		name string
+		req  PrepareRequest
+		want string
+	}{
+		{"claim UID", PrepareRequest{ClaimUID: "aabbccdd-1111-2222-3333-444444444444"}, "aabbccdd"},
+		{"share ID wins", PrepareRequest{ClaimUID: "aabbccdd-1111-2222-3333-444444444444", ShareID: "5ba1e000-aaaa-bbbb-cccc-dddddddddddd"}, "5ba1e000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.req.NameSuffix(); got != tt.want {
+				t.Errorf("NameSuffix() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
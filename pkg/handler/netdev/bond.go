@@ -0,0 +1,419 @@
+package netdev
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+)
+
+const (
+	defaultBondMode   = "active-backup"
+	defaultBondMiimon = 100
+)
+
+// BondHandler aggregates the netdevs allocated to a claim (VFs, physical
+// interfaces) and any configured host interfaces into a bond.
+//
+// The kernel does not let a bond change network namespace, so the members
+// are moved into the pod and the bond is assembled there by the NRI plugin
+// once they have arrived.  The pod sees the bond under netdev.interfaceName
+// and its members as <interfaceName>m<N>.
+type BondHandler struct {
+	// Links assembles the bond inside the pod netns.  Required.
+	Links *nri.LinkSetupTracker
+
+	// VFs reserves the VF members for the claim, so that no sriov-vf claim
+	// is handed one while it is bonded.  If nil, VF members are not
+	// reserved.
+	VFs *SriovVfHandler
+}
+
+func (h *BondHandler) Type() handler.DeviceType { return handler.DeviceTypeNetdev }
+func (h *BondHandler) Kinds() []string          { return []string{"bond"} }
+func (h *BondHandler) Virtual() bool            { return true }
+
+// Restore registers the bond assembly and the pod-side setups of a persisted
+// allocation again.
+func (h *BondHandler) Restore(alloc *handler.AllocationInfo) {
+	var cfg handler.NetdevConfig
+	var members []bondMember
+	if err := json.Unmarshal([]byte(alloc.Metadata["netdevConfig"]), &cfg); err != nil || h.Links == nil {
+		return
+	}
+	if err := json.Unmarshal([]byte(alloc.Metadata["bondMembers"]), &members); err != nil || len(members) == 0 {
+		klog.Warningf("Restoring claim %s: corrupt bond members: %v", alloc.ClaimUID, err)
+		return
+	}
+	if h.VFs != nil {
+		for _, m := range members {
+			if m.PF == "" {
+				continue
+			}
+			if err := h.VFs.owners.reserve(m.PF, m.VFIndex, alloc.ClaimUID); err != nil {
+				klog.Warningf("Restoring claim %s: %v", alloc.ClaimUID, err)
+			}
+		}
+	}
+	h.addAssembly(alloc.ClaimUID, alloc.Metadata["containerName"], members, &cfg)
+	restoreLinkSetups(h.Links, nil, alloc)
+}
+
+func (h *BondHandler) Validate(_ context.Context, cfg *handler.DeviceConfig) error {
+	if cfg.Netdev == nil {
+		return fmt.Errorf("netdev config is required for bond")
+	}
+	if err := rejectEthtool(cfg.Netdev, "bond"); err != nil {
+		return err
+	}
+	bond := cfg.Netdev.Bond
+	if bond == nil {
+		return nil
+	}
+	mode, err := bondMode(bond.Mode)
+	if err != nil {
+		return err
+	}
+	if bond.Miimon != nil && *bond.Miimon < 0 {
+		return fmt.Errorf("bond miimon must not be negative")
+	}
+	if bond.XmitHashPolicy != "" {
+		if netlink.StringToBondXmitHashPolicy(bond.XmitHashPolicy) == netlink.BOND_XMIT_HASH_POLICY_UNKNOWN {
+			return fmt.Errorf("unsupported bond xmit hash policy %q", bond.XmitHashPolicy)
+		}
+		switch mode {
+		case netlink.BOND_MODE_BALANCE_XOR, netlink.BOND_MODE_802_3AD, netlink.BOND_MODE_BALANCE_TLB:
+		default:
+			return fmt.Errorf("bond xmit hash policy does not apply to mode %s", mode)
+		}
+	}
+	for i, member := range bond.Members {
+		if member == "" {
+			return fmt.Errorf("bond member %d has no name", i)
+		}
+		if slices.Index(bond.Members, member) != i {
+			return fmt.Errorf("bond member %s listed twice", member)
+		}
+	}
+	// Members may also come from the allocation, so an empty list is
+	// checked in Prepare.
+	return validateLinkConfig(cfg.Netdev, h.Links)
+}
+
+// bondMode parses a bonding mode name; "" means active-backup.
+func bondMode(name string) (netlink.BondMode, error) {
+	if name == "" {
+		name = defaultBondMode
+	}
+	mode := netlink.StringToBondMode(name)
+	if mode == netlink.BOND_MODE_UNKNOWN {
+		return mode, fmt.Errorf("unsupported bond mode %q", name)
+	}
+	return mode, nil
+}
+
+// bondMember is a member interface and the host-side state Unprepare puts
+// back once it has returned from the pod.
+type bondMember struct {
+	Name          string `json:"name"`
+	ContainerName string `json:"containerName"`
+	Up            bool   `json:"up"`
+	MTU           int    `json:"mtu"`
+	MAC           string `json:"mac"`
+
+	// PF and VFIndex identify a VF member reserved with the SR-IOV handler.
+	PF      string `json:"pf,omitempty"`
+	VFIndex int    `json:"vfIndex,omitempty"`
+}
+
+// memberNetdev returns the host netdev behind an allocated device, or "" if
+// the device is not one (slot and pool devices, RDMA devices).
+func memberNetdev(device string) (string, error) {
+	if strings.HasPrefix(device, "netdev-virtual-") || strings.HasSuffix(device, "-pool") {
+		return "", nil
+	}
+	if name, ok := strings.CutPrefix(device, "netdev-"); ok {
+		return name, nil
+	}
+	if pf, index, ok := SplitOnDemandVFDevice(device); ok {
+		if vfs, err := listVFs(pf); err == nil {
+			if vfs[index] == "" {
+				return "", fmt.Errorf("on-demand VF %d on PF %s has not been created", index, pf)
+			}
+			return vfs[index], nil
+		}
+	}
+	vfName, _ := SplitVFProfileDevice(device)
+	if _, err := os.Stat(filepath.Join(netSysfsRoot, vfName)); err != nil {
+		klog.V(2).Infof("Allocated device %s is not a host netdev, not bonding it", device)
+		return "", nil
+	}
+	return vfName, nil
+}
+
+// bondMembers lists the interfaces to enslave: the claim's allocated
+// netdevs followed by the configured host interfaces.
+func bondMembers(req *handler.PrepareRequest) ([]string, error) {
+	var members []string
+	for _, device := range req.AllocatedDevices {
+		name, err := memberNetdev(device)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" && !slices.Contains(members, name) {
+			members = append(members, name)
+		}
+	}
+	if bond := req.Config.Netdev.Bond; bond != nil {
+		for _, name := range bond.Members {
+			if slices.Contains(members, name) {
+				return nil, fmt.Errorf("bond member %s is both allocated and configured", name)
+			}
+			members = append(members, name)
+		}
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("bond has no members: allocate netdevs in the claim or set netdev.bond.members")
+	}
+	return members, nil
+}
+
+func (h *BondHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (_ *handler.PrepareResult, err error) {
+	cfg := req.Config.Netdev
+	if cfg == nil {
+		return nil, fmt.Errorf("netdev config is required for bond")
+	}
+	if h.Links == nil {
+		return nil, fmt.Errorf("bond requires the NRI plugin to assemble the bond in the pod")
+	}
+	bondCfg := handler.BondConfig{}
+	if cfg.Bond != nil {
+		bondCfg = *cfg.Bond
+	}
+	if _, err := bondMode(bondCfg.Mode); err != nil {
+		return nil, err
+	}
+
+	names, err := bondMembers(req)
+	if err != nil {
+		return nil, err
+	}
+
+	containerName := cfg.InterfaceName
+	if containerName == "" {
+		containerName = "bond0"
+	}
+
+	members := make([]bondMember, 0, len(names))
+	defer func() {
+		if err != nil {
+			h.releaseVFs(req.ClaimUID, members)
+		}
+	}()
+	netDevices := make([]*cdispec.LinuxNetDevice, 0, len(names))
+	for i, name := range names {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("bond member %s not found: %w", name, err)
+		}
+		attrs := link.Attrs()
+		if attrs.MasterIndex != 0 {
+			return nil, fmt.Errorf("bond member %s is already enslaved (master index %d)", name, attrs.MasterIndex)
+		}
+		m := bondMember{
+			Name:          name,
+			ContainerName: fmt.Sprintf("%.12sm%d", containerName, i),
+			Up:            attrs.Flags&net.FlagUp != 0,
+			MTU:           attrs.MTU,
+			MAC:           attrs.HardwareAddr.String(),
+		}
+		if h.VFs != nil {
+			pf, index, isVF, err := h.VFs.reserveNetdev(req.ClaimUID, name)
+			if err != nil {
+				return nil, fmt.Errorf("reserve bond member %s: %w", name, err)
+			}
+			if isVF {
+				m.PF, m.VFIndex = pf, index
+			}
+		}
+		members = append(members, m)
+		netDevices = append(netDevices, &cdispec.LinuxNetDevice{HostInterfaceName: m.Name, Name: m.ContainerName})
+	}
+
+	h.addAssembly(req.ClaimUID, containerName, members, cfg)
+
+	encoded, _ := json.Marshal(members)
+	metadata := map[string]string{
+		"containerName": containerName,
+		"bondMembers":   string(encoded),
+	}
+	// Registered after the bond assembly, which creates the link.
+	if err = registerLinkConfig(h.Links, req, containerName, metadata); err != nil {
+		h.Links.Release(req.ClaimUID)
+		return nil, err
+	}
+	klog.Infof("Prepared bond %s for claim %s with members %v", containerName, req.ClaimUID, names)
+
+	ifName := fmt.Sprintf("bd%s", req.NameSuffix())
+	return &handler.PrepareResult{
+		PoolName:   "default",
+		DeviceName: ifName,
+		CDIEdits:   &cdispec.ContainerEdits{NetDevices: netDevices},
+		Allocation: &handler.AllocationInfo{
+			Type: handler.DeviceTypeNetdev, Kind: "bond",
+			ClaimUID: req.ClaimUID, DeviceName: ifName,
+			Metadata: metadata,
+		},
+	}, nil
+}
+
+// releaseVFs frees the VF members the claim reserved.
+func (h *BondHandler) releaseVFs(claimUID string, members []bondMember) {
+	if h.VFs == nil {
+		return
+	}
+	for _, m := range members {
+		if m.PF != "" {
+			h.VFs.ReleaseVF(claimUID, m.PF, m.VFIndex)
+		}
+	}
+}
+
+// addAssembly registers the link setup assembling the bond from members
+// once they are in the pod netns.
+func (h *BondHandler) addAssembly(claimUID, containerName string, members []bondMember, cfg *handler.NetdevConfig) {
+	bondCfg := handler.BondConfig{}
+	if cfg.Bond != nil {
+		bondCfg = *cfg.Bond
+	}
+	h.Links.AddPending(&nri.LinkSetup{
+		ClaimUID: claimUID,
+		IfName:   members[0].ContainerName,
+		Apply: func(netlink.Link) error {
+			return assembleBond(containerName, members, &bondCfg, cfg.MTU)
+		},
+		Teardown: func(netlink.Link) error {
+			return deleteLinkByName(containerName)
+		},
+	})
+}
+
+// assembleBond creates the bond inside the pod netns and enslaves the
+// members, which the runtime has already moved there.
+func assembleBond(name string, members []bondMember, cfg *handler.BondConfig, mtu int) error {
+	mode, err := bondMode(cfg.Mode)
+	if err != nil {
+		return err
+	}
+	bond := netlink.NewLinkBond(netlink.LinkAttrs{Name: name, MTU: mtu})
+	bond.Mode = mode
+	bond.Miimon = defaultBondMiimon
+	if cfg.Miimon != nil {
+		bond.Miimon = *cfg.Miimon
+	}
+	if cfg.XmitHashPolicy != "" {
+		bond.XmitHashPolicy = netlink.StringToBondXmitHashPolicy(cfg.XmitHashPolicy)
+	}
+	if err := netlink.LinkAdd(bond); err != nil {
+		return fmt.Errorf("create bond %s: %w", name, err)
+	}
+
+	for _, m := range members {
+		link, err := netlink.LinkByName(m.ContainerName)
+		if err == nil {
+			// The kernel only enslaves links that are down.
+			err = netlink.LinkSetDown(link)
+		}
+		if err == nil {
+			err = netlink.LinkSetMaster(link, bond)
+		}
+		if err != nil {
+			netlink.LinkDel(bond)
+			return fmt.Errorf("enslave %s to bond %s: %w", m.ContainerName, name, err)
+		}
+	}
+	if err := netlink.LinkSetUp(bond); err != nil {
+		netlink.LinkDel(bond)
+		return fmt.Errorf("bring up bond %s: %w", name, err)
+	}
+	klog.Infof("Assembled bond %s (mode=%s) from %d members", name, mode, len(members))
+	return nil
+}
+
+func deleteLinkByName(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil // already gone
+	}
+	return netlink.LinkDel(link)
+}
+
+// restoreBondMember puts back the host-side state of a member that has
+// returned from the pod netns.
+func restoreBondMember(m bondMember) error {
+	link, err := netlink.LinkByName(m.Name)
+	if err != nil {
+		klog.V(2).Infof("Bond member %s not on the host (not returned from the pod yet?): %v", m.Name, err)
+		return nil
+	}
+	if link.Attrs().MasterIndex != 0 {
+		if err := netlink.LinkSetNoMaster(link); err != nil {
+			return fmt.Errorf("release %s from its bond: %w", m.Name, err)
+		}
+	}
+	if m.MTU > 0 && link.Attrs().MTU != m.MTU {
+		if err := netlink.LinkSetMTU(link, m.MTU); err != nil {
+			return fmt.Errorf("restore MTU of %s: %w", m.Name, err)
+		}
+	}
+	if mac, err := net.ParseMAC(m.MAC); err == nil && link.Attrs().HardwareAddr.String() != mac.String() {
+		if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+			return fmt.Errorf("restore MAC of %s: %w", m.Name, err)
+		}
+	}
+	setState := netlink.LinkSetDown
+	if m.Up {
+		setState = netlink.LinkSetUp
+	}
+	if err := setState(link); err != nil {
+		return fmt.Errorf("restore link state of %s: %w", m.Name, err)
+	}
+	return nil
+}
+
+func (h *BondHandler) Unprepare(_ context.Context, req *handler.UnprepareRequest) error {
+	// Deleting the bond releases its members inside the pod netns.
+	if h.Links != nil {
+		h.Links.Release(req.ClaimUID)
+	}
+
+	var members []bondMember
+	if data := req.Allocation.Metadata["bondMembers"]; data != "" {
+		if err := json.Unmarshal([]byte(data), &members); err != nil {
+			return fmt.Errorf("decode bond members: %w", err)
+		}
+	}
+	var errs []error
+	for _, m := range members {
+		if err := restoreBondMember(m); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to restore bond members: %v", errs)
+	}
+	h.releaseVFs(req.ClaimUID, members)
+	klog.Infof("Released bond %s members for claim %s", req.Allocation.Metadata["containerName"], req.ClaimUID)
+	return nil
+}
@@ -0,0 +1,167 @@
+package netdev
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/handler"
+)
+
+// createdBridgeAlias marks bridges the driver created, so any claim can tell
+// them apart from bridges managed by someone else, even after a restart.
+const createdBridgeAlias = "dra.example.com: created for claims"
+
+// bridgeMu serializes bridge creation, port attachment and deletion across
+// claims, so that a bridge is never deleted as unused while a port is being
+// attached to it.
+var bridgeMu sync.Mutex
+
+// validateBridgeConfig checks bridge attachment settings.
+func validateBridgeConfig(cfg *handler.BridgeConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.Name == "" {
+		return fmt.Errorf("bridge.name is required")
+	}
+	if len(cfg.Name) > 15 {
+		return fmt.Errorf("bridge name %q is longer than 15 characters", cfg.Name)
+	}
+	if cfg.PVID < 0 || cfg.PVID > 4094 {
+		return fmt.Errorf("bridge PVID %d out of range 1-4094", cfg.PVID)
+	}
+	for _, vid := range cfg.VLANs {
+		if vid < 1 || vid > 4094 {
+			return fmt.Errorf("bridge VLAN %d out of range 1-4094", vid)
+		}
+		if vid == cfg.PVID {
+			return fmt.Errorf("bridge VLAN %d is both the PVID and tagged", vid)
+		}
+	}
+	return nil
+}
+
+// vlanFiltering reports whether the attachment needs a VLAN-aware bridge.
+func vlanFiltering(cfg *handler.BridgeConfig) bool {
+	return cfg.PVID > 0 || len(cfg.VLANs) > 0
+}
+
+// ensureBridge returns the bridge named in cfg, creating it if it does not
+// exist.  A bridge that already exists is never reconfigured.  Called with
+// bridgeMu held.
+func ensureBridge(cfg *handler.BridgeConfig) (netlink.Link, bool, error) {
+	if link, err := netlink.LinkByName(cfg.Name); err == nil {
+		br, ok := link.(*netlink.Bridge)
+		if !ok {
+			return nil, false, fmt.Errorf("%s is a %s device, not a Linux bridge", cfg.Name, link.Type())
+		}
+		if vlanFiltering(cfg) && (br.VlanFiltering == nil || !*br.VlanFiltering) {
+			return nil, false, fmt.Errorf("bridge %s does not have VLAN filtering enabled", cfg.Name)
+		}
+		return br, false, nil
+	}
+
+	filtering := vlanFiltering(cfg)
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: cfg.Name}}
+	if filtering {
+		// Only sent when needed: kernels without bridge VLAN support
+		// reject the attribute even when it is off.
+		br.VlanFiltering = &filtering
+	}
+	if err := netlink.LinkAdd(br); err != nil {
+		return nil, false, fmt.Errorf("failed to create bridge %s: %w", cfg.Name, err)
+	}
+	if err := netlink.LinkSetAlias(br, createdBridgeAlias); err != nil {
+		netlink.LinkDel(br)
+		return nil, false, fmt.Errorf("failed to mark bridge %s: %w", cfg.Name, err)
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		netlink.LinkDel(br)
+		return nil, false, fmt.Errorf("failed to bring up bridge %s: %w", cfg.Name, err)
+	}
+	klog.Infof("Created bridge %s (vlan_filtering=%t)", cfg.Name, filtering)
+	return br, true, nil
+}
+
+// attachBridgePort adds port to br with the VLAN, hairpin and isolation
+// settings of cfg.
+func attachBridgePort(port, br netlink.Link, cfg *handler.BridgeConfig) error {
+	name := port.Attrs().Name
+	if err := netlink.LinkSetMaster(port, br); err != nil {
+		return fmt.Errorf("failed to add %s to bridge %s: %w", name, cfg.Name, err)
+	}
+
+	if cfg.PVID > 0 {
+		// Replace the bridge's default PVID the kernel gave the new port.
+		vlans, err := netlink.BridgeVlanList()
+		if err != nil {
+			return fmt.Errorf("failed to list VLANs of %s: %w", name, err)
+		}
+		for _, info := range vlans[int32(port.Attrs().Index)] {
+			if info.PortVID() && info.Vid != uint16(cfg.PVID) {
+				if err := netlink.BridgeVlanDel(port, info.Vid, true, true, false, true); err != nil {
+					return fmt.Errorf("failed to remove default VLAN %d from %s: %w", info.Vid, name, err)
+				}
+			}
+		}
+		if err := netlink.BridgeVlanAdd(port, uint16(cfg.PVID), true, true, false, true); err != nil {
+			return fmt.Errorf("failed to set PVID %d on %s: %w", cfg.PVID, name, err)
+		}
+	}
+	for _, vid := range cfg.VLANs {
+		if err := netlink.BridgeVlanAdd(port, uint16(vid), false, false, false, true); err != nil {
+			return fmt.Errorf("failed to add tagged VLAN %d to %s: %w", vid, name, err)
+		}
+	}
+	if cfg.Hairpin {
+		if err := netlink.LinkSetHairpin(port, true); err != nil {
+			return fmt.Errorf("failed to enable hairpin on %s: %w", name, err)
+		}
+	}
+	if cfg.Isolated {
+		if err := netlink.LinkSetIsolated(port, true); err != nil {
+			return fmt.Errorf("failed to isolate %s: %w", name, err)
+		}
+	}
+	klog.Infof("Attached %s to bridge %s (pvid=%d, vlans=%v, hairpin=%t, isolated=%t)",
+		name, cfg.Name, cfg.PVID, cfg.VLANs, cfg.Hairpin, cfg.Isolated)
+	return nil
+}
+
+// deleteBridgeIfUnused deletes a bridge the driver created once it has no
+// ports left.
+func deleteBridgeIfUnused(name string) error {
+	bridgeMu.Lock()
+	defer bridgeMu.Unlock()
+	return deleteUnusedBridge(name)
+}
+
+// deleteUnusedBridge is deleteBridgeIfUnused with bridgeMu held.
+func deleteUnusedBridge(name string) error {
+	br, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil // already gone
+	}
+	if br.Attrs().Alias != createdBridgeAlias {
+		klog.V(2).Infof("Keeping bridge %s: not created by the driver", name)
+		return nil
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %w", err)
+	}
+	for _, link := range links {
+		if link.Attrs().MasterIndex == br.Attrs().Index {
+			klog.V(2).Infof("Keeping bridge %s: %s is still attached", name, link.Attrs().Name)
+			return nil
+		}
+	}
+	if err := netlink.LinkDel(br); err != nil {
+		return fmt.Errorf("failed to delete bridge %s: %w", name, err)
+	}
+	klog.Infof("Deleted unused bridge %s", name)
+	return nil
+}
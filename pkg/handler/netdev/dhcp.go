@@ -0,0 +1,93 @@
+package netdev
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/example/dra-poc/pkg/dhcp"
+	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
+)
+
+// In dhcp IPAM mode the driver runs DHCP clients for the claim on the link
+// once it is in the pod netns.  Moving a link drops its addresses, so the
+// clients are started by the NRI plugin like the other pod-side settings,
+// and stopped, releasing the leases, on Unprepare.
+
+// usesDHCP reports whether cfg asks for DHCP addresses.
+func usesDHCP(cfg *handler.NetdevConfig) bool {
+	return cfg != nil && cfg.IPAM != nil && cfg.IPAM.Mode == handler.IPAMModeDHCP
+}
+
+// validateDHCP checks the dhcp IPAM settings of cfg.  The clients need the
+// NRI plugin and a DHCP manager.
+func validateDHCP(cfg *handler.NetdevConfig, links *nri.LinkSetupTracker, mgr *dhcp.Manager) error {
+	if !usesDHCP(cfg) {
+		return nil
+	}
+	if links == nil || mgr == nil {
+		return fmt.Errorf("ipam mode dhcp needs the NRI plugin and the DHCP client")
+	}
+	if cfg.State == "down" {
+		return fmt.Errorf("ipam mode dhcp needs the link up")
+	}
+	if cfg.Routing != nil && cfg.Routing.VRF != "" {
+		return fmt.Errorf("a VRF cannot be combined with ipam mode dhcp")
+	}
+	if opts := dhcpOptions(cfg); !opts.IPv4 && !opts.IPv6 {
+		return fmt.Errorf("ipam.dhcp disables both IPv4 and IPv6")
+	}
+	return nil
+}
+
+// dhcpOptions returns the client options for cfg.  Like a gateway, the
+// DHCPv4 router is used only as the config's routing asks: in its table, or
+// as the pod's default route with routing.defaultRoute.  An IPv4 gateway
+// in the config replaces it.
+func dhcpOptions(cfg *handler.NetdevConfig) dhcp.Options {
+	opts := dhcp.Options{IPv4: true}
+	if c := cfg.IPAM.DHCP; c != nil {
+		if c.IPv4 != nil {
+			opts.IPv4 = *c.IPv4
+		}
+		opts.IPv6 = c.IPv6
+		opts.Hostname = c.Hostname
+	}
+	if r := cfg.Routing; r != nil {
+		opts.DefaultRoute, opts.Table, opts.RulePriority = r.DefaultRoute, r.Table, r.RulePriority
+		if opts.Table != 0 && opts.RulePriority == 0 {
+			opts.RulePriority = defaultRulePriority
+		}
+	}
+	for _, gw := range cfg.Gateways {
+		if ip := net.ParseIP(gw); ip != nil && ip.To4() != nil {
+			opts.NoRouter, opts.DefaultRoute = true, false
+		}
+	}
+	return opts
+}
+
+// registerDHCP registers a link setup starting the claim's DHCP clients on
+// containerName in the pod netns.  Apply returns once every requested
+// family has a lease, so the container starts with its addresses.
+func registerDHCP(links *nri.LinkSetupTracker, mgr *dhcp.Manager, req *handler.PrepareRequest, containerName string, metadata map[string]string) {
+	if !usesDHCP(req.Config.Netdev) || links == nil || mgr == nil {
+		return
+	}
+	opts := dhcpOptions(req.Config.Netdev)
+	setup := &nri.LinkSetup{ClaimUID: req.ClaimUID, IfName: containerName}
+	setup.Apply = func(netlink.Link) error {
+		return mgr.Start(req.ClaimUID, setup.NetnsPath, containerName, opts)
+	}
+	links.AddPending(setup)
+	metadata["dhcp"] = "true"
+}
+
+// stopDHCP releases the claim's DHCP leases.
+func stopDHCP(mgr *dhcp.Manager, req *handler.UnprepareRequest) {
+	if mgr != nil && req.Allocation.Metadata["dhcp"] == "true" {
+		mgr.Stop(req.ClaimUID)
+	}
+}
@@ -8,20 +8,34 @@ import (
 	"k8s.io/klog/v2"
 
 	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
 	cdispec "tags.cncf.io/container-device-interface/specs-go"
 )
 
 // DummyHandler creates dummy network interfaces (useful for testing)
-type DummyHandler struct{}
+type DummyHandler struct {
+	// Links applies addresses and routes after the link moved into the pod.
+	// Nil rejects claims that ask for them.
+	Links *nri.LinkSetupTracker
+}
 
 func (h *DummyHandler) Type() handler.DeviceType { return handler.DeviceTypeNetdev }
 func (h *DummyHandler) Kinds() []string          { return []string{"dummy"} }
+func (h *DummyHandler) Virtual() bool            { return true }
+
+// Restore registers the pod-side setups of a persisted allocation again.
+func (h *DummyHandler) Restore(alloc *handler.AllocationInfo) {
+	restoreLinkSetups(h.Links, nil, alloc)
+}
 
 func (h *DummyHandler) Validate(_ context.Context, cfg *handler.DeviceConfig) error {
 	if cfg.Netdev == nil {
 		return fmt.Errorf("netdev config is required for dummy")
 	}
-	return nil
+	if err := rejectEthtool(cfg.Netdev, "dummy"); err != nil {
+		return err
+	}
+	return validateLinkConfig(cfg.Netdev, h.Links)
 }
 
 func (h *DummyHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
@@ -31,7 +45,7 @@ func (h *DummyHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (
 	}
 
 	// Generate a unique dummy interface name
-	ifName := fmt.Sprintf("dm%s", req.ClaimUID[:8])
+	ifName := fmt.Sprintf("dm%s", req.NameSuffix())
 
 	containerName := cfg.InterfaceName
 	if containerName == "" {
@@ -66,6 +80,15 @@ func (h *DummyHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (
 
 	klog.Infof("Created dummy interface %s", ifName)
 
+	metadata := map[string]string{
+		"createdInterface": ifName,
+		"containerName":    containerName,
+	}
+	if err := registerLinkConfig(h.Links, req, containerName, metadata); err != nil {
+		netlink.LinkDel(link)
+		return nil, err
+	}
+
 	return &handler.PrepareResult{
 		PoolName:   "default",
 		DeviceName: ifName,
@@ -82,15 +105,15 @@ func (h *DummyHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (
 			Kind:       "dummy",
 			ClaimUID:   req.ClaimUID,
 			DeviceName: ifName,
-			Metadata: map[string]string{
-				"createdInterface": ifName,
-				"containerName":    containerName,
-			},
+			Metadata:   metadata,
 		},
 	}, nil
 }
 
 func (h *DummyHandler) Unprepare(_ context.Context, req *handler.UnprepareRequest) error {
+	if h.Links != nil {
+		h.Links.Release(req.ClaimUID)
+	}
 	ifName := req.Allocation.Metadata["createdInterface"]
 	if ifName == "" {
 		return nil
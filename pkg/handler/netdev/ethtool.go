@@ -0,0 +1,224 @@
+package netdev
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/ethtool"
+	"github.com/example/dra-poc/pkg/handler"
+)
+
+// Ethtool settings are applied in the host netns before the link moves into
+// the pod, and stay with it.  For devices the driver did not create, the
+// original values of what a claim changed are stored in the allocation
+// metadata, so that Unprepare can restore them even after a driver restart.
+
+// ethtoolSettings are the original values of the settings a claim changed.
+type ethtoolSettings struct {
+	Channels *ethtool.Channels `json:"channels,omitempty"`
+	Rings    *ethtool.Rings    `json:"rings,omitempty"`
+	Coalesce *ethtool.Coalesce `json:"coalesce,omitempty"`
+	Features map[string]bool   `json:"features,omitempty"` // Kernel names
+}
+
+// validateEthtool checks the ethtool settings of cfg.
+func validateEthtool(cfg *handler.EthtoolConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	check := func(name string, v *int) error {
+		if v != nil && (*v < 0 || int64(*v) > math.MaxUint32) {
+			return fmt.Errorf("ethtool %s %d out of range", name, *v)
+		}
+		return nil
+	}
+	var errs []error
+	if r := cfg.Rings; r != nil {
+		errs = append(errs, check("rings.rx", r.RX), check("rings.tx", r.TX))
+		if (r.RX != nil && *r.RX == 0) || (r.TX != nil && *r.TX == 0) {
+			errs = append(errs, fmt.Errorf("ethtool ring sizes must be positive"))
+		}
+	}
+	if c := cfg.Channels; c != nil {
+		errs = append(errs, check("channels.rx", c.RX), check("channels.tx", c.TX),
+			check("channels.other", c.Other), check("channels.combined", c.Combined))
+	}
+	if c := cfg.Coalesce; c != nil {
+		errs = append(errs, check("coalesce.rxUsecs", c.RXUsecs), check("coalesce.rxFrames", c.RXFrames),
+			check("coalesce.txUsecs", c.TXUsecs), check("coalesce.txFrames", c.TXFrames))
+	}
+	for name := range cfg.Features {
+		if name == "" {
+			errs = append(errs, fmt.Errorf("empty ethtool feature name"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rejectEthtool fails for ethtool settings on a kind whose handler does not
+// apply them.
+func rejectEthtool(cfg *handler.NetdevConfig, kind string) error {
+	if cfg.Ethtool != nil {
+		return fmt.Errorf("ethtool settings are not supported on %s links", kind)
+	}
+	return nil
+}
+
+// applyEthtool applies the claim's ethtool settings to ifname.  With
+// restore, the original values are recorded in metadata for Unprepare.  On
+// failure, whatever was changed is reverted.
+func applyEthtool(ifname string, cfg *handler.EthtoolConfig, metadata map[string]string, restore bool) error {
+	if cfg == nil {
+		return nil
+	}
+	var orig ethtoolSettings
+	fail := func(err error) error {
+		if rerr := setEthtool(ifname, orig); rerr != nil {
+			klog.Warningf("Failed to roll back ethtool settings of %s: %v", ifname, rerr)
+		}
+		return err
+	}
+
+	// Channels first: some drivers resize the rings along with them.
+	if c := cfg.Channels; c != nil {
+		cur, err := ethtool.GetChannels(ifname)
+		if err != nil {
+			return err
+		}
+		next := cur
+		setUint32(&next.RX, c.RX)
+		setUint32(&next.TX, c.TX)
+		setUint32(&next.Other, c.Other)
+		setUint32(&next.Combined, c.Combined)
+		if next.RX > cur.MaxRX || next.TX > cur.MaxTX || next.Other > cur.MaxOther || next.Combined > cur.MaxCombined {
+			return fail(fmt.Errorf("channels of %s exceed the maxima rx %d, tx %d, other %d, combined %d",
+				ifname, cur.MaxRX, cur.MaxTX, cur.MaxOther, cur.MaxCombined))
+		}
+		if next != cur {
+			if err := ethtool.SetChannels(ifname, next); err != nil {
+				return fail(err)
+			}
+			orig.Channels = &cur
+		}
+	}
+	if r := cfg.Rings; r != nil {
+		cur, err := ethtool.GetRings(ifname)
+		if err != nil {
+			return fail(err)
+		}
+		next := cur
+		setUint32(&next.RX, r.RX)
+		setUint32(&next.TX, r.TX)
+		if next.RX > cur.RXMax || next.TX > cur.TXMax {
+			return fail(fmt.Errorf("rings of %s exceed the maxima rx %d, tx %d", ifname, cur.RXMax, cur.TXMax))
+		}
+		if next != cur {
+			if err := ethtool.SetRings(ifname, next); err != nil {
+				return fail(err)
+			}
+			orig.Rings = &cur
+		}
+	}
+	if c := cfg.Coalesce; c != nil {
+		cur, err := ethtool.GetCoalesce(ifname)
+		if err != nil {
+			return fail(err)
+		}
+		next := cur
+		setUint32(&next.RXUsecs, c.RXUsecs)
+		setUint32(&next.RXMaxFrames, c.RXFrames)
+		setUint32(&next.TXUsecs, c.TXUsecs)
+		setUint32(&next.TXMaxFrames, c.TXFrames)
+		setFlag(&next.AdaptiveRX, c.AdaptiveRX)
+		setFlag(&next.AdaptiveTX, c.AdaptiveTX)
+		if next != cur {
+			if err := ethtool.SetCoalesce(ifname, next); err != nil {
+				return fail(err)
+			}
+			orig.Coalesce = &cur
+		}
+	}
+	if len(cfg.Features) > 0 {
+		want, err := ethtool.Resolve(ifname, cfg.Features)
+		if err != nil {
+			return fail(err)
+		}
+		cur, err := ethtool.GetFeatures(ifname)
+		if err != nil {
+			return fail(err)
+		}
+		// Recorded first, as a failed change may have applied some.
+		orig.Features = make(map[string]bool)
+		for name := range want {
+			orig.Features[name] = cur[name].Active
+		}
+		if err := ethtool.SetFeatures(ifname, want); err != nil {
+			return fail(err)
+		}
+	}
+
+	if restore {
+		data, err := json.Marshal(orig)
+		if err != nil {
+			return fail(err)
+		}
+		metadata["ethtoolOriginal"] = string(data)
+	}
+	klog.Infof("Applied ethtool settings to %s", ifname)
+	return nil
+}
+
+// restoreEthtool puts back the original ethtool settings of ifname recorded
+// in metadata.
+func restoreEthtool(ifname string, metadata map[string]string) error {
+	data, ok := metadata["ethtoolOriginal"]
+	if !ok {
+		return nil
+	}
+	var orig ethtoolSettings
+	if err := json.Unmarshal([]byte(data), &orig); err != nil {
+		return fmt.Errorf("corrupt ethtool snapshot for %s: %w", ifname, err)
+	}
+	if err := setEthtool(ifname, orig); err != nil {
+		return fmt.Errorf("failed to restore ethtool settings of %s: %w", ifname, err)
+	}
+	klog.Infof("Restored ethtool settings of %s", ifname)
+	return nil
+}
+
+// setEthtool applies s in the reverse order of applyEthtool.
+func setEthtool(ifname string, s ethtoolSettings) error {
+	var errs []error
+	if len(s.Features) > 0 {
+		errs = append(errs, ethtool.SetFeatures(ifname, s.Features))
+	}
+	if s.Coalesce != nil {
+		errs = append(errs, ethtool.SetCoalesce(ifname, *s.Coalesce))
+	}
+	if s.Rings != nil {
+		errs = append(errs, ethtool.SetRings(ifname, *s.Rings))
+	}
+	if s.Channels != nil {
+		errs = append(errs, ethtool.SetChannels(ifname, *s.Channels))
+	}
+	return errors.Join(errs...)
+}
+
+func setUint32(dst *uint32, v *int) {
+	if v != nil {
+		*dst = uint32(*v)
+	}
+}
+
+func setFlag(dst *uint32, v *bool) {
+	if v != nil {
+		*dst = 0
+		if *v {
+			*dst = 1
+		}
+	}
+}
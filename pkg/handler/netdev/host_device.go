@@ -8,18 +8,29 @@ import (
 	"k8s.io/klog/v2"
 
 	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
 	cdispec "tags.cncf.io/container-device-interface/specs-go"
 )
 
 // HostDeviceHandler moves a pre-existing host network interface into a pod.
-// The interface is expected to already exist on the host, fully configured
-// (IP addresses, routes, etc.) by an external system. This handler simply
-// tells the container runtime to move it into the container's network
-// namespace via CDI netDevices.
-type HostDeviceHandler struct{}
+// The interface is expected to already exist on the host, configured by an
+// external system. This handler simply tells the container runtime to move it
+// into the container's network namespace via CDI netDevices.  Addresses do not
+// survive the move, so they are given in the claim config instead.
+type HostDeviceHandler struct {
+	// Links applies addresses and routes after the link moved into the pod.
+	// Nil rejects claims that ask for them.
+	Links *nri.LinkSetupTracker
+}
 
 func (h *HostDeviceHandler) Type() handler.DeviceType { return handler.DeviceTypeNetdev }
 func (h *HostDeviceHandler) Kinds() []string          { return []string{"host-device"} }
+func (h *HostDeviceHandler) Virtual() bool            { return true }
+
+// Restore registers the pod-side setups of a persisted allocation again.
+func (h *HostDeviceHandler) Restore(alloc *handler.AllocationInfo) {
+	restoreLinkSetups(h.Links, nil, alloc)
+}
 
 func (h *HostDeviceHandler) Validate(_ context.Context, cfg *handler.DeviceConfig) error {
 	if cfg.Netdev == nil {
@@ -28,7 +39,10 @@ func (h *HostDeviceHandler) Validate(_ context.Context, cfg *handler.DeviceConfi
 	if cfg.Netdev.HostDevice == "" {
 		return fmt.Errorf("hostDevice (the name of the existing host interface) is required for host-device")
 	}
-	return nil
+	if err := validateEthtool(cfg.Netdev.Ethtool); err != nil {
+		return err
+	}
+	return validateLinkConfig(cfg.Netdev, h.Links)
 }
 
 func (h *HostDeviceHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
@@ -60,6 +74,23 @@ func (h *HostDeviceHandler) Prepare(_ context.Context, req *handler.PrepareReque
 		}
 	}
 
+	metadata := map[string]string{
+		"hostDevice":    hostIF,
+		"containerName": containerName,
+	}
+	recordHostMAC(cfg, link, metadata)
+	// Restored on Unprepare, as the interface is owned externally.
+	if err := applyEthtool(hostIF, cfg.Ethtool, metadata, true); err != nil {
+		return nil, fmt.Errorf("failed to apply ethtool settings to %s: %w", hostIF, err)
+	}
+
+	if err := registerLinkConfig(h.Links, req, containerName, metadata); err != nil {
+		if rerr := restoreEthtool(hostIF, metadata); rerr != nil {
+			klog.Warningf("%v", rerr)
+		}
+		return nil, err
+	}
+
 	klog.Infof("Prepared host-device %s for claim %s (will appear as %s in container)",
 		hostIF, req.ClaimUID, containerName)
 
@@ -79,10 +110,7 @@ func (h *HostDeviceHandler) Prepare(_ context.Context, req *handler.PrepareReque
 			Kind:       "host-device",
 			ClaimUID:   req.ClaimUID,
 			DeviceName: hostIF,
-			Metadata: map[string]string{
-				"hostDevice":    hostIF,
-				"containerName": containerName,
-			},
+			Metadata:   metadata,
 		},
 	}, nil
 }
@@ -91,7 +119,26 @@ func (h *HostDeviceHandler) Unprepare(_ context.Context, req *handler.UnprepareR
 	// The interface was created by an external system and will be returned to
 	// the host network namespace automatically when the container exits.
 	// We intentionally do NOT delete it.
+	if h.Links != nil {
+		h.Links.Release(req.ClaimUID)
+	}
 	hostIF := req.Allocation.Metadata["hostDevice"]
+	_, hasEthtool := req.Allocation.Metadata["ethtoolOriginal"]
+	_, hasMAC := req.Allocation.Metadata["hostMAC"]
+	if hasEthtool || hasMAC {
+		// Back in the host netns once the pod's netns is gone.
+		link, err := netlink.LinkByName(hostIF)
+		if err != nil {
+			klog.Warningf("Host interface %s not found, cannot restore its settings: %v", hostIF, err)
+		} else {
+			if err := restoreEthtool(hostIF, req.Allocation.Metadata); err != nil {
+				return err
+			}
+			if err := restoreHostMAC(link, req.Allocation.Metadata); err != nil {
+				return err
+			}
+		}
+	}
 	klog.Infof("Released host-device %s for claim %s (device owned externally, not deleted)",
 		hostIF, req.ClaimUID)
 	return nil
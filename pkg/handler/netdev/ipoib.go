@@ -8,6 +8,7 @@ import (
 	"k8s.io/klog/v2"
 
 	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
 	cdispec "tags.cncf.io/container-device-interface/specs-go"
 )
 
@@ -27,22 +28,38 @@ import (
 //   - interfaceName: name the interface should have inside the container
 //   - mtu:           override the default MTU
 //   - mode:          "datagram" (default) or "connected"
-type IpoibHandler struct{}
+//   - addresses, gateways, routes, state: applied inside the pod netns
+type IpoibHandler struct {
+	// Links applies addresses and routes after the link moved into the pod.
+	// Nil rejects claims that ask for them.
+	Links *nri.LinkSetupTracker
+}
 
 func (h *IpoibHandler) Type() handler.DeviceType { return handler.DeviceTypeNetdev }
 func (h *IpoibHandler) Kinds() []string          { return []string{"ipoib"} }
 
+// Restore registers the pod-side setups of a persisted allocation again.
+func (h *IpoibHandler) Restore(alloc *handler.AllocationInfo) {
+	restoreLinkSetups(h.Links, nil, alloc)
+}
+
 func (h *IpoibHandler) Validate(_ context.Context, cfg *handler.DeviceConfig) error {
 	if cfg.Netdev == nil {
 		return fmt.Errorf("netdev config is required for ipoib")
 	}
+	if err := rejectEthtool(cfg.Netdev, "ipoib"); err != nil {
+		return err
+	}
 	if cfg.Netdev.Parent == "" {
 		return fmt.Errorf("parent interface is required for ipoib")
 	}
 	if cfg.Netdev.Pkey == 0 {
 		return fmt.Errorf("pkey is required for ipoib")
 	}
-	return nil
+	if cfg.Netdev.MAC != "" {
+		return fmt.Errorf("the hardware address of an ipoib interface cannot be set")
+	}
+	return validateLinkConfig(cfg.Netdev, h.Links)
 }
 
 func (h *IpoibHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
@@ -77,7 +94,7 @@ func (h *IpoibHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (
 
 	// Interface name on the host: <parent>.<pkey hex> truncated via claim UID
 	// to avoid collisions when the same pkey is used across multiple claims.
-	ifName := fmt.Sprintf("ib%s", req.ClaimUID[:8])
+	ifName := fmt.Sprintf("ib%s", req.NameSuffix())
 
 	containerName := cfg.InterfaceName
 	if containerName == "" {
@@ -115,6 +132,17 @@ func (h *IpoibHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (
 	klog.Infof("Created ipoib interface %s (parent=%s, pkey=0x%04x, mode=%s)",
 		ifName, parent, pkey, cfg.Mode)
 
+	metadata := map[string]string{
+		"createdInterface": ifName,
+		"parent":           parent,
+		"pkey":             fmt.Sprintf("0x%04x", pkey),
+		"containerName":    containerName,
+	}
+	if err := registerLinkConfig(h.Links, req, containerName, metadata); err != nil {
+		netlink.LinkDel(ipoib)
+		return nil, err
+	}
+
 	return &handler.PrepareResult{
 		PoolName:   "default",
 		DeviceName: ifName,
@@ -128,17 +156,15 @@ func (h *IpoibHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (
 			Kind:       "ipoib",
 			ClaimUID:   req.ClaimUID,
 			DeviceName: ifName,
-			Metadata: map[string]string{
-				"createdInterface": ifName,
-				"parent":           parent,
-				"pkey":             fmt.Sprintf("0x%04x", pkey),
-				"containerName":    containerName,
-			},
+			Metadata:   metadata,
 		},
 	}, nil
 }
 
 func (h *IpoibHandler) Unprepare(_ context.Context, req *handler.UnprepareRequest) error {
+	if h.Links != nil {
+		h.Links.Release(req.ClaimUID)
+	}
 	ifName := req.Allocation.Metadata["createdInterface"]
 	if ifName == "" {
 		return nil
@@ -7,24 +7,58 @@ import (
 	"github.com/vishvananda/netlink"
 	"k8s.io/klog/v2"
 
+	"github.com/example/dra-poc/pkg/dhcp"
 	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
 	cdispec "tags.cncf.io/container-device-interface/specs-go"
 )
 
 // IpvlanHandler creates ipvlan interfaces off a parent
-type IpvlanHandler struct{}
+//
+// The parent is taken from the allocated <parent>-ipvlan-pool device, so a
+// CEL selector on the pool's parent attribute picks it; netdev.parent is only
+// required when no pool device was allocated.
+//
+// When the claim consumed bandwidth from the parent's pool device, the link is
+// shaped to that rate once it is inside the pod netns.
+type IpvlanHandler struct {
+	// Links applies bandwidth shaping, addresses and routes after the link
+	// moved into the pod.  Nil disables shaping and rejects claims that ask
+	// for addresses or routes.
+	Links *nri.LinkSetupTracker
+	// DHCP runs the clients of claims in dhcp IPAM mode.  Nil rejects such
+	// claims.
+	DHCP *dhcp.Manager
+}
 
 func (h *IpvlanHandler) Type() handler.DeviceType { return handler.DeviceTypeNetdev }
 func (h *IpvlanHandler) Kinds() []string          { return []string{"ipvlan"} }
+func (h *IpvlanHandler) Virtual() bool            { return true }
+
+// Restore registers the pod-side setups of a persisted allocation again.
+func (h *IpvlanHandler) Restore(alloc *handler.AllocationInfo) {
+	restoreLinkSetups(h.Links, h.DHCP, alloc)
+}
 
 func (h *IpvlanHandler) Validate(_ context.Context, cfg *handler.DeviceConfig) error {
 	if cfg.Netdev == nil {
 		return fmt.Errorf("netdev config is required for ipvlan")
 	}
-	if cfg.Netdev.Parent == "" {
-		return fmt.Errorf("parent interface is required for ipvlan")
+	if err := rejectEthtool(cfg.Netdev, "ipvlan"); err != nil {
+		return err
 	}
-	return nil
+	if cfg.Netdev.MAC != "" {
+		return fmt.Errorf("ipvlan interfaces share the parent's MAC, which cannot be set")
+	}
+	// The parent may come from the allocated pool device instead, so an
+	// empty parent is checked in Prepare.
+	if err := validateLinkConfig(cfg.Netdev, h.Links); err != nil {
+		return err
+	}
+	if usesDHCP(cfg.Netdev) && cfg.Netdev.Mode == "l3" {
+		return fmt.Errorf("ipam mode dhcp needs ipvlan mode l2, l3 does not pass broadcasts")
+	}
+	return validateDHCP(cfg.Netdev, h.Links, h.DHCP)
 }
 
 func (h *IpvlanHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
@@ -33,9 +67,9 @@ func (h *IpvlanHandler) Prepare(_ context.Context, req *handler.PrepareRequest)
 		return nil, fmt.Errorf("netdev config is required for ipvlan")
 	}
 
-	parent := cfg.Parent
-	if parent == "" {
-		return nil, fmt.Errorf("parent interface is required for ipvlan")
+	parent, err := resolveParent(req, "ipvlan")
+	if err != nil {
+		return nil, err
 	}
 
 	// Resolve ipvlan mode
@@ -50,7 +84,7 @@ func (h *IpvlanHandler) Prepare(_ context.Context, req *handler.PrepareRequest)
 	}
 
 	// Generate a unique interface name
-	ifName := fmt.Sprintf("iv%s", req.ClaimUID[:8])
+	ifName := fmt.Sprintf("iv%s", req.NameSuffix())
 
 	containerName := cfg.InterfaceName
 	if containerName == "" {
@@ -87,6 +121,18 @@ func (h *IpvlanHandler) Prepare(_ context.Context, req *handler.PrepareRequest)
 
 	klog.Infof("Created ipvlan interface %s (parent=%s, mode=%s)", ifName, parent, cfg.Mode)
 
+	metadata := map[string]string{
+		"createdInterface": ifName,
+		"parent":           parent,
+		"containerName":    containerName,
+	}
+	if err := registerLinkConfig(h.Links, req, containerName, metadata); err != nil {
+		netlink.LinkDel(iv)
+		return nil, err
+	}
+	registerDHCP(h.Links, h.DHCP, req, containerName, metadata)
+	registerShaping(h.Links, req, containerName, metadata)
+
 	return &handler.PrepareResult{
 		PoolName:   "default",
 		DeviceName: ifName,
@@ -103,16 +149,18 @@ func (h *IpvlanHandler) Prepare(_ context.Context, req *handler.PrepareRequest)
 			Kind:       "ipvlan",
 			ClaimUID:   req.ClaimUID,
 			DeviceName: ifName,
-			Metadata: map[string]string{
-				"createdInterface": ifName,
-				"parent":           parent,
-				"containerName":    containerName,
-			},
+			Metadata:   metadata,
 		},
 	}, nil
 }
 
 func (h *IpvlanHandler) Unprepare(_ context.Context, req *handler.UnprepareRequest) error {
+	// Release the leases while the link still has its addresses and MAC.
+	stopDHCP(h.DHCP, req)
+	if h.Links != nil {
+		h.Links.Release(req.ClaimUID)
+	}
+
 	ifName := req.Allocation.Metadata["createdInterface"]
 	if ifName == "" {
 		return nil
@@ -0,0 +1,682 @@
+package netdev
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/dhcp"
+	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
+)
+
+// CDI netDevices only moves and renames a link, and moving a link between
+// namespaces drops its addresses.  Addresses, routes, the MAC, the
+// operstate and per-interface sysctls are therefore applied by the NRI
+// plugin once the link is in the pod netns.
+
+// linkConfig is the parsed pod-side configuration of a link.
+type linkConfig struct {
+	addresses []*net.IPNet // IP is the address, not the network
+	gateways  []net.IP
+	routes    []linkRoute
+	mac       net.HardwareAddr
+	state     string // "up", "down" or "" to leave alone
+
+	table        int    // Route table for the link, 0 for main
+	rulePriority int    // Priority of the source rules selecting table
+	defaultRoute bool   // Also route by default through the link in main
+	vrf          string // VRF device bound to table that enslaves the link
+
+	sysctls []linkSysctl
+}
+
+// linkSysctl is a setting under net.<family>.conf.<ifname>.
+type linkSysctl struct {
+	family string // "ipv4" or "ipv6"
+	name   string
+	value  string
+}
+
+type linkRoute struct {
+	dst    *net.IPNet
+	via    net.IP
+	metric int
+}
+
+// hasLinkConfig reports whether cfg asks for pod-side link settings.
+func hasLinkConfig(cfg *handler.NetdevConfig) bool {
+	return cfg != nil && (len(cfg.Addresses) > 0 || len(cfg.Gateways) > 0 || len(cfg.Routes) > 0 ||
+		cfg.MAC != "" || cfg.State != "" || cfg.Routing != nil || len(cfg.Sysctls) > 0)
+}
+
+// validateLinkConfig checks the pod-side link settings of cfg.  They need
+// the NRI plugin, so they are rejected when links is nil.
+func validateLinkConfig(cfg *handler.NetdevConfig, links *nri.LinkSetupTracker) error {
+	if !hasLinkConfig(cfg) {
+		return nil
+	}
+	if links == nil {
+		return fmt.Errorf("addresses, routes, mac, state, routing and sysctls need the NRI plugin to configure the link in the pod")
+	}
+	_, err := parseLinkConfig(cfg)
+	return err
+}
+
+// parseLinkConfig parses the pod-side link settings of cfg, or returns nil
+// if there are none.
+func parseLinkConfig(cfg *handler.NetdevConfig) (*linkConfig, error) {
+	if !hasLinkConfig(cfg) {
+		return nil, nil
+	}
+	c := &linkConfig{state: cfg.State}
+	for _, s := range cfg.Addresses {
+		ip, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", s, err)
+		}
+		c.addresses = append(c.addresses, &net.IPNet{IP: ip, Mask: subnet.Mask})
+	}
+	families := map[bool]bool{}
+	for _, s := range cfg.Gateways {
+		gw := net.ParseIP(s)
+		if gw == nil {
+			return nil, fmt.Errorf("invalid gateway %q", s)
+		}
+		v4 := gw.To4() != nil
+		if families[v4] {
+			return nil, fmt.Errorf("more than one %s gateway", familyName(gw))
+		}
+		families[v4] = true
+		c.gateways = append(c.gateways, gw)
+	}
+	for _, r := range cfg.Routes {
+		_, dst, err := net.ParseCIDR(r.Dst)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route destination %q: %w", r.Dst, err)
+		}
+		route := linkRoute{dst: dst, metric: r.Metric}
+		if r.Via != "" {
+			if route.via = net.ParseIP(r.Via); route.via == nil {
+				return nil, fmt.Errorf("invalid route gateway %q", r.Via)
+			}
+			if (route.via.To4() != nil) != (dst.IP.To4() != nil) {
+				return nil, fmt.Errorf("route to %s via %s mixes address families", r.Dst, r.Via)
+			}
+		}
+		if r.Metric < 0 {
+			return nil, fmt.Errorf("route to %s has a negative metric", r.Dst)
+		}
+		c.routes = append(c.routes, route)
+	}
+	if cfg.MAC != "" {
+		mac, err := net.ParseMAC(cfg.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC %q: %w", cfg.MAC, err)
+		}
+		c.mac = mac
+	}
+	if r := cfg.Routing; r != nil {
+		if err := parseRouting(c, r); err != nil {
+			return nil, err
+		}
+		if r.VRF != "" && r.VRF == cfg.InterfaceName {
+			return nil, fmt.Errorf("VRF %s has the same name as the interface", r.VRF)
+		}
+	}
+	if err := parseSysctls(c, cfg.Sysctls); err != nil {
+		return nil, err
+	}
+	switch cfg.State {
+	case "":
+		// Setting the MAC takes the link down, so bring it back up.
+		if len(c.addresses) > 0 || len(c.gateways) > 0 || len(c.routes) > 0 || c.defaultRoute || c.vrf != "" || c.mac != nil {
+			c.state = "up"
+		}
+	case "up":
+	case "down":
+		if len(c.gateways) > 0 || len(c.routes) > 0 || c.defaultRoute {
+			return nil, fmt.Errorf("routes cannot be added to a link that is down")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported link state %q (use up or down)", cfg.State)
+	}
+	return c, nil
+}
+
+// Reserved route tables (see /etc/iproute2/rt_tables).
+const (
+	tableDefault = 253
+	tableMain    = 254
+	tableLocal   = 255
+)
+
+// defaultRulePriority puts the source rules ahead of the l3mdev (1000),
+// main (32766) and default (32767) rules.
+const defaultRulePriority = 100
+
+func parseRouting(c *linkConfig, r *handler.RoutingConfig) error {
+	switch {
+	case r.Table < 0 || int64(r.Table) > math.MaxUint32:
+		return fmt.Errorf("routing table %d out of range", r.Table)
+	case r.Table == tableDefault || r.Table == tableMain || r.Table == tableLocal:
+		return fmt.Errorf("routing table %d is reserved", r.Table)
+	case r.RulePriority < 0:
+		return fmt.Errorf("routing rule priority %d is negative", r.RulePriority)
+	case r.RulePriority > 0 && r.Table == 0:
+		return fmt.Errorf("routing.rulePriority needs routing.table")
+	case r.VRF != "" && r.Table == 0:
+		return fmt.Errorf("VRF %s needs routing.table", r.VRF)
+	case r.VRF != "" && r.DefaultRoute:
+		return fmt.Errorf("routing.defaultRoute cannot be combined with VRF %s", r.VRF)
+	case len(r.VRF) > 15 || strings.ContainsAny(r.VRF, "/ "):
+		return fmt.Errorf("invalid VRF name %q", r.VRF)
+	}
+	c.table, c.rulePriority, c.defaultRoute, c.vrf = r.Table, r.RulePriority, r.DefaultRoute, r.VRF
+	if c.rulePriority == 0 {
+		c.rulePriority = defaultRulePriority
+	}
+	return nil
+}
+
+var sysctlName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// parseSysctls parses per-interface sysctls keyed by family and name, e.g.
+// ipv4.rp_filter.  They are sorted, so they are applied in a stable order.
+func parseSysctls(c *linkConfig, sysctls map[string]string) error {
+	for key, value := range sysctls {
+		family, name, _ := strings.Cut(key, ".")
+		if (family != "ipv4" && family != "ipv6") || !sysctlName.MatchString(name) {
+			return fmt.Errorf("invalid sysctl %q: want ipv4.<name> or ipv6.<name>", key)
+		}
+		if value == "" || strings.Contains(value, "\n") {
+			return fmt.Errorf("invalid value %q for sysctl %s", value, key)
+		}
+		c.sysctls = append(c.sysctls, linkSysctl{family: family, name: name, value: value})
+	}
+	sort.Slice(c.sysctls, func(i, j int) bool {
+		a, b := c.sysctls[i], c.sysctls[j]
+		return a.family+"."+a.name < b.family+"."+b.name
+	})
+	if sysctls["ipv6.disable_ipv6"] == "1" {
+		for _, a := range c.addresses {
+			if a.IP.To4() == nil {
+				return fmt.Errorf("ipv6.disable_ipv6 conflicts with address %s", a)
+			}
+		}
+	}
+	return nil
+}
+
+// procSysNet is where the current netns's sysctls are.
+const procSysNet = "/proc/sys/net"
+
+// setSysctls writes the link's sysctls.  /proc/sys/net shows the netns of
+// the calling thread, which is the pod's while the link is configured.
+func (c *linkConfig) setSysctls(name string) error {
+	for _, s := range c.sysctls {
+		path := filepath.Join(procSysNet, s.family, "conf", name, s.name)
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("sysctl net.%s.conf.%s.%s: %w", s.family, name, s.name, err)
+		}
+		_, err = f.WriteString(s.value)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("set sysctl net.%s.conf.%s.%s to %s: %w", s.family, name, s.name, s.value, err)
+		}
+	}
+	return nil
+}
+
+func familyName(ip net.IP) string {
+	if ip.To4() != nil {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// registerLinkConfig asks the NRI plugin to apply the pod-side link
+// settings of the claim to containerName once it is in the pod netns.
+// Nothing is registered if the settings, which include what the driver
+// filled in after validateLinkConfig, do not parse.
+func registerLinkConfig(links *nri.LinkSetupTracker, req *handler.PrepareRequest, containerName string, metadata map[string]string) error {
+	if links == nil {
+		return nil
+	}
+	c, err := parseLinkConfig(req.Config.Netdev)
+	if err != nil {
+		return err
+	}
+	// Kept for restoreLinkSetups, with what the driver filled in (IPAM
+	// addresses, MACs).
+	if data, err := json.Marshal(req.Config.Netdev); err == nil {
+		metadata["netdevConfig"] = string(data)
+	}
+	if c == nil {
+		return nil
+	}
+
+	// Addresses and routes go with the netns.  A physical link keeps its
+	// MAC when it returns to the host; see recordHostMAC.
+	links.AddPending(&nri.LinkSetup{
+		ClaimUID: req.ClaimUID,
+		IfName:   containerName,
+		Apply:    c.apply,
+	})
+	if len(req.Config.Netdev.Addresses) > 0 {
+		metadata["addresses"] = strings.Join(req.Config.Netdev.Addresses, ",")
+	}
+	return nil
+}
+
+// recordHostMAC saves the MAC of a physical link that enters the pod with a
+// MAC from the claim.  The pod netns is gone by the time the link returns to
+// the host, so Unprepare puts it back there with restoreHostMAC.
+func recordHostMAC(cfg *handler.NetdevConfig, link netlink.Link, metadata map[string]string) {
+	if cfg.MAC != "" {
+		metadata["hostMAC"] = link.Attrs().HardwareAddr.String()
+	}
+}
+
+// restoreHostMAC sets the MAC recordHostMAC saved back on link, which is
+// in the host netns again.
+func restoreHostMAC(link netlink.Link, metadata map[string]string) error {
+	mac, err := net.ParseMAC(metadata["hostMAC"])
+	if err != nil || link.Attrs().HardwareAddr.String() == mac.String() {
+		return nil
+	}
+	name := link.Attrs().Name
+	// Most drivers only change the MAC of a link that is down.
+	if err := netlink.LinkSetDown(link); err != nil {
+		return fmt.Errorf("bring down %s to restore its MAC: %w", name, err)
+	}
+	if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+		return fmt.Errorf("restore MAC of %s: %w", name, err)
+	}
+	klog.Infof("Restored MAC %s on %s", mac, name)
+	return nil
+}
+
+// restoreLinkSetups registers the link setups of a prepared claim again after
+// a driver restart, in the order of Prepare: link settings, DHCP clients and
+// shaping.  Setups that were applied before the restart are made active
+// again rather than pending.
+func restoreLinkSetups(links *nri.LinkSetupTracker, mgr *dhcp.Manager, alloc *handler.AllocationInfo) {
+	data, ok := alloc.Metadata["netdevConfig"]
+	if links == nil || !ok {
+		return
+	}
+	var cfg handler.NetdevConfig
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		klog.Warningf("Restoring claim %s: corrupt netdev config: %v", alloc.ClaimUID, err)
+		return
+	}
+	req := &handler.PrepareRequest{
+		ClaimUID: alloc.ClaimUID,
+		ShareID:  alloc.ShareID,
+		Config:   &handler.DeviceConfig{Type: handler.DeviceTypeNetdev, Netdev: &cfg},
+	}
+	containerName := alloc.Metadata["containerName"]
+	scratch := make(map[string]string)
+	if err := registerLinkConfig(links, req, containerName, scratch); err != nil {
+		klog.Warningf("Restoring claim %s: %v", alloc.ClaimUID, err)
+		return
+	}
+	if alloc.Metadata["dhcp"] == "true" {
+		registerDHCP(links, mgr, req, containerName, scratch)
+	}
+	if bps, err := strconv.ParseUint(alloc.Metadata["bandwidth"], 10, 64); err == nil && alloc.Metadata["ifb"] != "" {
+		addShaping(links, alloc.ClaimUID, containerName, alloc.Metadata["ifb"], bps)
+	}
+}
+
+// apply configures link, which is in the current netns.
+func (c *linkConfig) apply(link netlink.Link) error {
+	name := link.Attrs().Name
+	if c.mac != nil {
+		if err := netlink.LinkSetDown(link); err != nil {
+			return fmt.Errorf("set %s down: %w", name, err)
+		}
+		if err := netlink.LinkSetHardwareAddr(link, c.mac); err != nil {
+			return fmt.Errorf("set MAC of %s: %w", name, err)
+		}
+		link.Attrs().HardwareAddr = c.mac
+	}
+	// Enslave before adding addresses, so that their subnet routes land in
+	// the VRF's table.
+	if c.vrf != "" {
+		if err := c.enslave(link); err != nil {
+			return err
+		}
+	}
+	// Before the link comes up, as some, e.g. ipv6.addr_gen_mode and
+	// ipv6.accept_ra, are only read then.
+	if err := c.setSysctls(name); err != nil {
+		return err
+	}
+	switch c.state {
+	case "up":
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("set %s up: %w", name, err)
+		}
+	case "down":
+		if err := netlink.LinkSetDown(link); err != nil {
+			return fmt.Errorf("set %s down: %w", name, err)
+		}
+	}
+
+	for _, a := range c.addresses {
+		addr := &netlink.Addr{IPNet: a}
+		if a.IP.To4() == nil {
+			// Skip duplicate address detection so the address is usable,
+			// and can be announced, right away.
+			addr.Flags = syscall.IFA_F_NODAD
+		}
+		if err := netlink.AddrReplace(link, addr); err != nil {
+			return fmt.Errorf("add address %s to %s: %w", a, name, err)
+		}
+	}
+	for _, gw := range c.gateways {
+		if c.table != 0 {
+			if err := c.addRoute(link, defaultRoute(gw), gw, 0, c.table); err != nil {
+				return err
+			}
+		}
+		switch {
+		case c.defaultRoute:
+			// Take over the pod's default route, as the claim asked.
+			if err := c.addRoute(link, defaultRoute(gw), gw, 0, 0); err != nil {
+				return err
+			}
+		case c.table == 0:
+			if err := c.addDefaultRoute(link, gw); err != nil {
+				return err
+			}
+		}
+	}
+	if c.defaultRoute {
+		// Families without a gateway route by default directly on the link.
+		for _, a := range c.addresses {
+			if !c.hasGateway(a.IP) {
+				if err := c.addRoute(link, defaultRoute(a.IP), nil, 0, 0); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, r := range c.routes {
+		if err := c.addRoute(link, r.dst, r.via, r.metric, c.table); err != nil {
+			return err
+		}
+	}
+	if c.table != 0 && c.vrf == "" {
+		if err := c.addSourceRouting(link); err != nil {
+			return err
+		}
+	}
+
+	if c.state == "up" {
+		c.announce(link)
+	}
+	return nil
+}
+
+// addRoute adds a route through link to table, 0 for main, replacing one
+// to the same destination.
+func (c *linkConfig) addRoute(link netlink.Link, dst *net.IPNet, via net.IP, metric, table int) error {
+	if err := netlink.RouteReplace(c.route(link, dst, via, metric, table)); err != nil {
+		return fmt.Errorf("add route to %s via %s: %w", dst, via, err)
+	}
+	return nil
+}
+
+// addDefaultRoute adds a default route via gw to the main table.  Unlike
+// addRoute it does not replace the default route of the pod's primary
+// interface, which needs routing.defaultRoute: it adds a route with a higher
+// metric, used only once the other is gone.
+func (c *linkConfig) addDefaultRoute(link netlink.Link, gw net.IP) error {
+	family := netlink.FAMILY_V4
+	if gw.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: tableMain}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("list %s routes: %w", familyName(gw), err)
+	}
+	metric := 0
+	for _, r := range routes {
+		if r.Dst != nil && !isDefaultRoute(r.Dst) {
+			continue
+		}
+		if r.LinkIndex == link.Attrs().Index && r.Gw.Equal(gw) {
+			return nil // Added by an earlier attempt
+		}
+		metric = max(metric, r.Priority+1)
+	}
+	if err := netlink.RouteAdd(c.route(link, defaultRoute(gw), gw, metric, 0)); err != nil {
+		return fmt.Errorf("add default route via %s: %w", gw, err)
+	}
+	return nil
+}
+
+func isDefaultRoute(dst *net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+// route returns a route through link to table, 0 for main.
+func (c *linkConfig) route(link netlink.Link, dst *net.IPNet, via net.IP, metric, table int) *netlink.Route {
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       dst,
+		Gw:        via,
+		Priority:  metric,
+		Table:     table,
+	}
+	if via == nil {
+		route.Scope = netlink.SCOPE_LINK
+	} else if !c.onSubnet(via) {
+		// A gateway outside the link's subnets is reachable on the link.
+		route.Flags = int(netlink.FLAG_ONLINK)
+	}
+	return route
+}
+
+// addSourceRouting copies the subnet routes of the link's addresses into
+// its table and selects the table for traffic from those addresses.
+func (c *linkConfig) addSourceRouting(link netlink.Link) error {
+	for _, a := range c.addresses {
+		subnet := &net.IPNet{IP: a.IP.Mask(a.Mask), Mask: a.Mask}
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       subnet,
+			Src:       a.IP,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     c.table,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("add route to %s in table %d: %w", subnet, c.table, err)
+		}
+
+		rule := netlink.NewRule()
+		rule.Src = hostPrefix(a.IP)
+		rule.Table = c.table
+		rule.Priority = c.rulePriority
+		rule.Family = netlink.FAMILY_V4
+		if a.IP.To4() == nil {
+			rule.Family = netlink.FAMILY_V6
+		}
+		// Rules cannot be replaced; one left by an earlier attempt is fine.
+		if err := netlink.RuleAdd(rule); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("add rule from %s lookup %d: %w", a.IP, c.table, err)
+		}
+	}
+	return nil
+}
+
+// enslave adds link to the VRF, creating the VRF if no other link of the
+// pod created it yet.
+func (c *linkConfig) enslave(link netlink.Link) error {
+	vrf, err := netlink.LinkByName(c.vrf)
+	if err != nil {
+		if err := netlink.LinkAdd(&netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: c.vrf}, Table: uint32(c.table)}); err != nil {
+			return fmt.Errorf("create VRF %s: %w", c.vrf, err)
+		}
+		if vrf, err = netlink.LinkByName(c.vrf); err != nil {
+			return fmt.Errorf("VRF %s: %w", c.vrf, err)
+		}
+		klog.Infof("Created VRF %s (table %d)", c.vrf, c.table)
+	}
+	v, ok := vrf.(*netlink.Vrf)
+	if !ok {
+		return fmt.Errorf("%s exists and is a %s, not a VRF", c.vrf, vrf.Type())
+	}
+	if v.Table != uint32(c.table) {
+		return fmt.Errorf("VRF %s uses table %d, not %d", c.vrf, v.Table, c.table)
+	}
+	if err := netlink.LinkSetUp(vrf); err != nil {
+		return fmt.Errorf("set VRF %s up: %w", c.vrf, err)
+	}
+	if link.Attrs().MasterIndex == vrf.Attrs().Index {
+		return nil
+	}
+	if err := netlink.LinkSetMasterByIndex(link, vrf.Attrs().Index); err != nil {
+		return fmt.Errorf("enslave %s to VRF %s: %w", link.Attrs().Name, c.vrf, err)
+	}
+	return nil
+}
+
+func (c *linkConfig) hasGateway(ip net.IP) bool {
+	for _, gw := range c.gateways {
+		if (gw.To4() != nil) == (ip.To4() != nil) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostPrefix(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func (c *linkConfig) onSubnet(ip net.IP) bool {
+	for _, a := range c.addresses {
+		if a.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultRoute(gw net.IP) *net.IPNet {
+	if gw.To4() != nil {
+		return &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	}
+	return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+}
+
+// announce sends a gratuitous ARP for each IPv4 address and an unsolicited
+// neighbor advertisement for each IPv6 address, so peers update caches that
+// may still point at a previous owner of the address.
+func (c *linkConfig) announce(link netlink.Link) {
+	mac := link.Attrs().HardwareAddr
+	if len(mac) != 6 {
+		return // Not Ethernet (e.g. IPoIB)
+	}
+	for _, a := range c.addresses {
+		var err error
+		if ip4 := a.IP.To4(); ip4 != nil {
+			err = sendGratuitousARP(link.Attrs().Index, mac, ip4)
+		} else {
+			err = sendUnsolicitedNA(link.Attrs().Index, mac, a.IP)
+		}
+		if err != nil {
+			klog.Warningf("Failed to announce %s on %s: %v", a.IP, link.Attrs().Name, err)
+		}
+	}
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// sendGratuitousARP broadcasts an ARP request for ip from ip.  The socket is
+// created in the calling thread's netns.
+func sendGratuitousARP(ifindex int, mac net.HardwareAddr, ip net.IP) error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return fmt.Errorf("open packet socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	pkt := make([]byte, 28)
+	binary.BigEndian.PutUint16(pkt[0:], 1)      // Ethernet
+	binary.BigEndian.PutUint16(pkt[2:], 0x0800) // IPv4
+	pkt[4], pkt[5] = 6, 4
+	binary.BigEndian.PutUint16(pkt[6:], 1) // Request
+	copy(pkt[8:], mac)
+	copy(pkt[14:], ip)
+	copy(pkt[24:], ip)
+
+	dst := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  ifindex,
+		Halen:    6,
+	}
+	copy(dst.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	return syscall.Sendto(fd, pkt, 0, dst)
+}
+
+// sendUnsolicitedNA sends a neighbor advertisement for ip to all nodes,
+// with the override flag so that it replaces cached entries.
+func sendUnsolicitedNA(ifindex int, mac net.HardwareAddr, ip net.IP) error {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return fmt.Errorf("open ICMPv6 socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	// Neighbor discovery messages must have a hop limit of 255.
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifindex); err != nil {
+		return err
+	}
+	src := &syscall.SockaddrInet6{}
+	copy(src.Addr[:], ip.To16())
+	if err := syscall.Bind(fd, src); err != nil {
+		return fmt.Errorf("bind to %s: %w", ip, err)
+	}
+
+	// The kernel fills in the ICMPv6 checksum.
+	pkt := make([]byte, 32)
+	pkt[0] = 136  // Neighbor advertisement
+	pkt[4] = 0x20 // Override
+	copy(pkt[8:], ip.To16())
+	pkt[24], pkt[25] = 2, 1 // Target link-layer address option, 8 bytes
+	copy(pkt[26:], mac)
+
+	dst := &syscall.SockaddrInet6{ZoneId: uint32(ifindex)}
+	copy(dst.Addr[:], net.IPv6linklocalallnodes)
+	return syscall.Sendto(fd, pkt, 0, dst)
+}
@@ -7,24 +7,52 @@ import (
 	"github.com/vishvananda/netlink"
 	"k8s.io/klog/v2"
 
+	"github.com/example/dra-poc/pkg/dhcp"
 	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
 	cdispec "tags.cncf.io/container-device-interface/specs-go"
 )
 
 // MacvlanHandler creates macvlan interfaces off a parent.
-type MacvlanHandler struct{}
+//
+// The parent is taken from the allocated <parent>-macvlan-pool device, so a
+// CEL selector on the pool's parent attribute picks it; netdev.parent is only
+// required when no pool device was allocated.
+//
+// When the claim consumed bandwidth from the parent's pool device, the link is
+// shaped to that rate once it is inside the pod netns.
+type MacvlanHandler struct {
+	// Links applies bandwidth shaping, addresses and routes after the link
+	// moved into the pod.  Nil disables shaping and rejects claims that ask
+	// for addresses or routes.
+	Links *nri.LinkSetupTracker
+	// DHCP runs the clients of claims in dhcp IPAM mode.  Nil rejects such
+	// claims.
+	DHCP *dhcp.Manager
+}
 
 func (h *MacvlanHandler) Type() handler.DeviceType { return handler.DeviceTypeNetdev }
 func (h *MacvlanHandler) Kinds() []string          { return []string{"macvlan"} }
+func (h *MacvlanHandler) Virtual() bool            { return true }
+
+// Restore registers the pod-side setups of a persisted allocation again.
+func (h *MacvlanHandler) Restore(alloc *handler.AllocationInfo) {
+	restoreLinkSetups(h.Links, h.DHCP, alloc)
+}
 
 func (h *MacvlanHandler) Validate(_ context.Context, cfg *handler.DeviceConfig) error {
 	if cfg.Netdev == nil {
 		return fmt.Errorf("netdev config is required for macvlan")
 	}
-	if cfg.Netdev.Parent == "" {
-		return fmt.Errorf("parent interface is required for macvlan")
+	// The parent may come from the allocated pool device instead, so an
+	// empty parent is checked in Prepare.
+	if err := validateEthtool(cfg.Netdev.Ethtool); err != nil {
+		return err
 	}
-	return nil
+	if err := validateLinkConfig(cfg.Netdev, h.Links); err != nil {
+		return err
+	}
+	return validateDHCP(cfg.Netdev, h.Links, h.DHCP)
 }
 
 func (h *MacvlanHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
@@ -32,9 +60,9 @@ func (h *MacvlanHandler) Prepare(_ context.Context, req *handler.PrepareRequest)
 	if cfg == nil {
 		return nil, fmt.Errorf("netdev config is required for macvlan")
 	}
-	parent := cfg.Parent
-	if parent == "" {
-		return nil, fmt.Errorf("parent interface is required for macvlan")
+	parent, err := resolveParent(req, "macvlan")
+	if err != nil {
+		return nil, err
 	}
 
 	mode := netlink.MACVLAN_MODE_BRIDGE
@@ -49,7 +77,7 @@ func (h *MacvlanHandler) Prepare(_ context.Context, req *handler.PrepareRequest)
 		return nil, fmt.Errorf("unsupported macvlan mode: %s", cfg.Mode)
 	}
 
-	ifName := fmt.Sprintf("mv%s", req.ClaimUID[:8])
+	ifName := fmt.Sprintf("mv%s", req.NameSuffix())
 	containerName := cfg.InterfaceName
 	if containerName == "" {
 		containerName = "eth1"
@@ -78,9 +106,26 @@ func (h *MacvlanHandler) Prepare(_ context.Context, req *handler.PrepareRequest)
 		netlink.LinkDel(mv)
 		return nil, fmt.Errorf("failed to bring up macvlan interface %s: %w", ifName, err)
 	}
+	// The link is deleted on Unprepare, so nothing needs restoring.
+	if err := applyEthtool(ifName, cfg.Ethtool, nil, false); err != nil {
+		netlink.LinkDel(mv)
+		return nil, fmt.Errorf("failed to apply ethtool settings to %s: %w", ifName, err)
+	}
 
 	klog.Infof("Created macvlan interface %s (parent=%s, mode=%s)", ifName, parent, cfg.Mode)
 
+	metadata := map[string]string{
+		"createdInterface": ifName,
+		"parent":           parent,
+		"containerName":    containerName,
+	}
+	if err := registerLinkConfig(h.Links, req, containerName, metadata); err != nil {
+		netlink.LinkDel(mv)
+		return nil, err
+	}
+	registerDHCP(h.Links, h.DHCP, req, containerName, metadata)
+	registerShaping(h.Links, req, containerName, metadata)
+
 	return &handler.PrepareResult{
 		PoolName:   "default",
 		DeviceName: ifName,
@@ -92,16 +137,18 @@ func (h *MacvlanHandler) Prepare(_ context.Context, req *handler.PrepareRequest)
 		Allocation: &handler.AllocationInfo{
 			Type: handler.DeviceTypeNetdev, Kind: "macvlan",
 			ClaimUID: req.ClaimUID, DeviceName: ifName,
-			Metadata: map[string]string{
-				"createdInterface": ifName,
-				"parent":           parent,
-				"containerName":    containerName,
-			},
+			Metadata: metadata,
 		},
 	}, nil
 }
 
 func (h *MacvlanHandler) Unprepare(_ context.Context, req *handler.UnprepareRequest) error {
+	// Release the leases while the link still has its addresses and MAC.
+	stopDHCP(h.DHCP, req)
+	if h.Links != nil {
+		h.Links.Release(req.ClaimUID)
+	}
+
 	ifName := req.Allocation.Metadata["createdInterface"]
 	if ifName == "" {
 		return nil
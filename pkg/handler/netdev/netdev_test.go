@@ -2,12 +2,27 @@ package netdev
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"k8s.io/apimachinery/pkg/api/resource"
 
+	"github.com/example/dra-poc/pkg/dhcp"
+	"github.com/example/dra-poc/pkg/ethtool"
 	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
+	"github.com/example/dra-poc/pkg/ovs"
+	"github.com/example/dra-poc/pkg/ovs/ovstest"
 )
 
 // skipUnlessRoot skips a test if not running as root (netlink requires CAP_NET_ADMIN).
@@ -25,6 +40,21 @@ func cleanupLink(name string) {
 	}
 }
 
+// addTestParent creates an up dummy link to serve as a parent, skipping the
+// test where the kernel cannot create links (e.g. in unprivileged sandboxes).
+func addTestParent(t *testing.T, name string) {
+	t.Helper()
+	skipUnlessRoot(t)
+	parent := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	if err := netlink.LinkAdd(parent); err != nil {
+		t.Skipf("skipping: cannot create dummy link: %v", err)
+	}
+	t.Cleanup(func() { cleanupLink(name) })
+	if err := netlink.LinkSetUp(parent); err != nil {
+		t.Fatalf("failed to up parent: %v", err)
+	}
+}
+
 // ─── Validate tests (no root needed) ─────────────────────────────────────────
 
 func TestDummyHandler_Validate(t *testing.T) {
@@ -44,10 +74,11 @@ func TestMacvlanHandler_Validate(t *testing.T) {
 	if err := h.Validate(context.Background(), &handler.DeviceConfig{}); err == nil {
 		t.Error("expected error when Netdev is nil")
 	}
+	// The parent may come from the allocated pool device, checked in Prepare.
 	if err := h.Validate(context.Background(), &handler.DeviceConfig{
 		Netdev: &handler.NetdevConfig{Kind: "macvlan"},
-	}); err == nil {
-		t.Error("expected error when parent is empty")
+	}); err != nil {
+		t.Errorf("unexpected error when parent is empty: %v", err)
 	}
 	if err := h.Validate(context.Background(), &handler.DeviceConfig{
 		Netdev: &handler.NetdevConfig{Kind: "macvlan", Parent: "eth0"},
@@ -61,10 +92,11 @@ func TestIpvlanHandler_Validate(t *testing.T) {
 	if err := h.Validate(context.Background(), &handler.DeviceConfig{}); err == nil {
 		t.Error("expected error when Netdev is nil")
 	}
+	// The parent may come from the allocated pool device, checked in Prepare.
 	if err := h.Validate(context.Background(), &handler.DeviceConfig{
 		Netdev: &handler.NetdevConfig{Kind: "ipvlan"},
-	}); err == nil {
-		t.Error("expected error when parent is empty")
+	}); err != nil {
+		t.Errorf("unexpected error when parent is empty: %v", err)
 	}
 	if err := h.Validate(context.Background(), &handler.DeviceConfig{
 		Netdev: &handler.NetdevConfig{Kind: "ipvlan", Parent: "eth0"},
@@ -131,6 +163,11 @@ func TestHandlerMetadata(t *testing.T) {
 		{"sriov-vf", &SriovVfHandler{}, handler.DeviceTypeNetdev, []string{"sriov-vf"}},
 		{"host-device", &HostDeviceHandler{}, handler.DeviceTypeNetdev, []string{"host-device"}},
 		{"ipoib", &IpoibHandler{}, handler.DeviceTypeNetdev, []string{"ipoib"}},
+		{"sf", &SFHandler{}, handler.DeviceTypeNetdev, []string{"sf"}},
+		{"vlan", &VlanHandler{}, handler.DeviceTypeNetdev, []string{"vlan"}},
+		{"vxlan", &VxlanHandler{}, handler.DeviceTypeNetdev, []string{"vxlan"}},
+		{"geneve", &GeneveHandler{}, handler.DeviceTypeNetdev, []string{"geneve"}},
+		{"bond", &BondHandler{}, handler.DeviceTypeNetdev, []string{"bond"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -388,6 +425,71 @@ func TestMacvlanHandler_MissingParent(t *testing.T) {
 	}
 }
 
+func TestMacvlanHandler_NoParent(t *testing.T) {
+	h := &MacvlanHandler{}
+	_, err := h.Prepare(context.Background(), &handler.PrepareRequest{
+		ClaimUID:        "mvnone00-0000-0000-0000-000000000000",
+		AllocatedDevice: "netdev-virtual-macvlan",
+		Config: &handler.DeviceConfig{
+			Type:   handler.DeviceTypeNetdev,
+			Netdev: &handler.NetdevConfig{Kind: "macvlan"},
+		},
+	})
+	if err == nil {
+		t.Error("should fail without a configured parent or pool device")
+	}
+}
+
+func TestMacvlanHandler_ConflictingParent(t *testing.T) {
+	h := &MacvlanHandler{}
+	_, err := h.Prepare(context.Background(), &handler.PrepareRequest{
+		ClaimUID:        "mvconf00-0000-0000-0000-000000000000",
+		AllocatedDevice: "ens1f0-macvlan-pool",
+		Config: &handler.DeviceConfig{
+			Type:   handler.DeviceTypeNetdev,
+			Netdev: &handler.NetdevConfig{Kind: "macvlan", Parent: "ens2f0"},
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "conflicts") {
+		t.Errorf("expected parent conflict error, got %v", err)
+	}
+}
+
+func TestResolveParent(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		allocated  string
+		kind       string
+		want       string
+		wantErr    bool
+	}{
+		{"from pool device", "", "ens1f0-macvlan-pool", "macvlan", "ens1f0", false},
+		{"matching config", "ens1f0", "ens1f0-macvlan-pool", "macvlan", "ens1f0", false},
+		{"conflicting config", "ens2f0", "ens1f0-macvlan-pool", "macvlan", "", true},
+		{"config only", "eth0", "netdev-virtual-macvlan", "macvlan", "eth0", false},
+		{"other kind's pool", "eth0", "ens1f0-ipvlan-pool", "macvlan", "eth0", false},
+		{"ipvlan pool", "", "ens1f0-ipvlan-pool", "ipvlan", "ens1f0", false},
+		{"neither", "", "", "ipvlan", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveParent(&handler.PrepareRequest{
+				AllocatedDevice: tt.allocated,
+				Config: &handler.DeviceConfig{
+					Netdev: &handler.NetdevConfig{Kind: tt.kind, Parent: tt.configured},
+				},
+			}, tt.kind)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveParent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveParent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestIpvlanHandler_PrepareAndUnprepare(t *testing.T) {
 	skipUnlessRoot(t)
 
@@ -752,3 +854,2412 @@ func TestUnprepareEmptyMetadata(t *testing.T) {
 		})
 	}
 }
+
+// ─── Bandwidth shaping tests ─────────────────────────────────────────────────
+
+func TestConsumedBandwidth(t *testing.T) {
+	tests := []struct {
+		name     string
+		consumed map[string]resource.Quantity
+		want     uint64
+	}{
+		{"none", nil, 0},
+		{"other capacity", map[string]resource.Quantity{"dra.example.com/slots": resource.MustParse("1")}, 0},
+		{"zero", map[string]resource.Quantity{handler.CapacityBandwidth: resource.MustParse("0")}, 0},
+		{"10G", map[string]resource.Quantity{handler.CapacityBandwidth: resource.MustParse("10G")}, 10_000_000_000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := consumedBandwidth(&handler.PrepareRequest{ConsumedCapacity: tt.consumed})
+			if got != tt.want {
+				t.Errorf("consumedBandwidth() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterShaping(t *testing.T) {
+	req := &handler.PrepareRequest{ClaimUID: "bwtest00-1111-2222-3333-444444444444"}
+	links := nri.NewLinkSetupTracker()
+
+	metadata := map[string]string{}
+	registerShaping(links, req, "net1", metadata)
+	if len(metadata) != 0 || len(links.ConsumePendingForClaims([]string{req.ClaimUID})) != 0 {
+		t.Errorf("expected no shaping without consumed bandwidth, got %v", metadata)
+	}
+
+	req.ConsumedCapacity = map[string]resource.Quantity{handler.CapacityBandwidth: resource.MustParse("1G")}
+	registerShaping(nil, req, "net1", metadata)
+	if len(metadata) != 0 {
+		t.Errorf("expected no shaping without a tracker, got %v", metadata)
+	}
+
+	registerShaping(links, req, "net1", metadata)
+	if metadata["bandwidth"] != "1000000000" || metadata["ifb"] != "ifbbwtest00" {
+		t.Errorf("metadata = %v, want bandwidth 1000000000 and ifb ifbbwtest00", metadata)
+	}
+	setups := links.ConsumePendingForClaims([]string{req.ClaimUID})
+	if len(setups) != 1 {
+		t.Fatalf("expected 1 pending setup, got %d", len(setups))
+	}
+	if setups[0].IfName != "net1" || setups[0].Apply == nil || setups[0].Teardown == nil {
+		t.Errorf("unexpected setup: %+v", setups[0])
+	}
+}
+
+func TestApplyBandwidth_Rollback(t *testing.T) {
+	skipUnlessRoot(t)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origNS, err := netns.Get()
+	if err != nil {
+		t.Fatalf("get netns: %v", err)
+	}
+	defer origNS.Close()
+	testNS, err := netns.New()
+	if err != nil {
+		t.Skipf("skipping: cannot create netns: %v", err)
+	}
+	defer testNS.Close()
+	defer netns.Set(origNS)
+
+	// A link already holding the IFB's name makes the IFB setup fail.
+	for _, veth := range []*netlink.Veth{
+		{LinkAttrs: netlink.LinkAttrs{Name: "shp0"}, PeerName: "shp1"},
+		{LinkAttrs: netlink.LinkAttrs{Name: "ifbshp0"}, PeerName: "ifbshp1"},
+	} {
+		if err := netlink.LinkAdd(veth); err != nil {
+			t.Skipf("skipping: cannot create veth pair: %v", err)
+		}
+	}
+	link, err := netlink.LinkByName("shp0")
+	if err != nil {
+		t.Fatalf("link not found: %v", err)
+	}
+	hasTBF := func(handle uint32) bool {
+		qdiscs, err := netlink.QdiscList(link)
+		if err != nil {
+			t.Fatalf("list qdiscs: %v", err)
+		}
+		for _, q := range qdiscs {
+			if _, ok := q.(*netlink.Tbf); ok && q.Attrs().Handle == handle {
+				return true
+			}
+		}
+		return false
+	}
+
+	if err := applyBandwidth(link, "ifbshp0", 1_000_000_000); err == nil {
+		t.Fatal("expected applyBandwidth to fail with the IFB name taken")
+	}
+	if hasTBF(tbfHandle) {
+		t.Error("egress TBF left behind after the IFB setup failed")
+	}
+	if _, err := netlink.LinkByName("ifbshp0"); err != nil {
+		t.Errorf("rollback removed a link it did not create: %v", err)
+	}
+
+	// Teardown only removes the qdiscs applyBandwidth installs.
+	foreign := tbfQdisc(link.Attrs().Index)
+	foreign.Handle = netlink.MakeHandle(2, 0)
+	foreign.Rate, foreign.Limit, foreign.Buffer = 125_000, 100_000, netlink.Xmittime(125_000, minBurstBytes)
+	if err := netlink.QdiscAdd(foreign); err != nil {
+		t.Skipf("skipping: cannot add tbf qdisc: %v", err)
+	}
+	if err := removeBandwidth(link, "ifbnone"); err != nil {
+		t.Errorf("removeBandwidth: %v", err)
+	}
+	if !hasTBF(foreign.Handle) {
+		t.Error("removeBandwidth deleted a qdisc it did not install")
+	}
+}
+
+func TestSplitVFProfileDevice(t *testing.T) {
+	tests := []struct {
+		device, vf, profile string
+	}{
+		{"ens1f0v3", "ens1f0v3", ""},
+		{VFProfileDeviceName("ens1f0v3", "large"), "ens1f0v3", "large"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		vf, profile := SplitVFProfileDevice(tt.device)
+		if vf != tt.vf || profile != tt.profile {
+			t.Errorf("SplitVFProfileDevice(%q) = %q, %q; want %q, %q", tt.device, vf, profile, tt.vf, tt.profile)
+		}
+	}
+}
+
+func TestValidateVFConfig(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+	tests := []struct {
+		name    string
+		cfg     *handler.VFConfig
+		wantErr bool
+	}{
+		{"nil", nil, false},
+		{"full", &handler.VFConfig{
+			MAC: "02:00:00:00:00:01", VLAN: intPtr(100), QoS: 3, VLANProto: "802.1ad",
+			LinkState: "enable", MinTxRate: intPtr(100), MaxTxRate: intPtr(1000),
+		}, false},
+		{"untag", &handler.VFConfig{VLAN: intPtr(0)}, false},
+		{"bad mac", &handler.VFConfig{MAC: "nope"}, true},
+		{"vlan range", &handler.VFConfig{VLAN: intPtr(4096)}, true},
+		{"qos without vlan", &handler.VFConfig{QoS: 2}, true},
+		{"qos range", &handler.VFConfig{VLAN: intPtr(10), QoS: 8}, true},
+		{"bad proto", &handler.VFConfig{VLAN: intPtr(10), VLANProto: "802.1x"}, true},
+		{"proto without vlan", &handler.VFConfig{VLANProto: "802.1Q"}, true},
+		{"bad link state", &handler.VFConfig{LinkState: "up"}, true},
+		{"negative rate", &handler.VFConfig{MaxTxRate: intPtr(-1)}, true},
+		{"min above max", &handler.VFConfig{MinTxRate: intPtr(500), MaxTxRate: intPtr(100)}, true},
+		{"min with unlimited max", &handler.VFConfig{MinTxRate: intPtr(500), MaxTxRate: intPtr(0)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&SriovVfHandler{}).Validate(context.Background(), &handler.DeviceConfig{
+				Netdev: &handler.NetdevConfig{Kind: "sriov-vf", VF: tt.cfg},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVFSettings_With(t *testing.T) {
+	mac, _ := net.ParseMAC("0a:00:00:00:00:01")
+	orig := vfSettingsFromInfo(netlink.VfInfo{
+		ID: 3, Mac: mac, Spoofchk: true, LinkState: netlink.VF_LINK_STATE_AUTO, MaxTxRate: 500,
+	})
+
+	// No config leaves everything alone.
+	if got := orig.with(nil); got != orig {
+		t.Errorf("with(nil) = %+v, want %+v", got, orig)
+	}
+
+	vlan, minRate := 42, 100
+	off, on := false, true
+	got := orig.with(&handler.VFConfig{
+		MAC:       "02:AA:BB:CC:DD:EE",
+		VLAN:      &vlan,
+		QoS:       5,
+		VLANProto: "802.1AD",
+		SpoofChk:  &off,
+		Trust:     &on,
+		LinkState: "disable",
+		MinTxRate: &minRate,
+	})
+	want := vfSettings{
+		MAC:       "02:aa:bb:cc:dd:ee",
+		VLAN:      42,
+		QoS:       5,
+		VLANProto: int(netlink.VLAN_PROTOCOL_8021AD),
+		SpoofChk:  false,
+		Trust:     true,
+		LinkState: netlink.VF_LINK_STATE_DISABLE,
+		MinTxRate: 100,
+		MaxTxRate: 500, // untouched
+	}
+	if got != want {
+		t.Errorf("with() = %+v, want %+v", got, want)
+	}
+
+	// The snapshot survives the trip through allocation metadata.
+	decoded, err := decodeVFSettings(encodeVFSettings(orig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != orig {
+		t.Errorf("decoded snapshot = %+v, want %+v", decoded, orig)
+	}
+}
+
+func TestSriovVfHandler_UnprepareRestoreCorruptSnapshot(t *testing.T) {
+	err := (&SriovVfHandler{}).Unprepare(context.Background(), &handler.UnprepareRequest{
+		ClaimUID: "aabbccdd-1111-2222-3333-444444444444",
+		Allocation: &handler.AllocationInfo{
+			Metadata: map[string]string{
+				"vfInterface": "nonexistent-vf",
+				"pf":          "nonexistent-pf",
+				"vfIndex":     "0",
+				"vfOriginal":  "{broken",
+			},
+		},
+	})
+	if err == nil {
+		t.Error("expected error for a corrupt VF snapshot")
+	}
+}
+
+func TestProfileVFConfig(t *testing.T) {
+	rate := func(v int) *int { return &v }
+	trust := true
+
+	// Without a profile rate the claim's settings are used as they are.
+	if cfg, err := profileVFConfig(nil, "", 0); err != nil || cfg != nil {
+		t.Errorf("no profile: %+v, %v", cfg, err)
+	}
+	cfg, err := profileVFConfig(&handler.VFConfig{Trust: &trust}, "large", 10000)
+	if err != nil || cfg.MaxTxRate == nil || *cfg.MaxTxRate != 10000 || cfg.Trust == nil {
+		t.Errorf("profile rate not applied: %+v, %v", cfg, err)
+	}
+	if cfg, err := profileVFConfig(&handler.VFConfig{MaxTxRate: rate(2000)}, "large", 10000); err != nil || *cfg.MaxTxRate != 2000 {
+		t.Errorf("lower claim rate not kept: %+v, %v", cfg, err)
+	}
+	for _, bad := range []*handler.VFConfig{
+		{MaxTxRate: rate(20000)},
+		{MaxTxRate: rate(0)}, // Unlimited
+		{MinTxRate: rate(20000)},
+	} {
+		if _, err := profileVFConfig(bad, "large", 10000); err == nil {
+			t.Errorf("profileVFConfig(%+v) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestVFOwners(t *testing.T) {
+	var o vfOwners
+	vfs := map[int]string{0: "ens1f0v0", 1: "", 2: "ens1f0v2", 3: "ens1f0v3"}
+	idx := func(i int) *int { return &i }
+
+	// VF 0 is taken by the scheduler-allocated path.
+	if err := o.reserve("ens1f0", 0, "claim-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.reserve("ens1f0", 0, "claim-a"); err != nil {
+		t.Errorf("re-reserving own VF: %v", err)
+	}
+	err := o.reserve("ens1f0", 0, "claim-b")
+	if err == nil || !strings.Contains(err.Error(), "already held by claim claim-a") {
+		t.Errorf("reserve of held VF: err = %v, want already held by claim-a", err)
+	}
+
+	// Free selection skips held VFs and VFs without a host netdev.
+	i, name, err := o.reserveFree("ens1f0", vfs, nil, "claim-b")
+	if err != nil || i != 2 || name != "ens1f0v2" {
+		t.Errorf("reserveFree = %d, %q, %v; want 2, ens1f0v2", i, name, err)
+	}
+
+	// An explicit index is honoured, and conflicts fail clearly.
+	if i, name, err := o.reserveFree("ens1f0", vfs, idx(3), "claim-c"); err != nil || i != 3 || name != "ens1f0v3" {
+		t.Errorf("reserveFree(3) = %d, %q, %v; want 3, ens1f0v3", i, name, err)
+	}
+	if _, _, err := o.reserveFree("ens1f0", vfs, idx(3), "claim-d"); err == nil {
+		t.Error("reserveFree of a held index succeeded")
+	}
+	if _, _, err := o.reserveFree("ens1f0", vfs, idx(1), "claim-d"); err == nil {
+		t.Error("reserveFree of a VF without netdev succeeded")
+	}
+	if o.owner("ens1f0", 1) != "" {
+		t.Error("failed reservation left VF 1 held")
+	}
+	if _, _, err := o.reserveFree("ens1f0", vfs, idx(7), "claim-d"); err == nil {
+		t.Error("reserveFree of a missing index succeeded")
+	}
+	if _, _, err := o.reserveFree("ens1f0", vfs, nil, "claim-d"); err == nil {
+		t.Error("reserveFree on an exhausted PF succeeded")
+	}
+
+	// Release only frees VFs the claim holds.
+	o.release("ens1f0", 2, "claim-x")
+	if o.owner("ens1f0", 2) != "claim-b" {
+		t.Error("release by another claim freed the VF")
+	}
+	o.release("ens1f0", 2, "claim-b")
+	if i, _, err := o.reserveFree("ens1f0", vfs, nil, "claim-d"); err != nil || i != 2 {
+		t.Errorf("reserveFree after release = %d, %v; want 2", i, err)
+	}
+}
+
+func TestSriovVfHandler_Restore(t *testing.T) {
+	h := &SriovVfHandler{}
+	h.Restore(&handler.AllocationInfo{
+		ClaimUID: "claim-a",
+		Metadata: map[string]string{"vfInterface": "ens1f0v4", "pf": "ens1f0", "vfIndex": "4"},
+	})
+	// Allocations from before ownership tracking carry no PF; ignore them.
+	h.Restore(&handler.AllocationInfo{
+		ClaimUID: "claim-old",
+		Metadata: map[string]string{"vfInterface": "ens1f0v5"},
+	})
+
+	if got := h.owners.owner("ens1f0", 4); got != "claim-a" {
+		t.Errorf("owner of VF 4 = %q, want claim-a", got)
+	}
+	if err := h.owners.reserve("ens1f0", 4, "claim-b"); err == nil {
+		t.Error("restored VF was handed to another claim")
+	}
+}
+
+// fakePCISysfs builds a minimal /sys/bus/pci tree with one VF bound to
+// origDriver in IOMMU group 42.
+func fakePCISysfs(t *testing.T, addr, origDriver string) string {
+	t.Helper()
+	root := t.TempDir()
+	mkdir := func(p string) {
+		if err := os.MkdirAll(filepath.Join(root, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch := func(p string) {
+		if err := os.WriteFile(filepath.Join(root, p), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdir("devices/" + addr)
+	mkdir("drivers/" + origDriver)
+	mkdir("drivers/vfio-pci")
+	mkdir("kernel/iommu_groups/42")
+	touch("devices/" + addr + "/driver_override")
+	touch("drivers/" + origDriver + "/bind")
+	touch("drivers/" + origDriver + "/unbind")
+	touch("drivers/vfio-pci/unbind")
+	touch("drivers_probe")
+	if err := os.Symlink(filepath.Join(root, "drivers", origDriver), filepath.Join(root, "devices", addr, "driver")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "kernel/iommu_groups/42"), filepath.Join(root, "devices", addr, "iommu_group")); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestBindAndUnbindVFIO(t *testing.T) {
+	const addr = "0000:3b:02.1"
+	root := fakePCISysfs(t, addr, "iavf")
+	old := pciSysfsRoot
+	pciSysfsRoot = root
+	defer func() { pciSysfsRoot = old }()
+
+	b, err := bindVFIO(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.OriginalDriver != "iavf" || b.IOMMUGroup != "42" {
+		t.Errorf("binding = %+v, want original driver iavf and group 42", b)
+	}
+	if got := readFile(t, filepath.Join(root, "devices", addr, "driver_override")); got != "vfio-pci" {
+		t.Errorf("driver_override = %q, want vfio-pci", got)
+	}
+	if got := readFile(t, filepath.Join(root, "drivers/iavf/unbind")); got != addr {
+		t.Errorf("iavf unbind = %q, want %s", got, addr)
+	}
+	if got := readFile(t, filepath.Join(root, "drivers_probe")); got != addr {
+		t.Errorf("drivers_probe = %q, want %s", got, addr)
+	}
+
+	// Simulate the kernel having moved the device to vfio-pci.
+	driverLink := filepath.Join(root, "devices", addr, "driver")
+	os.Remove(driverLink)
+	os.Symlink(filepath.Join(root, "drivers/vfio-pci"), driverLink)
+
+	if err := unbindVFIO(b); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(root, "devices", addr, "driver_override")); got != "\n" {
+		t.Errorf("driver_override after unbind = %q, want cleared", got)
+	}
+	if got := readFile(t, filepath.Join(root, "drivers/vfio-pci/unbind")); got != addr {
+		t.Errorf("vfio-pci unbind = %q, want %s", got, addr)
+	}
+	if got := readFile(t, filepath.Join(root, "drivers/iavf/bind")); got != addr {
+		t.Errorf("iavf bind = %q, want %s", got, addr)
+	}
+}
+
+func TestBindVFIO_NoIOMMUGroup(t *testing.T) {
+	const addr = "0000:3b:02.2"
+	root := fakePCISysfs(t, addr, "iavf")
+	os.Remove(filepath.Join(root, "devices", addr, "iommu_group"))
+	old := pciSysfsRoot
+	pciSysfsRoot = root
+	defer func() { pciSysfsRoot = old }()
+
+	if _, err := bindVFIO(addr); err == nil {
+		t.Fatal("expected error without an IOMMU group")
+	}
+	if got := readFile(t, filepath.Join(root, "devices", addr, "driver_override")); got != "" {
+		t.Errorf("driver_override = %q, want untouched", got)
+	}
+}
+
+func TestVFIOEdits(t *testing.T) {
+	edits := vfioEdits(&vfioBinding{PCIAddress: "0000:3b:02.1", IOMMUGroup: "42"}, "dpdk-0")
+
+	if len(edits.DeviceNodes) != 2 {
+		t.Fatalf("DeviceNodes = %d, want 2", len(edits.DeviceNodes))
+	}
+	if edits.DeviceNodes[0].Path != "/dev/vfio/vfio" || edits.DeviceNodes[1].Path != "/dev/vfio/42" {
+		t.Errorf("device nodes = %s, %s; want /dev/vfio/vfio, /dev/vfio/42", edits.DeviceNodes[0].Path, edits.DeviceNodes[1].Path)
+	}
+	if len(edits.NetDevices) != 0 {
+		t.Error("vfio VF must not be moved as a netdev")
+	}
+	if len(edits.Env) != 1 || edits.Env[0] != "PCIDEVICE_DPDK_0=0000:3b:02.1" {
+		t.Errorf("Env = %v, want [PCIDEVICE_DPDK_0=0000:3b:02.1]", edits.Env)
+	}
+}
+
+func TestSriovVfHandler_ValidateMode(t *testing.T) {
+	h := &SriovVfHandler{}
+	tests := []struct {
+		name    string
+		cfg     handler.NetdevConfig
+		wantErr bool
+	}{
+		{"netdev", handler.NetdevConfig{Kind: "sriov-vf"}, false},
+		{"vfio", handler.NetdevConfig{Kind: "sriov-vf", Mode: VFModeVFIO}, false},
+		{"vfio with mtu", handler.NetdevConfig{Kind: "sriov-vf", Mode: VFModeVFIO, MTU: 9000}, true},
+		{"unknown", handler.NetdevConfig{Kind: "sriov-vf", Mode: "uio"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := h.Validate(context.Background(), &handler.DeviceConfig{Netdev: &tt.cfg})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSplitOnDemandVFDevice(t *testing.T) {
+	tests := []struct {
+		device string
+		pf     string
+		index  int
+		ok     bool
+	}{
+		{OnDemandVFDeviceName("ens1f0", 3), "ens1f0", 3, true},
+		{"enp-vf-a-vf12", "enp-vf-a", 12, true},
+		{"ens1f0v3", "", -1, false},
+		{"-vf1", "", -1, false},
+		{"ens1f0-vfx", "", -1, false},
+	}
+	for _, tt := range tests {
+		pf, index, ok := SplitOnDemandVFDevice(tt.device)
+		if pf != tt.pf || index != tt.index || ok != tt.ok {
+			t.Errorf("SplitOnDemandVFDevice(%q) = %q, %d, %v; want %q, %d, %v",
+				tt.device, pf, index, ok, tt.pf, tt.index, tt.ok)
+		}
+	}
+}
+
+// fakeNetSysfs builds a /sys/class/net tree with one PF whose sriov_numvfs
+// reads numVFs.  VF 0 already has the netdev <pf>v0, as if the kernel had
+// created it.
+func fakeNetSysfs(t *testing.T, pf string, numVFs int) string {
+	t.Helper()
+	root := t.TempDir()
+	device := filepath.Join(root, pf, "device")
+	if err := os.MkdirAll(filepath.Join(device, "virtfn0", "net", pf+"v0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for file, value := range map[string]string{"sriov_numvfs": strconv.Itoa(numVFs), "sriov_totalvfs": "8"} {
+		if err := os.WriteFile(filepath.Join(device, file), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := netSysfsRoot
+	netSysfsRoot = root
+	t.Cleanup(func() { netSysfsRoot = old })
+	return root
+}
+
+func TestEnsureVFs(t *testing.T) {
+	root := fakeNetSysfs(t, "ens1f0", 0)
+	numVFs := filepath.Join(root, "ens1f0", "device", "sriov_numvfs")
+
+	if err := ensureVFs("ens1f0", 4); err != nil {
+		t.Fatalf("ensureVFs: %v", err)
+	}
+	if got := readFile(t, numVFs); got != "4" {
+		t.Errorf("sriov_numvfs = %q, want 4", got)
+	}
+	if err := ensureVFs("ens1f0", 2); err != nil {
+		t.Errorf("ensureVFs with enough VFs: %v", err)
+	}
+	if err := ensureVFs("ens1f0", 6); err == nil {
+		t.Error("expected error raising sriov_numvfs from non-zero")
+	}
+	if current, total, err := NumVFs("ens1f0"); err != nil || current != 4 || total != 8 {
+		t.Errorf("NumVFs = %d, %d, %v; want 4, 8, nil", current, total, err)
+	}
+}
+
+func TestSriovVfHandler_ProvisionVF(t *testing.T) {
+	root := fakeNetSysfs(t, "ens1f0", 0)
+	numVFs := filepath.Join(root, "ens1f0", "device", "sriov_numvfs")
+	h := &SriovVfHandler{OnDemand: map[string]int{"ens1f0": 4}, RemoveIdleVFs: true}
+	ctx := context.Background()
+
+	name, err := h.ProvisionVF(ctx, "claim-a", "ens1f0", 0)
+	if err != nil {
+		t.Fatalf("ProvisionVF: %v", err)
+	}
+	if name != "ens1f0v0" {
+		t.Errorf("VF netdev = %q, want ens1f0v0", name)
+	}
+	if got := readFile(t, numVFs); got != "4" {
+		t.Errorf("sriov_numvfs = %q, want 4", got)
+	}
+	if _, err := h.ProvisionVF(ctx, "claim-a", "ens1f0", 0); err != nil {
+		t.Errorf("ProvisionVF is not idempotent: %v", err)
+	}
+	if _, err := h.ProvisionVF(ctx, "claim-b", "ens1f0", 0); err == nil {
+		t.Error("VF held by claim-a was provisioned for claim-b")
+	}
+	if _, err := h.ProvisionVF(ctx, "claim-b", "ens1f0", 4); err == nil {
+		t.Error("expected error for VF index beyond the budget")
+	}
+	if _, err := h.ProvisionVF(ctx, "claim-b", "ens2f0", 0); err == nil {
+		t.Error("expected error for PF without a budget")
+	}
+
+	h.ReleaseVF("claim-b", "ens1f0", 0)
+	if got := readFile(t, numVFs); got != "4" {
+		t.Errorf("VFs removed although claim-a holds one (sriov_numvfs = %q)", got)
+	}
+	h.ReleaseVF("claim-a", "ens1f0", 0)
+	if got := readFile(t, numVFs); got != "0" {
+		t.Errorf("idle VFs not removed (sriov_numvfs = %q)", got)
+	}
+}
+
+func TestSriovVfHandler_ReserveNetdev(t *testing.T) {
+	root := t.TempDir()
+	old := netSysfsRoot
+	netSysfsRoot = root
+	t.Cleanup(func() { netSysfsRoot = old })
+
+	// ens1f0v1 is VF 1 of ens1f0; eth9 is not a VF.
+	pci := filepath.Join(root, "pci")
+	for _, dir := range []string{"0000:01:00.0/net/ens1f0", "0000:01:00.2/net/ens1f0v1", "eth9/device"} {
+		if err := os.MkdirAll(filepath.Join(pci, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"pci/0000:01:00.0/virtfn1": "../0000:01:00.2",
+		"pci/0000:01:00.2/physfn":  "../0000:01:00.0",
+		"ens1f0v1/device":          "../pci/0000:01:00.2",
+		"eth9":                     "pci/eth9",
+	} {
+		path := filepath.Join(root, link)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := &SriovVfHandler{}
+	if _, _, isVF, err := h.reserveNetdev("claim-a", "eth9"); isVF || err != nil {
+		t.Errorf("reserveNetdev(eth9) = VF %v, %v; want not a VF", isVF, err)
+	}
+	pf, index, isVF, err := h.reserveNetdev("claim-a", "ens1f0v1")
+	if err != nil || !isVF || pf != "ens1f0" || index != 1 {
+		t.Fatalf("reserveNetdev(ens1f0v1) = %q, %d, %v, %v; want ens1f0, 1", pf, index, isVF, err)
+	}
+	if _, _, err := h.owners.reserveFree("ens1f0", map[int]string{1: "ens1f0v1"}, nil, "claim-b"); err == nil {
+		t.Error("bonded VF handed to another claim")
+	}
+	if _, _, _, err := h.reserveNetdev("claim-b", "ens1f0v1"); err == nil {
+		t.Error("VF held by claim-a reserved for claim-b")
+	}
+	h.ReleaseVF("claim-a", pf, index)
+	if owner := h.owners.owner("ens1f0", 1); owner != "" {
+		t.Errorf("VF still held by %q after release", owner)
+	}
+}
+
+func TestSriovVfHandler_ValidateRepresentor(t *testing.T) {
+	tests := []struct {
+		name    string
+		rep     *handler.RepresentorConfig
+		wantErr bool
+	}{
+		{"bridge", &handler.RepresentorConfig{Bridge: "br0"}, false},
+		{"ovs", &handler.RepresentorConfig{OVS: &handler.OVSConfig{Bridge: "br-int"}}, false},
+		{"bridge and ovs", &handler.RepresentorConfig{Bridge: "br0", OVS: &handler.OVSConfig{Bridge: "br-int"}}, true},
+		{"ovs without bridge", &handler.RepresentorConfig{OVS: &handler.OVSConfig{Tag: 10}}, true},
+	}
+	h := &SriovVfHandler{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := h.Validate(context.Background(), &handler.DeviceConfig{
+				Netdev: &handler.NetdevConfig{Kind: "sriov-vf", Representor: tt.rep},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSriovVfHandler_ReleaseRepresentor(t *testing.T) {
+	srv := ovstest.NewServer(t, "br-int")
+	h := &SriovVfHandler{OVS: &ovs.Client{Socket: srv.Socket}}
+	ctx := context.Background()
+	req := &handler.PrepareRequest{ClaimUID: "reptest0-1111-2222-3333-444444444444"}
+	if err := addOVSPort(ctx, h.OVS, req, "pf0vf3", &handler.OVSConfig{Bridge: "br-int"}); err != nil {
+		t.Fatalf("addOVSPort: %v", err)
+	}
+
+	metadata := map[string]string{"representor": "pf0vf3", "representorOVSBridge": "br-int"}
+	if err := h.releaseRepresentor(ctx, metadata); err != nil {
+		t.Fatalf("releaseRepresentor: %v", err)
+	}
+	if ports := srv.Ports("br-int"); len(ports) != 0 {
+		t.Errorf("ports on br-int after release = %v, want none", ports)
+	}
+	if err := (&SriovVfHandler{}).releaseRepresentor(ctx, metadata); err != nil {
+		t.Errorf("release without OVS client: %v", err)
+	}
+}
+
+func TestFindRepresentor(t *testing.T) {
+	root := t.TempDir()
+	old := netSysfsRoot
+	netSysfsRoot = root
+	t.Cleanup(func() { netSysfsRoot = old })
+
+	netdevs := map[string][2]string{ // name → switch ID, port name
+		"ens1f0":       {"aabb", "p0"},
+		"ens1f1":       {"ccdd", "p1"},
+		"ens1f0_0":     {"aabb", "pf0vf0"},
+		"ens1f0_1":     {"aabb", "pf0vf1"},
+		"ens1f1_1":     {"ccdd", "pf1vf1"},
+		"eth_pf1vf2":   {"aabb", "pf1vf2"}, // other PF on the same switch
+		"eth_pf0vf2":   {"aabb", "pf0vf2"},
+		"oldrep3":      {"aabb", "vf3"},
+		"noswitchport": {"", ""},
+	}
+	for name, attrs := range netdevs {
+		dir := filepath.Join(root, name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if attrs[0] == "" {
+			continue
+		}
+		os.WriteFile(filepath.Join(dir, "phys_switch_id"), []byte(attrs[0]+"\n"), 0644)
+		os.WriteFile(filepath.Join(dir, "phys_port_name"), []byte(attrs[1]+"\n"), 0644)
+	}
+
+	tests := []struct {
+		pf    string
+		index int
+		want  string
+	}{
+		{"ens1f0", 0, "ens1f0_0"},
+		{"ens1f0", 1, "ens1f0_1"},
+		{"ens1f0", 2, "eth_pf0vf2"},
+		{"ens1f0", 3, "oldrep3"},
+		{"ens1f1", 1, "ens1f1_1"},
+		{"ens1f0", 4, ""},
+		{"noswitchport", 0, ""},
+	}
+	for _, tt := range tests {
+		got, err := findRepresentor(tt.pf, tt.index)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("findRepresentor(%s, %d) = %q, want error", tt.pf, tt.index, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("findRepresentor(%s, %d) = %q, %v; want %q", tt.pf, tt.index, got, err, tt.want)
+		}
+	}
+}
+
+func TestPrepareRepresentor_RequiresSwitchdev(t *testing.T) {
+	h := &SriovVfHandler{}
+	ctx := context.Background()
+	req := func(cfg *handler.NetdevConfig) *handler.PrepareRequest {
+		return &handler.PrepareRequest{Config: &handler.DeviceConfig{Netdev: cfg}}
+	}
+	cfg := &handler.NetdevConfig{Kind: "sriov-vf", Representor: &handler.RepresentorConfig{Bridge: "br0"}}
+	metadata := map[string]string{}
+	if err := h.prepareRepresentor(ctx, req(cfg), "nonexistent-pf", 0, metadata); err == nil {
+		t.Error("expected error for representor settings on a non-switchdev PF")
+	}
+	if err := h.prepareRepresentor(ctx, req(&handler.NetdevConfig{Kind: "sriov-vf"}), "nonexistent-pf", 0, metadata); err != nil {
+		t.Errorf("legacy PF without representor settings: %v", err)
+	}
+	if _, ok := metadata["representor"]; ok {
+		t.Error("representor recorded for a non-switchdev PF")
+	}
+}
+
+func TestSFHandler_Validate(t *testing.T) {
+	h := &SFHandler{}
+	ctx := context.Background()
+	if err := h.Validate(ctx, &handler.DeviceConfig{Type: handler.DeviceTypeNetdev}); err == nil {
+		t.Error("expected error for missing netdev config")
+	}
+	cfg := &handler.DeviceConfig{Type: handler.DeviceTypeNetdev, Netdev: &handler.NetdevConfig{
+		Kind: "sf", SF: &handler.SFConfig{MAC: "not-a-mac"},
+	}}
+	if err := h.Validate(ctx, cfg); err == nil {
+		t.Error("expected error for invalid SF MAC")
+	}
+	cfg.Netdev.SF.MAC = "02:00:00:00:20:01"
+	if err := h.Validate(ctx, cfg); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
+
+func TestDevlinkHandleAndPFNumber(t *testing.T) {
+	root := t.TempDir()
+	old := netSysfsRoot
+	netSysfsRoot = root
+	t.Cleanup(func() { netSysfsRoot = old })
+
+	pci := filepath.Join(root, "devices", "pci0000:00", "0000:03:00.1")
+	bus := filepath.Join(root, "bus", "pci")
+	for _, dir := range []string{pci, bus, filepath.Join(root, "ens1f1"), filepath.Join(root, "ens1f0")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Symlink(bus, filepath.Join(pci, "subsystem"))
+	os.Symlink(pci, filepath.Join(root, "ens1f1", "device"))
+	os.WriteFile(filepath.Join(root, "ens1f0", "phys_port_name"), []byte("p0\n"), 0644)
+
+	b, d, err := devlinkHandle("ens1f1")
+	if err != nil || b != "pci" || d != "0000:03:00.1" {
+		t.Errorf("devlinkHandle = %q, %q, %v; want pci, 0000:03:00.1", b, d, err)
+	}
+	if _, _, err := devlinkHandle("ens1f0"); err == nil {
+		t.Error("expected error for a netdev without a device")
+	}
+	if n := pfNumber("ens1f1"); n != 1 {
+		t.Errorf("pfNumber from PCI function = %d, want 1", n)
+	}
+	if n := pfNumber("ens1f0"); n != 0 {
+		t.Errorf("pfNumber from port name = %d, want 0", n)
+	}
+}
+
+func TestFindSF(t *testing.T) {
+	root := t.TempDir()
+	old := auxSysfsRoot
+	auxSysfsRoot = filepath.Join(root, "bus", "auxiliary", "devices")
+	t.Cleanup(func() { auxSysfsRoot = old })
+
+	pci := filepath.Join(root, "devices", "pci0000:00", "0000:03:00.0")
+	addSF := func(aux, sfnum string, dirs ...string) {
+		dir := filepath.Join(pci, aux)
+		for _, d := range append([]string{""}, dirs...) {
+			if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		os.WriteFile(filepath.Join(dir, "sfnum"), []byte(sfnum+"\n"), 0644)
+		os.MkdirAll(auxSysfsRoot, 0755)
+		os.Symlink(dir, filepath.Join(auxSysfsRoot, aux))
+	}
+	addSF("mlx5_core.sf.2", "88", "net/enp3s0f0s88",
+		"mlx5_core.rdma.2/infiniband/mlx5_2", "mlx5_core.rdma.2/infiniband_verbs/uverbs2")
+	addSF("mlx5_core.sf.3", "89", "net/enp3s0f0s89", "mlx5_core.rdma.3")
+	addSF("mlx5_core.sf.4", "90")
+
+	sf := findSF("0000:03:00.0", 88)
+	if sf == nil || sf.Netdev != "enp3s0f0s88" || sf.RDMADevice != "mlx5_2" || sf.Uverbs != "uverbs2" {
+		t.Errorf("findSF(88) = %+v", sf)
+	}
+	if sf := findSF("0000:03:00.0", 89); sf != nil {
+		t.Errorf("findSF(89) = %+v before its RDMA device probed", sf)
+	}
+	if sf := findSF("0000:03:00.0", 90); sf != nil {
+		t.Errorf("findSF(90) = %+v without a netdev", sf)
+	}
+	if sf := findSF("0000:04:00.0", 88); sf != nil {
+		t.Errorf("findSF matched an SF of another PF: %+v", sf)
+	}
+}
+
+// TestSFHandler_Netdevsim runs the SF lifecycle against the kernel's
+// netdevsim devlink implementation.  It is skipped when netdevsim is not
+// loaded or does not support SF ports.
+func TestSFHandler_Netdevsim(t *testing.T) {
+	skipUnlessRoot(t)
+	const nsimBus = "/sys/bus/netdevsim"
+	if _, err := os.Stat(filepath.Join(nsimBus, "new_device")); err != nil {
+		t.Skip("skipping: netdevsim not loaded")
+	}
+	id := strconv.Itoa(1000 + os.Getpid()%1000)
+	if err := os.WriteFile(filepath.Join(nsimBus, "new_device"), []byte(id+" 1"), 0200); err != nil {
+		t.Skipf("skipping: cannot create netdevsim device: %v", err)
+	}
+	t.Cleanup(func() { os.WriteFile(filepath.Join(nsimBus, "del_device"), []byte(id), 0200) })
+
+	device := "netdevsim" + id
+	dev, err := netlink.DevLinkGetDeviceByName("netdevsim", device)
+	if err != nil {
+		t.Skipf("skipping: no devlink device for %s: %v", device, err)
+	}
+	if err := netlink.DevLinkSetEswitchMode(dev, EswitchModeSwitchdev); err != nil {
+		t.Skipf("skipping: cannot switch %s to switchdev: %v", device, err)
+	}
+	netdevs, err := os.ReadDir(filepath.Join(nsimBus, "devices", device, "net"))
+	if err != nil || len(netdevs) == 0 {
+		t.Fatalf("netdevsim %s has no netdev: %v", device, err)
+	}
+	pf := netdevs[0].Name()
+
+	if b, d, err := devlinkHandle(pf); err != nil || b != "netdevsim" || d != device {
+		t.Fatalf("devlinkHandle(%s) = %q, %q, %v", pf, b, d, err)
+	}
+
+	h := &SFHandler{}
+	req := &handler.PrepareRequest{
+		ClaimUID: "sf-claim-uid-1234",
+		Config: &handler.DeviceConfig{Type: handler.DeviceTypeNetdev, Netdev: &handler.NetdevConfig{
+			Kind: "sf", Parent: pf,
+		}},
+	}
+	result, err := h.Prepare(context.Background(), req)
+	if err != nil {
+		if strings.Contains(err.Error(), "not supported") {
+			t.Skipf("skipping: netdevsim does not support SF ports: %v", err)
+		}
+		t.Fatalf("Prepare: %v", err)
+	}
+	if err := h.Unprepare(context.Background(), &handler.UnprepareRequest{
+		ClaimUID: req.ClaimUID, Allocation: result.Allocation,
+	}); err != nil {
+		t.Fatalf("Unprepare: %v", err)
+	}
+}
+
+func TestVlanHandler_Validate(t *testing.T) {
+	h := &VlanHandler{}
+	ctx := context.Background()
+	valid := func() *handler.DeviceConfig {
+		return &handler.DeviceConfig{Netdev: &handler.NetdevConfig{
+			Kind: "vlan",
+			VLAN: &handler.VLANConfig{
+				ID: 100, Protocol: "802.1ad",
+				EgressQoS:  map[uint32]uint32{0: 0, 5: 5},
+				IngressQoS: map[uint32]uint32{5: 5},
+			},
+		}}
+	}
+	if err := h.Validate(ctx, valid()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*handler.DeviceConfig)
+	}{
+		{"no netdev", func(c *handler.DeviceConfig) { c.Netdev = nil }},
+		{"no vlan", func(c *handler.DeviceConfig) { c.Netdev.VLAN = nil }},
+		{"id 0", func(c *handler.DeviceConfig) { c.Netdev.VLAN.ID = 0 }},
+		{"id 4095", func(c *handler.DeviceConfig) { c.Netdev.VLAN.ID = 4095 }},
+		{"bad protocol", func(c *handler.DeviceConfig) { c.Netdev.VLAN.Protocol = "802.1x" }},
+		{"egress pcp", func(c *handler.DeviceConfig) { c.Netdev.VLAN.EgressQoS[1] = 8 }},
+		{"ingress pcp", func(c *handler.DeviceConfig) { c.Netdev.VLAN.IngressQoS[8] = 1 }},
+	}
+	for _, tt := range tests {
+		cfg := valid()
+		tt.modify(cfg)
+		if err := h.Validate(ctx, cfg); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestVlanHandler_PrepareAndUnprepare(t *testing.T) {
+	addTestParent(t, "testvlparent0")
+
+	h := &VlanHandler{}
+	ctx := context.Background()
+	req := &handler.PrepareRequest{
+		ClaimUID: "vltest00-1111-2222-3333-444444444444",
+		Config: &handler.DeviceConfig{
+			Type: handler.DeviceTypeNetdev,
+			Netdev: &handler.NetdevConfig{
+				Kind:          "vlan",
+				Parent:        "testvlparent0",
+				InterfaceName: "vltest",
+				VLAN: &handler.VLANConfig{
+					ID:        100,
+					EgressQoS: map[uint32]uint32{5: 3},
+				},
+			},
+		},
+	}
+
+	result, err := h.Prepare(ctx, req)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	defer cleanupLink(result.DeviceName)
+
+	link, err := netlink.LinkByName(result.DeviceName)
+	if err != nil {
+		t.Fatalf("vlan interface not found: %v", err)
+	}
+	vlan, ok := link.(*netlink.Vlan)
+	if !ok {
+		t.Fatalf("link type = %s, want vlan", link.Type())
+	}
+	if vlan.VlanId != 100 || vlan.VlanProtocol != netlink.VLAN_PROTOCOL_8021Q {
+		t.Errorf("vlan = %d/%s, want 100/802.1Q", vlan.VlanId, vlan.VlanProtocol)
+	}
+	if vlan.EgressQosMap[5] != 3 {
+		t.Errorf("egress QoS map = %v, want 5:3", vlan.EgressQosMap)
+	}
+	if result.CDIEdits.NetDevices[0].Name != "vltest" {
+		t.Errorf("container name = %s, want vltest", result.CDIEdits.NetDevices[0].Name)
+	}
+
+	if err := h.Unprepare(ctx, &handler.UnprepareRequest{
+		ClaimUID:   req.ClaimUID,
+		Allocation: result.Allocation,
+	}); err != nil {
+		t.Fatalf("Unprepare failed: %v", err)
+	}
+	if _, err := netlink.LinkByName(result.DeviceName); err == nil {
+		t.Error("vlan interface should be gone")
+	}
+}
+
+func TestTunnelHandlers_Validate(t *testing.T) {
+	ctx := context.Background()
+	learning := false
+	tests := []struct {
+		name    string
+		handler handler.DeviceHandler
+		netdev  *handler.NetdevConfig
+		wantErr bool
+	}{
+		{"vxlan no tunnel", &VxlanHandler{}, &handler.NetdevConfig{Kind: "vxlan"}, true},
+		{"vxlan remote", &VxlanHandler{}, &handler.NetdevConfig{Kind: "vxlan", Tunnel: &handler.TunnelConfig{
+			VNI: 42, Remote: "192.0.2.1", Local: "192.0.2.2", Learning: &learning, TTL: 64,
+		}}, false},
+		{"vxlan group", &VxlanHandler{}, &handler.NetdevConfig{Kind: "vxlan", Parent: "eth0", Tunnel: &handler.TunnelConfig{
+			VNI: 42, Group: "239.1.1.1",
+		}}, false},
+		{"vxlan fdb only", &VxlanHandler{}, &handler.NetdevConfig{Kind: "vxlan", Tunnel: &handler.TunnelConfig{
+			VNI: 42, FDB: []handler.FDBEntry{{Dst: "192.0.2.1"}, {MAC: "02:00:00:00:00:01", Dst: "2001:db8::1"}},
+		}}, false},
+		{"vxlan unicast group", &VxlanHandler{}, &handler.NetdevConfig{Kind: "vxlan", Tunnel: &handler.TunnelConfig{
+			VNI: 42, Group: "192.0.2.1",
+		}}, true},
+		{"vxlan remote and group", &VxlanHandler{}, &handler.NetdevConfig{Kind: "vxlan", Tunnel: &handler.TunnelConfig{
+			VNI: 42, Remote: "192.0.2.1", Group: "239.1.1.1",
+		}}, true},
+		{"vxlan vni too large", &VxlanHandler{}, &handler.NetdevConfig{Kind: "vxlan", Tunnel: &handler.TunnelConfig{
+			VNI: 1 << 24,
+		}}, true},
+		{"vxlan bad fdb mac", &VxlanHandler{}, &handler.NetdevConfig{Kind: "vxlan", Tunnel: &handler.TunnelConfig{
+			VNI: 42, FDB: []handler.FDBEntry{{MAC: "zz", Dst: "192.0.2.1"}},
+		}}, true},
+		{"vxlan bad fdb dst", &VxlanHandler{}, &handler.NetdevConfig{Kind: "vxlan", Tunnel: &handler.TunnelConfig{
+			VNI: 42, FDB: []handler.FDBEntry{{Dst: "peer"}},
+		}}, true},
+		{"vxlan ttl", &VxlanHandler{}, &handler.NetdevConfig{Kind: "vxlan", Tunnel: &handler.TunnelConfig{
+			VNI: 42, TTL: 256,
+		}}, true},
+		{"geneve", &GeneveHandler{}, &handler.NetdevConfig{Kind: "geneve", Tunnel: &handler.TunnelConfig{
+			VNI: 42, Remote: "2001:db8::1", DstPort: 6082,
+		}}, false},
+		{"geneve no remote", &GeneveHandler{}, &handler.NetdevConfig{Kind: "geneve", Tunnel: &handler.TunnelConfig{
+			VNI: 42,
+		}}, true},
+		{"geneve fdb", &GeneveHandler{}, &handler.NetdevConfig{Kind: "geneve", Tunnel: &handler.TunnelConfig{
+			VNI: 42, Remote: "192.0.2.1", FDB: []handler.FDBEntry{{Dst: "192.0.2.1"}},
+		}}, true},
+		{"geneve underlay", &GeneveHandler{}, &handler.NetdevConfig{Kind: "geneve", Parent: "eth0", Tunnel: &handler.TunnelConfig{
+			VNI: 42, Remote: "192.0.2.1",
+		}}, true},
+		{"geneve port", &GeneveHandler{}, &handler.NetdevConfig{Kind: "geneve", Tunnel: &handler.TunnelConfig{
+			VNI: 42, Remote: "192.0.2.1", DstPort: 70000,
+		}}, true},
+	}
+	for _, tt := range tests {
+		err := tt.handler.Validate(ctx, &handler.DeviceConfig{Type: handler.DeviceTypeNetdev, Netdev: tt.netdev})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestVxlanHandler_PrepareAndUnprepare(t *testing.T) {
+	addTestParent(t, "testvxunder0")
+
+	h := &VxlanHandler{}
+	ctx := context.Background()
+	req := &handler.PrepareRequest{
+		ClaimUID: "vxtest00-1111-2222-3333-444444444444",
+		Config: &handler.DeviceConfig{
+			Type: handler.DeviceTypeNetdev,
+			Netdev: &handler.NetdevConfig{
+				Kind:   "vxlan",
+				Parent: "testvxunder0",
+				Tunnel: &handler.TunnelConfig{
+					VNI: 4242,
+					FDB: []handler.FDBEntry{{Dst: "192.0.2.1"}, {Dst: "192.0.2.2"}},
+				},
+			},
+		},
+	}
+
+	result, err := h.Prepare(ctx, req)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	defer cleanupLink(result.DeviceName)
+
+	link, err := netlink.LinkByName(result.DeviceName)
+	if err != nil {
+		t.Fatalf("vxlan interface not found: %v", err)
+	}
+	vxlan, ok := link.(*netlink.Vxlan)
+	if !ok {
+		t.Fatalf("link type = %s, want vxlan", link.Type())
+	}
+	if vxlan.VxlanId != 4242 || vxlan.Port != vxlanPort {
+		t.Errorf("vxlan id/port = %d/%d, want 4242/%d", vxlan.VxlanId, vxlan.Port, vxlanPort)
+	}
+	fdb, err := netlink.NeighList(link.Attrs().Index, syscall.AF_BRIDGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := 0
+	for _, n := range fdb {
+		if n.IP != nil && n.State&netlink.NUD_PERMANENT != 0 {
+			peers++
+		}
+	}
+	if peers != 2 {
+		t.Errorf("permanent FDB entries with a peer = %d, want 2 (%+v)", peers, fdb)
+	}
+
+	if err := h.Unprepare(ctx, &handler.UnprepareRequest{
+		ClaimUID:   req.ClaimUID,
+		Allocation: result.Allocation,
+	}); err != nil {
+		t.Fatalf("Unprepare failed: %v", err)
+	}
+	if _, err := netlink.LinkByName(result.DeviceName); err == nil {
+		t.Error("vxlan interface should be gone")
+	}
+}
+
+func TestBondHandler_Validate(t *testing.T) {
+	ctx := context.Background()
+	miimon, negative := 200, -1
+	tests := []struct {
+		name    string
+		bond    *handler.BondConfig
+		wantErr bool
+	}{
+		{"defaults", nil, false},
+		{"lacp", &handler.BondConfig{Mode: "802.3ad", Miimon: &miimon, XmitHashPolicy: "layer3+4"}, false},
+		{"members", &handler.BondConfig{Members: []string{"eth1", "eth2"}}, false},
+		{"unknown mode", &handler.BondConfig{Mode: "round-robin"}, true},
+		{"negative miimon", &handler.BondConfig{Miimon: &negative}, true},
+		{"unknown hash policy", &handler.BondConfig{Mode: "balance-xor", XmitHashPolicy: "layer5"}, true},
+		{"hash policy on active-backup", &handler.BondConfig{XmitHashPolicy: "layer2"}, true},
+		{"empty member", &handler.BondConfig{Members: []string{""}}, true},
+		{"duplicate member", &handler.BondConfig{Members: []string{"eth1", "eth1"}}, true},
+	}
+	h := &BondHandler{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := h.Validate(ctx, &handler.DeviceConfig{
+				Type:   handler.DeviceTypeNetdev,
+				Netdev: &handler.NetdevConfig{Kind: "bond", Bond: tt.bond},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBondMembers(t *testing.T) {
+	root := fakeNetSysfs(t, "ens1f0", 1)
+	if err := os.MkdirAll(filepath.Join(root, "ens1f1v2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &handler.PrepareRequest{
+		AllocatedDevices: []string{
+			"netdev-virtual-bond",
+			"ens1f0-vf0",
+			"ens1f1v2-profile-fast",
+			"netdev-eth3",
+			"eth1-macvlan-pool",
+			"uverbs0",
+		},
+		Config: &handler.DeviceConfig{Netdev: &handler.NetdevConfig{
+			Kind: "bond",
+			Bond: &handler.BondConfig{Members: []string{"eth4"}},
+		}},
+	}
+	got, err := bondMembers(req)
+	if err != nil {
+		t.Fatalf("bondMembers: %v", err)
+	}
+	want := []string{"ens1f0v0", "ens1f1v2", "eth3", "eth4"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("bondMembers = %v, want %v", got, want)
+	}
+
+	req.Config.Netdev.Bond.Members = []string{"eth3"}
+	if _, err := bondMembers(req); err == nil {
+		t.Error("expected error for a member both allocated and configured")
+	}
+
+	req.AllocatedDevices = []string{"netdev-virtual-bond"}
+	req.Config.Netdev.Bond = nil
+	if _, err := bondMembers(req); err == nil {
+		t.Error("expected error for a bond without members")
+	}
+}
+
+func TestBondHandler_PrepareAndUnprepare(t *testing.T) {
+	addTestParent(t, "testbdm0")
+	addTestParent(t, "testbdm1")
+
+	links := nri.NewLinkSetupTracker()
+	h := &BondHandler{Links: links}
+	ctx := context.Background()
+	req := &handler.PrepareRequest{
+		ClaimUID:         "bdtest00-1111-2222-3333-444444444444",
+		AllocatedDevices: []string{"netdev-virtual-bond", "netdev-testbdm0"},
+		Config: &handler.DeviceConfig{
+			Type: handler.DeviceTypeNetdev,
+			Netdev: &handler.NetdevConfig{
+				Kind:          "bond",
+				InterfaceName: "bond1",
+				Bond:          &handler.BondConfig{Members: []string{"testbdm1"}},
+			},
+		},
+	}
+
+	result, err := h.Prepare(ctx, req)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	var moved []string
+	for _, dev := range result.CDIEdits.NetDevices {
+		moved = append(moved, dev.HostInterfaceName+"="+dev.Name)
+	}
+	if got := strings.Join(moved, ","); got != "testbdm0=bond1m0,testbdm1=bond1m1" {
+		t.Errorf("netDevices = %s, want testbdm0=bond1m0,testbdm1=bond1m1", got)
+	}
+	setups := links.ConsumePendingForClaims([]string{req.ClaimUID})
+	if len(setups) != 1 || setups[0].IfName != "bond1m0" {
+		t.Fatalf("pending setups = %+v, want one for bond1m0", setups)
+	}
+
+	// Unprepare restores what the pod may have changed on a member.
+	link, _ := netlink.LinkByName("testbdm1")
+	if err := netlink.LinkSetDown(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetMTU(link, 1400); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Unprepare(ctx, &handler.UnprepareRequest{
+		ClaimUID:   req.ClaimUID,
+		Allocation: result.Allocation,
+	}); err != nil {
+		t.Fatalf("Unprepare failed: %v", err)
+	}
+	link, _ = netlink.LinkByName("testbdm1")
+	if link.Attrs().MTU != 1500 || link.Attrs().Flags&net.FlagUp == 0 {
+		t.Errorf("member after Unprepare: mtu=%d flags=%s, want 1500 and up", link.Attrs().MTU, link.Attrs().Flags)
+	}
+}
+
+func TestAssembleBond(t *testing.T) {
+	addTestParent(t, "testbdm2")
+	addTestParent(t, "testbdm3")
+	defer cleanupLink("testbond0")
+
+	members := []bondMember{{ContainerName: "testbdm2"}, {ContainerName: "testbdm3"}}
+	cfg := &handler.BondConfig{Mode: "balance-xor", XmitHashPolicy: "layer2+3"}
+	if err := assembleBond("testbond0", members, cfg, 0); err != nil {
+		if strings.Contains(err.Error(), "create bond") {
+			t.Skipf("skipping: bonding not available: %v", err)
+		}
+		t.Fatalf("assembleBond: %v", err)
+	}
+
+	link, err := netlink.LinkByName("testbond0")
+	if err != nil {
+		t.Fatalf("bond not found: %v", err)
+	}
+	bond, ok := link.(*netlink.Bond)
+	if !ok {
+		t.Fatalf("link type = %s, want bond", link.Type())
+	}
+	if bond.Mode != netlink.BOND_MODE_BALANCE_XOR || bond.Miimon != defaultBondMiimon ||
+		bond.XmitHashPolicy != netlink.BOND_XMIT_HASH_POLICY_LAYER2_3 {
+		t.Errorf("bond mode/miimon/hash = %s/%d/%s", bond.Mode, bond.Miimon, bond.XmitHashPolicy)
+	}
+	for _, m := range members {
+		slave, _ := netlink.LinkByName(m.ContainerName)
+		if slave.Attrs().MasterIndex != bond.Index {
+			t.Errorf("%s master index = %d, want %d", m.ContainerName, slave.Attrs().MasterIndex, bond.Index)
+		}
+	}
+
+	if err := deleteLinkByName("testbond0"); err != nil {
+		t.Fatalf("delete bond: %v", err)
+	}
+}
+
+func TestVethHandler_ValidateBridge(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		bridge  *handler.BridgeConfig
+		wantErr bool
+	}{
+		{"no bridge", nil, false},
+		{"plain", &handler.BridgeConfig{Name: "br0", Hairpin: true, Isolated: true}, false},
+		{"vlans", &handler.BridgeConfig{Name: "br0", PVID: 10, VLANs: []int{20, 30}}, false},
+		{"no name", &handler.BridgeConfig{PVID: 10}, true},
+		{"long name", &handler.BridgeConfig{Name: "bridge-name-too-long"}, true},
+		{"pvid range", &handler.BridgeConfig{Name: "br0", PVID: 4095}, true},
+		{"vlan range", &handler.BridgeConfig{Name: "br0", VLANs: []int{0}}, true},
+		{"pvid tagged", &handler.BridgeConfig{Name: "br0", PVID: 10, VLANs: []int{10}}, true},
+	}
+	h := &VethHandler{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := h.Validate(ctx, &handler.DeviceConfig{
+				Type:   handler.DeviceTypeNetdev,
+				Netdev: &handler.NetdevConfig{Kind: "veth", Bridge: tt.bridge},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVethHandler_Bridge(t *testing.T) {
+	skipUnlessRoot(t)
+	defer cleanupLink("testbr0")
+
+	h := &VethHandler{}
+	ctx := context.Background()
+	req := &handler.PrepareRequest{
+		ClaimUID: "brtest00-1111-2222-3333-444444444444",
+		Config: &handler.DeviceConfig{
+			Type: handler.DeviceTypeNetdev,
+			Netdev: &handler.NetdevConfig{
+				Kind: "veth",
+				Bridge: &handler.BridgeConfig{
+					Name: "testbr0", Hairpin: true, Isolated: true, DeleteUnused: true,
+				},
+			},
+		},
+	}
+
+	result, err := h.Prepare(ctx, req)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	hostEnd := result.Allocation.Metadata["hostEnd"]
+	defer cleanupLink(hostEnd)
+
+	br, err := netlink.LinkByName("testbr0")
+	if err != nil {
+		t.Fatalf("bridge not created: %v", err)
+	}
+	if br.Attrs().Alias != createdBridgeAlias {
+		t.Errorf("bridge alias = %q, want %q", br.Attrs().Alias, createdBridgeAlias)
+	}
+	port, _ := netlink.LinkByName(hostEnd)
+	if port.Attrs().MasterIndex != br.Attrs().Index {
+		t.Fatalf("%s master index = %d, want %d", hostEnd, port.Attrs().MasterIndex, br.Attrs().Index)
+	}
+	protinfo, err := netlink.LinkGetProtinfo(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !protinfo.Hairpin || !protinfo.Isolated {
+		t.Errorf("port flags = %s, want hairpin and isolated", protinfo.String())
+	}
+
+	if err := h.Unprepare(ctx, &handler.UnprepareRequest{
+		ClaimUID:   req.ClaimUID,
+		Allocation: result.Allocation,
+	}); err != nil {
+		t.Fatalf("Unprepare failed: %v", err)
+	}
+	if _, err := netlink.LinkByName("testbr0"); err == nil {
+		t.Error("unused driver-created bridge should be gone")
+	}
+}
+
+func TestVethHandler_BridgeVLANs(t *testing.T) {
+	skipUnlessRoot(t)
+	on := true
+	probe := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "testbr2"}, VlanFiltering: &on}
+	if err := netlink.LinkAdd(probe); err != nil {
+		t.Skipf("skipping: cannot create a VLAN-filtering bridge: %v", err)
+	}
+	netlink.LinkDel(probe)
+	defer cleanupLink("testbr2")
+
+	h := &VethHandler{}
+	ctx := context.Background()
+	req := &handler.PrepareRequest{
+		ClaimUID: "brtest02-1111-2222-3333-444444444444",
+		Config: &handler.DeviceConfig{
+			Type: handler.DeviceTypeNetdev,
+			Netdev: &handler.NetdevConfig{
+				Kind:   "veth",
+				Bridge: &handler.BridgeConfig{Name: "testbr2", PVID: 10, VLANs: []int{20, 30}},
+			},
+		},
+	}
+	result, err := h.Prepare(ctx, req)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	hostEnd := result.Allocation.Metadata["hostEnd"]
+	defer cleanupLink(hostEnd)
+
+	br, _ := netlink.LinkByName("testbr2")
+	if filtering := br.(*netlink.Bridge).VlanFiltering; filtering == nil || !*filtering {
+		t.Error("bridge should have VLAN filtering enabled")
+	}
+	port, _ := netlink.LinkByName(hostEnd)
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, info := range vlans[int32(port.Attrs().Index)] {
+		got = append(got, fmt.Sprintf("%d/pvid=%t/untagged=%t", info.Vid, info.PortVID(), info.EngressUntag()))
+	}
+	want := "10/pvid=true/untagged=true 20/pvid=false/untagged=false 30/pvid=false/untagged=false"
+	if strings.Join(got, " ") != want {
+		t.Errorf("port VLANs = %s, want %s", strings.Join(got, " "), want)
+	}
+
+	if err := h.Unprepare(ctx, &handler.UnprepareRequest{
+		ClaimUID:   req.ClaimUID,
+		Allocation: result.Allocation,
+	}); err != nil {
+		t.Fatalf("Unprepare failed: %v", err)
+	}
+	if _, err := netlink.LinkByName("testbr2"); err != nil {
+		t.Error("bridge should be kept without deleteUnused")
+	}
+}
+
+func TestVethHandler_BridgeKeepsForeignBridge(t *testing.T) {
+	skipUnlessRoot(t)
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "testbr1"}}
+	if err := netlink.LinkAdd(br); err != nil {
+		t.Skipf("skipping: cannot create bridge: %v", err)
+	}
+	defer cleanupLink("testbr1")
+
+	h := &VethHandler{}
+	ctx := context.Background()
+	req := &handler.PrepareRequest{
+		ClaimUID: "brtest01-1111-2222-3333-444444444444",
+		Config: &handler.DeviceConfig{
+			Type: handler.DeviceTypeNetdev,
+			Netdev: &handler.NetdevConfig{
+				Kind:   "veth",
+				Bridge: &handler.BridgeConfig{Name: "testbr1", DeleteUnused: true},
+			},
+		},
+	}
+	result, err := h.Prepare(ctx, req)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	defer cleanupLink(result.Allocation.Metadata["hostEnd"])
+
+	if err := h.Unprepare(ctx, &handler.UnprepareRequest{
+		ClaimUID:   req.ClaimUID,
+		Allocation: result.Allocation,
+	}); err != nil {
+		t.Fatalf("Unprepare failed: %v", err)
+	}
+	if _, err := netlink.LinkByName("testbr1"); err != nil {
+		t.Error("bridge the driver did not create should be kept")
+	}
+
+	// A VLAN attachment needs the bridge to filter VLANs already.
+	req.Config.Netdev.Bridge.PVID = 10
+	if _, err := h.Prepare(ctx, req); err == nil {
+		t.Error("expected error attaching with a PVID to a bridge without VLAN filtering")
+	}
+}
+
+func TestVethHandler_ValidateOVS(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		netdev  *handler.NetdevConfig
+		wantErr bool
+	}{
+		{"access port", &handler.NetdevConfig{OVS: &handler.OVSConfig{Bridge: "br-int", Tag: 100}}, false},
+		{"trunk port", &handler.NetdevConfig{OVS: &handler.OVSConfig{Bridge: "br-int", Trunks: []int{0, 10}}}, false},
+		{"no bridge", &handler.NetdevConfig{OVS: &handler.OVSConfig{Tag: 100}}, true},
+		{"tag range", &handler.NetdevConfig{OVS: &handler.OVSConfig{Bridge: "br-int", Tag: 4096}}, true},
+		{"tag 4095", &handler.NetdevConfig{OVS: &handler.OVSConfig{Bridge: "br-int", Tag: 4095}}, true},
+		{"tag 4094", &handler.NetdevConfig{OVS: &handler.OVSConfig{Bridge: "br-int", Tag: 4094}}, false},
+		{"tag and trunks", &handler.NetdevConfig{OVS: &handler.OVSConfig{Bridge: "br-int", Tag: 10, Trunks: []int{20}}}, true},
+		{"trunk range", &handler.NetdevConfig{OVS: &handler.OVSConfig{Bridge: "br-int", Trunks: []int{-1}}}, true},
+		{"trunk 4095", &handler.NetdevConfig{OVS: &handler.OVSConfig{Bridge: "br-int", Trunks: []int{4095}}}, true},
+		{"reserved external id", &handler.NetdevConfig{OVS: &handler.OVSConfig{
+			Bridge: "br-int", ExternalIDs: map[string]string{ovsClaimUIDKey: "x"},
+		}}, true},
+		{"bridge and ovs", &handler.NetdevConfig{
+			Bridge: &handler.BridgeConfig{Name: "br0"},
+			OVS:    &handler.OVSConfig{Bridge: "br-int"},
+		}, true},
+	}
+	h := &VethHandler{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.netdev.Kind = "veth"
+			err := h.Validate(ctx, &handler.DeviceConfig{Type: handler.DeviceTypeNetdev, Netdev: tt.netdev})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVethHandler_OVS(t *testing.T) {
+	skipUnlessRoot(t)
+	srv := ovstest.NewServer(t, "br-int")
+
+	h := &VethHandler{OVS: &ovs.Client{Socket: srv.Socket}}
+	ctx := context.Background()
+	req := &handler.PrepareRequest{
+		ClaimUID:  "ovstest0-1111-2222-3333-444444444444",
+		Namespace: "team-a",
+		ClaimName: "web-net",
+		Config: &handler.DeviceConfig{
+			Type: handler.DeviceTypeNetdev,
+			Netdev: &handler.NetdevConfig{
+				Kind: "veth",
+				OVS: &handler.OVSConfig{
+					Bridge:      "br-int",
+					Tag:         42,
+					ExternalIDs: map[string]string{"iface-id": "team-a_web"},
+				},
+			},
+		},
+	}
+
+	result, err := h.Prepare(ctx, req)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	hostEnd := result.Allocation.Metadata["hostEnd"]
+	defer cleanupLink(hostEnd)
+
+	port, iface, ok := srv.Port(hostEnd)
+	if !ok {
+		t.Fatalf("%s not added to br-int (ports: %v)", hostEnd, srv.Ports("br-int"))
+	}
+	if port["tag"] != float64(42) {
+		t.Errorf("tag = %v, want 42", port["tag"])
+	}
+	ids := ovstest.Map(iface["external_ids"])
+	want := map[string]string{
+		ovsClaimUIDKey:       req.ClaimUID,
+		ovsClaimNamespaceKey: "team-a",
+		ovsClaimNameKey:      "web-net",
+		"iface-id":           "team-a_web",
+	}
+	for k, v := range want {
+		if ids[k] != v {
+			t.Errorf("external_ids[%s] = %q, want %q", k, ids[k], v)
+		}
+	}
+
+	if err := h.Unprepare(ctx, &handler.UnprepareRequest{
+		ClaimUID:   req.ClaimUID,
+		Allocation: result.Allocation,
+	}); err != nil {
+		t.Fatalf("Unprepare failed: %v", err)
+	}
+	if ports := srv.Ports("br-int"); len(ports) != 0 {
+		t.Errorf("ports on br-int after Unprepare = %v, want none", ports)
+	}
+	if _, err := netlink.LinkByName(hostEnd); err == nil {
+		t.Error("host veth end should be gone")
+	}
+
+	// A missing bridge fails Prepare and leaves no veth behind.
+	req.Config.Netdev.OVS.Bridge = "br-missing"
+	if _, err := h.Prepare(ctx, req); err == nil {
+		t.Fatal("expected error plugging into a missing OVS bridge")
+	}
+	if _, err := netlink.LinkByName(hostEnd); err == nil {
+		t.Error("veth should be deleted after a failed OVS attachment")
+	}
+}
+
+func TestParseLinkConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       handler.NetdevConfig
+		wantErr   bool
+		wantNil   bool
+		wantState string
+	}{
+		{name: "none", wantNil: true},
+		{
+			name: "dual stack",
+			cfg: handler.NetdevConfig{
+				Addresses: []string{"192.0.2.10/24", "2001:db8::10/64"},
+				Gateways:  []string{"192.0.2.1", "2001:db8::1"},
+				Routes:    []handler.RouteConfig{{Dst: "198.51.100.0/24", Via: "192.0.2.254", Metric: 10}, {Dst: "203.0.113.0/24"}},
+			},
+			wantState: "up",
+		},
+		{name: "mac only", cfg: handler.NetdevConfig{MAC: "02:00:00:00:00:01"}, wantState: "up"},
+		{name: "mac on a down link", cfg: handler.NetdevConfig{MAC: "02:00:00:00:00:01", State: "down"}, wantState: "down"},
+		{name: "explicit down", cfg: handler.NetdevConfig{Addresses: []string{"192.0.2.10/24"}, State: "down"}, wantState: "down"},
+		{name: "bad address", cfg: handler.NetdevConfig{Addresses: []string{"192.0.2.10"}}, wantErr: true},
+		{name: "bad gateway", cfg: handler.NetdevConfig{Gateways: []string{"gw"}}, wantErr: true},
+		{name: "two IPv4 gateways", cfg: handler.NetdevConfig{Gateways: []string{"192.0.2.1", "192.0.2.2"}}, wantErr: true},
+		{name: "bad route", cfg: handler.NetdevConfig{Routes: []handler.RouteConfig{{Dst: "10.0.0.1"}}}, wantErr: true},
+		{name: "mixed families", cfg: handler.NetdevConfig{Routes: []handler.RouteConfig{{Dst: "10.0.0.0/8", Via: "2001:db8::1"}}}, wantErr: true},
+		{name: "negative metric", cfg: handler.NetdevConfig{Routes: []handler.RouteConfig{{Dst: "10.0.0.0/8", Metric: -1}}}, wantErr: true},
+		{name: "bad MAC", cfg: handler.NetdevConfig{MAC: "02:00"}, wantErr: true},
+		{name: "bad state", cfg: handler.NetdevConfig{State: "dormant"}, wantErr: true},
+		{name: "routes on a down link", cfg: handler.NetdevConfig{Gateways: []string{"192.0.2.1"}, State: "down"}, wantErr: true},
+		{name: "routing table", cfg: handler.NetdevConfig{Addresses: []string{"192.0.2.10/24"}, Routing: &handler.RoutingConfig{Table: 100}}, wantState: "up"},
+		{name: "default route only", cfg: handler.NetdevConfig{Routing: &handler.RoutingConfig{DefaultRoute: true}}, wantState: "up"},
+		{name: "VRF", cfg: handler.NetdevConfig{Routing: &handler.RoutingConfig{Table: 100, VRF: "vrf-blue"}}, wantState: "up"},
+		{name: "main table", cfg: handler.NetdevConfig{Routing: &handler.RoutingConfig{Table: 254}}, wantErr: true},
+		{name: "negative table", cfg: handler.NetdevConfig{Routing: &handler.RoutingConfig{Table: -1}}, wantErr: true},
+		{name: "table above 32 bits", cfg: handler.NetdevConfig{Routing: &handler.RoutingConfig{Table: math.MaxUint32 + 1}}, wantErr: true},
+		{name: "rule priority without table", cfg: handler.NetdevConfig{Routing: &handler.RoutingConfig{RulePriority: 50}}, wantErr: true},
+		{name: "VRF without table", cfg: handler.NetdevConfig{Routing: &handler.RoutingConfig{VRF: "vrf-blue"}}, wantErr: true},
+		{name: "VRF name too long", cfg: handler.NetdevConfig{Routing: &handler.RoutingConfig{Table: 100, VRF: "vrf-0123456789ab"}}, wantErr: true},
+		{name: "VRF and default route", cfg: handler.NetdevConfig{Routing: &handler.RoutingConfig{Table: 100, VRF: "vrf-blue", DefaultRoute: true}}, wantErr: true},
+		{name: "VRF named like the interface", cfg: handler.NetdevConfig{InterfaceName: "net1", Routing: &handler.RoutingConfig{Table: 100, VRF: "net1"}}, wantErr: true},
+		{name: "default route on a down link", cfg: handler.NetdevConfig{Routing: &handler.RoutingConfig{DefaultRoute: true}, State: "down"}, wantErr: true},
+		{name: "sysctls", cfg: handler.NetdevConfig{Sysctls: map[string]string{"ipv4.rp_filter": "0", "ipv6.accept_ra": "0"}}},
+		{name: "sysctl without family", cfg: handler.NetdevConfig{Sysctls: map[string]string{"rp_filter": "0"}}, wantErr: true},
+		{name: "sysctl path", cfg: handler.NetdevConfig{Sysctls: map[string]string{"ipv4.all/rp_filter": "0"}}, wantErr: true},
+		{name: "empty sysctl value", cfg: handler.NetdevConfig{Sysctls: map[string]string{"ipv4.rp_filter": ""}}, wantErr: true},
+		{name: "IPv6 disabled with an IPv6 address", cfg: handler.NetdevConfig{Addresses: []string{"2001:db8::10/64"}, Sysctls: map[string]string{"ipv6.disable_ipv6": "1"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseLinkConfig(&tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLinkConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (c == nil) != tt.wantNil {
+				t.Fatalf("parseLinkConfig() = %+v, want nil %t", c, tt.wantNil)
+			}
+			if c != nil && c.state != tt.wantState {
+				t.Errorf("state = %q, want %q", c.state, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestValidateDHCP(t *testing.T) {
+	ctx := context.Background()
+	links, mgr := nri.NewLinkSetupTracker(), &dhcp.Manager{}
+	dhcpMode := func(netdev *handler.NetdevConfig) *handler.DeviceConfig {
+		netdev.IPAM = &handler.IPAMConfig{Mode: handler.IPAMModeDHCP}
+		return &handler.DeviceConfig{Type: handler.DeviceTypeNetdev, Netdev: netdev}
+	}
+	if err := (&MacvlanHandler{Links: links, DHCP: mgr}).Validate(ctx, dhcpMode(&handler.NetdevConfig{Kind: "macvlan"})); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (&MacvlanHandler{Links: links}).Validate(ctx, dhcpMode(&handler.NetdevConfig{Kind: "macvlan"})); err == nil {
+		t.Error("expected error without a DHCP manager")
+	}
+	if err := (&MacvlanHandler{DHCP: mgr}).Validate(ctx, dhcpMode(&handler.NetdevConfig{Kind: "macvlan"})); err == nil {
+		t.Error("expected error without a link setup tracker")
+	}
+	if err := (&MacvlanHandler{Links: links, DHCP: mgr}).Validate(ctx, dhcpMode(&handler.NetdevConfig{Kind: "macvlan", State: "down"})); err == nil {
+		t.Error("expected error for a down link")
+	}
+	noFamily := dhcpMode(&handler.NetdevConfig{Kind: "ipvlan"})
+	noFamily.Netdev.IPAM.DHCP = &handler.DHCPConfig{IPv4: new(bool)}
+	if err := (&IpvlanHandler{Links: links, DHCP: mgr}).Validate(ctx, noFamily); err == nil {
+		t.Error("expected error with both families disabled")
+	}
+	if err := (&IpvlanHandler{Links: links, DHCP: mgr}).Validate(ctx, dhcpMode(&handler.NetdevConfig{Kind: "ipvlan", Mode: "l3"})); err == nil {
+		t.Error("expected error for ipvlan in l3 mode")
+	}
+	if err := (&MacvlanHandler{Links: links, DHCP: mgr}).Validate(ctx, dhcpMode(&handler.NetdevConfig{Kind: "macvlan", Routing: &handler.RoutingConfig{Table: 100}})); err != nil {
+		t.Errorf("unexpected error for a routing table with dhcp: %v", err)
+	}
+	if err := (&MacvlanHandler{Links: links, DHCP: mgr}).Validate(ctx, dhcpMode(&handler.NetdevConfig{Kind: "macvlan", Routing: &handler.RoutingConfig{Table: 100, VRF: "vrf-blue"}})); err == nil {
+		t.Error("expected error for a VRF with dhcp")
+	}
+}
+
+func TestDHCPOptions(t *testing.T) {
+	cfg := &handler.NetdevConfig{IPAM: &handler.IPAMConfig{Mode: handler.IPAMModeDHCP}}
+	// The pod keeps its default route unless the claim opts in.
+	if opts := dhcpOptions(cfg); !opts.IPv4 || opts.IPv6 || opts.DefaultRoute || opts.Table != 0 || opts.NoRouter {
+		t.Errorf("default options = %+v", opts)
+	}
+	cfg.Routing = &handler.RoutingConfig{DefaultRoute: true}
+	if opts := dhcpOptions(cfg); !opts.DefaultRoute {
+		t.Errorf("options with routing.defaultRoute = %+v", opts)
+	}
+	cfg.Routing = &handler.RoutingConfig{Table: 100}
+	if opts := dhcpOptions(cfg); opts.Table != 100 || opts.RulePriority != defaultRulePriority || opts.DefaultRoute {
+		t.Errorf("options with routing.table = %+v", opts)
+	}
+	cfg.IPAM.DHCP = &handler.DHCPConfig{IPv6: true, Hostname: "web-0"}
+	cfg.Routing = &handler.RoutingConfig{DefaultRoute: true}
+	cfg.Gateways = []string{"2001:db8::1", "192.0.2.1"}
+	// The configured IPv4 gateway replaces the DHCP router.
+	if opts := dhcpOptions(cfg); !opts.IPv4 || !opts.IPv6 || opts.Hostname != "web-0" || opts.DefaultRoute || !opts.NoRouter {
+		t.Errorf("options = %+v", opts)
+	}
+}
+
+func TestRegisterDHCP(t *testing.T) {
+	links, mgr := nri.NewLinkSetupTracker(), &dhcp.Manager{}
+	req := &handler.PrepareRequest{
+		ClaimUID: "claim-dhcp",
+		Config: &handler.DeviceConfig{Netdev: &handler.NetdevConfig{
+			Kind: "macvlan", IPAM: &handler.IPAMConfig{Mode: handler.IPAMModeDHCP},
+		}},
+	}
+	metadata := map[string]string{}
+	registerDHCP(links, mgr, req, "net1", metadata)
+	if metadata["dhcp"] != "true" {
+		t.Errorf("metadata = %v", metadata)
+	}
+	setups := links.ConsumePendingForClaims([]string{"claim-dhcp"})
+	if len(setups) != 1 || setups[0].IfName != "net1" {
+		t.Fatalf("pending setups = %+v", setups)
+	}
+	// Without a pod netns the client cannot start.
+	if err := setups[0].Apply(nil); err == nil {
+		t.Error("expected Apply to fail without a netns")
+	}
+}
+
+func TestRestoreLinkSetups(t *testing.T) {
+	links, mgr := nri.NewLinkSetupTracker(), &dhcp.Manager{}
+	req := &handler.PrepareRequest{
+		ClaimUID: "claim-restore",
+		Config: &handler.DeviceConfig{Netdev: &handler.NetdevConfig{
+			Kind:      "macvlan",
+			Addresses: []string{"192.0.2.10/24"},
+			IPAM:      &handler.IPAMConfig{Mode: handler.IPAMModeDHCP},
+		}},
+		ConsumedCapacity: map[string]resource.Quantity{handler.CapacityBandwidth: resource.MustParse("1G")},
+	}
+	metadata := map[string]string{"containerName": "net1"}
+	if err := registerLinkConfig(links, req, "net1", metadata); err != nil {
+		t.Fatalf("registerLinkConfig: %v", err)
+	}
+	registerDHCP(links, mgr, req, "net1", metadata)
+	registerShaping(links, req, "net1", metadata)
+	prepared := links.ConsumePendingForClaims([]string{"claim-restore"})
+
+	// A restarted driver registers the same setups from the metadata.
+	restarted := nri.NewLinkSetupTracker()
+	restoreLinkSetups(restarted, mgr, &handler.AllocationInfo{ClaimUID: "claim-restore", Metadata: metadata})
+	restored := restarted.ConsumePendingForClaims([]string{"claim-restore"})
+	if len(restored) != len(prepared) || len(restored) != 3 {
+		t.Fatalf("restored %d setups, want the %d of Prepare", len(restored), len(prepared))
+	}
+	for _, s := range restored {
+		if s.IfName != "net1" || s.Apply == nil {
+			t.Errorf("restored setup = %+v", s)
+		}
+	}
+
+	// Nothing was recorded without a tracker.
+	restoreLinkSetups(restarted, mgr, &handler.AllocationInfo{ClaimUID: "claim-other", Metadata: map[string]string{}})
+	if got := restarted.ConsumePendingForClaims([]string{"claim-other"}); len(got) != 0 {
+		t.Errorf("restored %d setups without a recorded config", len(got))
+	}
+}
+
+func TestValidateLinkConfig_RequiresTracker(t *testing.T) {
+	ctx := context.Background()
+	cfg := &handler.DeviceConfig{
+		Type:   handler.DeviceTypeNetdev,
+		Netdev: &handler.NetdevConfig{Kind: "veth", Addresses: []string{"192.0.2.10/24"}},
+	}
+	if err := (&VethHandler{}).Validate(ctx, cfg); err == nil {
+		t.Error("expected error for addresses without a link setup tracker")
+	}
+	if err := (&VethHandler{Links: nri.NewLinkSetupTracker()}).Validate(ctx, cfg); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	cfg.Netdev = &handler.NetdevConfig{Kind: "ipvlan", Parent: "eth0", MAC: "02:00:00:00:00:01"}
+	if err := (&IpvlanHandler{Links: nri.NewLinkSetupTracker()}).Validate(ctx, cfg); err == nil {
+		t.Error("expected error setting the MAC of an ipvlan")
+	}
+	cfg.Netdev = &handler.NetdevConfig{Kind: "sriov-vf", Mode: VFModeVFIO, Addresses: []string{"192.0.2.10/24"}}
+	if err := (&SriovVfHandler{Links: nri.NewLinkSetupTracker()}).Validate(ctx, cfg); err == nil {
+		t.Error("expected error for addresses on a VF in vfio-pci mode")
+	}
+
+	// Routing errors surface in Validate, before anything is created.
+	for _, r := range []*handler.RoutingConfig{
+		{Table: math.MaxUint32 + 1},
+		{RulePriority: 50},
+		{Table: 100, VRF: "vrf-blue", DefaultRoute: true},
+		{Table: 100, VRF: "eth1"},
+	} {
+		netdev := &handler.NetdevConfig{Kind: "veth", InterfaceName: "eth1", Routing: r}
+		if err := validateLinkConfig(netdev, nri.NewLinkSetupTracker()); err == nil {
+			t.Errorf("expected error for routing %+v", *r)
+		}
+	}
+}
+
+func TestRegisterLinkConfig(t *testing.T) {
+	links := nri.NewLinkSetupTracker()
+	req := &handler.PrepareRequest{
+		ClaimUID: "lcfg0000-1111-2222-3333-444444444444",
+		Config:   &handler.DeviceConfig{Netdev: &handler.NetdevConfig{Kind: "veth"}},
+	}
+	metadata := map[string]string{}
+
+	if err := registerLinkConfig(links, req, "net1", metadata); err != nil {
+		t.Fatalf("registerLinkConfig: %v", err)
+	}
+	if setups := links.ConsumePendingForClaims([]string{req.ClaimUID}); len(setups) != 0 {
+		t.Errorf("expected no setup without link settings, got %d", len(setups))
+	}
+
+	// Settings that do not parse fail Prepare rather than being dropped.
+	req.Config.Netdev.Addresses = []string{"192.0.2.300/24"}
+	if err := registerLinkConfig(links, req, "net1", metadata); err == nil {
+		t.Error("expected error for an invalid address")
+	}
+	if setups := links.ConsumePendingForClaims([]string{req.ClaimUID}); len(setups) != 0 {
+		t.Errorf("expected no setup for invalid link settings, got %d", len(setups))
+	}
+
+	req.Config.Netdev.Addresses = []string{"192.0.2.10/24", "2001:db8::10/64"}
+	if err := registerLinkConfig(links, req, "net1", metadata); err != nil {
+		t.Fatalf("registerLinkConfig: %v", err)
+	}
+	setups := links.ConsumePendingForClaims([]string{req.ClaimUID})
+	if len(setups) != 1 || setups[0].IfName != "net1" || setups[0].Apply == nil {
+		t.Fatalf("unexpected setups: %+v", setups)
+	}
+	if got := metadata["addresses"]; got != "192.0.2.10/24,2001:db8::10/64" {
+		t.Errorf("addresses metadata = %q", got)
+	}
+}
+
+func TestLinkConfig_Apply(t *testing.T) {
+	skipUnlessRoot(t)
+
+	// Work in a scratch netns so host addresses and routes are untouched.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origNS, err := netns.Get()
+	if err != nil {
+		t.Fatalf("get netns: %v", err)
+	}
+	defer origNS.Close()
+	testNS, err := netns.New()
+	if err != nil {
+		t.Skipf("skipping: cannot create netns: %v", err)
+	}
+	defer testNS.Close()
+	defer netns.Set(origNS)
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "lcfg0"}, PeerName: "lcfg1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("skipping: cannot create veth pair: %v", err)
+	}
+	peer, _ := netlink.LinkByName("lcfg1")
+	netlink.LinkSetUp(peer)
+
+	c, err := parseLinkConfig(&handler.NetdevConfig{
+		Addresses: []string{"192.0.2.10/24", "2001:db8::10/64"},
+		Gateways:  []string{"192.0.2.1", "2001:db8::1"},
+		Routes: []handler.RouteConfig{
+			{Dst: "198.51.100.0/24", Via: "192.0.2.254", Metric: 10},
+			{Dst: "203.0.113.0/24"},
+		},
+		MAC: "02:00:00:00:aa:01",
+	})
+	if err != nil {
+		t.Fatalf("parseLinkConfig: %v", err)
+	}
+	link, err := netlink.LinkByName("lcfg0")
+	if err != nil {
+		t.Fatalf("link not found: %v", err)
+	}
+
+	// Listen on the peer for the gratuitous ARP.
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		t.Fatalf("open packet socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ARP), Ifindex: peer.Attrs().Index}); err != nil {
+		t.Fatalf("bind packet socket: %v", err)
+	}
+	syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 2})
+
+	if err := c.apply(link); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	buf := make([]byte, 64)
+	if n, _, err := syscall.Recvfrom(fd, buf, 0); err != nil {
+		t.Errorf("no gratuitous ARP received: %v", err)
+	} else if n < 28 || !net.IP(buf[14:18]).Equal(net.ParseIP("192.0.2.10")) || !net.IP(buf[24:28]).Equal(net.ParseIP("192.0.2.10")) {
+		t.Errorf("unexpected ARP packet % x", buf[:n])
+	}
+	// Applying again, as on a retry, is harmless.
+	if err := c.apply(link); err != nil {
+		t.Fatalf("apply again: %v", err)
+	}
+
+	link, _ = netlink.LinkByName("lcfg0")
+	if link.Attrs().HardwareAddr.String() != "02:00:00:00:aa:01" {
+		t.Errorf("MAC = %s, want 02:00:00:00:aa:01", link.Attrs().HardwareAddr)
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		t.Error("link should be up")
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatalf("AddrList: %v", err)
+	}
+	var got []string
+	for _, a := range addrs {
+		if !a.IP.IsLinkLocalUnicast() {
+			got = append(got, a.IPNet.String())
+		}
+	}
+	if strings.Join(got, ",") != "192.0.2.10/24,2001:db8::10/64" {
+		t.Errorf("addresses = %v", got)
+	}
+
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatalf("RouteList: %v", err)
+	}
+	want := map[string]string{
+		"0.0.0.0/0":       "192.0.2.1",
+		"::/0":            "2001:db8::1",
+		"198.51.100.0/24": "192.0.2.254",
+		"203.0.113.0/24":  "<nil>",
+	}
+	for _, r := range routes {
+		dst := "0.0.0.0/0"
+		if r.Dst != nil {
+			dst = r.Dst.String()
+		} else if r.Family == netlink.FAMILY_V6 {
+			dst = "::/0"
+		}
+		if gw, ok := want[dst]; ok && gw == r.Gw.String() {
+			delete(want, dst)
+		}
+	}
+	if len(want) != 0 {
+		t.Errorf("missing routes (dst → via): %v", want)
+	}
+}
+
+func TestLinkConfig_ApplyMACOnly(t *testing.T) {
+	skipUnlessRoot(t)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origNS, err := netns.Get()
+	if err != nil {
+		t.Fatalf("get netns: %v", err)
+	}
+	defer origNS.Close()
+	testNS, err := netns.New()
+	if err != nil {
+		t.Skipf("skipping: cannot create netns: %v", err)
+	}
+	defer testNS.Close()
+	defer netns.Set(origNS)
+
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "mac0"}, PeerName: "mac1"}); err != nil {
+		t.Skipf("skipping: cannot create veth pair: %v", err)
+	}
+	// As set by a MAC policy, with no addresses.
+	c, err := parseLinkConfig(&handler.NetdevConfig{MAC: "02:00:00:00:aa:02"})
+	if err != nil {
+		t.Fatalf("parseLinkConfig: %v", err)
+	}
+	link, _ := netlink.LinkByName("mac0")
+	netlink.LinkSetUp(link)
+	if err := c.apply(link); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	link, _ = netlink.LinkByName("mac0")
+	if link.Attrs().HardwareAddr.String() != "02:00:00:00:aa:02" {
+		t.Errorf("MAC = %s, want 02:00:00:00:aa:02", link.Attrs().HardwareAddr)
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		t.Error("link left down after setting its MAC")
+	}
+}
+
+func TestRestoreHostMAC(t *testing.T) {
+	skipUnlessRoot(t)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origNS, err := netns.Get()
+	if err != nil {
+		t.Fatalf("get netns: %v", err)
+	}
+	defer origNS.Close()
+	testNS, err := netns.New()
+	if err != nil {
+		t.Skipf("skipping: cannot create netns: %v", err)
+	}
+	defer testNS.Close()
+	defer netns.Set(origNS)
+
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "hmac0"}, PeerName: "hmac1"}); err != nil {
+		t.Skipf("skipping: cannot create veth pair: %v", err)
+	}
+	link, _ := netlink.LinkByName("hmac0")
+	hostMAC := link.Attrs().HardwareAddr.String()
+
+	metadata := map[string]string{}
+	recordHostMAC(&handler.NetdevConfig{}, link, metadata)
+	if _, ok := metadata["hostMAC"]; ok {
+		t.Error("host MAC recorded for a claim without a MAC")
+	}
+	recordHostMAC(&handler.NetdevConfig{MAC: "02:00:00:00:aa:03"}, link, metadata)
+	if metadata["hostMAC"] != hostMAC {
+		t.Fatalf("recorded host MAC = %q, want %s", metadata["hostMAC"], hostMAC)
+	}
+
+	// The pod set the claim's MAC, and the link came back with it.
+	c, _ := parseLinkConfig(&handler.NetdevConfig{MAC: "02:00:00:00:aa:03"})
+	if err := c.apply(link); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	link, _ = netlink.LinkByName("hmac0")
+	if err := restoreHostMAC(link, metadata); err != nil {
+		t.Fatalf("restoreHostMAC: %v", err)
+	}
+	link, _ = netlink.LinkByName("hmac0")
+	if got := link.Attrs().HardwareAddr.String(); got != hostMAC {
+		t.Errorf("MAC after restore = %s, want %s", got, hostMAC)
+	}
+}
+
+func TestLinkConfig_GatewayKeepsPrimaryDefault(t *testing.T) {
+	skipUnlessRoot(t)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origNS, err := netns.Get()
+	if err != nil {
+		t.Fatalf("get netns: %v", err)
+	}
+	defer origNS.Close()
+	testNS, err := netns.New()
+	if err != nil {
+		t.Skipf("skipping: cannot create netns: %v", err)
+	}
+	defer testNS.Close()
+	defer netns.Set(origNS)
+
+	for _, name := range []string{"pri0", "sec0"} {
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}); err != nil {
+			t.Skipf("skipping: cannot create veth pair: %v", err)
+		}
+	}
+	// pri0 stands in for the CNI interface and its default route.
+	primary, err := parseLinkConfig(&handler.NetdevConfig{Addresses: []string{"10.0.0.2/24"}, Gateways: []string{"10.0.0.1"}})
+	if err != nil {
+		t.Fatalf("parseLinkConfig: %v", err)
+	}
+	pri, _ := netlink.LinkByName("pri0")
+	if err := primary.apply(pri); err != nil {
+		t.Fatalf("apply primary: %v", err)
+	}
+
+	sec, _ := netlink.LinkByName("sec0")
+	c, _ := parseLinkConfig(&handler.NetdevConfig{Addresses: []string{"192.0.2.10/24"}, Gateways: []string{"192.0.2.1"}})
+	for i := 0; i < 2; i++ { // The second time as on a retry
+		if err := c.apply(sec); err != nil {
+			t.Fatalf("apply #%d: %v", i+1, err)
+		}
+	}
+	if r, err := netlink.RouteGet(net.ParseIP("203.0.113.1")); err != nil || r[0].LinkIndex != pri.Attrs().Index {
+		t.Errorf("default route = %+v, %v; want through pri0", r, err)
+	}
+	routes, _ := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{LinkIndex: sec.Attrs().Index}, netlink.RT_FILTER_OIF)
+	var backup *netlink.Route
+	for i, r := range routes {
+		if r.Dst == nil || isDefaultRoute(r.Dst) {
+			backup = &routes[i]
+		}
+	}
+	if backup == nil || !backup.Gw.Equal(net.ParseIP("192.0.2.1")) || backup.Priority != 1 {
+		t.Errorf("sec0 default route = %+v, want via 192.0.2.1 with metric 1", backup)
+	}
+
+	c, _ = parseLinkConfig(&handler.NetdevConfig{
+		Addresses: []string{"192.0.2.10/24"}, Gateways: []string{"192.0.2.1"},
+		Routing: &handler.RoutingConfig{DefaultRoute: true},
+	})
+	if err := c.apply(sec); err != nil {
+		t.Fatalf("apply with defaultRoute: %v", err)
+	}
+	if r, err := netlink.RouteGet(net.ParseIP("203.0.113.1")); err != nil || r[0].LinkIndex != sec.Attrs().Index {
+		t.Errorf("default route = %+v, %v; want through sec0", r, err)
+	}
+}
+
+func TestLinkConfig_ApplyRouting(t *testing.T) {
+	skipUnlessRoot(t)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origNS, err := netns.Get()
+	if err != nil {
+		t.Fatalf("get netns: %v", err)
+	}
+	defer origNS.Close()
+	testNS, err := netns.New()
+	if err != nil {
+		t.Skipf("skipping: cannot create netns: %v", err)
+	}
+	defer testNS.Close()
+	defer netns.Set(origNS)
+
+	for _, name := range []string{"rt0", "rt1"} {
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}); err != nil {
+			t.Skipf("skipping: cannot create veth pair: %v", err)
+		}
+	}
+
+	// rt0 routes through table 100, selected by its source address, and
+	// also carries the main default route.
+	c, err := parseLinkConfig(&handler.NetdevConfig{
+		Addresses: []string{"192.0.2.10/24"},
+		Gateways:  []string{"192.0.2.1"},
+		Routes:    []handler.RouteConfig{{Dst: "198.51.100.0/24", Via: "192.0.2.254"}},
+		Routing:   &handler.RoutingConfig{Table: 100, DefaultRoute: true},
+	})
+	if err != nil {
+		t.Fatalf("parseLinkConfig: %v", err)
+	}
+	link, _ := netlink.LinkByName("rt0")
+	for i := 0; i < 2; i++ { // The second time as on a retry
+		if err := c.apply(link); err != nil {
+			t.Fatalf("apply #%d: %v", i+1, err)
+		}
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 100}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatalf("RouteList: %v", err)
+	}
+	want := map[string]string{"0.0.0.0/0": "192.0.2.1", "198.51.100.0/24": "192.0.2.254", "192.0.2.0/24": "<nil>"}
+	for _, r := range routes {
+		dst := "0.0.0.0/0"
+		if r.Dst != nil {
+			dst = r.Dst.String()
+		}
+		if gw, ok := want[dst]; ok && gw == r.Gw.String() {
+			delete(want, dst)
+		}
+	}
+	if len(want) != 0 {
+		t.Errorf("missing routes in table 100 (dst → via): %v", want)
+	}
+	main, _ := netlink.RouteGet(net.ParseIP("203.0.113.1"))
+	if len(main) != 1 || main[0].LinkIndex != link.Attrs().Index {
+		t.Errorf("main default route = %+v, want through rt0", main)
+	}
+	rules, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatalf("RuleList: %v", err)
+	}
+	var found int
+	for _, r := range rules {
+		if r.Table == 100 && r.Priority == defaultRulePriority && r.Src != nil && r.Src.String() == "192.0.2.10/32" {
+			found++
+		}
+	}
+	if found != 1 {
+		t.Errorf("found %d rules from 192.0.2.10 lookup 100, want 1", found)
+	}
+
+	// rt1 is enslaved to a VRF created for it.
+	c, err = parseLinkConfig(&handler.NetdevConfig{
+		Addresses: []string{"198.18.0.10/24"},
+		Routing:   &handler.RoutingConfig{Table: 200, VRF: "vrf-test"},
+	})
+	if err != nil {
+		t.Fatalf("parseLinkConfig: %v", err)
+	}
+	link, _ = netlink.LinkByName("rt1")
+	if err := c.apply(link); err != nil {
+		if strings.Contains(err.Error(), "create VRF") {
+			t.Skipf("skipping: VRFs unsupported: %v", err)
+		}
+		t.Fatalf("apply: %v", err)
+	}
+	vrf, err := netlink.LinkByName("vrf-test")
+	if err != nil {
+		t.Fatalf("VRF not created: %v", err)
+	}
+	if v, ok := vrf.(*netlink.Vrf); !ok || v.Table != 200 {
+		t.Errorf("vrf-test = %+v, want a VRF on table 200", vrf)
+	}
+	link, _ = netlink.LinkByName("rt1")
+	if link.Attrs().MasterIndex != vrf.Attrs().Index {
+		t.Errorf("rt1 master = %d, want %d", link.Attrs().MasterIndex, vrf.Attrs().Index)
+	}
+	if err := c.apply(link); err != nil {
+		t.Fatalf("apply again: %v", err)
+	}
+
+	// A VRF already bound to another table is not reused.
+	c, _ = parseLinkConfig(&handler.NetdevConfig{Routing: &handler.RoutingConfig{Table: 300, VRF: "vrf-test"}})
+	if err := c.apply(link); err == nil {
+		t.Error("expected error for a VRF on another table")
+	}
+}
+
+func TestLinkConfig_ApplySysctls(t *testing.T) {
+	skipUnlessRoot(t)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origNS, err := netns.Get()
+	if err != nil {
+		t.Fatalf("get netns: %v", err)
+	}
+	defer origNS.Close()
+	testNS, err := netns.New()
+	if err != nil {
+		t.Skipf("skipping: cannot create netns: %v", err)
+	}
+	defer testNS.Close()
+	defer netns.Set(origNS)
+
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "sys0"}, PeerName: "sys1"}); err != nil {
+		t.Skipf("skipping: cannot create veth pair: %v", err)
+	}
+	c, err := parseLinkConfig(&handler.NetdevConfig{
+		Addresses: []string{"192.0.2.10/24"},
+		Sysctls:   map[string]string{"ipv4.rp_filter": "2", "ipv4.arp_ignore": "1", "ipv6.accept_ra": "0"},
+	})
+	if err != nil {
+		t.Fatalf("parseLinkConfig: %v", err)
+	}
+	link, _ := netlink.LinkByName("sys0")
+	if err := c.apply(link); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	for key, want := range map[string]string{"ipv4/conf/sys0/rp_filter": "2", "ipv4/conf/sys0/arp_ignore": "1", "ipv6/conf/sys0/accept_ra": "0"} {
+		got, err := os.ReadFile(filepath.Join(procSysNet, key))
+		if err != nil {
+			t.Errorf("read %s: %v", key, err)
+		} else if strings.TrimSpace(string(got)) != want {
+			t.Errorf("%s = %q, want %s", key, got, want)
+		}
+	}
+	// The peer keeps the netns defaults.
+	if got, _ := os.ReadFile(filepath.Join(procSysNet, "ipv4/conf/sys1/rp_filter")); strings.TrimSpace(string(got)) == "2" {
+		t.Error("rp_filter of sys1 changed")
+	}
+
+	c, _ = parseLinkConfig(&handler.NetdevConfig{Sysctls: map[string]string{"ipv4.no_such_sysctl": "1"}})
+	if err := c.apply(link); err == nil {
+		t.Error("expected error for an unknown sysctl")
+	}
+}
+
+// ─── Ethtool tests ───────────────────────────────────────────────────────────
+
+func TestValidateEthtool(t *testing.T) {
+	n := func(v int) *int { return &v }
+	tests := []struct {
+		name    string
+		cfg     *handler.EthtoolConfig
+		wantErr bool
+	}{
+		{"nil", nil, false},
+		{"full", &handler.EthtoolConfig{
+			Rings:    &handler.EthtoolRings{RX: n(4096), TX: n(4096)},
+			Channels: &handler.EthtoolChannels{Combined: n(8), RX: n(0)},
+			Coalesce: &handler.EthtoolCoalesce{RXUsecs: n(0), AdaptiveRX: new(bool)},
+			Features: map[string]bool{"gro": true, "lro": false, "rx-vlan-filter": false},
+		}, false},
+		{"zero ring", &handler.EthtoolConfig{Rings: &handler.EthtoolRings{RX: n(0)}}, true},
+		{"negative channels", &handler.EthtoolConfig{Channels: &handler.EthtoolChannels{Combined: n(-1)}}, true},
+		{"coalesce out of range", &handler.EthtoolConfig{Coalesce: &handler.EthtoolCoalesce{TXFrames: n(1 << 40)}}, true},
+		{"empty feature", &handler.EthtoolConfig{Features: map[string]bool{"": true}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateEthtool(tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("validateEthtool() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	cfg := &handler.DeviceConfig{Type: handler.DeviceTypeNetdev, Netdev: &handler.NetdevConfig{
+		Kind: "sriov-vf", Mode: VFModeVFIO, Ethtool: &handler.EthtoolConfig{Features: map[string]bool{"gro": true}},
+	}}
+	if err := (&SriovVfHandler{}).Validate(context.Background(), cfg); err == nil {
+		t.Error("expected error for ethtool settings on a VF in vfio-pci mode")
+	}
+}
+
+func TestValidateEthtool_UnsupportedKinds(t *testing.T) {
+	ethtool := &handler.EthtoolConfig{Features: map[string]bool{"gro": true}}
+	tests := []struct {
+		h   handler.DeviceHandler
+		cfg handler.NetdevConfig
+	}{
+		{&IpvlanHandler{}, handler.NetdevConfig{Kind: "ipvlan", Parent: "eth0"}},
+		{&VethHandler{}, handler.NetdevConfig{Kind: "veth"}},
+		{&DummyHandler{}, handler.NetdevConfig{Kind: "dummy"}},
+		{&VlanHandler{}, handler.NetdevConfig{Kind: "vlan", VLAN: &handler.VLANConfig{ID: 100}}},
+		{&VxlanHandler{}, handler.NetdevConfig{Kind: "vxlan", Tunnel: &handler.TunnelConfig{VNI: 42}}},
+		{&GeneveHandler{}, handler.NetdevConfig{Kind: "geneve", Tunnel: &handler.TunnelConfig{VNI: 42, Remote: "192.0.2.1"}}},
+		{&BondHandler{}, handler.NetdevConfig{Kind: "bond"}},
+		{&SFHandler{}, handler.NetdevConfig{Kind: "sf"}},
+		{&IpoibHandler{}, handler.NetdevConfig{Kind: "ipoib", Parent: "ib0", Pkey: 0x8001}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cfg.Kind, func(t *testing.T) {
+			cfg := &handler.DeviceConfig{Type: handler.DeviceTypeNetdev, Netdev: &tt.cfg}
+			if err := tt.h.Validate(context.Background(), cfg); err != nil {
+				t.Fatalf("Validate() without ethtool: %v", err)
+			}
+			tt.cfg.Ethtool = ethtool
+			if err := tt.h.Validate(context.Background(), cfg); err == nil {
+				t.Error("expected error for ethtool settings")
+			}
+		})
+	}
+}
+
+func TestApplyAndRestoreEthtool(t *testing.T) {
+	skipUnlessRoot(t)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origNS, err := netns.Get()
+	if err != nil {
+		t.Fatalf("get netns: %v", err)
+	}
+	defer origNS.Close()
+	testNS, err := netns.New()
+	if err != nil {
+		t.Skipf("skipping: cannot create netns: %v", err)
+	}
+	defer testNS.Close()
+	defer netns.Set(origNS)
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "et0", NumTxQueues: 4, NumRxQueues: 4}, PeerName: "et1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("skipping: cannot create veth pair: %v", err)
+	}
+	origChannels, err := ethtool.GetChannels("et0")
+	if err != nil || origChannels.MaxRX < 2 {
+		t.Skipf("skipping: veth channels unsupported (%+v, %v)", origChannels, err)
+	}
+	origFeatures, err := ethtool.GetFeatures("et0")
+	if err != nil {
+		t.Fatalf("GetFeatures: %v", err)
+	}
+	if !origFeatures["tx-tcp-segmentation"].Changeable {
+		t.Skip("skipping: tso is fixed on veth")
+	}
+	tso := !origFeatures["tx-tcp-segmentation"].Active
+	rx := 2
+	if origChannels.RX == 2 {
+		rx = 1
+	}
+
+	cfg := &handler.EthtoolConfig{
+		Channels: &handler.EthtoolChannels{RX: &rx},
+		Features: map[string]bool{"tso": tso},
+	}
+	metadata := map[string]string{}
+	if err := applyEthtool("et0", cfg, metadata, true); err != nil {
+		t.Fatalf("applyEthtool: %v", err)
+	}
+	if ch, _ := ethtool.GetChannels("et0"); ch.RX != uint32(rx) {
+		t.Errorf("rx channels = %d, want %d", ch.RX, rx)
+	}
+	if f, _ := ethtool.GetFeatures("et0"); f["tx-tcp-segmentation"].Active != tso {
+		t.Errorf("tso = %t, want %t", !tso, tso)
+	}
+	if metadata["ethtoolOriginal"] == "" {
+		t.Fatal("no ethtool snapshot recorded")
+	}
+
+	if err := restoreEthtool("et0", metadata); err != nil {
+		t.Fatalf("restoreEthtool: %v", err)
+	}
+	if ch, _ := ethtool.GetChannels("et0"); ch.RX != origChannels.RX {
+		t.Errorf("restored rx channels = %d, want %d", ch.RX, origChannels.RX)
+	}
+	if f, _ := ethtool.GetFeatures("et0"); f["tx-tcp-segmentation"].Active != !tso {
+		t.Errorf("restored tso = %t, want %t", tso, !tso)
+	}
+
+	// A failure reverts what was already changed.
+	cfg.Features = map[string]bool{"no-such-feature": true}
+	if err := applyEthtool("et0", cfg, map[string]string{}, true); err == nil {
+		t.Error("expected error for an unknown feature")
+	}
+	if ch, _ := ethtool.GetChannels("et0"); ch.RX != origChannels.RX {
+		t.Errorf("rx channels after a failed apply = %d, want %d", ch.RX, origChannels.RX)
+	}
+	tooMany := int(origChannels.MaxRX) + 1
+	if err := applyEthtool("et0", &handler.EthtoolConfig{Channels: &handler.EthtoolChannels{RX: &tooMany}}, nil, false); err == nil {
+		t.Error("expected error for channels above the maximum")
+	}
+
+	if err := restoreEthtool("et0", map[string]string{"ethtoolOriginal": "{"}); err == nil {
+		t.Error("expected error for a corrupt snapshot")
+	}
+}
@@ -0,0 +1,187 @@
+package netdev
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// On-demand VFs are published before they exist, as <pf>-vf<index>.  The
+// driver creates them through sriov_numvfs once a claim is allocated.
+
+// vfCreateTimeout bounds how long ProvisionVF waits for a VF netdev.
+const vfCreateTimeout = 30 * time.Second
+
+// OnDemandVFDeviceName returns the published device name of VF index on pf.
+func OnDemandVFDeviceName(pf string, index int) string {
+	return fmt.Sprintf("%s-vf%d", pf, index)
+}
+
+// SplitOnDemandVFDevice parses a name built by OnDemandVFDeviceName.
+func SplitOnDemandVFDevice(device string) (pf string, index int, ok bool) {
+	i := strings.LastIndex(device, "-vf")
+	if i <= 0 {
+		return "", -1, false
+	}
+	index, err := strconv.Atoi(device[i+len("-vf"):])
+	if err != nil || index < 0 {
+		return "", -1, false
+	}
+	return device[:i], index, true
+}
+
+// NumVFs returns the current and maximum VF count of a PF.
+func NumVFs(pf string) (current, total int, err error) {
+	deviceDir := filepath.Join(netSysfsRoot, pf, "device")
+	if current, err = readSysfsInt(filepath.Join(deviceDir, "sriov_numvfs")); err != nil {
+		return 0, 0, err
+	}
+	if total, err = readSysfsInt(filepath.Join(deviceDir, "sriov_totalvfs")); err != nil {
+		return 0, 0, err
+	}
+	return current, total, nil
+}
+
+// ensureVFs makes sure pf has at least count VFs.  The kernel only lets
+// sriov_numvfs change from zero, so a PF with fewer VFs cannot grow here.
+func ensureVFs(pf string, count int) error {
+	current, _, err := NumVFs(pf)
+	if err != nil {
+		return err
+	}
+	if current >= count {
+		return nil
+	}
+	if current > 0 {
+		return fmt.Errorf("PF %s has %d VFs, need %d: sriov_numvfs can only be raised from 0", pf, current, count)
+	}
+	if err := writeSysfs(filepath.Join(netSysfsRoot, pf, "device", "sriov_numvfs"), strconv.Itoa(count)); err != nil {
+		return err
+	}
+	klog.Infof("Created %d VFs on PF %s", count, pf)
+	return nil
+}
+
+// removeVFs destroys all VFs of pf.
+func removeVFs(pf string) error {
+	if err := writeSysfs(filepath.Join(netSysfsRoot, pf, "device", "sriov_numvfs"), "0"); err != nil {
+		return err
+	}
+	klog.Infof("Removed all VFs from PF %s", pf)
+	return nil
+}
+
+// waitForVF polls until VF index of pf has a netdev on the host.
+func waitForVF(ctx context.Context, pf string, index int) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, vfCreateTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		vfs, err := listVFs(pf)
+		if err == nil && vfs[index] != "" {
+			return vfs[index], nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("VF %d on PF %s has no netdev after %s", index, pf, vfCreateTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func readSysfsInt(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// ProvisionVF creates the VFs of an on-demand PF if they do not exist yet,
+// reserves VF index for the claim and waits for its netdev.  It returns the
+// VF's netdev name.  Calling it again for a VF the claim holds is safe.
+func (h *SriovVfHandler) ProvisionVF(ctx context.Context, claimUID, pf string, index int) (string, error) {
+	budget, ok := h.OnDemand[pf]
+	if !ok {
+		return "", fmt.Errorf("PF %s does not create VFs on demand", pf)
+	}
+	if index < 0 || index >= budget {
+		return "", fmt.Errorf("VF index %d out of range for PF %s (budget %d)", index, pf, budget)
+	}
+	if err := h.owners.reserve(pf, index, claimUID); err != nil {
+		return "", err
+	}
+
+	// Holding a reservation keeps removeIdleVFs away from the PF.
+	h.numVFsMu.Lock()
+	err := ensureVFs(pf, budget)
+	h.numVFsMu.Unlock()
+	if err != nil {
+		h.ReleaseVF(claimUID, pf, index)
+		return "", err
+	}
+
+	name, err := waitForVF(ctx, pf, index)
+	if err != nil {
+		h.ReleaseVF(claimUID, pf, index)
+		return "", err
+	}
+	klog.Infof("Provisioned VF %d (%s) on PF %s for claim %s", index, name, pf, claimUID)
+	return name, nil
+}
+
+// ReleaseVF frees VF index on pf if the claim holds it, removing the PF's
+// VFs when RemoveIdleVFs is set and none is held any more.
+func (h *SriovVfHandler) ReleaseVF(claimUID, pf string, index int) {
+	h.owners.release(pf, index, claimUID)
+	h.removeIdleVFs(pf)
+}
+
+// reserveNetdev reserves the VF behind the host netdev name for claimUID,
+// like the VFs of sriov-vf claims.  ok is false if name is not a VF.
+func (h *SriovVfHandler) reserveNetdev(claimUID, name string) (pf string, index int, ok bool, err error) {
+	if _, err := os.Stat(filepath.Join(netSysfsRoot, name, "device", "physfn")); err != nil {
+		return "", -1, false, nil
+	}
+	if pf, index, err = lookupVF(name); err != nil {
+		return "", -1, true, err
+	}
+	if err := h.owners.reserve(pf, index, claimUID); err != nil {
+		return "", -1, true, err
+	}
+	return pf, index, true, nil
+}
+
+func (h *SriovVfHandler) removeIdleVFs(pf string) {
+	if _, ok := h.OnDemand[pf]; !ok || !h.RemoveIdleVFs {
+		return
+	}
+	h.owners.ifIdle(pf, func() {
+		h.numVFsMu.Lock()
+		defer h.numVFsMu.Unlock()
+		if current, _, err := NumVFs(pf); err != nil || current == 0 {
+			return
+		}
+		if err := removeVFs(pf); err != nil {
+			klog.Warningf("Failed to remove idle VFs of PF %s: %v", pf, err)
+		}
+	})
+}
+
+// splitOnDemand parses an allocated device name as an on-demand VF of one
+// of the handler's on-demand PFs.
+func (h *SriovVfHandler) splitOnDemand(device string) (pf string, index int, ok bool) {
+	pf, index, ok = SplitOnDemandVFDevice(device)
+	if _, onDemand := h.OnDemand[pf]; !ok || !onDemand {
+		return "", -1, false
+	}
+	return pf, index, true
+}
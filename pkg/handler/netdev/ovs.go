@@ -0,0 +1,73 @@
+package netdev
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/ovs"
+)
+
+// external_ids keys identifying the claim that owns an OVS port.
+const (
+	ovsClaimUIDKey       = "dra.example.com/claim-uid"
+	ovsClaimNamespaceKey = "dra.example.com/claim-namespace"
+	ovsClaimNameKey      = "dra.example.com/claim-name"
+)
+
+// validateOVSConfig checks OVS attachment settings.
+func validateOVSConfig(cfg *handler.OVSConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.Bridge == "" {
+		return fmt.Errorf("ovs.bridge is required")
+	}
+	if cfg.Tag < 0 || cfg.Tag > 4094 {
+		return fmt.Errorf("OVS tag %d out of range 0-4094 (0 = untagged)", cfg.Tag)
+	}
+	if cfg.Tag > 0 && len(cfg.Trunks) > 0 {
+		return fmt.Errorf("OVS tag and trunks are mutually exclusive")
+	}
+	for _, vid := range cfg.Trunks {
+		if vid < 0 || vid > 4094 {
+			return fmt.Errorf("OVS trunk VLAN %d out of range 0-4094", vid)
+		}
+	}
+	for _, key := range []string{ovsClaimUIDKey, ovsClaimNamespaceKey, ovsClaimNameKey} {
+		if _, ok := cfg.ExternalIDs[key]; ok {
+			return fmt.Errorf("OVS external ID %s is set by the driver", key)
+		}
+	}
+	return nil
+}
+
+// addOVSPort plugs port into the OVS bridge of cfg.
+func addOVSPort(ctx context.Context, client *ovs.Client, req *handler.PrepareRequest, port string, cfg *handler.OVSConfig) error {
+	if client == nil {
+		return fmt.Errorf("OVS attachment is not enabled (set --ovsdb-socket)")
+	}
+	ids := map[string]string{
+		ovsClaimUIDKey:       req.ClaimUID,
+		ovsClaimNamespaceKey: req.Namespace,
+		ovsClaimNameKey:      req.ClaimName,
+	}
+	for k, v := range cfg.ExternalIDs {
+		ids[k] = v
+	}
+	err := client.AddPort(ctx, ovs.Port{
+		Bridge:      cfg.Bridge,
+		Name:        port,
+		Type:        cfg.InterfaceType,
+		Tag:         cfg.Tag,
+		Trunks:      cfg.Trunks,
+		ExternalIDs: ids,
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("Added %s to OVS bridge %s (tag=%d, trunks=%v)", port, cfg.Bridge, cfg.Tag, cfg.Trunks)
+	return nil
+}
@@ -0,0 +1,40 @@
+package netdev
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/example/dra-poc/pkg/handler"
+)
+
+// poolParent returns the parent interface encoded in a parent pool device
+// name (<parent>-<kind>-pool, as published for macvlan/ipvlan), or "" if the
+// device is not a pool device of that kind.
+func poolParent(allocatedDevice, kind string) string {
+	parent, ok := strings.CutSuffix(allocatedDevice, "-"+kind+"-pool")
+	if !ok {
+		return ""
+	}
+	return parent
+}
+
+// resolveParent picks the parent interface for a <kind> link.  The
+// scheduler-chosen pool device wins; an explicitly configured parent is only
+// needed when no pool device was allocated, and must agree with it otherwise.
+func resolveParent(req *handler.PrepareRequest, kind string) (string, error) {
+	configured := req.Config.Netdev.Parent
+	allocated := poolParent(req.AllocatedDevice, kind)
+
+	switch {
+	case allocated != "" && configured != "" && configured != allocated:
+		return "", fmt.Errorf("configured parent %s conflicts with allocated %s device %s",
+			configured, kind, req.AllocatedDevice)
+	case allocated != "":
+		return allocated, nil
+	case configured != "":
+		return configured, nil
+	default:
+		return "", fmt.Errorf("parent interface is required for %s: set netdev.parent or allocate a <parent>-%s-pool device",
+			kind, kind)
+	}
+}
@@ -0,0 +1,321 @@
+package netdev
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+)
+
+// sfCreateTimeout bounds how long Prepare waits for an SF's netdev.
+const sfCreateTimeout = 30 * time.Second
+
+// auxSysfsRoot lists auxiliary bus devices, which is where activated SFs
+// appear; a variable so tests can use a fake tree.
+var auxSysfsRoot = "/sys/bus/auxiliary/devices"
+
+// SFHandler creates Scalable Functions (subfunctions) on a PF through devlink
+// port management and hands their netdev to the pod.
+//
+// The PF is taken from the allocated <pf>-sf-pool device, published for PFs
+// in switchdev mode, or from netdev.parent.  The SF is deleted on Unprepare.
+type SFHandler struct {
+	// Links applies addresses and routes after the link moved into the pod.
+	// Nil rejects claims that ask for them.
+	Links *nri.LinkSetupTracker
+}
+
+func (h *SFHandler) Type() handler.DeviceType { return handler.DeviceTypeNetdev }
+func (h *SFHandler) Kinds() []string          { return []string{"sf"} }
+
+// Restore registers the pod-side setups of a persisted allocation again.
+func (h *SFHandler) Restore(alloc *handler.AllocationInfo) {
+	restoreLinkSetups(h.Links, nil, alloc)
+}
+
+func (h *SFHandler) Validate(_ context.Context, cfg *handler.DeviceConfig) error {
+	if cfg.Netdev == nil {
+		return fmt.Errorf("netdev config is required for sf")
+	}
+	if err := rejectEthtool(cfg.Netdev, "sf"); err != nil {
+		return err
+	}
+	if sf := cfg.Netdev.SF; sf != nil && sf.MAC != "" {
+		if _, err := net.ParseMAC(sf.MAC); err != nil {
+			return fmt.Errorf("invalid SF MAC %q: %w", sf.MAC, err)
+		}
+	}
+	return validateLinkConfig(cfg.Netdev, h.Links)
+}
+
+func (h *SFHandler) Prepare(ctx context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
+	cfg := req.Config.Netdev
+	if cfg == nil {
+		return nil, fmt.Errorf("netdev config is required for sf")
+	}
+	pf, err := resolveParent(req, "sf")
+	if err != nil {
+		return nil, err
+	}
+	bus, device, err := devlinkHandle(pf)
+	if err != nil {
+		return nil, err
+	}
+
+	containerName := cfg.InterfaceName
+	if containerName == "" {
+		containerName = "eth1"
+	}
+
+	port, sfNum, err := addSFPort(bus, device, pfNumber(pf), req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add SF on PF %s: %w", pf, err)
+	}
+	deletePort := func() {
+		if err := netlink.DevLinkPortDel(bus, device, port.PortIndex); err != nil {
+			klog.Warningf("Failed to delete SF port %d on %s/%s: %v", port.PortIndex, bus, device, err)
+		}
+	}
+
+	fn := netlink.DevlinkPortFnSetAttrs{StateValid: true}
+	fn.FnAttrs.State = nl.DEVLINK_PORT_FN_STATE_ACTIVE
+	if cfg.SF != nil && cfg.SF.MAC != "" {
+		fn.FnAttrs.HwAddr, _ = net.ParseMAC(cfg.SF.MAC) // validated
+		fn.HwAddrValid = true
+	}
+	if err := netlink.DevlinkPortFnSet(bus, device, port.PortIndex, fn); err != nil {
+		deletePort()
+		return nil, fmt.Errorf("failed to activate SF %d on PF %s: %w", sfNum, pf, err)
+	}
+
+	sf, err := waitForSF(ctx, device, sfNum)
+	if err != nil {
+		deletePort()
+		return nil, err
+	}
+
+	if cfg.MTU > 0 {
+		link, err := netlink.LinkByName(sf.Netdev)
+		if err == nil {
+			err = netlink.LinkSetMTU(link, cfg.MTU)
+		}
+		if err != nil {
+			deletePort()
+			return nil, fmt.Errorf("failed to set MTU on SF %s: %w", sf.Netdev, err)
+		}
+	}
+
+	klog.Infof("Created SF %d (%s, port %d) on PF %s for claim %s", sfNum, sf.Netdev, port.PortIndex, pf, req.ClaimUID)
+
+	metadata := map[string]string{
+		"sfInterface":   sf.Netdev,
+		"containerName": containerName,
+		"parent":        pf,
+		"devlinkBus":    bus,
+		"devlinkDevice": device,
+		"portIndex":     strconv.FormatUint(uint64(port.PortIndex), 10),
+		"sfNumber":      strconv.FormatUint(uint64(sfNum), 10),
+	}
+	if port.NetdeviceName != "" {
+		metadata["representor"] = port.NetdeviceName
+	}
+	if err := registerLinkConfig(h.Links, req, containerName, metadata); err != nil {
+		deletePort()
+		return nil, err
+	}
+
+	edits := &cdispec.ContainerEdits{
+		NetDevices: []*cdispec.LinuxNetDevice{
+			{HostInterfaceName: sf.Netdev, Name: containerName},
+		},
+	}
+	if sf.RDMADevice != "" {
+		metadata["rdmaDevice"] = sf.RDMADevice
+	}
+	if sf.Uverbs != "" {
+		path := filepath.Join("/dev/infiniband", sf.Uverbs)
+		edits.DeviceNodes = append(edits.DeviceNodes, &cdispec.DeviceNode{Path: path, HostPath: path, Permissions: "rw"})
+	}
+
+	return &handler.PrepareResult{
+		PoolName:   "default",
+		DeviceName: sf.Netdev,
+		CDIEdits:   edits,
+		Allocation: &handler.AllocationInfo{
+			Type:       handler.DeviceTypeNetdev,
+			Kind:       "sf",
+			ClaimUID:   req.ClaimUID,
+			DeviceName: sf.Netdev,
+			Metadata:   metadata,
+		},
+	}, nil
+}
+
+func (h *SFHandler) Unprepare(_ context.Context, req *handler.UnprepareRequest) error {
+	if h.Links != nil {
+		h.Links.Release(req.ClaimUID)
+	}
+	md := req.Allocation.Metadata
+	portIndex, err := strconv.ParseUint(md["portIndex"], 10, 32)
+	if err != nil {
+		return nil
+	}
+	bus, device := md["devlinkBus"], md["devlinkDevice"]
+
+	// Deactivating first detaches the SF driver cleanly; deleting an active
+	// port works too, so a failure here is not fatal.
+	fn := netlink.DevlinkPortFnSetAttrs{StateValid: true}
+	fn.FnAttrs.State = nl.DEVLINK_PORT_FN_STATE_INACTIVE
+	if err := netlink.DevlinkPortFnSet(bus, device, uint32(portIndex), fn); err != nil {
+		klog.V(2).Infof("Failed to deactivate SF port %d on %s/%s: %v", portIndex, bus, device, err)
+	}
+	if err := netlink.DevLinkPortDel(bus, device, uint32(portIndex)); err != nil {
+		if errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.EINVAL) {
+			klog.V(2).Infof("SF port %d on %s/%s already removed: %v", portIndex, bus, device, err)
+			return nil
+		}
+		return fmt.Errorf("failed to delete SF %s: %w", md["sfInterface"], err)
+	}
+	klog.Infof("Deleted SF %s (port %d on %s/%s)", md["sfInterface"], portIndex, bus, device)
+	return nil
+}
+
+// addSFPort adds a pcisf port for the claim.  Without a configured number
+// the SF number is derived from the claim, moving on to the next one if it
+// is taken.
+func addSFPort(bus, device string, pfNum uint16, req *handler.PrepareRequest) (*netlink.DevlinkPort, uint32, error) {
+	var sfNum uint32
+	attempts := 1
+	if cfg := req.Config.Netdev.SF; cfg != nil && cfg.Number != nil {
+		sfNum = *cfg.Number
+	} else {
+		h := fnv.New32a()
+		h.Write([]byte(req.NameSuffix()))
+		sfNum = h.Sum32() % 0x10000
+		attempts = 8
+	}
+
+	for i := 0; ; i++ {
+		port, err := netlink.DevLinkPortAdd(bus, device, nl.DEVLINK_PORT_FLAVOUR_PCI_SF, netlink.DevLinkPortAddAttrs{
+			PfNumber:      pfNum,
+			SfNumber:      sfNum,
+			SfNumberValid: true,
+		})
+		if err == nil {
+			return port, sfNum, nil
+		}
+		if !errors.Is(err, syscall.EEXIST) || i+1 >= attempts {
+			return nil, 0, fmt.Errorf("SF number %d: %w", sfNum, err)
+		}
+		sfNum = (sfNum + 1) % 0x10000
+	}
+}
+
+// devlinkHandle returns the devlink bus and device name of a PF netdev,
+// e.g. pci/0000:03:00.0 or netdevsim/netdevsim1.
+func devlinkHandle(pf string) (bus, device string, err error) {
+	deviceDir := filepath.Join(netSysfsRoot, pf, "device")
+	target, err := os.Readlink(deviceDir)
+	if err != nil {
+		return "", "", fmt.Errorf("PF %s has no device: %w", pf, err)
+	}
+	subsystem, err := os.Readlink(filepath.Join(deviceDir, "subsystem"))
+	if err != nil {
+		return "", "", fmt.Errorf("PF %s has no bus: %w", pf, err)
+	}
+	return filepath.Base(subsystem), filepath.Base(target), nil
+}
+
+// pfNumber returns the PF number of pf on its NIC, from its uplink
+// representor's port name ("p1") or else its PCI function.
+func pfNumber(pf string) uint16 {
+	if m := uplinkPortName.FindStringSubmatch(readSysfsString(filepath.Join(netSysfsRoot, pf, "phys_port_name"))); m != nil {
+		n, _ := strconv.ParseUint(m[1], 10, 16)
+		return uint16(n)
+	}
+	addr := netdevPCIAddress(pf)
+	if i := strings.LastIndex(addr, "."); i >= 0 {
+		n, _ := strconv.ParseUint(addr[i+1:], 10, 16)
+		return uint16(n)
+	}
+	return 0
+}
+
+// sfDevice is what an activated SF exposes on the host.
+type sfDevice struct {
+	Netdev     string
+	RDMADevice string // IB device name, "" if the SF has no RDMA function
+	Uverbs     string // uverbs char device name, "" if none
+}
+
+// waitForSF polls the auxiliary bus until SF sfNum of the devlink device
+// is ready (see findSF).
+func waitForSF(ctx context.Context, device string, sfNum uint32) (*sfDevice, error) {
+	ctx, cancel := context.WithTimeout(ctx, sfCreateTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if sf := findSF(device, sfNum); sf != nil {
+			return sf, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("SF %d on %s has no netdev after %s", sfNum, device, sfCreateTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// findSF looks for the auxiliary device of SF sfNum under device, and
+// returns nil until its netdev, and its RDMA device if it has one, exist.
+// The RDMA device lives on a child auxiliary device of the SF.
+func findSF(device string, sfNum uint32) *sfDevice {
+	entries, err := os.ReadDir(auxSysfsRoot)
+	if err != nil {
+		return nil
+	}
+	want := strconv.FormatUint(uint64(sfNum), 10)
+	for _, entry := range entries {
+		dir := filepath.Join(auxSysfsRoot, entry.Name())
+		if readSysfsString(filepath.Join(dir, "sfnum")) != want {
+			continue
+		}
+		target, err := filepath.EvalSymlinks(dir)
+		if err != nil || !strings.Contains(target, string(filepath.Separator)+device+string(filepath.Separator)) {
+			continue
+		}
+		netdevs, _ := os.ReadDir(filepath.Join(dir, "net"))
+		if len(netdevs) == 0 {
+			return nil
+		}
+		sf := &sfDevice{Netdev: netdevs[0].Name()}
+		if ib, _ := filepath.Glob(filepath.Join(dir, "*", "infiniband", "*")); len(ib) > 0 {
+			sf.RDMADevice = filepath.Base(ib[0])
+		} else if rdma, _ := filepath.Glob(filepath.Join(dir, "*.rdma.*")); len(rdma) > 0 {
+			// The SF has an RDMA function that is still probing.
+			return nil
+		}
+		if uverbs, _ := filepath.Glob(filepath.Join(dir, "*", "infiniband_verbs", "uverbs*")); len(uverbs) > 0 {
+			sf.Uverbs = filepath.Base(uverbs[0])
+		}
+		return sf
+	}
+	return nil
+}
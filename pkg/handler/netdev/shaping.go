@@ -0,0 +1,221 @@
+package netdev
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
+)
+
+const (
+	shapingLatencyMs = 25        // TBF queueing latency used to size the limit
+	minBurstBytes    = 64 * 1024 // Must comfortably exceed the MTU
+)
+
+// consumedBandwidth returns the bandwidth (bits/s) charged to the claim by the
+// scheduler, or 0 if the allocated device has no bandwidth capacity.
+func consumedBandwidth(req *handler.PrepareRequest) uint64 {
+	q, ok := req.ConsumedCapacity[handler.CapacityBandwidth]
+	if !ok || q.Sign() <= 0 {
+		return 0
+	}
+	return uint64(q.Value())
+}
+
+// registerShaping asks the NRI plugin to enforce the bandwidth the claim
+// consumed on its link once it is in the pod netns.  The rate and the IFB
+// used for ingress shaping are recorded in metadata for restoreLinkSetups.
+func registerShaping(links *nri.LinkSetupTracker, req *handler.PrepareRequest, containerName string, metadata map[string]string) {
+	bps := consumedBandwidth(req)
+	if bps == 0 {
+		return
+	}
+	if links == nil {
+		klog.Warningf("Claim %s consumed %d bit/s of bandwidth but no link setup tracker is configured; not shaping", req.ClaimUID, bps)
+		return
+	}
+
+	ifbName := fmt.Sprintf("ifb%s", req.NameSuffix())
+	addShaping(links, req.ClaimUID, containerName, ifbName, bps)
+	metadata["bandwidth"] = strconv.FormatUint(bps, 10)
+	metadata["ifb"] = ifbName
+}
+
+// addShaping registers the link setup shaping containerName to bps.
+func addShaping(links *nri.LinkSetupTracker, claimUID, containerName, ifbName string, bps uint64) {
+	links.AddPending(&nri.LinkSetup{
+		ClaimUID: claimUID,
+		IfName:   containerName,
+		Apply: func(link netlink.Link) error {
+			return applyBandwidth(link, ifbName, bps)
+		},
+		Teardown: func(link netlink.Link) error {
+			return removeBandwidth(link, ifbName)
+		},
+	})
+}
+
+// Handles of the qdiscs applyBandwidth installs on the link.
+var (
+	tbfHandle     = netlink.MakeHandle(1, 0)
+	ingressHandle = netlink.MakeHandle(0xffff, 0)
+)
+
+// applyBandwidth shapes egress with a TBF root qdisc on link and ingress by
+// redirecting all received traffic to an IFB device shaped the same way.  On
+// failure, whatever was installed is removed again, so Apply can be retried.
+func applyBandwidth(link netlink.Link, ifbName string, bps uint64) (err error) {
+	name := link.Attrs().Name
+	if err := addTBF(link.Attrs().Index, bps); err != nil {
+		return fmt.Errorf("egress tbf on %s: %w", name, err)
+	}
+	// Roll back what was installed, and only that.
+	var (
+		ifbLink netlink.Link
+		ingress *netlink.Ingress
+	)
+	defer func() {
+		if err == nil {
+			return
+		}
+		errs := []error{netlink.QdiscDel(tbfQdisc(link.Attrs().Index))}
+		if ingress != nil {
+			errs = append(errs, netlink.QdiscDel(ingress))
+		}
+		if ifbLink != nil {
+			errs = append(errs, netlink.LinkDel(ifbLink))
+		}
+		if rerr := errors.Join(errs...); rerr != nil {
+			klog.Warningf("Failed to roll back shaping of %s: %v", name, rerr)
+		}
+	}()
+
+	ifb := &netlink.Ifb{LinkAttrs: netlink.LinkAttrs{
+		Name:   ifbName,
+		TxQLen: 1000,
+		MTU:    link.Attrs().MTU,
+	}}
+	if err := netlink.LinkAdd(ifb); err != nil {
+		return fmt.Errorf("create ifb %s: %w", ifbName, err)
+	}
+	if ifbLink, err = netlink.LinkByName(ifbName); err != nil {
+		return fmt.Errorf("find ifb %s: %w", ifbName, err)
+	}
+	if err := netlink.LinkSetUp(ifbLink); err != nil {
+		return fmt.Errorf("bring up ifb %s: %w", ifbName, err)
+	}
+	if err := addTBF(ifbLink.Attrs().Index, bps); err != nil {
+		return fmt.Errorf("ingress tbf on %s: %w", ifbName, err)
+	}
+
+	ingressQdisc := &netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    ingressHandle,
+		Parent:    netlink.HANDLE_INGRESS,
+	}}
+	if err := netlink.QdiscAdd(ingressQdisc); err != nil {
+		return fmt.Errorf("ingress qdisc on %s: %w", name, err)
+	}
+	ingress = ingressQdisc
+
+	// Match-all u32 filter (nil selector) redirecting to the IFB.
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: ifbLink.Attrs().Index,
+		Actions:    []netlink.Action{netlink.NewMirredAction(ifbLink.Attrs().Index)},
+	}
+	if err := netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("redirect filter on %s: %w", name, err)
+	}
+
+	klog.Infof("Shaped %s to %d bit/s (ingress via %s)", name, bps, ifbName)
+	return nil
+}
+
+// removeBandwidth deletes the qdiscs installed by applyBandwidth and its IFB.
+// Other qdiscs on the link are left alone.
+func removeBandwidth(link netlink.Link, ifbName string) error {
+	errs := removeShapingQdiscs(link)
+
+	if ifb, err := netlink.LinkByName(ifbName); err == nil {
+		if err := netlink.LinkDel(ifb); err != nil {
+			errs = append(errs, fmt.Errorf("delete ifb %s: %w", ifbName, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("bandwidth teardown errors: %v", errs)
+	}
+	klog.Infof("Removed bandwidth shaping from %s", link.Attrs().Name)
+	return nil
+}
+
+// removeShapingQdiscs deletes the qdiscs with the handles applyBandwidth
+// installs from link.
+func removeShapingQdiscs(link netlink.Link) []error {
+	var errs []error
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return []error{fmt.Errorf("list qdiscs on %s: %w", link.Attrs().Name, err)}
+	}
+	for _, q := range qdiscs {
+		attrs := q.Attrs()
+		switch q.(type) {
+		case *netlink.Tbf:
+			if attrs.Handle != tbfHandle || attrs.Parent != netlink.HANDLE_ROOT {
+				continue
+			}
+		case *netlink.Ingress:
+			if attrs.Handle != ingressHandle {
+				continue
+			}
+		default:
+			continue
+		}
+		if err := netlink.QdiscDel(q); err != nil {
+			errs = append(errs, fmt.Errorf("delete %s qdisc on %s: %w", q.Type(), link.Attrs().Name, err))
+		}
+	}
+	return errs
+}
+
+// addTBF installs a token bucket root qdisc limiting the link to bps.
+func addTBF(linkIndex int, bps uint64) error {
+	rate := bps / 8 // bytes per second
+	if rate == 0 {
+		return fmt.Errorf("rate %d bit/s is too low", bps)
+	}
+
+	burst := uint32(rate / 100) // 10ms worth of traffic
+	if burst < minBurstBytes {
+		burst = minBurstBytes
+	}
+	latency := float64(netlink.TIME_UNITS_PER_SEC) * shapingLatencyMs / 1000
+
+	qdisc := tbfQdisc(linkIndex)
+	qdisc.Rate = rate
+	qdisc.Limit = uint32(float64(rate)*latency/float64(netlink.TIME_UNITS_PER_SEC)) + burst
+	qdisc.Buffer = netlink.Xmittime(rate, burst)
+	return netlink.QdiscAdd(qdisc)
+}
+
+// tbfQdisc returns the root TBF qdisc of applyBandwidth on a link.
+func tbfQdisc(linkIndex int) *netlink.Tbf {
+	return &netlink.Tbf{QdiscAttrs: netlink.QdiscAttrs{
+		LinkIndex: linkIndex,
+		Handle:    tbfHandle,
+		Parent:    netlink.HANDLE_ROOT,
+	}}
+}
@@ -5,29 +5,121 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/vishvananda/netlink"
 	"k8s.io/klog/v2"
 
 	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
+	"github.com/example/dra-poc/pkg/ovs"
 	cdispec "tags.cncf.io/container-device-interface/specs-go"
 )
 
+// VFProfileSeparator joins a VF interface name and a profile name in the
+// device names published for VF profiles (e.g. ens1f0v3-profile-large).
+const VFProfileSeparator = "-profile-"
+
+// VFProfileDeviceName returns the published device name of a VF profile.
+func VFProfileDeviceName(vfName, profile string) string {
+	return vfName + VFProfileSeparator + profile
+}
+
+// SplitVFProfileDevice splits a published VF device name into the VF
+// interface name and its profile.  profile is "" for plain VF devices.
+func SplitVFProfileDevice(device string) (vfName, profile string) {
+	if i := strings.LastIndex(device, VFProfileSeparator); i > 0 {
+		return device[:i], device[i+len(VFProfileSeparator):]
+	}
+	return device, ""
+}
+
 // SriovVfHandler manages SR-IOV Virtual Function devices
-type SriovVfHandler struct{}
+type SriovVfHandler struct {
+	// OnDemand maps PFs whose VFs the driver creates itself to the number
+	// of VFs it may create on each.  See ProvisionVF.
+	OnDemand map[string]int
+
+	// RemoveIdleVFs destroys the VFs of an on-demand PF once no claim
+	// holds any of them.
+	RemoveIdleVFs bool
+
+	// ProfileRates maps VF profiles to their bandwidth in Mb/s, which is
+	// set as the max TX rate of VFs allocated through them.
+	ProfileRates map[string]int
+
+	// owners tracks which claim holds each VF.  It is rebuilt from persisted
+	// allocations through Restore when the driver starts.
+	owners vfOwners
+
+	// Links applies addresses and routes after the VF moved into the pod.
+	// Nil rejects claims that ask for them.
+	Links *nri.LinkSetupTracker
+
+	// OVS reaches the local OVSDB server for representor.ovs.  Nil
+	// disables OVS attachment.
+	OVS *ovs.Client
+
+	// numVFsMu serializes sriov_numvfs writes.
+	numVFsMu sync.Mutex
+}
 
 func (h *SriovVfHandler) Type() handler.DeviceType { return handler.DeviceTypeNetdev }
 func (h *SriovVfHandler) Kinds() []string          { return []string{"sriov-vf"} }
 
+// Restore re-reserves the VF held by a persisted allocation and registers
+// its pod-side setups again.
+func (h *SriovVfHandler) Restore(alloc *handler.AllocationInfo) {
+	restoreLinkSetups(h.Links, nil, alloc)
+	pf := alloc.Metadata["pf"]
+	index, err := strconv.Atoi(alloc.Metadata["vfIndex"])
+	if pf == "" || err != nil {
+		return
+	}
+	if err := h.owners.reserve(pf, index, alloc.ClaimUID); err != nil {
+		klog.Warningf("Restoring claim %s: %v", alloc.ClaimUID, err)
+	}
+}
+
 func (h *SriovVfHandler) Validate(_ context.Context, cfg *handler.DeviceConfig) error {
 	if cfg.Netdev == nil {
 		return fmt.Errorf("netdev config is required for sriov-vf")
 	}
-	return nil
+	switch cfg.Netdev.Mode {
+	case "":
+	case VFModeVFIO:
+		if cfg.Netdev.MTU > 0 {
+			return fmt.Errorf("mtu cannot be set on a VF in %s mode", VFModeVFIO)
+		}
+		if hasLinkConfig(cfg.Netdev) {
+			return fmt.Errorf("addresses, routes, mac and state cannot be set on a VF in %s mode", VFModeVFIO)
+		}
+		if cfg.Netdev.Ethtool != nil {
+			return fmt.Errorf("ethtool settings cannot be applied to a VF in %s mode", VFModeVFIO)
+		}
+	default:
+		return fmt.Errorf("unsupported sriov-vf mode %q (use %q or leave empty for a netdev)", cfg.Netdev.Mode, VFModeVFIO)
+	}
+	if err := validateVFConfig(cfg.Netdev.VF); err != nil {
+		return err
+	}
+	if err := validateEthtool(cfg.Netdev.Ethtool); err != nil {
+		return err
+	}
+	if rep := cfg.Netdev.Representor; rep != nil {
+		if rep.Bridge != "" && rep.OVS != nil {
+			return fmt.Errorf("representor bridge and ovs are mutually exclusive")
+		}
+		if err := validateOVSConfig(rep.OVS); err != nil {
+			return fmt.Errorf("representor: %w", err)
+		}
+	}
+	return validateLinkConfig(cfg.Netdev, h.Links)
 }
 
-func (h *SriovVfHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
+func (h *SriovVfHandler) Prepare(ctx context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
 	cfg := req.Config.Netdev
 	if cfg == nil {
 		return nil, fmt.Errorf("netdev config is required for sriov-vf")
@@ -38,39 +130,141 @@ func (h *SriovVfHandler) Prepare(_ context.Context, req *handler.PrepareRequest)
 		containerName = "eth1"
 	}
 
-	// For SR-IOV, the scheduler should have assigned us a specific VF via AllocatedDevice
-	vfName := req.AllocatedDevice
-	if vfName == "" {
-		// Try to find a VF from the parent PF
+	// For SR-IOV, the scheduler should have assigned us a specific VF via
+	// AllocatedDevice, possibly one of several profiles published for it.
+	// Either way the VF is reserved for the claim until Unprepare.
+	vfName, profile := SplitVFProfileDevice(req.AllocatedDevice)
+	var pfName string
+	var index int
+	if pf, i, ok := h.splitOnDemand(req.AllocatedDevice); ok {
+		// Created by ProvisionVF before the pod was bound.
+		vfs, err := listVFs(pf)
+		if err != nil {
+			return nil, err
+		}
+		if vfs[i] == "" {
+			return nil, fmt.Errorf("on-demand VF %d on PF %s has not been created", i, pf)
+		}
+		if err := h.owners.reserve(pf, i, req.ClaimUID); err != nil {
+			return nil, err
+		}
+		pfName, index, vfName = pf, i, vfs[i]
+	} else if vfName != "" {
+		var err error
+		pfName, index, err = lookupVF(vfName)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.owners.reserve(pfName, index, req.ClaimUID); err != nil {
+			return nil, err
+		}
+	} else {
+		// Try to find a free VF on the parent PF
 		if cfg.Parent == "" {
 			return nil, fmt.Errorf("either allocated device or parent PF must be specified for sriov-vf")
 		}
-		var err error
-		vfName, err = findAvailableVF(cfg.Parent, cfg.VFIndex)
+		vfs, err := listVFs(cfg.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find VF on parent %s: %w", cfg.Parent, err)
+		}
+		pfName = cfg.Parent
+		index, vfName, err = h.owners.reserveFree(pfName, vfs, cfg.VFIndex, req.ClaimUID)
 		if err != nil {
 			return nil, fmt.Errorf("failed to find VF on parent %s: %w", cfg.Parent, err)
 		}
 	}
 
+	result, err := h.prepareVF(ctx, req, containerName, pfName, index, vfName, profile)
+	if err != nil {
+		h.owners.release(pfName, index, req.ClaimUID)
+		return nil, err
+	}
+	return result, nil
+}
+
+// prepareVF configures a reserved VF and builds the prepare result.
+func (h *SriovVfHandler) prepareVF(ctx context.Context, req *handler.PrepareRequest, containerName, pfName string, index int, vfName, profile string) (*handler.PrepareResult, error) {
+	cfg := req.Config.Netdev
+
 	// Verify the VF interface exists
 	link, err := netlink.LinkByName(vfName)
 	if err != nil {
 		return nil, fmt.Errorf("VF interface %s not found: %w", vfName, err)
 	}
 
+	metadata := map[string]string{
+		"vfInterface":   vfName,
+		"containerName": containerName,
+		"pf":            pfName,
+		"vfIndex":       strconv.Itoa(index),
+	}
+	recordHostMAC(cfg, link, metadata)
+
+	vfCfg, err := profileVFConfig(cfg.VF, profile, h.ProfileRates[profile])
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply PF-side VF settings, remembering the originals for Unprepare
+	if vfCfg != nil {
+		pf, err := netlink.LinkByName(pfName)
+		if err != nil {
+			return nil, fmt.Errorf("PF %s not found: %w", pfName, err)
+		}
+		orig, err := snapshotVF(pf, index)
+		if err != nil {
+			return nil, err
+		}
+		if err := setVF(pf, index, orig, orig.with(vfCfg)); err != nil {
+			if rerr := setVF(pf, index, orig.with(vfCfg), orig); rerr != nil {
+				klog.Warningf("Failed to roll back VF %s settings: %v", vfName, rerr)
+			}
+			return nil, fmt.Errorf("failed to configure VF %s: %w", vfName, err)
+		}
+		metadata["vfOriginal"] = encodeVFSettings(orig)
+		klog.Infof("Configured VF %d on PF %s for claim %s", index, pfName, req.ClaimUID)
+	}
+
+	// In switchdev mode the VF's representor stays on the host
+	if err := h.prepareRepresentor(ctx, req, pfName, index, metadata); err != nil {
+		restoreVF(metadata)
+		return nil, err
+	}
+
+	if profile != "" {
+		metadata["profile"] = profile
+	}
+
+	if cfg.Mode == VFModeVFIO {
+		return h.prepareVFIO(ctx, req, containerName, vfName, metadata)
+	}
+
 	// Set MTU if specified
 	if cfg.MTU > 0 {
 		if err := netlink.LinkSetMTU(link, cfg.MTU); err != nil {
+			h.undoVF(ctx, metadata)
 			return nil, fmt.Errorf("failed to set MTU on VF %s: %w", vfName, err)
 		}
 	}
 
+	// Restored on Unprepare, as the VF outlives the claim
+	if err := applyEthtool(vfName, cfg.Ethtool, metadata, true); err != nil {
+		h.undoVF(ctx, metadata)
+		return nil, fmt.Errorf("failed to apply ethtool settings to VF %s: %w", vfName, err)
+	}
+
 	// Bring up the VF
 	if err := netlink.LinkSetUp(link); err != nil {
+		h.undoVF(ctx, metadata)
 		return nil, fmt.Errorf("failed to bring up VF %s: %w", vfName, err)
 	}
 
-	klog.Infof("Prepared SR-IOV VF %s for claim %s", vfName, req.ClaimUID)
+	if err := registerLinkConfig(h.Links, req, containerName, metadata); err != nil {
+		h.undoVF(ctx, metadata)
+		return nil, err
+	}
+
+	klog.Infof("Prepared SR-IOV VF %s for claim %s (profile=%q)", vfName, req.ClaimUID, profile)
 
 	return &handler.PrepareResult{
 		PoolName:   "default",
@@ -88,70 +282,237 @@ func (h *SriovVfHandler) Prepare(_ context.Context, req *handler.PrepareRequest)
 			Kind:       "sriov-vf",
 			ClaimUID:   req.ClaimUID,
 			DeviceName: vfName,
-			Metadata: map[string]string{
-				"vfInterface":   vfName,
-				"containerName": containerName,
-			},
+			Metadata:   metadata,
 		},
 	}, nil
 }
 
-func (h *SriovVfHandler) Unprepare(_ context.Context, req *handler.UnprepareRequest) error {
+// profileVFConfig returns the VF settings of a claim allocated through
+// profile, whose bandwidth rate (Mb/s) caps the VF's max TX rate.  The claim
+// may ask for less, not for more.
+func profileVFConfig(cfg *handler.VFConfig, profile string, rate int) (*handler.VFConfig, error) {
+	if rate <= 0 {
+		return cfg, nil
+	}
+	var out handler.VFConfig
+	if cfg != nil {
+		if r := cfg.MaxTxRate; r != nil {
+			if *r == 0 || *r > rate {
+				return nil, fmt.Errorf("VF maxTxRate must be within the %d Mb/s of profile %s", rate, profile)
+			}
+			return cfg, nil
+		}
+		if cfg.MinTxRate != nil && *cfg.MinTxRate > rate {
+			return nil, fmt.Errorf("VF minTxRate %d exceeds the %d Mb/s of profile %s", *cfg.MinTxRate, rate, profile)
+		}
+		out = *cfg
+	}
+	out.MaxTxRate = &rate
+	return &out, nil
+}
+
+// prepareVFIO rebinds a configured VF to vfio-pci and exposes it as a
+// userspace device.
+func (h *SriovVfHandler) prepareVFIO(ctx context.Context, req *handler.PrepareRequest, containerName, vfName string, metadata map[string]string) (*handler.PrepareResult, error) {
+	pciAddr := netdevPCIAddress(vfName)
+	if pciAddr == "" {
+		h.undoVF(ctx, metadata)
+		return nil, fmt.Errorf("failed to resolve PCI address of VF %s", vfName)
+	}
+
+	binding, err := bindVFIO(pciAddr)
+	if err != nil {
+		h.undoVF(ctx, metadata)
+		return nil, fmt.Errorf("failed to bind VF %s to %s: %w", vfName, vfioDriver, err)
+	}
+	metadata["mode"] = VFModeVFIO
+	metadata["pciAddress"] = binding.PCIAddress
+	metadata["originalDriver"] = binding.OriginalDriver
+	metadata["iommuGroup"] = binding.IOMMUGroup
+
+	if _, err := os.Stat(filepath.Join(vfioDevDir, binding.IOMMUGroup)); err != nil {
+		unbindVFIO(binding)
+		h.undoVF(ctx, metadata)
+		return nil, fmt.Errorf("VFIO group device for VF %s: %w", vfName, err)
+	}
+
+	klog.Infof("Prepared SR-IOV VF %s (%s) as %s for claim %s", vfName, pciAddr, vfioDriver, req.ClaimUID)
+
+	return &handler.PrepareResult{
+		PoolName:   "default",
+		DeviceName: vfName,
+		CDIEdits:   vfioEdits(binding, containerName),
+		Allocation: &handler.AllocationInfo{
+			Type:       handler.DeviceTypeNetdev,
+			Kind:       "sriov-vf",
+			ClaimUID:   req.ClaimUID,
+			DeviceName: vfName,
+			Metadata:   metadata,
+		},
+	}, nil
+}
+
+func (h *SriovVfHandler) Unprepare(ctx context.Context, req *handler.UnprepareRequest) error {
+	if h.Links != nil {
+		h.Links.Release(req.ClaimUID)
+	}
 	vfName := req.Allocation.Metadata["vfInterface"]
 	if vfName == "" {
 		return nil
 	}
 
-	// For SR-IOV VFs, we don't delete the interface - just bring it down
-	link, err := netlink.LinkByName(vfName)
-	if err != nil {
-		klog.V(2).Infof("SR-IOV VF %s not found during unprepare: %v", vfName, err)
-		return nil
+	// The PF and the representor stay in the host netns, so restore them
+	// even when the VF netdev itself is not visible here.
+	if err := h.releaseRepresentor(ctx, req.Allocation.Metadata); err != nil {
+		return err
+	}
+	if err := restoreVF(req.Allocation.Metadata); err != nil {
+		return err
 	}
 
-	if err := netlink.LinkSetDown(link); err != nil {
-		klog.Warningf("Failed to bring down VF %s: %v", vfName, err)
+	if req.Allocation.Metadata["mode"] == VFModeVFIO {
+		if err := unbindVFIO(&vfioBinding{
+			PCIAddress:     req.Allocation.Metadata["pciAddress"],
+			OriginalDriver: req.Allocation.Metadata["originalDriver"],
+			IOMMUGroup:     req.Allocation.Metadata["iommuGroup"],
+		}); err != nil {
+			return fmt.Errorf("failed to return VF %s to its driver: %w", vfName, err)
+		}
 	}
 
-	klog.Infof("Unprepared SR-IOV VF %s", vfName)
+	if req.Allocation.Metadata["mode"] != VFModeVFIO {
+		// For SR-IOV VFs, we don't delete the interface - just bring it down
+		if link, err := netlink.LinkByName(vfName); err != nil {
+			klog.V(2).Infof("SR-IOV VF %s not found during unprepare: %v", vfName, err)
+		} else {
+			if err := restoreEthtool(vfName, req.Allocation.Metadata); err != nil {
+				return err
+			}
+			if err := restoreHostMAC(link, req.Allocation.Metadata); err != nil {
+				return err
+			}
+			if err := netlink.LinkSetDown(link); err != nil {
+				klog.Warningf("Failed to bring down VF %s: %v", vfName, err)
+			}
+		}
+	}
+
+	// Only once the VF is back to its original state may another claim get
+	// it.
+	if index, err := strconv.Atoi(req.Allocation.Metadata["vfIndex"]); err == nil {
+		h.ReleaseVF(req.ClaimUID, req.Allocation.Metadata["pf"], index)
+	}
+	if req.Allocation.Metadata["mode"] == VFModeVFIO {
+		klog.Infof("Unprepared SR-IOV VF %s (%s)", vfName, req.Allocation.Metadata["pciAddress"])
+	} else {
+		klog.Infof("Unprepared SR-IOV VF %s", vfName)
+	}
 	return nil
 }
 
-// findAvailableVF finds an available VF interface on the given PF
-func findAvailableVF(pfName string, vfIndex int) (string, error) {
-	// If a specific VF index is requested, look for it directly
-	if vfIndex >= 0 {
-		vfDir := fmt.Sprintf("/sys/class/net/%s/device/virtfn%d/net", pfName, vfIndex)
-		entries, err := os.ReadDir(vfDir)
-		if err != nil {
-			return "", fmt.Errorf("VF index %d not found on PF %s: %w", vfIndex, pfName, err)
-		}
-		if len(entries) > 0 {
-			return entries[0].Name(), nil
+// prepareRepresentor records the representor of a VF whose PF is in
+// switchdev mode and attaches it to the configured Linux or OVS bridge.
+func (h *SriovVfHandler) prepareRepresentor(ctx context.Context, req *handler.PrepareRequest, pf string, index int, metadata map[string]string) error {
+	cfg := req.Config.Netdev
+	if EswitchMode(pf) != EswitchModeSwitchdev {
+		if cfg.Representor != nil {
+			return fmt.Errorf("representor settings require PF %s in %s mode", pf, EswitchModeSwitchdev)
 		}
-		return "", fmt.Errorf("no net device for VF index %d on PF %s", vfIndex, pfName)
+		return nil
 	}
-
-	// Scan for available VFs
-	pfDeviceDir := filepath.Join("/sys/class/net", pfName, "device")
-	entries, err := os.ReadDir(pfDeviceDir)
+	rep, err := findRepresentor(pf, index)
 	if err != nil {
-		return "", fmt.Errorf("failed to read PF device dir: %w", err)
+		if cfg.Representor != nil {
+			return err
+		}
+		klog.Warningf("VF %d on switchdev PF %s: %v", index, pf, err)
+		return nil
 	}
+	metadata["representor"] = rep
 
-	for _, entry := range entries {
-		if !strings.HasPrefix(entry.Name(), "virtfn") {
-			continue
+	if cfg.Representor != nil && cfg.Representor.Bridge != "" {
+		if err := attachRepresentor(rep, cfg.Representor.Bridge); err != nil {
+			return err
 		}
-		vfNetDir := filepath.Join(pfDeviceDir, entry.Name(), "net")
-		netEntries, err := os.ReadDir(vfNetDir)
-		if err != nil {
-			continue
+		metadata["representorBridge"] = cfg.Representor.Bridge
+	}
+	if cfg.Representor != nil && cfg.Representor.OVS != nil {
+		if err := addOVSPort(ctx, h.OVS, req, rep, cfg.Representor.OVS); err != nil {
+			return err
+		}
+		metadata["representorOVSBridge"] = cfg.Representor.OVS.Bridge
+		link, err := netlink.LinkByName(rep)
+		if err == nil {
+			err = netlink.LinkSetUp(link)
 		}
-		if len(netEntries) > 0 {
-			return netEntries[0].Name(), nil
+		if err != nil {
+			h.releaseRepresentor(ctx, metadata)
+			return fmt.Errorf("failed to bring up representor %s: %w", rep, err)
 		}
 	}
+	return nil
+}
+
+// releaseRepresentor removes the representor recorded in metadata from the
+// Linux or OVS bridge Prepare attached it to.
+func (h *SriovVfHandler) releaseRepresentor(ctx context.Context, metadata map[string]string) error {
+	detachRepresentor(metadata)
+	rep, bridge := metadata["representor"], metadata["representorOVSBridge"]
+	if rep == "" || bridge == "" {
+		return nil
+	}
+	// OVS keeps the port record after the representor is gone
+	if h.OVS == nil {
+		klog.Warningf("Cannot remove representor %s from OVS bridge %s: OVS attachment is not enabled", rep, bridge)
+		return nil
+	}
+	if err := h.OVS.DelPort(ctx, rep); err != nil {
+		return fmt.Errorf("failed to remove representor %s from OVS bridge %s: %w", rep, bridge, err)
+	}
+	klog.Infof("Removed representor %s from OVS bridge %s", rep, bridge)
+	return nil
+}
+
+// undoVF reverts the host-side changes of prepareVF after a failure.
+func (h *SriovVfHandler) undoVF(ctx context.Context, metadata map[string]string) {
+	if err := restoreEthtool(metadata["vfInterface"], metadata); err != nil {
+		klog.Warningf("%v", err)
+	}
+	if err := h.releaseRepresentor(ctx, metadata); err != nil {
+		klog.Warningf("%v", err)
+	}
+	restoreVF(metadata)
+}
+
+// restoreVF puts back the PF-side VF settings recorded in metadata.  The
+// current settings are re-read from the PF so that only what differs is
+// written.
+func restoreVF(metadata map[string]string) error {
+	data, ok := metadata["vfOriginal"]
+	if !ok {
+		return nil
+	}
+	orig, err := decodeVFSettings(data)
+	if err != nil {
+		return fmt.Errorf("corrupt VF snapshot for %s: %w", metadata["vfInterface"], err)
+	}
+	index, err := strconv.Atoi(metadata["vfIndex"])
+	if err != nil {
+		return fmt.Errorf("corrupt VF index for %s: %w", metadata["vfInterface"], err)
+	}
 
-	return "", fmt.Errorf("no available VFs found on PF %s", pfName)
+	pf, err := netlink.LinkByName(metadata["pf"])
+	if err != nil {
+		klog.Warningf("PF %s not found, cannot restore VF %d: %v", metadata["pf"], index, err)
+		return nil
+	}
+	current, err := snapshotVF(pf, index)
+	if err != nil {
+		return err
+	}
+	if err := setVF(pf, index, current, orig); err != nil {
+		return fmt.Errorf("failed to restore VF %s: %w", metadata["vfInterface"], err)
+	}
+	klog.Infof("Restored VF %d settings on PF %s", index, pf.Attrs().Name)
+	return nil
 }
@@ -0,0 +1,127 @@
+package netdev
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+)
+
+// EswitchModeSwitchdev is the devlink eswitch mode in which every VF has a
+// representor netdev on the host, used e.g. for OVS hardware offload.
+const EswitchModeSwitchdev = "switchdev"
+
+// EswitchMode returns the devlink eswitch mode of a PF ("legacy" or
+// "switchdev"), or "" if the PF has no devlink device.
+func EswitchMode(pf string) string {
+	pciAddr := netdevPCIAddress(pf)
+	if pciAddr == "" {
+		return ""
+	}
+	dev, err := netlink.DevLinkGetDeviceByName("pci", pciAddr)
+	if err != nil {
+		klog.V(2).Infof("No devlink device for PF %s (%s): %v", pf, pciAddr, err)
+		return ""
+	}
+	return dev.Attrs.Eswitch.Mode
+}
+
+// VF representors are named by the driver, so they are found through the
+// switch ID they share with their PF and their port name: "pf0vf3" (or
+// "c1pf0vf3" on multi-controller NICs) and "vf3" on older kernels.  The PF's
+// own uplink representor is named "p0".
+var (
+	vfPortName     = regexp.MustCompile(`^(?:c\d+)?(?:pf(\d+))?vf(\d+)$`)
+	uplinkPortName = regexp.MustCompile(`^p(\d+)$`)
+)
+
+// findRepresentor returns the representor netdev of VF index on pf.
+func findRepresentor(pf string, index int) (string, error) {
+	switchID := readSysfsString(filepath.Join(netSysfsRoot, pf, "phys_switch_id"))
+	if switchID == "" {
+		return "", fmt.Errorf("PF %s has no switch ID", pf)
+	}
+	pfNum := -1
+	if m := uplinkPortName.FindStringSubmatch(readSysfsString(filepath.Join(netSysfsRoot, pf, "phys_port_name"))); m != nil {
+		pfNum, _ = strconv.Atoi(m[1])
+	}
+
+	entries, err := os.ReadDir(netSysfsRoot)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == pf || readSysfsString(filepath.Join(netSysfsRoot, name, "phys_switch_id")) != switchID {
+			continue
+		}
+		m := vfPortName.FindStringSubmatch(readSysfsString(filepath.Join(netSysfsRoot, name, "phys_port_name")))
+		if m == nil {
+			continue
+		}
+		if vf, _ := strconv.Atoi(m[2]); vf != index {
+			continue
+		}
+		if n, err := strconv.Atoi(m[1]); err == nil && pfNum >= 0 && n != pfNum {
+			continue
+		}
+		return name, nil
+	}
+	return "", fmt.Errorf("no representor found for VF %d on PF %s", index, pf)
+}
+
+// attachRepresentor brings up a representor and adds it to a Linux bridge.
+func attachRepresentor(rep, bridge string) error {
+	link, err := netlink.LinkByName(rep)
+	if err != nil {
+		return fmt.Errorf("representor %s not found: %w", rep, err)
+	}
+	br, err := netlink.LinkByName(bridge)
+	if err != nil {
+		return fmt.Errorf("bridge %s not found: %w", bridge, err)
+	}
+	if br.Type() != "bridge" {
+		return fmt.Errorf("%s is a %s device, not a Linux bridge", bridge, br.Type())
+	}
+	if err := netlink.LinkSetMaster(link, br); err != nil {
+		return fmt.Errorf("failed to add representor %s to bridge %s: %w", rep, bridge, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		netlink.LinkSetNoMaster(link)
+		return fmt.Errorf("failed to bring up representor %s: %w", rep, err)
+	}
+	klog.Infof("Attached representor %s to bridge %s", rep, bridge)
+	return nil
+}
+
+// detachRepresentor removes the representor recorded in metadata from the
+// bridge Prepare attached it to.
+func detachRepresentor(metadata map[string]string) {
+	rep, bridge := metadata["representor"], metadata["representorBridge"]
+	if rep == "" || bridge == "" {
+		return
+	}
+	link, err := netlink.LinkByName(rep)
+	if err != nil {
+		klog.V(2).Infof("Representor %s not found during unprepare: %v", rep, err)
+		return
+	}
+	if err := netlink.LinkSetNoMaster(link); err != nil {
+		klog.Warningf("Failed to detach representor %s from bridge %s: %v", rep, bridge, err)
+		return
+	}
+	klog.Infof("Detached representor %s from bridge %s", rep, bridge)
+}
+
+func readSysfsString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
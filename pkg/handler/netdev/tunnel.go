@@ -0,0 +1,316 @@
+package netdev
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+)
+
+// Default UDP destination ports (IANA).
+const (
+	vxlanPort  = 4789
+	genevePort = 6081
+)
+
+// VxlanHandler creates a VXLAN tunnel device per claim.
+//
+// The device is created in the host netns, so its underlay socket stays on
+// the host network when the device moves into the pod.  Static FDB entries
+// are installed as permanent entries, which survive the move.
+type VxlanHandler struct {
+	// Links applies addresses and routes after the link moved into the pod.
+	// Nil rejects claims that ask for them.
+	Links *nri.LinkSetupTracker
+}
+
+func (h *VxlanHandler) Type() handler.DeviceType { return handler.DeviceTypeNetdev }
+func (h *VxlanHandler) Kinds() []string          { return []string{"vxlan"} }
+func (h *VxlanHandler) Virtual() bool            { return true }
+
+// Restore registers the pod-side setups of a persisted allocation again.
+func (h *VxlanHandler) Restore(alloc *handler.AllocationInfo) {
+	restoreLinkSetups(h.Links, nil, alloc)
+}
+
+func (h *VxlanHandler) Validate(_ context.Context, cfg *handler.DeviceConfig) error {
+	if cfg.Netdev == nil {
+		return fmt.Errorf("netdev config is required for vxlan")
+	}
+	if err := rejectEthtool(cfg.Netdev, "vxlan"); err != nil {
+		return err
+	}
+	t := cfg.Netdev.Tunnel
+	if err := validateTunnel(t, "vxlan"); err != nil {
+		return err
+	}
+	if t.Remote != "" && t.Group != "" {
+		return fmt.Errorf("vxlan remote and group are mutually exclusive")
+	}
+	if t.Group != "" {
+		if ip := net.ParseIP(t.Group); ip == nil || !ip.IsMulticast() {
+			return fmt.Errorf("vxlan group %q is not a multicast address", t.Group)
+		}
+	}
+	if t.Local != "" && net.ParseIP(t.Local) == nil {
+		return fmt.Errorf("invalid vxlan local address %q", t.Local)
+	}
+	for _, e := range t.FDB {
+		if e.MAC != "" {
+			if _, err := net.ParseMAC(e.MAC); err != nil {
+				return fmt.Errorf("invalid FDB MAC %q: %w", e.MAC, err)
+			}
+		}
+		if net.ParseIP(e.Dst) == nil {
+			return fmt.Errorf("invalid FDB destination %q", e.Dst)
+		}
+	}
+	return validateLinkConfig(cfg.Netdev, h.Links)
+}
+
+func (h *VxlanHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
+	cfg := req.Config.Netdev
+	if cfg == nil || cfg.Tunnel == nil {
+		return nil, fmt.Errorf("netdev.tunnel is required for vxlan")
+	}
+	t := cfg.Tunnel
+
+	ifName := fmt.Sprintf("vx%s", req.NameSuffix())
+	vxlan := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{Name: ifName},
+		VxlanId:   int(t.VNI),
+		SrcAddr:   net.ParseIP(t.Local),
+		TTL:       t.TTL,
+		Learning:  t.Learning == nil || *t.Learning,
+		Port:      vxlanPort,
+	}
+	// The kernel uses the group attribute for a unicast remote as well.
+	if t.Remote != "" {
+		vxlan.Group = net.ParseIP(t.Remote)
+	} else if t.Group != "" {
+		vxlan.Group = net.ParseIP(t.Group)
+	}
+	if t.DstPort > 0 {
+		vxlan.Port = t.DstPort
+	}
+	if cfg.Parent != "" {
+		underlay, err := netlink.LinkByName(cfg.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("underlay interface %s not found: %w", cfg.Parent, err)
+		}
+		vxlan.VtepDevIndex = underlay.Attrs().Index
+	}
+	if cfg.MTU > 0 {
+		vxlan.LinkAttrs.MTU = cfg.MTU
+	}
+
+	if err := netlink.LinkAdd(vxlan); err != nil {
+		return nil, fmt.Errorf("failed to create vxlan interface %s: %w", ifName, err)
+	}
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		netlink.LinkDel(vxlan)
+		return nil, fmt.Errorf("vxlan interface %s not found after creation: %w", ifName, err)
+	}
+	for _, e := range t.FDB {
+		if err := addFDBEntry(link, e); err != nil {
+			netlink.LinkDel(link)
+			return nil, err
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		netlink.LinkDel(link)
+		return nil, fmt.Errorf("failed to bring up vxlan interface %s: %w", ifName, err)
+	}
+
+	result, err := tunnelResult(req, h.Links, "vxlan", ifName, t)
+	if err != nil {
+		netlink.LinkDel(link)
+		return nil, err
+	}
+	klog.Infof("Created vxlan interface %s (vni=%d, port=%d, fdb entries=%d)", ifName, t.VNI, vxlan.Port, len(t.FDB))
+	return result, nil
+}
+
+func (h *VxlanHandler) Unprepare(_ context.Context, req *handler.UnprepareRequest) error {
+	return deleteTunnel(req, h.Links, "vxlan")
+}
+
+// addFDBEntry installs a permanent FDB entry sending e.MAC to e.Dst.
+func addFDBEntry(link netlink.Link, e handler.FDBEntry) error {
+	mac := net.HardwareAddr{0, 0, 0, 0, 0, 0}
+	if e.MAC != "" {
+		mac, _ = net.ParseMAC(e.MAC) // validated
+	}
+	// Append, not set: the all-zeros MAC may have one entry per peer.
+	err := netlink.NeighAppend(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT | netlink.NUD_NOARP,
+		Flags:        netlink.NTF_SELF,
+		IP:           net.ParseIP(e.Dst),
+		HardwareAddr: mac,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add FDB entry %s dst %s on %s: %w", mac, e.Dst, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// GeneveHandler creates a Geneve tunnel device per claim.  Geneve has a
+// single remote per device and no FDB.
+type GeneveHandler struct {
+	// Links applies addresses and routes after the link moved into the pod.
+	// Nil rejects claims that ask for them.
+	Links *nri.LinkSetupTracker
+}
+
+func (h *GeneveHandler) Type() handler.DeviceType { return handler.DeviceTypeNetdev }
+func (h *GeneveHandler) Kinds() []string          { return []string{"geneve"} }
+func (h *GeneveHandler) Virtual() bool            { return true }
+
+// Restore registers the pod-side setups of a persisted allocation again.
+func (h *GeneveHandler) Restore(alloc *handler.AllocationInfo) {
+	restoreLinkSetups(h.Links, nil, alloc)
+}
+
+func (h *GeneveHandler) Validate(_ context.Context, cfg *handler.DeviceConfig) error {
+	if cfg.Netdev == nil {
+		return fmt.Errorf("netdev config is required for geneve")
+	}
+	if err := rejectEthtool(cfg.Netdev, "geneve"); err != nil {
+		return err
+	}
+	t := cfg.Netdev.Tunnel
+	if err := validateTunnel(t, "geneve"); err != nil {
+		return err
+	}
+	switch {
+	case t.Remote == "":
+		return fmt.Errorf("geneve requires a remote address")
+	case t.Group != "", t.Local != "", t.Learning != nil, len(t.FDB) > 0:
+		return fmt.Errorf("group, local, learning and fdb are vxlan-only settings")
+	case cfg.Netdev.Parent != "":
+		return fmt.Errorf("geneve does not support an underlay device")
+	}
+	return validateLinkConfig(cfg.Netdev, h.Links)
+}
+
+func (h *GeneveHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
+	cfg := req.Config.Netdev
+	if cfg == nil || cfg.Tunnel == nil {
+		return nil, fmt.Errorf("netdev.tunnel is required for geneve")
+	}
+	t := cfg.Tunnel
+
+	ifName := fmt.Sprintf("gn%s", req.NameSuffix())
+	geneve := &netlink.Geneve{
+		LinkAttrs: netlink.LinkAttrs{Name: ifName},
+		ID:        t.VNI,
+		Remote:    net.ParseIP(t.Remote),
+		Ttl:       uint8(t.TTL),
+		Dport:     genevePort,
+	}
+	if t.DstPort > 0 {
+		geneve.Dport = uint16(t.DstPort)
+	}
+	if cfg.MTU > 0 {
+		geneve.LinkAttrs.MTU = cfg.MTU
+	}
+
+	if err := netlink.LinkAdd(geneve); err != nil {
+		return nil, fmt.Errorf("failed to create geneve interface %s: %w", ifName, err)
+	}
+	if err := netlink.LinkSetUp(geneve); err != nil {
+		netlink.LinkDel(geneve)
+		return nil, fmt.Errorf("failed to bring up geneve interface %s: %w", ifName, err)
+	}
+
+	result, err := tunnelResult(req, h.Links, "geneve", ifName, t)
+	if err != nil {
+		netlink.LinkDel(geneve)
+		return nil, err
+	}
+	klog.Infof("Created geneve interface %s (vni=%d, remote=%s, port=%d)", ifName, t.VNI, t.Remote, geneve.Dport)
+	return result, nil
+}
+
+func (h *GeneveHandler) Unprepare(_ context.Context, req *handler.UnprepareRequest) error {
+	return deleteTunnel(req, h.Links, "geneve")
+}
+
+// validateTunnel checks the settings vxlan and geneve share.
+func validateTunnel(t *handler.TunnelConfig, kind string) error {
+	if t == nil {
+		return fmt.Errorf("netdev.tunnel is required for %s", kind)
+	}
+	if t.VNI >= 1<<24 {
+		return fmt.Errorf("%s VNI %d exceeds 24 bits", kind, t.VNI)
+	}
+	if t.Remote != "" && net.ParseIP(t.Remote) == nil {
+		return fmt.Errorf("invalid %s remote address %q", kind, t.Remote)
+	}
+	if t.DstPort < 0 || t.DstPort > 65535 {
+		return fmt.Errorf("%s destination port %d out of range", kind, t.DstPort)
+	}
+	if t.TTL < 0 || t.TTL > 255 {
+		return fmt.Errorf("%s TTL %d out of range 0-255", kind, t.TTL)
+	}
+	return nil
+}
+
+func tunnelResult(req *handler.PrepareRequest, links *nri.LinkSetupTracker, kind, ifName string, t *handler.TunnelConfig) (*handler.PrepareResult, error) {
+	containerName := req.Config.Netdev.InterfaceName
+	if containerName == "" {
+		containerName = "eth1"
+	}
+	metadata := map[string]string{
+		"createdInterface": ifName,
+		"containerName":    containerName,
+		"vni":              fmt.Sprintf("%d", t.VNI),
+	}
+	if err := registerLinkConfig(links, req, containerName, metadata); err != nil {
+		return nil, err
+	}
+	return &handler.PrepareResult{
+		PoolName:   "default",
+		DeviceName: ifName,
+		CDIEdits: &cdispec.ContainerEdits{
+			NetDevices: []*cdispec.LinuxNetDevice{
+				{HostInterfaceName: ifName, Name: containerName},
+			},
+		},
+		Allocation: &handler.AllocationInfo{
+			Type: handler.DeviceTypeNetdev, Kind: kind,
+			ClaimUID: req.ClaimUID, DeviceName: ifName,
+			Metadata: metadata,
+		},
+	}, nil
+}
+
+func deleteTunnel(req *handler.UnprepareRequest, links *nri.LinkSetupTracker, kind string) error {
+	if links != nil {
+		links.Release(req.ClaimUID)
+	}
+	ifName := req.Allocation.Metadata["createdInterface"]
+	if ifName == "" {
+		return nil
+	}
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		klog.V(2).Infof("%s interface %s already removed: %v", kind, ifName, err)
+		return nil
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete %s interface %s: %w", kind, ifName, err)
+	}
+	klog.Infof("Deleted %s interface %s", kind, ifName)
+	return nil
+}
@@ -8,31 +8,60 @@ import (
 	"k8s.io/klog/v2"
 
 	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
+	"github.com/example/dra-poc/pkg/ovs"
 	cdispec "tags.cncf.io/container-device-interface/specs-go"
 )
 
-// VethHandler creates veth pairs (one end for the container)
-type VethHandler struct{}
+// VethHandler creates veth pairs (one end for the container).  With
+// netdev.bridge or netdev.ovs set, the host end is attached to a Linux
+// bridge or an Open vSwitch bridge.
+type VethHandler struct {
+	// OVS reaches the local OVSDB server.  Nil disables OVS attachment.
+	OVS *ovs.Client
+
+	// Links applies addresses and routes after the container end moved
+	// into the pod.  Nil rejects claims that ask for them.
+	Links *nri.LinkSetupTracker
+}
 
 func (h *VethHandler) Type() handler.DeviceType { return handler.DeviceTypeNetdev }
 func (h *VethHandler) Kinds() []string          { return []string{"veth"} }
+func (h *VethHandler) Virtual() bool            { return true }
+
+// Restore registers the pod-side setups of a persisted allocation again.
+func (h *VethHandler) Restore(alloc *handler.AllocationInfo) {
+	restoreLinkSetups(h.Links, nil, alloc)
+}
 
 func (h *VethHandler) Validate(_ context.Context, cfg *handler.DeviceConfig) error {
 	if cfg.Netdev == nil {
 		return fmt.Errorf("netdev config is required for veth")
 	}
-	return nil
+	if err := rejectEthtool(cfg.Netdev, "veth"); err != nil {
+		return err
+	}
+	if cfg.Netdev.Bridge != nil && cfg.Netdev.OVS != nil {
+		return fmt.Errorf("bridge and ovs are mutually exclusive")
+	}
+	if err := validateBridgeConfig(cfg.Netdev.Bridge); err != nil {
+		return err
+	}
+	if err := validateOVSConfig(cfg.Netdev.OVS); err != nil {
+		return err
+	}
+	return validateLinkConfig(cfg.Netdev, h.Links)
 }
 
-func (h *VethHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
+func (h *VethHandler) Prepare(ctx context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
 	cfg := req.Config.Netdev
 	if cfg == nil {
 		return nil, fmt.Errorf("netdev config is required for veth")
 	}
 
 	// Generate unique veth pair names
-	hostEnd := fmt.Sprintf("vh%s", req.ClaimUID[:8])
-	containerEnd := fmt.Sprintf("vc%s", req.ClaimUID[:8])
+	hostEnd := fmt.Sprintf("vh%s", req.NameSuffix())
+	containerEnd := fmt.Sprintf("vc%s", req.NameSuffix())
 
 	containerName := cfg.InterfaceName
 	if containerName == "" {
@@ -79,6 +108,37 @@ func (h *VethHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (*
 
 	klog.Infof("Created veth pair %s/%s", hostEnd, containerEnd)
 
+	metadata := map[string]string{
+		"hostEnd":       hostEnd,
+		"containerEnd":  containerEnd,
+		"containerName": containerName,
+	}
+	if cfg.Bridge != nil {
+		if err := attachVethToBridge(hostLink, cfg.Bridge); err != nil {
+			netlink.LinkDel(veth)
+			return nil, err
+		}
+		metadata["bridge"] = cfg.Bridge.Name
+		if cfg.Bridge.DeleteUnused {
+			metadata["bridgeDeleteUnused"] = "true"
+		}
+	}
+	if cfg.OVS != nil {
+		if err := addOVSPort(ctx, h.OVS, req, hostEnd, cfg.OVS); err != nil {
+			netlink.LinkDel(veth)
+			return nil, err
+		}
+		metadata["ovsBridge"] = cfg.OVS.Bridge
+	}
+	if err := registerLinkConfig(h.Links, req, containerName, metadata); err != nil {
+		// Also takes the host end off its bridge or OVS port.
+		h.Unprepare(ctx, &handler.UnprepareRequest{
+			ClaimUID:   req.ClaimUID,
+			Allocation: &handler.AllocationInfo{ClaimUID: req.ClaimUID, Metadata: metadata},
+		})
+		return nil, err
+	}
+
 	// The container end gets moved into the container netns via CDI
 	return &handler.PrepareResult{
 		PoolName:   "default",
@@ -96,32 +156,63 @@ func (h *VethHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (*
 			Kind:       "veth",
 			ClaimUID:   req.ClaimUID,
 			DeviceName: containerEnd,
-			Metadata: map[string]string{
-				"hostEnd":       hostEnd,
-				"containerEnd":  containerEnd,
-				"containerName": containerName,
-			},
+			Metadata:   metadata,
 		},
 	}, nil
 }
 
-func (h *VethHandler) Unprepare(_ context.Context, req *handler.UnprepareRequest) error {
-	// Deleting one end of the veth pair deletes both
+// attachVethToBridge attaches the host end to its bridge, removing a bridge
+// it created again if the attachment fails.
+func attachVethToBridge(hostLink netlink.Link, cfg *handler.BridgeConfig) error {
+	bridgeMu.Lock()
+	defer bridgeMu.Unlock()
+
+	br, created, err := ensureBridge(cfg)
+	if err != nil {
+		return err
+	}
+	if err := attachBridgePort(hostLink, br, cfg); err != nil {
+		netlink.LinkSetNoMaster(hostLink)
+		if created {
+			deleteUnusedBridge(cfg.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *VethHandler) Unprepare(ctx context.Context, req *handler.UnprepareRequest) error {
+	if h.Links != nil {
+		h.Links.Release(req.ClaimUID)
+	}
+	// Deleting one end of the veth pair deletes both, and removes the host
+	// end from its Linux bridge
 	hostEnd := req.Allocation.Metadata["hostEnd"]
 	if hostEnd == "" {
 		return nil
 	}
 
+	// OVS keeps the port record after its interface is gone
+	if bridge := req.Allocation.Metadata["ovsBridge"]; bridge != "" {
+		if h.OVS == nil {
+			klog.Warningf("Cannot remove %s from OVS bridge %s: OVS attachment is not enabled", hostEnd, bridge)
+		} else if err := h.OVS.DelPort(ctx, hostEnd); err != nil {
+			return err
+		}
+	}
+
 	link, err := netlink.LinkByName(hostEnd)
 	if err != nil {
 		klog.V(2).Infof("veth host end %s already removed: %v", hostEnd, err)
-		return nil
+	} else {
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete veth pair (host=%s): %w", hostEnd, err)
+		}
+		klog.Infof("Deleted veth pair (host=%s)", hostEnd)
 	}
 
-	if err := netlink.LinkDel(link); err != nil {
-		return fmt.Errorf("failed to delete veth pair (host=%s): %w", hostEnd, err)
+	if req.Allocation.Metadata["bridgeDeleteUnused"] == "true" {
+		return deleteBridgeIfUnused(req.Allocation.Metadata["bridge"])
 	}
-
-	klog.Infof("Deleted veth pair (host=%s)", hostEnd)
 	return nil
 }
@@ -0,0 +1,235 @@
+package netdev
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/example/dra-poc/pkg/handler"
+)
+
+// vfSettings is the PF-side configuration of one VF.  The original settings
+// are stored in the allocation metadata so Unprepare can restore them even
+// after a driver restart.
+type vfSettings struct {
+	MAC       string `json:"mac"`
+	VLAN      int    `json:"vlan"`
+	QoS       int    `json:"qos"`
+	VLANProto int    `json:"vlanProto"`
+	SpoofChk  bool   `json:"spoofChk"`
+	Trust     bool   `json:"trust"`
+	LinkState uint32 `json:"linkState"`
+	MinTxRate int    `json:"minTxRate"`
+	MaxTxRate int    `json:"maxTxRate"`
+}
+
+var vfLinkStates = map[string]uint32{
+	"auto":    netlink.VF_LINK_STATE_AUTO,
+	"enable":  netlink.VF_LINK_STATE_ENABLE,
+	"disable": netlink.VF_LINK_STATE_DISABLE,
+}
+
+// validateVFConfig checks VF settings before anything touches the PF.
+func validateVFConfig(cfg *handler.VFConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.MAC != "" {
+		if _, err := net.ParseMAC(cfg.MAC); err != nil {
+			return fmt.Errorf("invalid VF MAC %q: %w", cfg.MAC, err)
+		}
+	}
+	if cfg.VLAN != nil && (*cfg.VLAN < 0 || *cfg.VLAN > 4095) {
+		return fmt.Errorf("VF VLAN %d out of range 0-4095", *cfg.VLAN)
+	}
+	if cfg.QoS < 0 || cfg.QoS > 7 {
+		return fmt.Errorf("VF QoS %d out of range 0-7", cfg.QoS)
+	}
+	if cfg.QoS > 0 && (cfg.VLAN == nil || *cfg.VLAN == 0) {
+		return fmt.Errorf("VF QoS requires a non-zero VLAN")
+	}
+	if cfg.VLANProto != "" {
+		if netlink.StringToVlanProtocol(strings.ToLower(cfg.VLANProto)) == netlink.VLAN_PROTOCOL_UNKNOWN {
+			return fmt.Errorf("unsupported VF VLAN protocol %q (use 802.1Q or 802.1ad)", cfg.VLANProto)
+		}
+		if cfg.VLAN == nil {
+			return fmt.Errorf("VF VLAN protocol requires a VLAN")
+		}
+	}
+	if _, ok := vfLinkStates[cfg.LinkState]; cfg.LinkState != "" && !ok {
+		return fmt.Errorf("unsupported VF link state %q (use auto, enable or disable)", cfg.LinkState)
+	}
+	if cfg.MinTxRate != nil && *cfg.MinTxRate < 0 {
+		return fmt.Errorf("VF min tx rate must not be negative")
+	}
+	if cfg.MaxTxRate != nil && *cfg.MaxTxRate < 0 {
+		return fmt.Errorf("VF max tx rate must not be negative")
+	}
+	if cfg.MinTxRate != nil && cfg.MaxTxRate != nil && *cfg.MaxTxRate > 0 && *cfg.MinTxRate > *cfg.MaxTxRate {
+		return fmt.Errorf("VF min tx rate %d exceeds max tx rate %d", *cfg.MinTxRate, *cfg.MaxTxRate)
+	}
+	return nil
+}
+
+// vfSettingsFromInfo converts the kernel's view of a VF.
+func vfSettingsFromInfo(info netlink.VfInfo) vfSettings {
+	return vfSettings{
+		MAC:       info.Mac.String(),
+		VLAN:      info.Vlan,
+		QoS:       info.Qos,
+		VLANProto: info.VlanProto,
+		SpoofChk:  info.Spoofchk,
+		Trust:     info.Trust != 0,
+		LinkState: info.LinkState,
+		MinTxRate: int(info.MinTxRate),
+		MaxTxRate: int(info.MaxTxRate),
+	}
+}
+
+// with returns s overridden by the fields set in cfg.
+func (s vfSettings) with(cfg *handler.VFConfig) vfSettings {
+	if cfg == nil {
+		return s
+	}
+	if cfg.MAC != "" {
+		mac, _ := net.ParseMAC(cfg.MAC) // validated
+		s.MAC = mac.String()
+	}
+	if cfg.VLAN != nil {
+		s.VLAN = *cfg.VLAN
+		s.QoS = cfg.QoS
+		s.VLANProto = int(netlink.VLAN_PROTOCOL_8021Q)
+		if cfg.VLANProto != "" {
+			s.VLANProto = int(netlink.StringToVlanProtocol(strings.ToLower(cfg.VLANProto)))
+		}
+	}
+	if cfg.SpoofChk != nil {
+		s.SpoofChk = *cfg.SpoofChk
+	}
+	if cfg.Trust != nil {
+		s.Trust = *cfg.Trust
+	}
+	if cfg.LinkState != "" {
+		s.LinkState = vfLinkStates[cfg.LinkState]
+	}
+	if cfg.MinTxRate != nil {
+		s.MinTxRate = *cfg.MinTxRate
+	}
+	if cfg.MaxTxRate != nil {
+		s.MaxTxRate = *cfg.MaxTxRate
+	}
+	return s
+}
+
+// snapshotVF reads the current settings of VF index on pf.
+func snapshotVF(pf netlink.Link, index int) (vfSettings, error) {
+	for _, info := range pf.Attrs().Vfs {
+		if info.ID == index {
+			return vfSettingsFromInfo(info), nil
+		}
+	}
+	return vfSettings{}, fmt.Errorf("VF %d not reported by PF %s", index, pf.Attrs().Name)
+}
+
+// setVF changes the settings of VF index on pf from "from" to "to", only
+// touching what differs.  It keeps going after a failure so that a restore
+// puts back as much as it can.
+func setVF(pf netlink.Link, index int, from, to vfSettings) error {
+	var errs []error
+	fail := func(what string, err error) {
+		errs = append(errs, fmt.Errorf("%s: %w", what, err))
+	}
+
+	if to.MAC != from.MAC {
+		mac, err := net.ParseMAC(to.MAC)
+		if err == nil {
+			err = netlink.LinkSetVfHardwareAddr(pf, index, mac)
+		}
+		if err != nil {
+			fail("mac "+to.MAC, err)
+		}
+	}
+	if to.VLAN != from.VLAN || to.QoS != from.QoS || to.VLANProto != from.VLANProto {
+		var err error
+		if to.VLANProto == int(netlink.VLAN_PROTOCOL_8021AD) {
+			err = netlink.LinkSetVfVlanQosProto(pf, index, to.VLAN, to.QoS, to.VLANProto)
+		} else {
+			// Not every PF driver accepts the proto attribute; 802.1Q is the default.
+			err = netlink.LinkSetVfVlanQos(pf, index, to.VLAN, to.QoS)
+		}
+		if err != nil {
+			fail(fmt.Sprintf("vlan %d qos %d", to.VLAN, to.QoS), err)
+		}
+	}
+	if to.SpoofChk != from.SpoofChk {
+		if err := netlink.LinkSetVfSpoofchk(pf, index, to.SpoofChk); err != nil {
+			fail("spoofchk", err)
+		}
+	}
+	if to.Trust != from.Trust {
+		if err := netlink.LinkSetVfTrust(pf, index, to.Trust); err != nil {
+			fail("trust", err)
+		}
+	}
+	if to.LinkState != from.LinkState {
+		if err := netlink.LinkSetVfState(pf, index, to.LinkState); err != nil {
+			fail("link state", err)
+		}
+	}
+	if to.MinTxRate != from.MinTxRate || to.MaxTxRate != from.MaxTxRate {
+		if err := netlink.LinkSetVfRate(pf, index, to.MinTxRate, to.MaxTxRate); err != nil {
+			fail(fmt.Sprintf("tx rate %d-%d Mb/s", to.MinTxRate, to.MaxTxRate), err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("VF %d on %s: %v", index, pf.Attrs().Name, errs)
+	}
+	return nil
+}
+
+// encodeVFSettings stores settings in allocation metadata.
+func encodeVFSettings(s vfSettings) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// decodeVFSettings reads settings stored by encodeVFSettings.
+func decodeVFSettings(data string) (vfSettings, error) {
+	var s vfSettings
+	err := json.Unmarshal([]byte(data), &s)
+	return s, err
+}
+
+// lookupVF returns the PF interface and VF index of a VF netdev.
+func lookupVF(vfName string) (pf string, index int, err error) {
+	deviceDir := filepath.Join(netSysfsRoot, vfName, "device")
+	pfNet, err := os.ReadDir(filepath.Join(deviceDir, "physfn", "net"))
+	if err != nil || len(pfNet) == 0 {
+		return "", -1, fmt.Errorf("no PF found for VF %s: %v", vfName, err)
+	}
+
+	vfDevice, err := os.Readlink(deviceDir)
+	if err != nil {
+		return "", -1, fmt.Errorf("resolve PCI device of VF %s: %w", vfName, err)
+	}
+	links, _ := filepath.Glob(filepath.Join(deviceDir, "physfn", "virtfn*"))
+	for _, link := range links {
+		target, err := os.Readlink(link)
+		if err != nil || filepath.Base(target) != filepath.Base(vfDevice) {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(link), "virtfn"))
+		if err != nil {
+			break
+		}
+		return pfNet[0].Name(), index, nil
+	}
+	return "", -1, fmt.Errorf("VF %s not listed by its PF %s", vfName, pfNet[0].Name())
+}
@@ -0,0 +1,136 @@
+package netdev
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+)
+
+// VFModeVFIO hands a VF to the container as a vfio-pci userspace device
+// (e.g. for DPDK) instead of a kernel netdev.
+const VFModeVFIO = "vfio"
+
+const vfioDriver = "vfio-pci"
+
+// Sysfs and devfs roots; variables so tests can point them at a fake tree.
+var (
+	netSysfsRoot = "/sys/class/net"
+	pciSysfsRoot = "/sys/bus/pci"
+	vfioDevDir   = "/dev/vfio"
+)
+
+// vfioBinding records what bindVFIO changed so unbindVFIO can undo it.
+type vfioBinding struct {
+	PCIAddress     string
+	OriginalDriver string // "" if the VF had no driver
+	IOMMUGroup     string
+}
+
+// bindVFIO moves the PCI function at pciAddr from its kernel driver to
+// vfio-pci using driver_override.
+func bindVFIO(pciAddr string) (*vfioBinding, error) {
+	deviceDir := filepath.Join(pciSysfsRoot, "devices", pciAddr)
+
+	b := &vfioBinding{PCIAddress: pciAddr}
+	if target, err := os.Readlink(filepath.Join(deviceDir, "driver")); err == nil {
+		b.OriginalDriver = filepath.Base(target)
+	}
+
+	group, err := os.Readlink(filepath.Join(deviceDir, "iommu_group"))
+	if err != nil {
+		return nil, fmt.Errorf("%s has no IOMMU group (is the IOMMU enabled?): %w", pciAddr, err)
+	}
+	b.IOMMUGroup = filepath.Base(group)
+
+	if b.OriginalDriver == vfioDriver {
+		return b, nil
+	}
+
+	if err := writeSysfs(filepath.Join(deviceDir, "driver_override"), vfioDriver); err != nil {
+		return nil, err
+	}
+	if b.OriginalDriver != "" {
+		if err := writeSysfs(filepath.Join(deviceDir, "driver", "unbind"), pciAddr); err != nil {
+			writeSysfs(filepath.Join(deviceDir, "driver_override"), "\n")
+			return nil, err
+		}
+	}
+	if err := writeSysfs(filepath.Join(pciSysfsRoot, "drivers_probe"), pciAddr); err != nil {
+		unbindVFIO(b)
+		return nil, err
+	}
+
+	klog.Infof("Bound %s to %s (was %q, iommu group %s)", pciAddr, vfioDriver, b.OriginalDriver, b.IOMMUGroup)
+	return b, nil
+}
+
+// unbindVFIO releases the PCI function from vfio-pci and gives it back to
+// its original driver.
+func unbindVFIO(b *vfioBinding) error {
+	deviceDir := filepath.Join(pciSysfsRoot, "devices", b.PCIAddress)
+
+	if b.OriginalDriver == vfioDriver {
+		return nil
+	}
+
+	// Clearing driver_override takes a lone newline.
+	if err := writeSysfs(filepath.Join(deviceDir, "driver_override"), "\n"); err != nil {
+		return err
+	}
+	if target, err := os.Readlink(filepath.Join(deviceDir, "driver")); err == nil && filepath.Base(target) == vfioDriver {
+		if err := writeSysfs(filepath.Join(deviceDir, "driver", "unbind"), b.PCIAddress); err != nil {
+			return err
+		}
+	}
+	if b.OriginalDriver != "" {
+		bind := filepath.Join(pciSysfsRoot, "drivers", b.OriginalDriver, "bind")
+		if err := writeSysfs(bind, b.PCIAddress); err != nil {
+			return err
+		}
+	}
+
+	klog.Infof("Returned %s to driver %q", b.PCIAddress, b.OriginalDriver)
+	return nil
+}
+
+// vfioEdits exposes the VFIO container and group devices and passes the
+// PCI address to the container as PCIDEVICE_<NAME>.
+func vfioEdits(b *vfioBinding, name string) *cdispec.ContainerEdits {
+	groupPath := filepath.Join(vfioDevDir, b.IOMMUGroup)
+	containerPath := filepath.Join(vfioDevDir, "vfio")
+	return &cdispec.ContainerEdits{
+		DeviceNodes: []*cdispec.DeviceNode{
+			{Path: containerPath, HostPath: containerPath, Permissions: "rw"},
+			{Path: groupPath, HostPath: groupPath, Permissions: "rw"},
+		},
+		Env: []string{fmt.Sprintf("%s=%s", pciAddressEnv(name), b.PCIAddress)},
+	}
+}
+
+// pciAddressEnv returns the environment variable carrying the PCI address
+// of the VF the claim named name.
+func pciAddressEnv(name string) string {
+	return "PCIDEVICE_" + strings.ToUpper(invalidEnvChars.Replace(name))
+}
+
+var invalidEnvChars = strings.NewReplacer("-", "_", ".", "_", "/", "_", ":", "_")
+
+func writeSysfs(path, value string) error {
+	if err := os.WriteFile(path, []byte(value), 0200); err != nil {
+		return fmt.Errorf("write %q to %s: %w", strings.TrimSpace(value), path, err)
+	}
+	return nil
+}
+
+// netdevPCIAddress returns the PCI address behind a netdev, or "".
+func netdevPCIAddress(name string) string {
+	target, err := os.Readlink(filepath.Join(netSysfsRoot, name, "device"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
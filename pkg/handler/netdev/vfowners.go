@@ -0,0 +1,141 @@
+package netdev
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// vfOwners records which claim holds each VF, per PF.  A VF that has moved
+// into a pod netns no longer shows up on the host, and one that is being
+// prepared still does, so sysfs alone cannot tell whether a VF is free.
+//
+// The zero value is ready to use.  Thread-safe.
+type vfOwners struct {
+	mu     sync.Mutex
+	owners map[string]map[int]string // PF → VF index → claim UID
+}
+
+// reserve marks VF index on pf as held by claimUID.  Reserving a VF the
+// claim already holds succeeds.
+func (o *vfOwners) reserve(pf string, index int, claimUID string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.reserveLocked(pf, index, claimUID)
+}
+
+func (o *vfOwners) reserveLocked(pf string, index int, claimUID string) error {
+	if owner, ok := o.owners[pf][index]; ok && owner != claimUID {
+		return fmt.Errorf("VF %d on PF %s is already held by claim %s", index, pf, owner)
+	}
+	if o.owners == nil {
+		o.owners = make(map[string]map[int]string)
+	}
+	if o.owners[pf] == nil {
+		o.owners[pf] = make(map[int]string)
+	}
+	o.owners[pf][index] = claimUID
+	return nil
+}
+
+// reserveFree picks a VF of pf that no claim holds and that has a netdev on
+// the host, and reserves it.  vfs maps VF index → netdev name ("" if the VF
+// has none).  If index is set, only that VF is considered.
+func (o *vfOwners) reserveFree(pf string, vfs map[int]string, index *int, claimUID string) (int, string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if index != nil {
+		name, ok := vfs[*index]
+		if !ok {
+			return -1, "", fmt.Errorf("VF index %d not found on PF %s", *index, pf)
+		}
+		if err := o.reserveLocked(pf, *index, claimUID); err != nil {
+			return -1, "", err
+		}
+		if name == "" {
+			delete(o.owners[pf], *index)
+			return -1, "", fmt.Errorf("VF %d on PF %s has no net device on the host (in use outside this driver?)", *index, pf)
+		}
+		return *index, name, nil
+	}
+
+	indices := make([]int, 0, len(vfs))
+	for i := range vfs {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	for _, i := range indices {
+		if _, held := o.owners[pf][i]; held || vfs[i] == "" {
+			continue
+		}
+		if err := o.reserveLocked(pf, i, claimUID); err != nil {
+			return -1, "", err
+		}
+		return i, vfs[i], nil
+	}
+	return -1, "", fmt.Errorf("no free VFs on PF %s", pf)
+}
+
+// release frees VF index on pf if claimUID holds it.
+func (o *vfOwners) release(pf string, index int, claimUID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.owners[pf][index] == claimUID {
+		delete(o.owners[pf], index)
+	}
+}
+
+// ifIdle runs fn while no claim holds a VF of pf, keeping new reservations
+// out until it returns.
+func (o *vfOwners) ifIdle(pf string, fn func()) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.owners[pf]) == 0 {
+		fn()
+	}
+}
+
+// owner returns the claim holding VF index on pf, or "".
+func (o *vfOwners) owner(pf string, index int) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.owners[pf][index]
+}
+
+// listVFs returns the VFs of a PF as VF index → host netdev name.  The name
+// is "" for VFs without a netdev in the host netns.
+func listVFs(pfName string) (map[int]string, error) {
+	pfDeviceDir := filepath.Join(netSysfsRoot, pfName, "device")
+	entries, err := os.ReadDir(pfDeviceDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PF device dir: %w", err)
+	}
+
+	vfs := make(map[int]string)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "virtfn") {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), "virtfn"))
+		if err != nil {
+			continue
+		}
+		vfs[index] = ""
+		netEntries, err := os.ReadDir(filepath.Join(pfDeviceDir, entry.Name(), "net"))
+		if err != nil {
+			klog.V(2).Infof("VF %d on PF %s has no host netdev: %v", index, pfName, err)
+			continue
+		}
+		if len(netEntries) > 0 {
+			vfs[index] = netEntries[0].Name()
+		}
+	}
+	return vfs, nil
+}
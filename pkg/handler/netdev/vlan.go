@@ -0,0 +1,181 @@
+package netdev
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+
+	"github.com/example/dra-poc/pkg/handler"
+	"github.com/example/dra-poc/pkg/nri"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+)
+
+// VlanHandler creates 802.1Q (or 802.1ad QinQ) sub-interfaces off a parent.
+//
+// The parent is taken from the allocated <parent>-vlan-pool device, so a CEL
+// selector on the pool's parent attribute picks it; netdev.parent is only
+// required when no pool device was allocated.
+//
+// When the claim consumed bandwidth from the parent's pool device, the link is
+// shaped to that rate once it is inside the pod netns.
+type VlanHandler struct {
+	// Links applies bandwidth shaping, addresses and routes after the link
+	// moved into the pod.  Nil disables shaping and rejects claims that ask
+	// for addresses or routes.
+	Links *nri.LinkSetupTracker
+}
+
+func (h *VlanHandler) Type() handler.DeviceType { return handler.DeviceTypeNetdev }
+func (h *VlanHandler) Kinds() []string          { return []string{"vlan"} }
+func (h *VlanHandler) Virtual() bool            { return true }
+
+// Restore registers the pod-side setups of a persisted allocation again.
+func (h *VlanHandler) Restore(alloc *handler.AllocationInfo) {
+	restoreLinkSetups(h.Links, nil, alloc)
+}
+
+func (h *VlanHandler) Validate(_ context.Context, cfg *handler.DeviceConfig) error {
+	if cfg.Netdev == nil {
+		return fmt.Errorf("netdev config is required for vlan")
+	}
+	if err := rejectEthtool(cfg.Netdev, "vlan"); err != nil {
+		return err
+	}
+	vlan := cfg.Netdev.VLAN
+	if vlan == nil {
+		return fmt.Errorf("netdev.vlan is required for vlan")
+	}
+	if vlan.ID < 1 || vlan.ID > 4094 {
+		return fmt.Errorf("VLAN ID %d out of range 1-4094", vlan.ID)
+	}
+	if _, err := vlanProtocol(vlan.Protocol); err != nil {
+		return err
+	}
+	for prio, pcp := range vlan.EgressQoS {
+		if pcp > 7 {
+			return fmt.Errorf("egress QoS map: priority %d maps to %d, want 0-7", prio, pcp)
+		}
+	}
+	for pcp := range vlan.IngressQoS {
+		if pcp > 7 {
+			return fmt.Errorf("ingress QoS map: %d is not an 802.1p priority (0-7)", pcp)
+		}
+	}
+	// The parent may come from the allocated pool device instead, so an
+	// empty parent is checked in Prepare.
+	return validateLinkConfig(cfg.Netdev, h.Links)
+}
+
+// vlanProtocol parses a VLAN protocol name; "" means 802.1Q.
+func vlanProtocol(name string) (netlink.VlanProtocol, error) {
+	if name == "" {
+		return netlink.VLAN_PROTOCOL_8021Q, nil
+	}
+	proto := netlink.StringToVlanProtocol(strings.ToLower(name))
+	if proto == netlink.VLAN_PROTOCOL_UNKNOWN {
+		return proto, fmt.Errorf("unsupported VLAN protocol %q (use 802.1Q or 802.1ad)", name)
+	}
+	return proto, nil
+}
+
+func (h *VlanHandler) Prepare(_ context.Context, req *handler.PrepareRequest) (*handler.PrepareResult, error) {
+	cfg := req.Config.Netdev
+	if cfg == nil || cfg.VLAN == nil {
+		return nil, fmt.Errorf("netdev.vlan is required for vlan")
+	}
+	parent, err := resolveParent(req, "vlan")
+	if err != nil {
+		return nil, err
+	}
+	proto, err := vlanProtocol(cfg.VLAN.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	ifName := fmt.Sprintf("vl%s", req.NameSuffix())
+	containerName := cfg.InterfaceName
+	if containerName == "" {
+		containerName = "eth1"
+	}
+
+	parentLink, err := netlink.LinkByName(parent)
+	if err != nil {
+		return nil, fmt.Errorf("parent interface %s not found: %w", parent, err)
+	}
+
+	vlan := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        ifName,
+			ParentIndex: parentLink.Attrs().Index,
+		},
+		VlanId:        cfg.VLAN.ID,
+		VlanProtocol:  proto,
+		EgressQosMap:  cfg.VLAN.EgressQoS,
+		IngressQosMap: cfg.VLAN.IngressQoS,
+	}
+	if cfg.MTU > 0 {
+		vlan.LinkAttrs.MTU = cfg.MTU
+	}
+
+	if err := netlink.LinkAdd(vlan); err != nil {
+		return nil, fmt.Errorf("failed to create vlan interface %s: %w", ifName, err)
+	}
+	if err := netlink.LinkSetUp(vlan); err != nil {
+		netlink.LinkDel(vlan)
+		return nil, fmt.Errorf("failed to bring up vlan interface %s: %w", ifName, err)
+	}
+
+	klog.Infof("Created vlan interface %s (parent=%s, id=%d, protocol=%s)", ifName, parent, cfg.VLAN.ID, proto)
+
+	metadata := map[string]string{
+		"createdInterface": ifName,
+		"parent":           parent,
+		"containerName":    containerName,
+		"vlanID":           fmt.Sprintf("%d", cfg.VLAN.ID),
+		"vlanProtocol":     proto.String(),
+	}
+	if err := registerLinkConfig(h.Links, req, containerName, metadata); err != nil {
+		netlink.LinkDel(vlan)
+		return nil, err
+	}
+	registerShaping(h.Links, req, containerName, metadata)
+
+	return &handler.PrepareResult{
+		PoolName:   "default",
+		DeviceName: ifName,
+		CDIEdits: &cdispec.ContainerEdits{
+			NetDevices: []*cdispec.LinuxNetDevice{
+				{HostInterfaceName: ifName, Name: containerName},
+			},
+		},
+		Allocation: &handler.AllocationInfo{
+			Type: handler.DeviceTypeNetdev, Kind: "vlan",
+			ClaimUID: req.ClaimUID, DeviceName: ifName,
+			Metadata: metadata,
+		},
+	}, nil
+}
+
+func (h *VlanHandler) Unprepare(_ context.Context, req *handler.UnprepareRequest) error {
+	if h.Links != nil {
+		h.Links.Release(req.ClaimUID)
+	}
+
+	ifName := req.Allocation.Metadata["createdInterface"]
+	if ifName == "" {
+		return nil
+	}
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		klog.V(2).Infof("vlan interface %s already removed: %v", ifName, err)
+		return nil
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete vlan interface %s: %w", ifName, err)
+	}
+	klog.Infof("Deleted vlan interface %s", ifName)
+	return nil
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"fmt"
+	"sort"
 
 	"k8s.io/klog/v2"
 )
@@ -57,3 +58,16 @@ func (r *HandlerRegistry) ListRegistered() map[DeviceType][]string {
 	}
 	return result
 }
+
+// VirtualKinds returns the sorted netdev kinds whose handlers create devices
+// on demand (see VirtualHandler)
+func (r *HandlerRegistry) VirtualKinds() []string {
+	var kinds []string
+	for kind, h := range r.handlers[DeviceTypeNetdev] {
+		if v, ok := h.(VirtualHandler); ok && v.Virtual() {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds
+}
@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	cdispec "tags.cncf.io/container-device-interface/specs-go"
 )
 
@@ -15,6 +16,10 @@ const (
 	DeviceTypeCombo  DeviceType = "combo"
 )
 
+// CapacityBandwidth is the consumable capacity published on macvlan/ipvlan
+// parent pool devices, in bits per second.
+const CapacityBandwidth = "dra.example.com/bandwidth"
+
 // DeviceHandler manages a specific device type/kind.
 type DeviceHandler interface {
 	Type() DeviceType
@@ -24,6 +29,20 @@ type DeviceHandler interface {
 	Validate(ctx context.Context, cfg *DeviceConfig) error
 }
 
+// VirtualHandler is implemented by handlers whose devices are created on
+// demand for each claim instead of being discovered on the node.  The
+// publisher advertises one multi-allocatable slot pool per virtual kind.
+type VirtualHandler interface {
+	Virtual() bool
+}
+
+// RestoringHandler is implemented by handlers that keep in-memory state about
+// prepared devices.  The driver passes every allocation it loads from disk to
+// Restore so that state survives driver restarts.
+type RestoringHandler interface {
+	Restore(alloc *AllocationInfo)
+}
+
 // PrepareRequest contains information needed to prepare a device.
 type PrepareRequest struct {
 	ClaimUID        string
@@ -31,6 +50,37 @@ type PrepareRequest struct {
 	ClaimName       string
 	AllocatedDevice string
 	Config          *DeviceConfig
+
+	// AllocatedDevices lists every device the scheduler allocated to the
+	// claim from this driver, in result order.  AllocatedDevice is one of
+	// them; handlers that aggregate several devices (bond) use the rest.
+	AllocatedDevices []string
+
+	// ShareID identifies this claim's share of a multi-allocatable device.
+	// Empty for devices that are allocated exclusively.
+	ShareID string
+
+	// ConsumedCapacity is the capacity the scheduler charged to this claim on
+	// a multi-allocatable device, keyed by qualified capacity name.
+	ConsumedCapacity map[string]resource.Quantity
+}
+
+// NameSuffix returns the short identifier handlers embed in host-side names
+// (interfaces, IFBs).  Claims sharing a published device are distinguished
+// by their ShareID; exclusive allocations fall back to the claim UID.
+func (r *PrepareRequest) NameSuffix() string {
+	if r.ShareID != "" {
+		return ShortID(r.ShareID)
+	}
+	return ShortID(r.ClaimUID)
+}
+
+// ShortID returns the first 8 characters of a UID.
+func ShortID(uid string) string {
+	if len(uid) > 8 {
+		return uid[:8]
+	}
+	return uid
 }
 
 // PrepareResult contains the result of preparing a device.
@@ -54,6 +104,12 @@ type AllocationInfo struct {
 	ClaimUID   string            `json:"claimUID"`
 	DeviceName string            `json:"deviceName"`
 	Metadata   map[string]string `json:"metadata"`
+
+	// Identity of the scheduler's allocation result, filled in by the driver
+	// and returned to the kubelet.  Empty when the claim had no allocation.
+	PoolName        string `json:"poolName,omitempty"`
+	AllocatedDevice string `json:"allocatedDevice,omitempty"`
+	ShareID         string `json:"shareID,omitempty"`
 }
 
 // DeviceConfig holds the parsed configuration from ResourceClaim opaque parameters.
@@ -71,9 +127,200 @@ type NetdevConfig struct {
 	MTU           int    `json:"mtu,omitempty"`
 	Parent        string `json:"parent,omitempty"`
 	Mode          string `json:"mode,omitempty"`
-	VFIndex       int    `json:"vfIndex,omitempty"`
+	VFIndex       *int   `json:"vfIndex,omitempty"`    // sriov-vf: VF to take from Parent (default: any free VF)
 	HostDevice    string `json:"hostDevice,omitempty"` // host-device: name of a pre-existing interface to move into the pod
 	Pkey          int    `json:"pkey,omitempty"`       // ipoib: partition key (e.g. 0x8001)
+
+	// VF holds sriov-vf settings applied through the PF.
+	VF *VFConfig `json:"vf,omitempty"`
+
+	// Ethtool holds ring, channel, coalescing and offload settings applied
+	// before the link moves into the pod.
+	Ethtool *EthtoolConfig `json:"ethtool,omitempty"`
+
+	// Representor configures the host-side representor of a sriov-vf whose
+	// PF is in switchdev mode.
+	Representor *RepresentorConfig `json:"representor,omitempty"`
+
+	// SF holds settings for sf (scalable function) devices.
+	SF *SFConfig `json:"sf,omitempty"`
+
+	// VLAN holds settings for vlan sub-interfaces.
+	VLAN *VLANConfig `json:"vlan,omitempty"`
+
+	// Tunnel holds settings for vxlan and geneve devices.
+	Tunnel *TunnelConfig `json:"tunnel,omitempty"`
+
+	// Bond holds settings for bond devices.
+	Bond *BondConfig `json:"bond,omitempty"`
+
+	// Bridge attaches the host end of a veth pair to a Linux bridge.
+	Bridge *BridgeConfig `json:"bridge,omitempty"`
+
+	// OVS plugs the host end of a veth pair into an Open vSwitch bridge.
+	OVS *OVSConfig `json:"ovs,omitempty"`
+
+	// Settings applied to the link once it is in the pod netns.
+	Addresses []string       `json:"addresses,omitempty"` // CIDRs, e.g. 192.0.2.10/24 or 2001:db8::10/64
+	Gateways  []string       `json:"gateways,omitempty"`  // Default gateways, at most one per address family
+	Routes    []RouteConfig  `json:"routes,omitempty"`    // Static routes through the link
+	MAC       string         `json:"mac,omitempty"`       // MAC address of the pod-side link
+	MACPolicy string         `json:"macPolicy,omitempty"` // "static" (default: use mac), "stable" (from namespace/claim name) or "pool"
+	State     string         `json:"state,omitempty"`     // "up" or "down" (default: up if addresses, routes or a MAC are set)
+	Routing   *RoutingConfig `json:"routing,omitempty"`   // Policy routing for multi-homed pods
+
+	// Sysctls are set under net.ipv4.conf.<ifname> and net.ipv6.conf.<ifname>
+	// in the pod netns, keyed by family and name, e.g. "ipv4.rp_filter": "0"
+	// or "ipv6.accept_ra": "0".  The driver only accepts those on its
+	// allow-list.
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+
+	// IPAM leases addresses from ranges defined in the driver config.
+	IPAM *IPAMConfig `json:"ipam,omitempty"`
+}
+
+// IPAMConfig selects where the link's addresses come from.
+//
+// In host-local mode (the default) it names the driver-configured ranges to
+// lease addresses from.  Each lease is added to Addresses, and its range's
+// gateway to Gateways unless one is already given for that address family.
+//
+// In dhcp mode the driver runs DHCP clients for the claim on the link inside
+// the pod netns instead.
+type IPAMConfig struct {
+	Mode   string      `json:"mode,omitempty"`   // "host-local" (default) or "dhcp"
+	Ranges []string    `json:"ranges,omitempty"` // One range per address, e.g. ["data-v4", "data-v6"]
+	DHCP   *DHCPConfig `json:"dhcp,omitempty"`   // DHCP client settings in dhcp mode
+}
+
+// IPAM modes.
+const (
+	IPAMModeHostLocal = "host-local"
+	IPAMModeDHCP      = "dhcp"
+)
+
+// DHCPConfig selects the DHCP clients run for a claim.
+type DHCPConfig struct {
+	IPv4     *bool  `json:"ipv4,omitempty"`     // Run a DHCPv4 client (default: true)
+	IPv6     bool   `json:"ipv6,omitempty"`     // Run a DHCPv6 client for an IA_NA address
+	Hostname string `json:"hostname,omitempty"` // Sent to the DHCPv4 server
+}
+
+// RouteConfig is a static route through the claim's link.  Without Via the
+// destination is directly reachable on the link.
+type RouteConfig struct {
+	Dst    string `json:"dst"`              // Destination CIDR
+	Via    string `json:"via,omitempty"`    // Next hop
+	Metric int    `json:"metric,omitempty"` // Route priority, lower wins
+}
+
+// RoutingConfig keeps a link's traffic apart from the pod's other
+// interfaces, so that replies leave by the interface they arrived on.
+type RoutingConfig struct {
+	// Table receives the link's gateways, routes and subnet routes instead
+	// of the main table.  Rules select it for traffic from the link's
+	// addresses.
+	Table int `json:"table,omitempty"`
+	// RulePriority of the source rules (default: 100).
+	RulePriority int `json:"rulePriority,omitempty"`
+	// DefaultRoute makes the link the pod's default route in the main
+	// table: via its gateways, or directly on the link without any.
+	DefaultRoute bool `json:"defaultRoute,omitempty"`
+	// VRF is the name of a VRF device, bound to Table, that is created in the
+	// pod and enslaves the link.  It replaces the source rules.
+	VRF string `json:"vrf,omitempty"`
+}
+
+// VFConfig holds SR-IOV VF settings that are applied on the PF.  Unset fields
+// leave the VF's current setting alone.
+type VFConfig struct {
+	MAC       string `json:"mac,omitempty"`
+	VLAN      *int   `json:"vlan,omitempty"`      // 0-4095, 0 = untagged
+	QoS       int    `json:"qos,omitempty"`       // 802.1p priority 0-7, requires a VLAN
+	VLANProto string `json:"vlanProto,omitempty"` // "802.1Q" (default) or "802.1ad"
+	SpoofChk  *bool  `json:"spoofChk,omitempty"`
+	Trust     *bool  `json:"trust,omitempty"`
+	LinkState string `json:"linkState,omitempty"` // "auto", "enable" or "disable"
+	MinTxRate *int   `json:"minTxRate,omitempty"` // Mb/s, 0 = no guarantee
+	MaxTxRate *int   `json:"maxTxRate,omitempty"` // Mb/s, 0 = unlimited
+}
+
+// EthtoolConfig holds ethtool settings for a netdev.  Unset fields leave the
+// current setting alone.  Devices the driver did not create, such as VFs
+// and host devices, get their original settings back on Unprepare.
+type EthtoolConfig struct {
+	Rings    *EthtoolRings    `json:"rings,omitempty"`
+	Channels *EthtoolChannels `json:"channels,omitempty"`
+	Coalesce *EthtoolCoalesce `json:"coalesce,omitempty"`
+	// Features turns offloads on or off, by their ethtool -K short names
+	// (e.g. gro, lro, tso) or kernel names (e.g. rx-vlan-filter).
+	Features map[string]bool `json:"features,omitempty"`
+}
+
+// EthtoolRings holds descriptor ring sizes.
+type EthtoolRings struct {
+	RX *int `json:"rx,omitempty"`
+	TX *int `json:"tx,omitempty"`
+}
+
+// EthtoolChannels holds queue counts.
+type EthtoolChannels struct {
+	RX       *int `json:"rx,omitempty"`
+	TX       *int `json:"tx,omitempty"`
+	Other    *int `json:"other,omitempty"`
+	Combined *int `json:"combined,omitempty"`
+}
+
+// EthtoolCoalesce holds interrupt coalescing settings.
+type EthtoolCoalesce struct {
+	RXUsecs    *int  `json:"rxUsecs,omitempty"`
+	RXFrames   *int  `json:"rxFrames,omitempty"`
+	TXUsecs    *int  `json:"txUsecs,omitempty"`
+	TXFrames   *int  `json:"txFrames,omitempty"`
+	AdaptiveRX *bool `json:"adaptiveRx,omitempty"`
+	AdaptiveTX *bool `json:"adaptiveTx,omitempty"`
+}
+
+// RepresentorConfig holds settings for the VF representor netdev, which
+// stays on the host when the VF moves into the pod.
+type RepresentorConfig struct {
+	Bridge string     `json:"bridge,omitempty"` // Linux bridge to attach the representor to
+	OVS    *OVSConfig `json:"ovs,omitempty"`    // Open vSwitch bridge to plug the representor into, instead of bridge
+}
+
+// SFConfig holds settings for a scalable function created on the parent PF.
+type SFConfig struct {
+	Number *uint32 `json:"number,omitempty"` // SF number on the PF (default: derived from the claim)
+	MAC    string  `json:"mac,omitempty"`    // Port function MAC address
+}
+
+// VLANConfig holds settings for a VLAN sub-interface of the parent.
+type VLANConfig struct {
+	ID         int               `json:"id"`                   // 1-4094
+	Protocol   string            `json:"protocol,omitempty"`   // "802.1Q" (default) or "802.1ad" for QinQ
+	EgressQoS  map[uint32]uint32 `json:"egressQoS,omitempty"`  // skb priority → 802.1p priority (0-7)
+	IngressQoS map[uint32]uint32 `json:"ingressQoS,omitempty"` // 802.1p priority (0-7) → skb priority
+}
+
+// TunnelConfig holds settings for an overlay tunnel device.  Fields marked
+// vxlan are rejected for geneve.  The underlay device of a vxlan tunnel is
+// netdev.parent.
+type TunnelConfig struct {
+	VNI      uint32     `json:"vni"`                // 24-bit network identifier
+	Remote   string     `json:"remote,omitempty"`   // Unicast peer address
+	Group    string     `json:"group,omitempty"`    // vxlan: multicast group, instead of remote
+	Local    string     `json:"local,omitempty"`    // vxlan: source address
+	DstPort  int        `json:"dstPort,omitempty"`  // UDP port (default 4789 for vxlan, 6081 for geneve)
+	Learning *bool      `json:"learning,omitempty"` // vxlan: learn remote MACs from traffic (default true)
+	TTL      int        `json:"ttl,omitempty"`      // Outer TTL, 0 = kernel default
+	FDB      []FDBEntry `json:"fdb,omitempty"`      // vxlan: static forwarding entries
+}
+
+// FDBEntry is a static vxlan forwarding entry sending traffic for MAC to the
+// peer at Dst.
+type FDBEntry struct {
+	MAC string `json:"mac,omitempty"` // Default 00:00:00:00:00:00: flood to the peer
+	Dst string `json:"dst"`
 }
 
 // RDMAConfig holds RDMA device specific configuration.
@@ -101,3 +348,33 @@ func (c *DeviceConfig) GetKind() string {
 	}
 	return ""
 }
+
+// BondConfig holds settings for a bond aggregating the claim's allocated
+// netdevs and any listed host interfaces.
+type BondConfig struct {
+	Mode           string   `json:"mode,omitempty"`           // Bonding mode (default active-backup)
+	Miimon         *int     `json:"miimon,omitempty"`         // Link monitoring interval in ms (default 100)
+	XmitHashPolicy string   `json:"xmitHashPolicy,omitempty"` // balance-xor, 802.3ad and balance-tlb only
+	Members        []string `json:"members,omitempty"`        // Additional host interfaces to enslave
+}
+
+// BridgeConfig attaches a host-side port to a Linux bridge, which is created
+// if it does not exist.  PVID and VLANs require a VLAN-filtering bridge.
+type BridgeConfig struct {
+	Name         string `json:"name"`
+	PVID         int    `json:"pvid,omitempty"`         // Untagged VLAN of the port (default: the bridge's default PVID)
+	VLANs        []int  `json:"vlans,omitempty"`        // Tagged VLANs of the port
+	Hairpin      bool   `json:"hairpin,omitempty"`      // Send frames back out the port they came in on
+	Isolated     bool   `json:"isolated,omitempty"`     // Only forward to non-isolated ports
+	DeleteUnused bool   `json:"deleteUnused,omitempty"` // Delete a driver-created bridge once its last port is gone
+}
+
+// OVSConfig plugs a host-side port into an Open vSwitch bridge.  The port
+// and its interface carry the claim's identity in external_ids.
+type OVSConfig struct {
+	Bridge        string            `json:"bridge"`
+	InterfaceType string            `json:"interfaceType,omitempty"` // OVS interface type (default: system)
+	Tag           int               `json:"tag,omitempty"`           // Access VLAN 1-4094, 0 = untagged
+	Trunks        []int             `json:"trunks,omitempty"`        // Trunked VLANs, instead of tag
+	ExternalIDs   map[string]string `json:"externalIDs,omitempty"`   // Extra external_ids, e.g. iface-id for OVN
+}
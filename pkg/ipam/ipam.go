@@ -0,0 +1,273 @@
+// Package ipam hands out addresses from named, node-local ranges, in the
+// spirit of the host-local CNI plugin.  Leases are held in memory; the
+// driver persists them with each claim's allocation state and restores them
+// when it starts.
+//
+// Pools describe cluster-scoped address space instead: the driver's
+// controller mode publishes their addresses as devices, so the scheduler
+// keeps them unique across nodes.
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// Config is the IPAM section of the driver configuration.
+type Config struct {
+	Ranges []Range `json:"ranges"`
+}
+
+// Range is a named block of addresses within a subnet.
+type Range struct {
+	Name       string   `json:"name"`
+	Subnet     string   `json:"subnet"`               // CIDR, e.g. 10.10.0.0/24
+	RangeStart string   `json:"rangeStart,omitempty"` // First address to hand out (default: first host address)
+	RangeEnd   string   `json:"rangeEnd,omitempty"`   // Last address to hand out (default: last host address)
+	Gateway    string   `json:"gateway,omitempty"`    // Default gateway for leases; never handed out
+	Exclude    []string `json:"exclude,omitempty"`    // Addresses or CIDRs never handed out
+}
+
+// Lease is an address held by a claim.
+type Lease struct {
+	Range   string `json:"range"`
+	Address string `json:"address"`           // Address with the subnet's prefix length, e.g. 10.10.0.5/24
+	Gateway string `json:"gateway,omitempty"` // The range's gateway
+}
+
+// LoadConfig reads a JSON configuration file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read IPAM config: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse IPAM config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// pool is a parsed range and the addresses leased from it.
+type pool struct {
+	subnet     netip.Prefix
+	start, end netip.Addr
+	gateway    netip.Addr
+	exclude    []netip.Prefix
+	leased     map[netip.Addr]string // address → claim UID
+	last       netip.Addr            // last address handed out
+}
+
+// Allocator hands out addresses from a fixed set of ranges.  Thread-safe.
+type Allocator struct {
+	mu    sync.Mutex
+	pools map[string]*pool
+}
+
+// New validates cfg and returns an allocator for its ranges.
+func New(cfg *Config) (*Allocator, error) {
+	a := &Allocator{pools: make(map[string]*pool)}
+	for _, r := range cfg.Ranges {
+		if r.Name == "" {
+			return nil, fmt.Errorf("IPAM range for %s has no name", r.Subnet)
+		}
+		if _, ok := a.pools[r.Name]; ok {
+			return nil, fmt.Errorf("IPAM range %s defined twice", r.Name)
+		}
+		p, err := parseRange(r)
+		if err != nil {
+			return nil, fmt.Errorf("IPAM range %s: %w", r.Name, err)
+		}
+		a.pools[r.Name] = p
+	}
+	return a, nil
+}
+
+func parseRange(r Range) (*pool, error) {
+	subnet, err := netip.ParsePrefix(r.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet: %w", err)
+	}
+	subnet = subnet.Masked()
+	p := &pool{subnet: subnet, leased: make(map[netip.Addr]string)}
+
+	// Skip the network address, and the broadcast address of IPv4 subnets.
+	// Point-to-point (/31) and single-address subnets have neither.
+	p.start, p.end = subnet.Addr().Next(), lastAddr(subnet)
+	switch {
+	case subnet.IsSingleIP() || (subnet.Addr().Is4() && subnet.Bits() == 31):
+		p.start = subnet.Addr()
+	case subnet.Addr().Is4():
+		p.end = p.end.Prev()
+	}
+	if r.RangeStart != "" {
+		if p.start, err = addrIn(subnet, r.RangeStart, "rangeStart"); err != nil {
+			return nil, err
+		}
+	}
+	if r.RangeEnd != "" {
+		if p.end, err = addrIn(subnet, r.RangeEnd, "rangeEnd"); err != nil {
+			return nil, err
+		}
+	}
+	if !p.start.IsValid() || !p.end.IsValid() || p.end.Less(p.start) {
+		return nil, fmt.Errorf("range %s-%s is empty", p.start, p.end)
+	}
+	if r.Gateway != "" {
+		if p.gateway, err = addrIn(subnet, r.Gateway, "gateway"); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range r.Exclude {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(s)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid exclude entry %q", s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		p.exclude = append(p.exclude, prefix.Masked())
+	}
+	return p, nil
+}
+
+func addrIn(subnet netip.Prefix, s, field string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return addr, fmt.Errorf("invalid %s: %w", field, err)
+	}
+	if !subnet.Contains(addr) {
+		return addr, fmt.Errorf("%s %s is outside subnet %s", field, addr, subnet)
+	}
+	return addr, nil
+}
+
+// lastAddr returns the highest address of prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// usable reports whether addr may be handed out at all.
+func (p *pool) usable(addr netip.Addr) bool {
+	if addr == p.gateway {
+		return false
+	}
+	for _, e := range p.exclude {
+		if e.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *pool) lease(addr netip.Addr, name string) Lease {
+	l := Lease{Range: name, Address: netip.PrefixFrom(addr, p.subnet.Bits()).String()}
+	if p.gateway.IsValid() {
+		l.Gateway = p.gateway.String()
+	}
+	return l
+}
+
+// HasRange reports whether a range named name is configured.
+func (a *Allocator) HasRange(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.pools[name]
+	return ok
+}
+
+// Allocate leases an address from the named range to claimUID.  A claim
+// that already holds an address in the range gets the same one back.
+// Addresses are handed out round-robin, so a released address is not
+// reused right away.
+func (a *Allocator) Allocate(claimUID, rangeName string) (Lease, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	p, ok := a.pools[rangeName]
+	if !ok {
+		return Lease{}, fmt.Errorf("unknown IPAM range %q", rangeName)
+	}
+	for addr, owner := range p.leased {
+		if owner == claimUID {
+			return p.lease(addr, rangeName), nil
+		}
+	}
+
+	addr := p.start
+	if p.last.IsValid() && p.last.Less(p.end) && !p.last.Less(p.start) {
+		addr = p.last.Next()
+	}
+	first := addr
+	for {
+		if _, taken := p.leased[addr]; !taken && p.usable(addr) {
+			p.leased[addr] = claimUID
+			p.last = addr
+			klog.Infof("Leased %s from IPAM range %s to claim %s", addr, rangeName, claimUID)
+			return p.lease(addr, rangeName), nil
+		}
+		if addr == p.end {
+			addr = p.start
+		} else {
+			addr = addr.Next()
+		}
+		if addr == first {
+			return Lease{}, fmt.Errorf("IPAM range %s is exhausted", rangeName)
+		}
+	}
+}
+
+// Release returns every address held by claimUID.
+func (a *Allocator) Release(claimUID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name, p := range a.pools {
+		for addr, owner := range p.leased {
+			if owner == claimUID {
+				delete(p.leased, addr)
+				klog.Infof("Released %s in IPAM range %s from claim %s", addr, name, claimUID)
+			}
+		}
+	}
+}
+
+// Restore re-leases addresses recorded for claimUID, e.g. in allocation
+// state persisted before a restart.  Leases whose range is no longer
+// configured, or whose address now falls outside it or is held by another
+// claim, are dropped with a warning.
+func (a *Allocator) Restore(claimUID string, leases []Lease) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, l := range leases {
+		p, ok := a.pools[l.Range]
+		if !ok {
+			klog.Warningf("Claim %s holds %s in IPAM range %s, which is no longer configured", claimUID, l.Address, l.Range)
+			continue
+		}
+		prefix, err := netip.ParsePrefix(l.Address)
+		if err != nil || !p.subnet.Contains(prefix.Addr()) {
+			klog.Warningf("Claim %s holds %s, which is not in IPAM range %s (%s)", claimUID, l.Address, l.Range, p.subnet)
+			continue
+		}
+		addr := prefix.Addr()
+		if owner, taken := p.leased[addr]; taken && owner != claimUID {
+			klog.Warningf("Claims %s and %s both hold %s in IPAM range %s", owner, claimUID, addr, l.Range)
+			continue
+		}
+		p.leased[addr] = claimUID
+		if !p.last.IsValid() || p.last.Less(addr) {
+			p.last = addr
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package ipam
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newAllocator(t *testing.T, ranges ...Range) *Allocator {
+	t.Helper()
+	a, err := New(&Config{Ranges: ranges})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return a
+}
+
+func TestNew_Validation(t *testing.T) {
+	tests := []struct {
+		name    string
+		r       Range
+		wantErr bool
+	}{
+		{"subnet only", Range{Name: "a", Subnet: "10.0.0.0/24"}, false},
+		{"ipv6", Range{Name: "a", Subnet: "2001:db8::/64", Gateway: "2001:db8::1"}, false},
+		{"full", Range{Name: "a", Subnet: "10.0.0.0/24", RangeStart: "10.0.0.10", RangeEnd: "10.0.0.20", Gateway: "10.0.0.1", Exclude: []string{"10.0.0.15", "10.0.0.16/31"}}, false},
+		{"no name", Range{Subnet: "10.0.0.0/24"}, true},
+		{"bad subnet", Range{Name: "a", Subnet: "10.0.0.0"}, true},
+		{"start outside", Range{Name: "a", Subnet: "10.0.0.0/24", RangeStart: "10.0.1.1"}, true},
+		{"end before start", Range{Name: "a", Subnet: "10.0.0.0/24", RangeStart: "10.0.0.20", RangeEnd: "10.0.0.10"}, true},
+		{"gateway outside", Range{Name: "a", Subnet: "10.0.0.0/24", Gateway: "10.0.1.1"}, true},
+		{"bad exclude", Range{Name: "a", Subnet: "10.0.0.0/24", Exclude: []string{"ten"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(&Config{Ranges: []Range{tt.r}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	dup := Range{Name: "a", Subnet: "10.0.0.0/24"}
+	if _, err := New(&Config{Ranges: []Range{dup, dup}}); err == nil {
+		t.Error("expected error for a range defined twice")
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	a := newAllocator(t, Range{
+		Name:    "data",
+		Subnet:  "10.0.0.0/29",
+		Gateway: "10.0.0.1",
+		Exclude: []string{"10.0.0.3"},
+	})
+
+	// .0 is the network, .1 the gateway, .3 excluded and .7 the broadcast.
+	want := []string{"10.0.0.2/29", "10.0.0.4/29", "10.0.0.5/29", "10.0.0.6/29"}
+	for i, addr := range want {
+		lease, err := a.Allocate(string(rune('a'+i)), "data")
+		if err != nil {
+			t.Fatalf("Allocate %d: %v", i, err)
+		}
+		if lease.Address != addr || lease.Gateway != "10.0.0.1" || lease.Range != "data" {
+			t.Errorf("lease %d = %+v, want %s via 10.0.0.1", i, lease, addr)
+		}
+	}
+	if _, err := a.Allocate("e", "data"); err == nil {
+		t.Error("expected exhausted range")
+	}
+
+	// Allocating again for a claim returns its lease.
+	if lease, _ := a.Allocate("b", "data"); lease.Address != "10.0.0.4/29" {
+		t.Errorf("repeated Allocate = %s, want 10.0.0.4/29", lease.Address)
+	}
+
+	// Released addresses are reused once the range wraps around.
+	a.Release("b")
+	lease, err := a.Allocate("e", "data")
+	if err != nil || lease.Address != "10.0.0.4/29" {
+		t.Errorf("Allocate after release = %s, %v; want 10.0.0.4/29", lease.Address, err)
+	}
+
+	if _, err := a.Allocate("f", "missing"); err == nil {
+		t.Error("expected error for an unknown range")
+	}
+}
+
+func TestAllocate_RoundRobin(t *testing.T) {
+	a := newAllocator(t, Range{Name: "v6", Subnet: "2001:db8::/120", RangeStart: "2001:db8::10", RangeEnd: "2001:db8::12"})
+
+	first, _ := a.Allocate("a", "v6")
+	a.Release("a")
+	second, _ := a.Allocate("b", "v6")
+	if first.Address != "2001:db8::10/120" || second.Address != "2001:db8::11/120" {
+		t.Errorf("leases = %s, %s; want 2001:db8::10/120, 2001:db8::11/120", first.Address, second.Address)
+	}
+	if second.Gateway != "" {
+		t.Errorf("gateway = %q, want none", second.Gateway)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	a := newAllocator(t,
+		Range{Name: "data", Subnet: "10.0.0.0/29"},
+		Range{Name: "small", Subnet: "10.0.1.0/30"},
+	)
+
+	a.Restore("old", []Lease{
+		{Range: "data", Address: "10.0.0.1/29"},
+		{Range: "gone", Address: "10.9.0.1/24"},  // range no longer configured
+		{Range: "small", Address: "10.0.0.2/29"}, // outside the range's subnet
+	})
+	a.Restore("other", []Lease{{Range: "data", Address: "10.0.0.1/29"}}) // conflict
+
+	lease, err := a.Allocate("new", "data")
+	if err != nil || lease.Address != "10.0.0.2/29" {
+		t.Errorf("Allocate after Restore = %s, %v; want 10.0.0.2/29", lease.Address, err)
+	}
+	if lease, _ := a.Allocate("old", "data"); lease.Address != "10.0.0.1/29" {
+		t.Errorf("restored lease = %s, want 10.0.0.1/29", lease.Address)
+	}
+	if lease, _ := a.Allocate("other", "data"); lease.Address == "10.0.0.1/29" {
+		t.Error("conflicting restore should not share an address")
+	}
+
+	a.Release("old")
+	a.Release("new")
+	a.Release("other")
+	if lease, _ := a.Allocate("x", "small"); lease.Address != "10.0.1.1/30" {
+		t.Errorf("small lease = %s, want 10.0.1.1/30", lease.Address)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipam.json")
+	data := `{"ranges": [{"name": "data", "subnet": "10.0.0.0/24", "gateway": "10.0.0.1", "exclude": ["10.0.0.2"]}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if len(cfg.Ranges) != 1 || cfg.Ranges[0].Name != "data" || cfg.Ranges[0].Exclude[0] != "10.0.0.2" {
+		t.Errorf("config = %+v", cfg)
+	}
+	if _, err := New(cfg); err != nil {
+		t.Errorf("New: %v", err)
+	}
+
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected error for a missing file")
+	}
+}
+
+func TestPoolBlocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    Pool
+		want    []string // block/address@gateway
+		wantErr bool
+	}{
+		{
+			name: "addresses",
+			pool: Pool{Range: Range{Name: "p", Subnet: "10.0.0.0/29", Gateway: "10.0.0.1", Exclude: []string{"10.0.0.5"}}},
+			want: []string{"10.0.0.2/32 10.0.0.2/29@10.0.0.1", "10.0.0.3/32 10.0.0.3/29@10.0.0.1", "10.0.0.4/32 10.0.0.4/29@10.0.0.1", "10.0.0.6/32 10.0.0.6/29@10.0.0.1"},
+		},
+		{
+			// The first block holds the network address and gateway, the
+			// last one the broadcast address.
+			name: "blocks",
+			pool: Pool{Range: Range{Name: "p", Subnet: "10.0.0.0/28", Gateway: "10.0.0.1"}, BlockSize: 30},
+			want: []string{"10.0.0.4/30 10.0.0.4/28@10.0.0.1", "10.0.0.8/30 10.0.0.8/28@10.0.0.1"},
+		},
+		{
+			name: "ipv6 range",
+			pool: Pool{Range: Range{Name: "p", Subnet: "2001:db8::/64", RangeStart: "2001:db8::10", RangeEnd: "2001:db8::11"}},
+			want: []string{"2001:db8::10/128 2001:db8::10/64@", "2001:db8::11/128 2001:db8::11/64@"},
+		},
+		{
+			name:    "block larger than subnet",
+			pool:    Pool{Range: Range{Name: "p", Subnet: "10.0.0.0/28"}, BlockSize: 24},
+			wantErr: true,
+		},
+		{
+			name:    "too many devices",
+			pool:    Pool{Range: Range{Name: "p", Subnet: "10.0.0.0/16"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks, err := tt.pool.Blocks()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Blocks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, b := range blocks {
+				got = append(got, b.Prefix.String()+" "+b.Address+"@"+b.Gateway)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Blocks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPoolConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pools.json")
+	data := `{"pools": [{"name": "flat", "subnet": "10.1.0.0/24", "blockSize": 30, "nodeSelector": {"rack": "a"}}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadPoolConfig(path)
+	if err != nil {
+		t.Fatalf("LoadPoolConfig: %v", err)
+	}
+	if len(cfg.Pools) != 1 {
+		t.Fatalf("pools = %+v", cfg.Pools)
+	}
+	p := cfg.Pools[0]
+	if p.Name != "flat" || p.Subnet != "10.1.0.0/24" || p.BlockSize != 30 || p.NodeSelector["rack"] != "a" {
+		t.Errorf("pool = %+v", p)
+	}
+}
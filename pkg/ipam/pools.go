@@ -0,0 +1,98 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+)
+
+// MaxPoolDevices caps the number of addresses or blocks a cluster pool may
+// publish, so a mistyped subnet does not flood the API server with slices.
+const MaxPoolDevices = 4096
+
+// PoolConfig defines cluster-scoped address pools.  Unlike ranges, whose
+// leases are tracked by a node's driver, every address or block of a pool is
+// published as a device and the scheduler hands each to at most one claim.
+type PoolConfig struct {
+	Pools []Pool `json:"pools"`
+}
+
+// Pool is a range whose addresses are published as devices.
+type Pool struct {
+	Range
+	// BlockSize is the prefix length of each device, e.g. 30 to hand out
+	// /30 blocks.  The default is one address per device.
+	BlockSize int `json:"blockSize,omitempty"`
+	// NodeSelector restricts the pool to nodes with these labels.  The
+	// default is all nodes.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+}
+
+// Block is one device of a pool.
+type Block struct {
+	Prefix  netip.Prefix // The addresses the device covers
+	Address string       // The block's first address with the subnet's prefix length, configured on the interface
+	Gateway string       // The pool's gateway
+}
+
+// LoadPoolConfig reads a JSON pool configuration file.
+func LoadPoolConfig(path string) (*PoolConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read IP pool config: %w", err)
+	}
+	var cfg PoolConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse IP pool config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Blocks validates the pool and returns its devices in address order.  A
+// block is skipped when it reaches outside the pool's range or holds the
+// gateway or an excluded address.
+func (p Pool) Blocks() ([]Block, error) {
+	r, err := parseRange(p.Range)
+	if err != nil {
+		return nil, err
+	}
+	bits := p.BlockSize
+	if bits == 0 {
+		bits = r.subnet.Addr().BitLen()
+	}
+	if bits < r.subnet.Bits() || bits > r.subnet.Addr().BitLen() {
+		return nil, fmt.Errorf("blockSize /%d does not fit subnet %s", bits, r.subnet)
+	}
+
+	var blocks []Block
+	for addr := r.start; addr.IsValid() && !r.end.Less(addr); {
+		prefix := netip.PrefixFrom(addr, bits).Masked()
+		last := lastAddr(prefix)
+		if !prefix.Addr().Less(r.start) && !r.end.Less(last) && r.blockUsable(prefix) {
+			if len(blocks) == MaxPoolDevices {
+				return nil, fmt.Errorf("more than %d blocks", MaxPoolDevices)
+			}
+			b := Block{Prefix: prefix, Address: netip.PrefixFrom(prefix.Addr(), r.subnet.Bits()).String()}
+			if r.gateway.IsValid() {
+				b.Gateway = r.gateway.String()
+			}
+			blocks = append(blocks, b)
+		}
+		addr = last.Next()
+	}
+	return blocks, nil
+}
+
+// blockUsable reports whether no address of prefix is reserved.
+func (p *pool) blockUsable(prefix netip.Prefix) bool {
+	if p.gateway.IsValid() && prefix.Contains(p.gateway) {
+		return false
+	}
+	for _, e := range p.exclude {
+		if e.Overlaps(prefix) {
+			return false
+		}
+	}
+	return true
+}
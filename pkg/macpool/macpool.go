@@ -0,0 +1,153 @@
+// Package macpool hands out MAC addresses to claims: stable ones derived
+// from a claim's namespace and name, or leases from a configured range.
+// Leases are held in memory; the driver persists them with each claim's
+// allocation state and restores them when it starts.
+package macpool
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// Stable returns the locally administered unicast MAC derived from a claim's
+// namespace and name.  A claim keeps its MAC when it is re-created under the
+// same name, e.g. after its pod restarts.
+func Stable(namespace, name string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(namespace + "/" + name))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac
+}
+
+// Pool leases MACs from a range.  Thread-safe.
+type Pool struct {
+	start, end uint64
+
+	mu     sync.Mutex
+	leased map[uint64]string // MAC → claim UID
+	last   uint64            // Last MAC handed out, 0 if none
+}
+
+// Parse parses a pool given as an OUI, e.g. 02:00:5e, which covers every
+// address under it, or as a range, e.g. 02:00:5e:00:00:00-02:00:5e:00:ff:ff.
+func Parse(s string) (*Pool, error) {
+	var start, end uint64
+	if first, last, ok := strings.Cut(s, "-"); ok {
+		var err error
+		if start, err = parseMAC(first); err != nil {
+			return nil, err
+		}
+		if end, err = parseMAC(last); err != nil {
+			return nil, err
+		}
+	} else {
+		oui, err := net.ParseMAC(s + ":00:00:00")
+		if err != nil || len(oui) != 6 {
+			return nil, fmt.Errorf("invalid MAC pool %q: want an OUI or <first>-<last>", s)
+		}
+		start = toUint(oui)
+		end = start | 0xffffff
+	}
+	if end < start {
+		return nil, fmt.Errorf("invalid MAC pool %q: last address before first", s)
+	}
+	if start>>40 != end>>40 || (start>>40)&0x01 != 0 {
+		return nil, fmt.Errorf("invalid MAC pool %q: addresses must be unicast with the same first octet", s)
+	}
+	return &Pool{start: start, end: end, leased: make(map[uint64]string)}, nil
+}
+
+func parseMAC(s string) (uint64, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) != 6 {
+		return 0, fmt.Errorf("invalid MAC %q", s)
+	}
+	return toUint(mac), nil
+}
+
+func toUint(mac net.HardwareAddr) uint64 {
+	return binary.BigEndian.Uint64(append([]byte{0, 0}, mac...))
+}
+
+func toMAC(v uint64) net.HardwareAddr {
+	b := binary.BigEndian.AppendUint64(nil, v)
+	return net.HardwareAddr(b[2:])
+}
+
+// String returns the pool as a range.
+func (p *Pool) String() string {
+	return fmt.Sprintf("%s-%s", toMAC(p.start), toMAC(p.end))
+}
+
+// Allocate leases a MAC to claimUID, skipping those inUse reports as taken
+// by links on the node.  A claim that already holds a lease gets it again.
+// Addresses are handed out round-robin, so a released MAC is not reused
+// while others are free.
+func (p *Pool) Allocate(claimUID string, inUse func(net.HardwareAddr) bool) (net.HardwareAddr, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for v, owner := range p.leased {
+		if owner == claimUID {
+			return toMAC(v), nil
+		}
+	}
+	v := p.start
+	if p.last >= p.start && p.last < p.end {
+		v = p.last + 1
+	}
+	for first := v; ; {
+		if _, taken := p.leased[v]; !taken && !inUse(toMAC(v)) {
+			p.leased[v] = claimUID
+			p.last = v
+			klog.Infof("Leased MAC %s to claim %s", toMAC(v), claimUID)
+			return toMAC(v), nil
+		}
+		if v == p.end {
+			v = p.start
+		} else {
+			v++
+		}
+		if v == first {
+			return nil, fmt.Errorf("MAC pool %s is exhausted", p)
+		}
+	}
+}
+
+// Release returns the MAC held by claimUID.
+func (p *Pool) Release(claimUID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for v, owner := range p.leased {
+		if owner == claimUID {
+			delete(p.leased, v)
+			klog.Infof("Released MAC %s from claim %s", toMAC(v), claimUID)
+		}
+	}
+}
+
+// Restore records a lease held by claimUID before a restart.  MACs outside
+// the pool, e.g. after the pool was reconfigured, are ignored.
+func (p *Pool) Restore(claimUID string, mac net.HardwareAddr) {
+	if len(mac) != 6 {
+		return
+	}
+	v := toUint(mac)
+	if v < p.start || v > p.end {
+		klog.Warningf("MAC %s of claim %s is outside pool %s", mac, claimUID, p)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if owner, ok := p.leased[v]; ok && owner != claimUID {
+		klog.Warningf("MAC %s restored for claim %s is already leased to claim %s", mac, claimUID, owner)
+		return
+	}
+	p.leased[v] = claimUID
+}
@@ -0,0 +1,104 @@
+package macpool
+
+import (
+	"net"
+	"testing"
+)
+
+func never(net.HardwareAddr) bool { return false }
+
+func TestStable(t *testing.T) {
+	mac := Stable("default", "web-0")
+	if len(mac) != 6 {
+		t.Fatalf("mac = %s", mac)
+	}
+	if mac[0]&0x02 == 0 || mac[0]&0x01 != 0 {
+		t.Errorf("%s is not a locally administered unicast MAC", mac)
+	}
+	if again := Stable("default", "web-0"); again.String() != mac.String() {
+		t.Errorf("Stable is not deterministic: %s then %s", mac, again)
+	}
+	if other := Stable("default", "web-1"); other.String() == mac.String() {
+		t.Errorf("claims web-0 and web-1 share %s", mac)
+	}
+	if other := Stable("prod", "web-0"); other.String() == mac.String() {
+		t.Errorf("namespaces default and prod share %s", mac)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"02:00:5e", "02:00:5e:00:00:00-02:00:5e:ff:ff:ff", false},
+		{"02:00:5e:00:00:10-02:00:5e:00:00:1f", "02:00:5e:00:00:10-02:00:5e:00:00:1f", false},
+		{"02-00-5e-00-00-10-02-00-5e-00-00-1f", "", true}, // Ambiguous with the dash separator
+		{"02:00:5e:00:00:1f-02:00:5e:00:00:10", "", true},
+		{"01:00:5e", "", true}, // Multicast
+		{"02:00:5e:00:00:00-04:00:00:00:00:00", "", true},
+		{"zz:00:5e", "", true},
+		{"02:00", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			p, err := Parse(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && p.String() != tt.want {
+				t.Errorf("pool = %s, want %s", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestPool_Allocate(t *testing.T) {
+	p, err := Parse("02:00:5e:00:00:00-02:00:5e:00:00:03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Links on the node already use :01.
+	inUse := func(mac net.HardwareAddr) bool { return mac.String() == "02:00:5e:00:00:01" }
+
+	a, _ := p.Allocate("a", inUse)
+	b, _ := p.Allocate("b", inUse)
+	if a.String() != "02:00:5e:00:00:00" || b.String() != "02:00:5e:00:00:02" {
+		t.Errorf("got %s and %s", a, b)
+	}
+	if again, _ := p.Allocate("a", inUse); again.String() != a.String() {
+		t.Errorf("second Allocate for a = %s, want %s", again, a)
+	}
+	c, _ := p.Allocate("c", inUse)
+	if c.String() != "02:00:5e:00:00:03" {
+		t.Errorf("c = %s", c)
+	}
+	if _, err := p.Allocate("d", inUse); err == nil {
+		t.Error("expected exhaustion")
+	}
+
+	// Released MACs are reused once the rest is taken.
+	p.Release("a")
+	if d, err := p.Allocate("d", inUse); err != nil || d.String() != a.String() {
+		t.Errorf("d = %s, %v; want %s", d, err, a)
+	}
+}
+
+func TestPool_Restore(t *testing.T) {
+	p, err := Parse("02:00:5e:00:00:00-02:00:5e:00:00:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, _ := net.ParseMAC("02:00:5e:00:00:00")
+	p.Restore("a", mac)
+	outside, _ := net.ParseMAC("02:00:5e:00:00:09")
+	p.Restore("b", outside)
+
+	if got, _ := p.Allocate("b", never); got.String() != "02:00:5e:00:00:01" {
+		t.Errorf("b = %s, want the MAC a does not hold", got)
+	}
+	if got, _ := p.Allocate("a", never); got.String() != mac.String() {
+		t.Errorf("a = %s, want its restored %s", got, mac)
+	}
+}
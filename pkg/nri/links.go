@@ -0,0 +1,304 @@
+package nri
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"k8s.io/klog/v2"
+)
+
+// LinkSetup describes configuration for a network interface that can only be
+// applied once the runtime has moved it into the pod's network namespace.
+//
+// Moving a link between namespaces closes it and tears down its qdiscs, so
+// anything that must survive the move (tc shaping, addresses, routes) is
+// registered here by a handler's Prepare() and applied by the NRI plugin
+// before the container that receives the CDI netDevice starts.
+type LinkSetup struct {
+	// ClaimUID is the DRA ResourceClaim UID that owns the link.
+	ClaimUID string
+	// IfName is the interface name inside the pod netns (the CDI netDevice name).
+	IfName string
+	// NetnsPath is the pod netns the setup is applied in.  The NRI plugin
+	// sets it before calling Apply.
+	NetnsPath string
+	// Apply runs with the calling thread inside the pod netns.
+	Apply func(link netlink.Link) error
+	// Teardown undoes Apply.  It runs inside the pod netns on Unprepare while
+	// the netns still exists.  May be nil.
+	Teardown func(link netlink.Link) error
+
+	// seq numbers the setups of a claim in registration order, which
+	// identifies them across driver restarts.
+	seq int
+}
+
+// ActiveLinkSetup records setups that were applied inside a pod's netns.
+type ActiveLinkSetup struct {
+	Setups    []*LinkSetup
+	PodUID    string
+	NetnsPath string // Pod netns path — needed to re-enter and undo the setup.
+}
+
+// LinkSetupTracker coordinates between netdev handlers (which know what the
+// moved link needs) and the NRI plugin (which knows when the link has landed
+// in the pod netns).
+//
+// Setups are functions and cannot be persisted.  After a driver restart the
+// handlers register the setups of prepared claims again, in the order they
+// did in Prepare.  With a state file (see Persist), the tracker remembers
+// which of them were applied, and where, and makes those active again
+// instead of pending, so that Release still tears them down.
+//
+// Thread-safe — called from both the DRA gRPC goroutines and NRI ttrpc goroutines.
+type LinkSetupTracker struct {
+	mu sync.Mutex
+
+	// pending maps claimUID → setups not yet applied.
+	pending map[string][]*LinkSetup
+
+	// active maps claimUID → setups applied inside a pod netns.
+	active map[string]*ActiveLinkSetup
+
+	// seqs maps claimUID → the last seq given to one of its setups.
+	seqs map[string]int
+
+	// applied maps claimUID → what the state file records as applied.
+	applied   map[string]*appliedLinkSetups
+	statePath string
+}
+
+// appliedLinkSetups is the persisted record of the setups of a claim applied
+// inside a pod netns.
+type appliedLinkSetups struct {
+	PodUID    string `json:"podUID"`
+	NetnsPath string `json:"netnsPath"`
+	Seqs      []int  `json:"seqs"`
+}
+
+// NewLinkSetupTracker creates a new tracker.
+func NewLinkSetupTracker() *LinkSetupTracker {
+	return &LinkSetupTracker{
+		pending: make(map[string][]*LinkSetup),
+		active:  make(map[string]*ActiveLinkSetup),
+		seqs:    make(map[string]int),
+		applied: make(map[string]*appliedLinkSetups),
+	}
+}
+
+// Persist records the applied setups in the file at path from now on, and
+// loads the record a previous run left there.  Call it before handlers
+// register the setups of restored claims.
+func (t *LinkSetupTracker) Persist(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.statePath = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &t.applied); err != nil {
+		return fmt.Errorf("corrupt link setup state %s: %w", path, err)
+	}
+	return nil
+}
+
+// save writes the record of applied setups.  Called with t.mu held.
+func (t *LinkSetupTracker) save() {
+	if t.statePath == "" {
+		return
+	}
+	data, err := json.Marshal(t.applied)
+	if err == nil {
+		tmp := t.statePath + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, t.statePath)
+		}
+	}
+	if err != nil {
+		klog.Warningf("Failed to persist link setup state: %v", err)
+	}
+}
+
+// AddPending registers a setup to apply once the claim's link is in the pod
+// netns.  A setup that was applied before a driver restart is made active
+// in its pod netns instead.
+func (t *LinkSetupTracker) AddPending(setup *LinkSetup) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if setup.seq == 0 {
+		t.seqs[setup.ClaimUID]++
+		setup.seq = t.seqs[setup.ClaimUID]
+	}
+	if r, ok := t.applied[setup.ClaimUID]; ok && slices.Contains(r.Seqs, setup.seq) {
+		t.addActive(setup, r.PodUID, r.NetnsPath)
+		klog.Infof("Restored applied link setup: claim=%s ifname=%s", setup.ClaimUID, setup.IfName)
+		return
+	}
+	t.pending[setup.ClaimUID] = append(t.pending[setup.ClaimUID], setup)
+	klog.Infof("Registered pending link setup: claim=%s ifname=%s", setup.ClaimUID, setup.IfName)
+}
+
+// RemovePending drops all setups that were never applied for a claim.
+func (t *LinkSetupTracker) RemovePending(claimUID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, claimUID)
+}
+
+// ConsumePendingForClaims returns and removes the pending setups of every
+// claim in the provided set, in registration order per claim.
+func (t *LinkSetupTracker) ConsumePendingForClaims(claimUIDs []string) []*LinkSetup {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var setups []*LinkSetup
+	for _, uid := range claimUIDs {
+		if s, ok := t.pending[uid]; ok {
+			setups = append(setups, s...)
+			delete(t.pending, uid)
+		}
+	}
+	return setups
+}
+
+// MarkActive records that a setup was applied inside a pod's netns.
+func (t *LinkSetupTracker) MarkActive(setup *LinkSetup, podUID, netnsPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.addActive(setup, podUID, netnsPath)
+
+	r, ok := t.applied[setup.ClaimUID]
+	if !ok {
+		r = &appliedLinkSetups{PodUID: podUID, NetnsPath: netnsPath}
+		t.applied[setup.ClaimUID] = r
+	}
+	r.Seqs = append(r.Seqs, setup.seq)
+	t.save()
+}
+
+// addActive adds setup to the claim's active setups.  Called with t.mu held.
+func (t *LinkSetupTracker) addActive(setup *LinkSetup, podUID, netnsPath string) {
+	a, ok := t.active[setup.ClaimUID]
+	if !ok {
+		a = &ActiveLinkSetup{PodUID: podUID, NetnsPath: netnsPath}
+		t.active[setup.ClaimUID] = a
+	}
+	a.Setups = append(a.Setups, setup)
+}
+
+// RemoveActive removes and returns the applied setups for a claim.
+func (t *LinkSetupTracker) RemoveActive(claimUID string) (*ActiveLinkSetup, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, ok := t.active[claimUID]
+	if ok {
+		delete(t.active, claimUID)
+	}
+	if _, ok := t.applied[claimUID]; ok {
+		delete(t.applied, claimUID)
+		t.save()
+	}
+	delete(t.seqs, claimUID)
+	return a, ok
+}
+
+// RemoveActiveForPod forgets all applied setups for a pod.  The links and
+// anything attached to them go away with the pod netns.
+func (t *LinkSetupTracker) RemoveActiveForPod(podUID string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removed := 0
+	for uid, a := range t.active {
+		if a.PodUID == podUID {
+			delete(t.active, uid)
+			removed++
+		}
+	}
+	n := len(t.applied)
+	for uid, r := range t.applied {
+		if r.PodUID == podUID {
+			delete(t.applied, uid)
+		}
+	}
+	if len(t.applied) != n {
+		t.save()
+	}
+	return removed
+}
+
+// Release undoes the applied setups for a claim inside its pod netns and drops
+// any that were never applied.  Called from a handler's Unprepare().
+func (t *LinkSetupTracker) Release(claimUID string) {
+	t.RemovePending(claimUID)
+
+	a, ok := t.RemoveActive(claimUID)
+	if !ok {
+		return
+	}
+	err := InNetns(a.NetnsPath, func() error {
+		for i := len(a.Setups) - 1; i >= 0; i-- {
+			s := a.Setups[i]
+			if s.Teardown == nil {
+				continue
+			}
+			link, err := netlink.LinkByName(s.IfName)
+			if err != nil {
+				klog.V(2).Infof("Link %s not found in pod netns during teardown (claim=%s): %v", s.IfName, claimUID, err)
+				continue
+			}
+			if err := s.Teardown(link); err != nil {
+				klog.Warningf("Link setup teardown for %s failed (claim=%s): %v", s.IfName, claimUID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		klog.V(2).Infof("Could not enter pod netns %s for link teardown (may be destroyed): %v", a.NetnsPath, err)
+	}
+}
+
+// String returns a summary for debugging.
+func (t *LinkSetupTracker) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("LinkSetupTracker{pending=%d, active=%d}", len(t.pending), len(t.active))
+}
+
+// InNetns runs fn on a locked OS thread switched into the network namespace
+// at netnsPath, restoring the init netns afterwards.
+func InNetns(netnsPath string, fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// Always use /proc/1/ns/net for the init netns — netns.Get() returns the
+	// calling thread's netns which may have been switched by another goroutine.
+	hostNS, err := netns.GetFromPath("/proc/1/ns/net")
+	if err != nil {
+		return fmt.Errorf("open init netns: %w", err)
+	}
+	defer hostNS.Close()
+
+	podNS, err := netns.GetFromPath(netnsPath)
+	if err != nil {
+		return fmt.Errorf("open netns %s: %w", netnsPath, err)
+	}
+	defer podNS.Close()
+
+	if err := netns.Set(podNS); err != nil {
+		return fmt.Errorf("enter netns %s: %w", netnsPath, err)
+	}
+	defer netns.Set(hostNS) // restore to host netns before unlocking the OS thread
+
+	return fn()
+}
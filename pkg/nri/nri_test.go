@@ -1,7 +1,15 @@
 package nri
 
 import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 )
 
 func TestTracker_AddAndConsumePending(t *testing.T) {
@@ -176,3 +184,147 @@ func TestExtractClaimUIDs_Dedup(t *testing.T) {
 		t.Fatalf("expected 1 deduplicated UID, got %d: %v", len(uids), uids)
 	}
 }
+
+func TestLinkSetupTracker_PendingAndActive(t *testing.T) {
+	tr := NewLinkSetupTracker()
+
+	tr.AddPending(&LinkSetup{ClaimUID: "claim-1", IfName: "net1"})
+	tr.AddPending(&LinkSetup{ClaimUID: "claim-1", IfName: "net1"})
+	tr.AddPending(&LinkSetup{ClaimUID: "claim-2", IfName: "net2"})
+
+	setups := tr.ConsumePendingForClaims([]string{"claim-1", "claim-3"})
+	if len(setups) != 2 {
+		t.Fatalf("expected 2 setups for claim-1, got %d", len(setups))
+	}
+
+	// Consumed setups are gone; claim-2 is still pending.
+	if got := tr.ConsumePendingForClaims([]string{"claim-1"}); len(got) != 0 {
+		t.Fatalf("expected 0 setups after consumption, got %d", len(got))
+	}
+
+	for _, s := range setups {
+		tr.MarkActive(s, "pod-uid-1", "/run/netns/pod1")
+	}
+	a, ok := tr.RemoveActive("claim-1")
+	if !ok {
+		t.Fatal("expected RemoveActive to find claim-1")
+	}
+	if len(a.Setups) != 2 || a.PodUID != "pod-uid-1" || a.NetnsPath != "/run/netns/pod1" {
+		t.Errorf("unexpected active setup: %+v", a)
+	}
+
+	if s := tr.String(); s != "LinkSetupTracker{pending=1, active=0}" {
+		t.Errorf("unexpected String(): %s", s)
+	}
+}
+
+func TestLinkSetupTracker_RemoveActiveForPod(t *testing.T) {
+	tr := NewLinkSetupTracker()
+
+	tr.MarkActive(&LinkSetup{ClaimUID: "claim-1", IfName: "net1"}, "pod-uid-1", "/run/netns/pod1")
+	tr.MarkActive(&LinkSetup{ClaimUID: "claim-2", IfName: "net2"}, "pod-uid-1", "/run/netns/pod1")
+	tr.MarkActive(&LinkSetup{ClaimUID: "claim-3", IfName: "net1"}, "pod-uid-2", "/run/netns/pod2")
+
+	if n := tr.RemoveActiveForPod("pod-uid-1"); n != 2 {
+		t.Fatalf("expected 2 removed for pod-uid-1, got %d", n)
+	}
+	if _, ok := tr.RemoveActive("claim-3"); !ok {
+		t.Error("claim-3 of pod-uid-2 should still be active")
+	}
+}
+
+func TestLinkSetupTracker_ReleaseDropsPending(t *testing.T) {
+	tr := NewLinkSetupTracker()
+
+	tr.AddPending(&LinkSetup{ClaimUID: "claim-1", IfName: "net1"})
+	tr.Release("claim-1") // never applied — nothing to tear down
+
+	if got := tr.ConsumePendingForClaims([]string{"claim-1"}); len(got) != 0 {
+		t.Fatalf("expected 0 setups after Release, got %d", len(got))
+	}
+}
+
+func TestLinkSetupTracker_Persist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.json")
+	tr := NewLinkSetupTracker()
+	if err := tr.Persist(path); err != nil {
+		t.Fatalf("Persist without a state file: %v", err)
+	}
+	tr.AddPending(&LinkSetup{ClaimUID: "claim-1", IfName: "net1"})
+	tr.AddPending(&LinkSetup{ClaimUID: "claim-1", IfName: "net1"})
+	setups := tr.ConsumePendingForClaims([]string{"claim-1"})
+	tr.MarkActive(setups[0], "pod-uid-1", "/run/netns/pod1")
+	tr.AddPending(setups[1]) // Retried later
+
+	// After a restart the handlers register the same setups again: the
+	// applied one is active in its netns, the other still pending.
+	restarted := NewLinkSetupTracker()
+	if err := restarted.Persist(path); err != nil {
+		t.Fatalf("Persist: %v", err)
+	}
+	restarted.AddPending(&LinkSetup{ClaimUID: "claim-1", IfName: "net1"})
+	restarted.AddPending(&LinkSetup{ClaimUID: "claim-1", IfName: "net1"})
+	if got := restarted.ConsumePendingForClaims([]string{"claim-1"}); len(got) != 1 {
+		t.Errorf("expected 1 pending setup after restart, got %d", len(got))
+	}
+	a, ok := restarted.RemoveActive("claim-1")
+	if !ok || len(a.Setups) != 1 || a.PodUID != "pod-uid-1" || a.NetnsPath != "/run/netns/pod1" {
+		t.Errorf("unexpected restored active setups: %+v", a)
+	}
+
+	// Removing the claim's active setups drops them from the record.
+	again := NewLinkSetupTracker()
+	if err := again.Persist(path); err != nil {
+		t.Fatalf("Persist: %v", err)
+	}
+	again.AddPending(&LinkSetup{ClaimUID: "claim-1", IfName: "net1"})
+	if got := again.ConsumePendingForClaims([]string{"claim-1"}); len(got) != 1 {
+		t.Errorf("expected the released setup to be pending, got %d", len(got))
+	}
+
+	os.WriteFile(path, []byte("{"), 0644)
+	if err := NewLinkSetupTracker().Persist(path); err == nil {
+		t.Error("expected error for a corrupt state file")
+	}
+}
+
+func TestPlugin_StartContainerFailsOnSetupError(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to enter network namespaces")
+	}
+	if ns, err := netns.GetFromPath("/proc/1/ns/net"); err != nil {
+		t.Skipf("cannot open the init netns: %v", err)
+	} else {
+		ns.Close()
+	}
+	const claimUID = "aabbccdd-1234-5678-abcd-1234567890ab"
+	links := NewLinkSetupTracker()
+	p := &Plugin{tracker: NewRDMANetnsTracker(), links: links}
+	pod := &api.PodSandbox{
+		Uid:         "pod-uid-1",
+		Annotations: map[string]string{"resource.kubernetes.io/app": claimUID},
+		Linux: &api.LinuxPodSandbox{Namespaces: []*api.LinuxNamespace{
+			{Type: "network", Path: "/proc/1/ns/net"},
+		}},
+	}
+
+	fail := true
+	links.AddPending(&LinkSetup{ClaimUID: claimUID, IfName: "lo", Apply: func(netlink.Link) error {
+		if fail {
+			return errors.New("no such thing")
+		}
+		return nil
+	}})
+	if err := p.StartContainer(context.Background(), pod, &api.Container{Name: "app"}); err == nil {
+		t.Fatal("expected the failed setup to fail the container start")
+	}
+
+	// The setup stays pending and is applied on the next start.
+	fail = false
+	if err := p.StartContainer(context.Background(), pod, &api.Container{Name: "app"}); err != nil {
+		t.Fatalf("retried StartContainer: %v", err)
+	}
+	if a, ok := links.RemoveActive(claimUID); !ok || len(a.Setups) != 1 {
+		t.Errorf("expected the setup to be active after the retry, got %+v", a)
+	}
+}
@@ -2,6 +2,7 @@ package nri
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"runtime"
 	"strings"
@@ -14,24 +15,27 @@ import (
 )
 
 const (
-	pluginName = "dra-rdma"
+	pluginName = "dra-netns"
 	pluginIdx  = "90" // Run late — after most other NRI plugins.
 )
 
-// Plugin is an NRI plugin that moves RDMA devices into pod network namespaces
-// in exclusive RDMA netns mode.
+// Plugin is an NRI plugin that performs the parts of device preparation that
+// need the pod's network namespace: moving RDMA devices in exclusive RDMA
+// netns mode, and configuring network links after the runtime moved them.
 //
 // It implements:
-//   - RunPodInterface  — move RDMA devices into the new sandbox netns
-//   - StopPodInterface — move RDMA devices back to the host (init) netns
+//   - RunPodInterface             — move RDMA devices into the new sandbox netns
+//   - StartContainerInterface     — apply pending link setups in the sandbox netns
+//   - StopPodInterface            — move RDMA devices back to the host (init) netns
 type Plugin struct {
 	stub    stub.Stub
 	tracker *RDMANetnsTracker
+	links   *LinkSetupTracker
 }
 
-// NewPlugin creates a new NRI plugin wired to the given tracker.
-func NewPlugin(tracker *RDMANetnsTracker) (*Plugin, error) {
-	p := &Plugin{tracker: tracker}
+// NewPlugin creates a new NRI plugin wired to the given trackers.
+func NewPlugin(tracker *RDMANetnsTracker, links *LinkSetupTracker) (*Plugin, error) {
+	p := &Plugin{tracker: tracker, links: links}
 
 	opts := []stub.Option{
 		stub.WithPluginName(pluginName),
@@ -48,7 +52,7 @@ func NewPlugin(tracker *RDMANetnsTracker) (*Plugin, error) {
 
 // Run starts the NRI plugin and blocks until the context is cancelled.
 func (p *Plugin) Run(ctx context.Context) error {
-	klog.Info("Starting NRI plugin for RDMA netns management")
+	klog.Info("Starting NRI plugin for pod netns management")
 	return p.stub.Run(ctx)
 }
 
@@ -127,6 +131,71 @@ func (p *Plugin) RunPodSandbox(_ context.Context, pod *api.PodSandbox) error {
 	return nil
 }
 
+// StartContainer is called before the runtime starts a container.  CDI
+// netDevices are moved into the sandbox netns when the container that
+// references them is created, so the links are visible in the pod netns by
+// now.  A setup that fails fails the container start; it stays pending, so
+// that the kubelet's retry applies it again.
+func (p *Plugin) StartContainer(_ context.Context, pod *api.PodSandbox, ctr *api.Container) error {
+	podName := fmt.Sprintf("%s/%s", pod.GetNamespace(), pod.GetName())
+
+	claimUIDs := extractClaimUIDs(pod.GetAnnotations())
+	if len(claimUIDs) == 0 {
+		return nil
+	}
+
+	setups := p.links.ConsumePendingForClaims(claimUIDs)
+	if len(setups) == 0 {
+		return nil
+	}
+
+	netnsPath := getNetNSPath(pod)
+	if netnsPath == "" {
+		klog.Warningf("Pod %s: no netns path available, cannot configure links", podName)
+		for _, s := range setups {
+			p.links.AddPending(s)
+		}
+		return nil
+	}
+
+	var (
+		retry  []*LinkSetup
+		failed []error
+	)
+	err := InNetns(netnsPath, func() error {
+		for _, s := range setups {
+			link, err := netlink.LinkByName(s.IfName)
+			if err != nil {
+				// Not moved yet — another container of the pod may carry
+				// the CDI device.  Try again when it starts.
+				klog.V(2).Infof("Pod %s: link %s not in pod netns yet (container=%s): %v", podName, s.IfName, ctr.GetName(), err)
+				retry = append(retry, s)
+				continue
+			}
+			s.NetnsPath = netnsPath
+			if err := s.Apply(link); err != nil {
+				klog.Errorf("Pod %s: failed to configure link %s (claim=%s): %v", podName, s.IfName, s.ClaimUID, err)
+				failed = append(failed, fmt.Errorf("configure link %s of claim %s: %w", s.IfName, s.ClaimUID, err))
+				retry = append(retry, s)
+				continue
+			}
+			p.links.MarkActive(s, pod.GetUid(), netnsPath)
+			klog.Infof("Configured link %s in pod %s netns (claim=%s)", s.IfName, podName, s.ClaimUID)
+		}
+		return nil
+	})
+	if err != nil {
+		klog.Errorf("Pod %s: failed to enter netns %s: %v", podName, netnsPath, err)
+		failed = append(failed, fmt.Errorf("configure links: %w", err))
+		retry = setups
+	}
+	for _, s := range retry {
+		p.links.AddPending(s)
+	}
+
+	return errors.Join(failed...)
+}
+
 // StopPodSandbox is called when a pod is stopping.  This is a backup path for
 // returning RDMA devices to the host netns.  The primary return happens in
 // Unprepare (called by the kubelet before StopPodSandbox), which removes the
@@ -139,6 +208,14 @@ func (p *Plugin) StopPodSandbox(_ context.Context, pod *api.PodSandbox) error {
 	podUID := pod.GetUid()
 	podName := fmt.Sprintf("%s/%s", pod.GetNamespace(), pod.GetName())
 
+	// Link setups need no undo here — the links and everything attached to
+	// them are destroyed or returned together with the pod netns.  The
+	// handlers restore the host-side state of returned physical links, such
+	// as their MAC, in Unprepare.
+	if n := p.links.RemoveActiveForPod(podUID); n > 0 {
+		klog.V(2).Infof("Pod %s: dropped %d configured links", podName, n)
+	}
+
 	moves := p.tracker.RemoveActiveForPod(podUID)
 	if len(moves) == 0 {
 		return nil
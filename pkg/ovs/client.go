@@ -0,0 +1,218 @@
+// Package ovs plugs ports into Open vSwitch bridges by talking to the OVSDB
+// server (RFC 7047) over its Unix socket, the same way ovs-vsctl does.
+package ovs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// DefaultSocket is where ovsdb-server listens on most distributions.
+const DefaultSocket = "/var/run/openvswitch/db.sock"
+
+const (
+	database       = "Open_vSwitch"
+	defaultTimeout = 10 * time.Second
+)
+
+// Client is an OVSDB client.  Each call opens its own connection, so the
+// zero value with Socket set is ready to use and safe for concurrent use.
+type Client struct {
+	// Socket is the path of the ovsdb-server Unix socket.
+	Socket string
+	// Timeout bounds each call.  Zero means 10 seconds.
+	Timeout time.Duration
+}
+
+// Port describes an OVS port with a single interface of the same name.
+type Port struct {
+	Bridge      string
+	Name        string
+	Type        string // Interface type; "" for a system interface such as a veth
+	Tag         int    // Access VLAN, 0 for none
+	Trunks      []int  // Trunked VLANs, empty for all
+	ExternalIDs map[string]string
+}
+
+// AddPort adds p to its bridge, replacing a port of the same name.
+func (c *Client) AddPort(ctx context.Context, p Port) error {
+	if err := c.DelPort(ctx, p.Name); err != nil {
+		return err
+	}
+
+	iface := map[string]any{
+		"name":         p.Name,
+		"external_ids": ovsMap(p.ExternalIDs),
+	}
+	if p.Type != "" {
+		iface["type"] = p.Type
+	}
+	port := map[string]any{
+		"name":         p.Name,
+		"interfaces":   namedUUID("iface"),
+		"external_ids": ovsMap(p.ExternalIDs),
+		"trunks":       ovsSet(p.Trunks),
+	}
+	if p.Tag > 0 {
+		port["tag"] = p.Tag
+	} else {
+		port["tag"] = ovsSet([]int(nil))
+	}
+
+	_, err := c.transact(ctx,
+		// Fails the transaction if the bridge does not exist.
+		map[string]any{
+			"op": "wait", "table": "Bridge", "timeout": 0,
+			"where":   []any{[]any{"name", "==", p.Bridge}},
+			"columns": []string{"name"}, "until": "==",
+			"rows": []any{map[string]any{"name": p.Bridge}},
+		},
+		map[string]any{"op": "insert", "table": "Interface", "row": iface, "uuid-name": "iface"},
+		map[string]any{"op": "insert", "table": "Port", "row": port, "uuid-name": "port"},
+		map[string]any{
+			"op": "mutate", "table": "Bridge",
+			"where":     []any{[]any{"name", "==", p.Bridge}},
+			"mutations": []any{[]any{"ports", "insert", ovsSet([]any{namedUUID("port")})}},
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("add port %s to OVS bridge %s: %w", p.Name, p.Bridge, err)
+	}
+	return nil
+}
+
+// DelPort removes the port named name from whichever bridge holds it.  It
+// is not an error if there is no such port.
+func (c *Client) DelPort(ctx context.Context, name string) error {
+	results, err := c.transact(ctx, map[string]any{
+		"op": "select", "table": "Port",
+		"where":   []any{[]any{"name", "==", name}},
+		"columns": []string{"_uuid"},
+	})
+	if err != nil {
+		return fmt.Errorf("look up OVS port %s: %w", name, err)
+	}
+	for _, row := range results[0].Rows {
+		uuid := row["_uuid"]
+		// The Port row and its Interface are garbage collected once no
+		// bridge references them.
+		_, err := c.transact(ctx, map[string]any{
+			"op": "mutate", "table": "Bridge",
+			"where":     []any{[]any{"ports", "includes", uuid}},
+			"mutations": []any{[]any{"ports", "delete", uuid}},
+		})
+		if err != nil {
+			return fmt.Errorf("delete OVS port %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// result is the outcome of one operation of a transaction.
+type result struct {
+	Count   int              `json:"count"`
+	Rows    []map[string]any `json:"rows"`
+	Error   string           `json:"error"`
+	Details string           `json:"details"`
+}
+
+type request struct {
+	Method string `json:"method"`
+	Params []any  `json:"params"`
+	ID     any    `json:"id"`
+}
+
+type response struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+// transact runs ops as one OVSDB transaction and returns their results.
+func (c *Client) transact(ctx context.Context, ops ...any) ([]result, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", c.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("connect to OVSDB: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+	if err := enc.Encode(request{Method: "transact", Params: append([]any{database}, ops...), ID: 1}); err != nil {
+		return nil, fmt.Errorf("send transaction: %w", err)
+	}
+	for {
+		var resp response
+		if err := dec.Decode(&resp); err != nil {
+			return nil, fmt.Errorf("read reply: %w", err)
+		}
+		if resp.Method == "echo" {
+			// Keepalive from the server; it expects its params back.
+			enc.Encode(map[string]any{"result": resp.Params, "error": nil, "id": resp.ID})
+			continue
+		}
+		if string(resp.ID) != "1" {
+			continue
+		}
+		if len(resp.Error) > 0 && string(resp.Error) != "null" {
+			return nil, fmt.Errorf("OVSDB error: %s", resp.Error)
+		}
+		var results []result
+		if err := json.Unmarshal(resp.Result, &results); err != nil {
+			return nil, fmt.Errorf("decode reply: %w", err)
+		}
+		// A transaction fails as a whole; the failing operation, or an
+		// extra trailing result for commit failures, carries the error.
+		for _, r := range results {
+			if r.Error != "" {
+				return nil, fmt.Errorf("%s: %s", r.Error, r.Details)
+			}
+		}
+		if len(results) < len(ops) {
+			return nil, fmt.Errorf("transaction returned %d results for %d operations", len(results), len(ops))
+		}
+		return results, nil
+	}
+}
+
+// ovsMap encodes m as an OVSDB map.
+func ovsMap(m map[string]string) []any {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]any, 0, len(m))
+	for _, k := range keys {
+		pairs = append(pairs, []any{k, m[k]})
+	}
+	return []any{"map", pairs}
+}
+
+// ovsSet encodes items as an OVSDB set.
+func ovsSet[T any](items []T) []any {
+	if items == nil {
+		items = []T{}
+	}
+	return []any{"set", items}
+}
+
+func namedUUID(name string) []any {
+	return []any{"named-uuid", name}
+}
@@ -0,0 +1,86 @@
+package ovs
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/example/dra-poc/pkg/ovs/ovstest"
+)
+
+func TestClient_AddAndDelPort(t *testing.T) {
+	srv := ovstest.NewServer(t, "br-int", "br-ex")
+	c := &Client{Socket: srv.Socket}
+	ctx := context.Background()
+
+	err := c.AddPort(ctx, Port{
+		Bridge:      "br-int",
+		Name:        "vhaabbccdd",
+		Tag:         100,
+		ExternalIDs: map[string]string{"iface-id": "pod-a"},
+	})
+	if err != nil {
+		t.Fatalf("AddPort: %v", err)
+	}
+	if got := srv.Ports("br-int"); !slices.Equal(got, []string{"vhaabbccdd"}) {
+		t.Fatalf("ports on br-int = %v, want [vhaabbccdd]", got)
+	}
+	port, iface, ok := srv.Port("vhaabbccdd")
+	if !ok || iface == nil {
+		t.Fatal("port or interface row missing")
+	}
+	if port["tag"] != float64(100) {
+		t.Errorf("tag = %v, want 100", port["tag"])
+	}
+	if id := ovstest.Map(iface["external_ids"])["iface-id"]; id != "pod-a" {
+		t.Errorf("interface iface-id = %q, want pod-a", id)
+	}
+	if _, ok := iface["type"]; ok {
+		t.Errorf("interface type = %v, want unset for a system interface", iface["type"])
+	}
+
+	// Adding again replaces the port, here moving it to another bridge.
+	err = c.AddPort(ctx, Port{Bridge: "br-ex", Name: "vhaabbccdd", Type: "system", Trunks: []int{10, 20}})
+	if err != nil {
+		t.Fatalf("AddPort again: %v", err)
+	}
+	if got := srv.Ports("br-int"); len(got) != 0 {
+		t.Errorf("ports on br-int = %v, want none", got)
+	}
+	port, iface, _ = srv.Port("vhaabbccdd")
+	if iface["type"] != "system" {
+		t.Errorf("interface type = %v, want system", iface["type"])
+	}
+	if trunks, _ := port["trunks"].([]any); len(trunks) != 2 {
+		t.Errorf("trunks = %v, want [set [10 20]]", port["trunks"])
+	}
+
+	if err := c.DelPort(ctx, "vhaabbccdd"); err != nil {
+		t.Fatalf("DelPort: %v", err)
+	}
+	if _, _, ok := srv.Port("vhaabbccdd"); ok {
+		t.Error("port should be gone")
+	}
+	if err := c.DelPort(ctx, "vhaabbccdd"); err != nil {
+		t.Errorf("DelPort of a missing port: %v", err)
+	}
+}
+
+func TestClient_AddPortMissingBridge(t *testing.T) {
+	srv := ovstest.NewServer(t, "br-int")
+	c := &Client{Socket: srv.Socket}
+
+	if err := c.AddPort(context.Background(), Port{Bridge: "br-missing", Name: "vh0"}); err == nil {
+		t.Fatal("expected error adding a port to a missing bridge")
+	}
+	if _, _, ok := srv.Port("vh0"); ok {
+		t.Error("failed transaction should not leave a port behind")
+	}
+}
+
+func TestClient_NoServer(t *testing.T) {
+	c := &Client{Socket: t.TempDir() + "/db.sock"}
+	if err := c.DelPort(context.Background(), "vh0"); err == nil {
+		t.Error("expected error without an OVSDB server")
+	}
+}
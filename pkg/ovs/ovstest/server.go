@@ -0,0 +1,375 @@
+// Package ovstest provides an in-memory OVSDB server for tests.
+package ovstest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Row is an OVSDB row in its JSON encoding: maps are ["map", [[k, v], ...]],
+// sets ["set", [...]] and references ["uuid", id].
+type Row map[string]any
+
+// Server implements the part of the Open_vSwitch schema that package ovs
+// uses: Bridge, Port and Interface rows with the transact operations wait,
+// select, insert and mutate.  Transactions are atomic; Port and Interface
+// rows no bridge references any more are garbage collected.
+type Server struct {
+	// Socket is the Unix socket the server listens on.
+	Socket string
+
+	mu         sync.Mutex
+	bridges    map[string][]string // bridge name → port UUIDs
+	ports      map[string]Row      // UUID → Port row
+	interfaces map[string]Row      // UUID → Interface row
+	nextUUID   int
+}
+
+// NewServer starts a server with the given empty bridges.  It stops when
+// the test ends.
+func NewServer(t testing.TB, bridges ...string) *Server {
+	t.Helper()
+	s := &Server{
+		Socket:     filepath.Join(t.TempDir(), "db.sock"),
+		bridges:    make(map[string][]string),
+		ports:      make(map[string]Row),
+		interfaces: make(map[string]Row),
+	}
+	for _, br := range bridges {
+		s.bridges[br] = nil
+	}
+	l, err := net.Listen("unix", s.Socket)
+	if err != nil {
+		t.Fatalf("listen on %s: %v", s.Socket, err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// Ports returns the names of the ports on bridge.
+func (s *Server) Ports(bridge string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, uuid := range s.bridges[bridge] {
+		names = append(names, s.ports[uuid]["name"].(string))
+	}
+	return names
+}
+
+// Port returns the Port and Interface rows of the port named name.
+func (s *Server) Port(name string) (port, iface Row, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, row := range s.ports {
+		if row["name"] != name {
+			continue
+		}
+		ref, _ := row["interfaces"].([]any)
+		if len(ref) == 2 {
+			iface = s.interfaces[fmt.Sprint(ref[1])]
+		}
+		return row, iface, true
+	}
+	return nil, nil, false
+}
+
+// Map decodes an OVSDB map column.
+func Map(v any) map[string]string {
+	m := make(map[string]string)
+	enc, _ := v.([]any)
+	if len(enc) != 2 || enc[0] != "map" {
+		return m
+	}
+	pairs, _ := enc[1].([]any)
+	for _, p := range pairs {
+		kv, _ := p.([]any)
+		if len(kv) == 2 {
+			m[fmt.Sprint(kv[0])] = fmt.Sprint(kv[1])
+		}
+	}
+	return m
+}
+
+type request struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	ID     any               `json:"id"`
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	dec, enc := json.NewDecoder(conn), json.NewEncoder(conn)
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		if req.Method != "transact" || len(req.Params) == 0 {
+			enc.Encode(map[string]any{"result": nil, "error": "unknown method " + req.Method, "id": req.ID})
+			continue
+		}
+		enc.Encode(map[string]any{"result": s.transact(req.Params[1:]), "error": nil, "id": req.ID})
+	}
+}
+
+// transact applies ops atomically and returns one result per operation.
+func (s *Server) transact(rawOps []json.RawMessage) []map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := s.snapshot()
+	named := make(map[string]string)
+	results := make([]map[string]any, 0, len(rawOps))
+	for _, raw := range rawOps {
+		var op map[string]any
+		if err := json.Unmarshal(raw, &op); err != nil {
+			results = append(results, map[string]any{"error": "syntax error", "details": err.Error()})
+			break
+		}
+		res, err := s.apply(op, named)
+		if err != nil {
+			results = append(results, map[string]any{"error": "constraint violation", "details": err.Error()})
+			s.restore(saved)
+			return results
+		}
+		results = append(results, res)
+	}
+	s.collectGarbage()
+	return results
+}
+
+func (s *Server) apply(op map[string]any, named map[string]string) (map[string]any, error) {
+	table, _ := op["table"].(string)
+	switch op["op"] {
+	case "wait":
+		name, err := nameCondition(op)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := s.bridges[name]; table != "Bridge" || !ok {
+			return nil, fmt.Errorf("timed out waiting for %s %s", table, name)
+		}
+		return map[string]any{}, nil
+
+	case "select":
+		name, err := nameCondition(op)
+		if err != nil || table != "Port" {
+			return nil, fmt.Errorf("unsupported select on %s", table)
+		}
+		rows := []any{}
+		for uuid, row := range s.ports {
+			if row["name"] == name {
+				rows = append(rows, map[string]any{"_uuid": []any{"uuid", uuid}})
+			}
+		}
+		return map[string]any{"rows": rows}, nil
+
+	case "insert":
+		row, _ := op["row"].(map[string]any)
+		s.nextUUID++
+		uuid := fmt.Sprintf("00000000-0000-0000-0000-%012d", s.nextUUID)
+		if name, ok := op["uuid-name"].(string); ok {
+			named[name] = uuid
+		}
+		resolved := resolve(row, named).(map[string]any)
+		switch table {
+		case "Port":
+			s.ports[uuid] = resolved
+		case "Interface":
+			s.interfaces[uuid] = resolved
+		default:
+			return nil, fmt.Errorf("unsupported insert into %s", table)
+		}
+		return map[string]any{"uuid": []any{"uuid", uuid}}, nil
+
+	case "mutate":
+		if table != "Bridge" {
+			return nil, fmt.Errorf("unsupported mutate on %s", table)
+		}
+		bridges, err := s.matchBridges(op, named)
+		if err != nil {
+			return nil, err
+		}
+		mutations, _ := op["mutations"].([]any)
+		for _, br := range bridges {
+			for _, m := range mutations {
+				mut, _ := m.([]any)
+				if len(mut) != 3 || mut[0] != "ports" {
+					return nil, fmt.Errorf("unsupported mutation %v", m)
+				}
+				for _, uuid := range uuids(mut[2], named) {
+					switch mut[1] {
+					case "insert":
+						if _, ok := s.ports[uuid]; !ok {
+							return nil, fmt.Errorf("referential integrity violation: no port %s", uuid)
+						}
+						s.bridges[br] = append(s.bridges[br], uuid)
+					case "delete":
+						s.bridges[br] = remove(s.bridges[br], uuid)
+					default:
+						return nil, fmt.Errorf("unsupported mutator %v", mut[1])
+					}
+				}
+			}
+		}
+		return map[string]any{"count": len(bridges)}, nil
+	}
+	return nil, fmt.Errorf("unsupported operation %v", op["op"])
+}
+
+// matchBridges evaluates a mutate's where clause: either name == <name> or
+// ports includes <uuid>.
+func (s *Server) matchBridges(op map[string]any, named map[string]string) ([]string, error) {
+	where, _ := op["where"].([]any)
+	if len(where) != 1 {
+		return nil, errors.New("expected a single condition")
+	}
+	cond, _ := where[0].([]any)
+	if len(cond) != 3 {
+		return nil, fmt.Errorf("malformed condition %v", where[0])
+	}
+	var matched []string
+	switch {
+	case cond[0] == "name" && cond[1] == "==":
+		if _, ok := s.bridges[fmt.Sprint(cond[2])]; ok {
+			matched = append(matched, fmt.Sprint(cond[2]))
+		}
+	case cond[0] == "ports" && cond[1] == "includes":
+		want := uuids(cond[2], named)
+		for br, ports := range s.bridges {
+			for _, uuid := range ports {
+				if len(want) == 1 && uuid == want[0] {
+					matched = append(matched, br)
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported condition %v", cond)
+	}
+	return matched, nil
+}
+
+func nameCondition(op map[string]any) (string, error) {
+	where, _ := op["where"].([]any)
+	if len(where) == 1 {
+		if cond, _ := where[0].([]any); len(cond) == 3 && cond[0] == "name" && cond[1] == "==" {
+			return fmt.Sprint(cond[2]), nil
+		}
+	}
+	return "", fmt.Errorf("unsupported condition %v", op["where"])
+}
+
+// uuids returns the UUIDs in a reference or set of references.
+func uuids(v any, named map[string]string) []string {
+	enc, _ := v.([]any)
+	if len(enc) != 2 {
+		return nil
+	}
+	switch enc[0] {
+	case "uuid":
+		return []string{fmt.Sprint(enc[1])}
+	case "named-uuid":
+		return []string{named[fmt.Sprint(enc[1])]}
+	case "set":
+		var out []string
+		items, _ := enc[1].([]any)
+		for _, item := range items {
+			out = append(out, uuids(item, named)...)
+		}
+		return out
+	}
+	return nil
+}
+
+// resolve replaces named-uuid references in v with the UUIDs they name.
+func resolve(v any, named map[string]string) any {
+	switch v := v.(type) {
+	case []any:
+		if len(v) == 2 && v[0] == "named-uuid" {
+			return []any{"uuid", named[fmt.Sprint(v[1])]}
+		}
+		out := make([]any, len(v))
+		for i := range v {
+			out[i] = resolve(v[i], named)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, val := range v {
+			out[k] = resolve(val, named)
+		}
+		return out
+	}
+	return v
+}
+
+// collectGarbage drops Port rows no bridge references and Interface rows no
+// port references, as ovsdb-server does for non-root tables.
+func (s *Server) collectGarbage() {
+	used := make(map[string]bool)
+	for _, ports := range s.bridges {
+		for _, uuid := range ports {
+			used[uuid] = true
+		}
+	}
+	for uuid := range s.ports {
+		if !used[uuid] {
+			delete(s.ports, uuid)
+		}
+	}
+	usedIfaces := make(map[string]bool)
+	for _, row := range s.ports {
+		for _, uuid := range uuids(row["interfaces"], nil) {
+			usedIfaces[uuid] = true
+		}
+	}
+	for uuid := range s.interfaces {
+		if !usedIfaces[uuid] {
+			delete(s.interfaces, uuid)
+		}
+	}
+}
+
+type state struct {
+	bridges    map[string][]string
+	ports      map[string]Row
+	interfaces map[string]Row
+}
+
+func (s *Server) snapshot() state {
+	bridges := make(map[string][]string, len(s.bridges))
+	for br, ports := range s.bridges {
+		bridges[br] = append([]string(nil), ports...)
+	}
+	return state{bridges: bridges, ports: maps.Clone(s.ports), interfaces: maps.Clone(s.interfaces)}
+}
+
+func (s *Server) restore(st state) {
+	s.bridges, s.ports, s.interfaces = st.bridges, st.ports, st.interfaces
+}
+
+func remove(list []string, item string) []string {
+	out := list[:0]
+	for _, v := range list {
+		if v != item {
+			out = append(out, v)
+		}
+	}
+	return out
+}